@@ -1,31 +1,100 @@
 package main
 
 import (
+	"bufio"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"github.com/jackwhelpton/fasthttp-routing/v2"
 	"github.com/kcz17/dimmer/filters"
+	"github.com/kcz17/dimmer/logging"
+	"github.com/kcz17/dimmer/onlinetraining"
 	"github.com/valyala/fasthttp"
+	"log"
+	"net/http"
+	"strings"
 	"time"
 )
 
 type APIServer struct {
 	Server *Server
+	// Metrics is optional. If set, metrics are served at GET /metrics.
+	Metrics logging.MetricsWriter
+	// Events is optional. If set, events published to it are streamed as
+	// Server-Sent Events at GET /events.
+	Events *logging.EventBroadcaster
+	// ProbabilityFloors is optional. If set, lowering a path's probability
+	// below its floor is rejected with 409 unless the request sets
+	// ?force=true.
+	ProbabilityFloors *filters.ProbabilityFloors
 }
 
+// sseHeartbeatInterval is the interval between comments written to event
+// streams, so subscribers which have disconnected are detected and cleaned up
+// even while no events are published.
+const sseHeartbeatInterval = 15 * time.Second
+
 func (s *APIServer) ListenAndServe(addr string) error {
+	return fasthttp.ListenAndServe(addr, s.newRouter().HandleRequest)
+}
+
+func (s *APIServer) newRouter() *routing.Router {
 	router := routing.New()
 
+	router.Get("/ready", s.getReadyHandler())
+
 	router.Post("/mode", s.setServerModeHandler())
+	router.Post("/config/apply", s.applyConfigHandler())
+
+	router.Post("/maintenance", s.setMaintenanceHandler())
 
 	router.Get("/probabilities", s.listPathProbabilitiesHandler())
 	router.Post("/probabilities", s.setPathProbabilitiesHandler())
 	router.Delete("/probabilities", s.clearPathProbabilitiesHandler())
+	// Paths may contain slashes, which the router cannot match before a static
+	// suffix, so /probabilities/{path}/[disable|enable] is dispatched manually.
+	router.Post("/probabilities/<pathAction:.*>", s.pathActionHandler())
+	router.Delete("/probabilities/<path:.*>", s.removePathProbabilityHandler())
 
 	router.Get("/training/stats", s.getOfflineTrainingStatsHandler())
+	router.Get("/training/online/status", s.getOnlineTrainingStatusHandler())
+	router.Post("/training/online/candidate-probability", s.setCandidateProbabilityHandler())
+
+	router.Get("/filter/stats", s.getFilterStatsHandler())
+	router.Delete("/filter/rules", s.removeFilterRuleHandler())
+
+	router.Post("/collector/window", s.setCollectorWindowHandler())
+
+	router.Post("/setpoint", s.setSetpointHandler())
+	router.Post("/gains", s.setGainsHandler())
+
+	if s.Metrics != nil {
+		router.Get("/metrics", s.getMetricsHandler())
+	}
+	if s.Events != nil {
+		router.Get("/events", s.streamEventsHandler())
+	}
+
+	// The OpenAPI document is generated from routeSpecs, which must describe
+	// each route registered above.
+	router.Get("/openapi.json", s.getOpenAPIHandler())
 
-	return fasthttp.ListenAndServe(addr, router.HandleRequest)
+	return router
+}
+
+// getReadyHandler returns 503 until the control loop has started and warmed
+// up and the backend is reachable, so traffic is not sent to the dimmer while
+// its dimming behaviour is erratic or it cannot proxy requests. Readiness does
+// not depend on proxied traffic, which the dimmer only receives once ready.
+func (s *APIServer) getReadyHandler() routing.Handler {
+	return func(c *routing.Context) error {
+		if !s.Server.dimming.ControlLoop.IsReady() {
+			return routing.NewHTTPError(http.StatusServiceUnavailable, "control loop warming up")
+		}
+		if !s.Server.isBackendReachable() {
+			return routing.NewHTTPError(http.StatusServiceUnavailable, "backend unreachable")
+		}
+		return c.Write("ready\n")
+	}
 }
 
 func (s *APIServer) setServerModeHandler() routing.Handler {
@@ -33,41 +102,140 @@ func (s *APIServer) setServerModeHandler() routing.Handler {
 		mode := &struct {
 			Mode string
 		}{}
-		if err := c.Read(&mode); err != nil {
-			return fmt.Errorf("could not parse body: %w", err)
+		if err := readBody(c, &mode, "{mode}"); err != nil {
+			return err
 		}
 
-		var err error
-		switch mode.Mode {
-		case "Default":
-			err = s.Server.SetDimmingMode(s.Server.defaultDimmingMode)
-		case "Disabled":
-			err = s.Server.SetDimmingMode(Disabled)
-			break
-		case "OfflineTraining":
-			err = s.Server.SetDimmingMode(OfflineTraining)
-			break
-		case "Dimming":
-			err = s.Server.SetDimmingMode(Dimming)
-			break
-		case "DimmingWithOnlineTraining":
-			err = s.Server.SetDimmingMode(DimmingWithOnlineTraining)
-			break
-		case "DimmingWithProfiling":
-			err = s.Server.SetDimmingMode(DimmingWithProfiling)
-			break
-		default:
-			err = errors.New("mode must be one of {Default|Disabled|OfflineTraining|Dimming|DimmingWithOnlineTraining|DimmingWithProfiling}")
-			break
-		}
+		dimmingMode, err := s.parseDimmingMode(mode.Mode)
 		if err != nil {
 			return err
 		}
+		if err := s.Server.SetDimmingMode(dimmingMode); err != nil {
+			return err
+		}
 
 		return c.Write("mode set\n")
 	}
 }
 
+// parseDimmingMode returns the mode with the given API name, where Default is
+// the mode the server started in.
+func (s *APIServer) parseDimmingMode(name string) (DimmingMode, error) {
+	switch name {
+	case "Default":
+		return s.Server.defaultDimmingMode, nil
+	case "Disabled":
+		return Disabled, nil
+	case "OfflineTraining":
+		return OfflineTraining, nil
+	case "Dimming":
+		return Dimming, nil
+	case "DimmingWithOnlineTraining":
+		return DimmingWithOnlineTraining, nil
+	case "DimmingWithProfiling":
+		return DimmingWithProfiling, nil
+	case "ShadowDimming":
+		return ShadowDimming, nil
+	default:
+		return 0, routing.NewHTTPError(http.StatusBadRequest, "mode must be one of {Default|Disabled|OfflineTraining|Dimming|DimmingWithOnlineTraining|DimmingWithProfiling|ShadowDimming}")
+	}
+}
+
+// applyConfigHandler changes the mode, path probabilities and controller
+// together, so deploy tooling never leaves the dimmer partially configured if
+// a change fails. Omitted fields are left unchanged. The effective
+// configuration is returned.
+func (s *APIServer) applyConfigHandler() routing.Handler {
+	return func(c *routing.Context) error {
+		body := &struct {
+			Mode          *string
+			Probabilities []filters.PathProbabilityRule
+			Controller    *struct {
+				Setpoint *float64
+				Kp       *float64
+				Ki       *float64
+				Kd       *float64
+			}
+		}{}
+		if err := readBody(c, &body, "{mode, probabilities, controller}"); err != nil {
+			return err
+		}
+
+		var change ConfigChange
+		if body.Mode != nil {
+			mode, err := s.parseDimmingMode(*body.Mode)
+			if err != nil {
+				return err
+			}
+			change.Mode = &mode
+		}
+		for _, rule := range body.Probabilities {
+			if err := s.checkProbabilityFloor(c, rule.Path, rule.Probability); err != nil {
+				return err
+			}
+		}
+		change.Probabilities = body.Probabilities
+		if controller := body.Controller; controller != nil {
+			change.Setpoint = controller.Setpoint
+			isAnyGainSet := controller.Kp != nil || controller.Ki != nil || controller.Kd != nil
+			isEveryGainSet := controller.Kp != nil && controller.Ki != nil && controller.Kd != nil
+			if isAnyGainSet && !isEveryGainSet {
+				return routing.NewHTTPError(http.StatusBadRequest, "expected controller {setpoint, kp, ki, kd} with all or no gains; got missing gain")
+			}
+			if isEveryGainSet {
+				change.Gains = &ControllerGains{Kp: *controller.Kp, Ki: *controller.Ki, Kd: *controller.Kd}
+			}
+		}
+
+		if err := change.validate(); err != nil {
+			return routing.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		config, err := s.Server.ApplyConfig(change)
+		if err != nil {
+			return routing.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+
+		b, err := json.Marshal(config)
+		if err != nil {
+			return fmt.Errorf("could not marshal effective config: err = %w", err)
+		}
+		c.SetContentType("application/json")
+		return c.Write(b)
+	}
+}
+
+// setMaintenanceHandler enables or disables maintenance mode, where all
+// requests receive a 503 response. retryAfter is optional and in seconds.
+// Maintenance mode is separate from the dimming mode, which is restored once
+// maintenance mode is disabled.
+func (s *APIServer) setMaintenanceHandler() routing.Handler {
+	return func(c *routing.Context) error {
+		maintenance := &struct {
+			Enabled    *bool
+			RetryAfter int
+		}{}
+		if err := readBody(c, &maintenance, "{enabled, retryAfter}"); err != nil {
+			return err
+		}
+
+		if maintenance.Enabled == nil {
+			return routing.NewHTTPError(http.StatusBadRequest, "expected {enabled, retryAfter}; got no enabled")
+		}
+		if maintenance.RetryAfter < 0 {
+			return routing.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("expected non-negative retryAfter; got retryAfter = %d", maintenance.RetryAfter))
+		}
+
+		if err := s.Server.SetMaintenance(*maintenance.Enabled, time.Duration(maintenance.RetryAfter)*time.Second); err != nil {
+			return err
+		}
+
+		if *maintenance.Enabled {
+			return c.Write("maintenance enabled\n")
+		}
+		return c.Write("maintenance disabled\n")
+	}
+}
+
 func (s *APIServer) getOfflineTrainingStatsHandler() routing.Handler {
 	return func(c *routing.Context) error {
 		aggregation := s.Server.offlineTraining.GetResponseTimeMetrics()
@@ -89,6 +257,128 @@ func (s *APIServer) getOfflineTrainingStatsHandler() routing.Handler {
 	}
 }
 
+// getOnlineTrainingStatusHandler returns the current phase of online training
+// both by name and as the numeric value exposed as a gauge, along with the
+// probabilities of each group and the comparison of the last round.
+func (s *APIServer) getOnlineTrainingStatusHandler() routing.Handler {
+	return func(c *routing.Context) error {
+		if s.Server.onlineTraining == nil {
+			return routing.NewHTTPError(http.StatusNotFound, "online training not configured")
+		}
+
+		status := s.Server.onlineTraining.Status()
+		minCandidateProbability, maxCandidateProbability := s.Server.onlineTraining.CandidateProbabilityRange()
+		response := &struct {
+			Phase                   string
+			PhaseValue              int
+			IsIterationActive       bool
+			CandidateProbability    float64
+			MinCandidateProbability float64
+			MaxCandidateProbability float64
+			ControlProbabilities    map[string]float64
+			CandidateProbabilities  []map[string]float64
+			LastComparison          *onlinetraining.Comparison
+		}{
+			Phase:                   status.Phase.String(),
+			PhaseValue:              int(status.Phase),
+			IsIterationActive:       status.IsIterationActive,
+			CandidateProbability:    s.Server.onlineTraining.CandidateProbability(),
+			MinCandidateProbability: minCandidateProbability,
+			MaxCandidateProbability: maxCandidateProbability,
+			ControlProbabilities:    status.ControlProbabilities,
+			CandidateProbabilities:  status.CandidateProbabilities,
+			LastComparison:          status.LastComparison,
+		}
+
+		b, err := json.Marshal(response)
+		if err != nil {
+			return fmt.Errorf("could not marshal online training status: err = %w", err)
+		}
+		return c.Write(b)
+	}
+}
+
+// setCandidateProbabilityHandler changes the proportion of sessions assigned
+// to the online training candidate group, within the configured range.
+func (s *APIServer) setCandidateProbabilityHandler() routing.Handler {
+	return func(c *routing.Context) error {
+		if s.Server.onlineTraining == nil {
+			return routing.NewHTTPError(http.StatusNotFound, "online training not configured")
+		}
+
+		candidate := &struct {
+			Probability *float64
+		}{}
+		if err := readBody(c, &candidate, "{probability}"); err != nil {
+			return err
+		}
+
+		if candidate.Probability == nil {
+			return routing.NewHTTPError(http.StatusBadRequest, "expected {probability}; got no probability")
+		}
+		if err := s.Server.onlineTraining.SetCandidateProbability(*candidate.Probability); err != nil {
+			return routing.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		return c.Write("candidate probability set\n")
+	}
+}
+
+// getFilterStatsHandler returns the number of requests received and matched by
+// the request filter since starting, indicating how much traffic is dimmable.
+func (s *APIServer) getFilterStatsHandler() routing.Handler {
+	return func(c *routing.Context) error {
+		total, matched := s.Server.filterMatchCounter.Counts()
+		response := &struct {
+			Total   uint64
+			Matched uint64
+			Ratio   float64
+		}{
+			Total:   total,
+			Matched: matched,
+		}
+		if total != 0 {
+			response.Ratio = float64(matched) / float64(total)
+		}
+
+		b, err := json.Marshal(response)
+		if err != nil {
+			return fmt.Errorf("could not marshal filter stats: err = %w", err)
+		}
+		return c.Write(b)
+	}
+}
+
+// removeFilterRuleHandler handles DELETE /filter/rules, which removes the
+// rule for a path and method from the request filter, or the rules for all
+// methods if no method is given, so a component stops being dimmed without a
+// restart.
+func (s *APIServer) removeFilterRuleHandler() routing.Handler {
+	return func(c *routing.Context) error {
+		var rule struct {
+			Path   string
+			Method string
+		}
+		if err := readBody(c, &rule, "{path, method}"); err != nil {
+			return err
+		}
+		if rule.Path == "" {
+			return routing.NewHTTPError(http.StatusBadRequest, "expected {path, method}; got empty path")
+		}
+
+		var err error
+		if rule.Method == "" {
+			err = s.Server.dimming.RequestFilter.RemovePathForAllMethods(rule.Path)
+		} else {
+			err = s.Server.dimming.RequestFilter.RemovePath(rule.Path, rule.Method)
+		}
+		if err != nil {
+			return routing.NewHTTPError(http.StatusNotFound, err.Error())
+		}
+		return c.Write("filter rule removed\n")
+	}
+}
+
 func (s *APIServer) listPathProbabilitiesHandler() routing.Handler {
 	return func(c *routing.Context) error {
 		return c.Write(fmt.Sprintf("probabilities:\n%v\n", s.Server.dimming.PathProbabilities.List()))
@@ -98,9 +388,19 @@ func (s *APIServer) listPathProbabilitiesHandler() routing.Handler {
 func (s *APIServer) setPathProbabilitiesHandler() routing.Handler {
 	return func(c *routing.Context) error {
 		var probabilities []filters.PathProbabilityRule
-		if err := c.Read(&probabilities); err != nil {
+		if err := readBody(c, &probabilities, "array of {path, probability}"); err != nil {
 			return err
 		}
+		for _, rule := range probabilities {
+			if rule.Path == "" {
+				return routing.NewHTTPError(http.StatusBadRequest, "expected array of {path, probability}; got rule with empty path")
+			}
+		}
+		for _, rule := range probabilities {
+			if err := s.checkProbabilityFloor(c, rule.Path, rule.Probability); err != nil {
+				return err
+			}
+		}
 
 		if err := s.Server.UpdatePathProbabilities(probabilities); err != nil {
 			return err
@@ -110,9 +410,197 @@ func (s *APIServer) setPathProbabilitiesHandler() routing.Handler {
 	}
 }
 
+// pathActionHandler handles POST /probabilities/{path}/disable, which stops a
+// single path from being dimmed, e.g. if dimming is found to break a component
+// during an incident, and POST /probabilities/{path}/enable, which restores the
+// path's probability from before it was disabled.
+func (s *APIServer) pathActionHandler() routing.Handler {
+	return func(c *routing.Context) error {
+		pathAction := c.Param("pathAction")
+		lastSlash := strings.LastIndex(pathAction, "/")
+		if lastSlash <= 0 {
+			return routing.NewHTTPError(http.StatusNotFound)
+		}
+		path, action := pathAction[:lastSlash], pathAction[lastSlash+1:]
+
+		var err error
+		switch action {
+		case "disable":
+			if err := s.checkProbabilityFloor(c, path, 0); err != nil {
+				return err
+			}
+			err = s.Server.DisablePathDimming(path)
+		case "enable":
+			err = s.Server.EnablePathDimming(path)
+		default:
+			return routing.NewHTTPError(http.StatusNotFound)
+		}
+		if err != nil {
+			return routing.NewHTTPError(http.StatusConflict, err.Error())
+		}
+		return c.Write(fmt.Sprintf("path %sd\n", action))
+	}
+}
+
+// checkProbabilityFloor returns a 409 error if setting the path's probability
+// to next lowers it below its floor, unless the request is forced. Forced
+// changes below the floor are logged so they can be audited.
+func (s *APIServer) checkProbabilityFloor(c *routing.Context, path string, next float64) error {
+	if s.ProbabilityFloors == nil {
+		return nil
+	}
+
+	err := s.ProbabilityFloors.Check(path, s.Server.dimming.PathProbabilities.Get(path), next)
+	if err == nil {
+		return nil
+	}
+	if string(c.QueryArgs().Peek("force")) == "true" {
+		log.Printf("forcing probability below floor: %v", err)
+		return nil
+	}
+	return routing.NewHTTPError(http.StatusConflict, fmt.Sprintf("%v; set ?force=true to override", err))
+}
+
 func (s *APIServer) clearPathProbabilitiesHandler() routing.Handler {
 	return func(c *routing.Context) error {
 		s.Server.dimming.PathProbabilities.Clear()
 		return c.Write(fmt.Sprintf("probabilities cleared\n"))
 	}
 }
+
+// removePathProbabilityHandler handles DELETE /probabilities/{path}, which
+// resets a single path to the default probability.
+func (s *APIServer) removePathProbabilityHandler() routing.Handler {
+	return func(c *routing.Context) error {
+		if err := s.Server.dimming.PathProbabilities.Remove(c.Param("path")); err != nil {
+			return routing.NewHTTPError(http.StatusNotFound, err.Error())
+		}
+		return c.Write("probability removed\n")
+	}
+}
+
+func (s *APIServer) setCollectorWindowHandler() routing.Handler {
+	return func(c *routing.Context) error {
+		window := &struct {
+			Size int
+		}{}
+		if err := readBody(c, &window, "{size}"); err != nil {
+			return err
+		}
+
+		if window.Size <= 0 {
+			return routing.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("expected positive size; got size = %d", window.Size))
+		}
+
+		if err := s.Server.dimming.ControlLoop.ResizeResponseTimeCollectorWindow(window.Size); err != nil {
+			return routing.NewHTTPError(http.StatusConflict, err.Error())
+		}
+
+		return c.Write("collector window set\n")
+	}
+}
+
+// setSetpointHandler changes the controller setpoint without restarting, e.g.
+// to tighten or relax the target response time during an incident.
+func (s *APIServer) setSetpointHandler() routing.Handler {
+	return func(c *routing.Context) error {
+		setpoint := &struct {
+			Setpoint *float64
+		}{}
+		if err := readBody(c, &setpoint, "{setpoint}"); err != nil {
+			return err
+		}
+
+		if setpoint.Setpoint == nil {
+			return routing.NewHTTPError(http.StatusBadRequest, "expected {setpoint}; got no setpoint")
+		}
+		if err := s.Server.dimming.ControlLoop.SetSetpoint(*setpoint.Setpoint); err != nil {
+			return routing.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		return c.Write("setpoint set\n")
+	}
+}
+
+// setGainsHandler changes the controller gains without restarting, so the
+// controller can be tuned without losing accumulated state.
+func (s *APIServer) setGainsHandler() routing.Handler {
+	return func(c *routing.Context) error {
+		gains := &struct {
+			Kp *float64
+			Ki *float64
+			Kd *float64
+		}{}
+		if err := readBody(c, &gains, "{kp, ki, kd}"); err != nil {
+			return err
+		}
+
+		if gains.Kp == nil || gains.Ki == nil || gains.Kd == nil {
+			return routing.NewHTTPError(http.StatusBadRequest, "expected {kp, ki, kd}; got missing gain")
+		}
+		if err := s.Server.dimming.ControlLoop.SetGains(*gains.Kp, *gains.Ki, *gains.Kd); err != nil {
+			return routing.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		return c.Write("gains set\n")
+	}
+}
+
+func (s *APIServer) getMetricsHandler() routing.Handler {
+	return func(c *routing.Context) error {
+		c.SetContentType("text/plain; version=0.0.4")
+		if err := s.Metrics.WriteMetrics(c.RequestCtx); err != nil {
+			return fmt.Errorf("could not write metrics: err = %w", err)
+		}
+		return nil
+	}
+}
+
+// streamEventsHandler streams events as Server-Sent Events, with the event
+// type as the SSE event name and the event as JSON data, until the client
+// disconnects.
+func (s *APIServer) streamEventsHandler() routing.Handler {
+	return func(c *routing.Context) error {
+		c.SetContentType("text/event-stream")
+		c.Response.Header.Set("Cache-Control", "no-cache")
+		// Headers are otherwise only sent with the first event, so clients
+		// could not tell the stream is open.
+		c.Response.ImmediateHeaderFlush = true
+		c.SetBodyStreamWriter(func(w *bufio.Writer) {
+			events, unsubscribe := s.Events.Subscribe()
+			defer unsubscribe()
+			heartbeat := time.NewTicker(sseHeartbeatInterval)
+			defer heartbeat.Stop()
+
+			for {
+				select {
+				case event := <-events:
+					data, err := json.Marshal(event)
+					if err != nil {
+						log.Printf("expected json.Marshal(event) returns nil err; dropping %s event; got err = %v", event.Type, err)
+						continue
+					}
+					fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+				case <-heartbeat.C:
+					fmt.Fprint(w, ": heartbeat\n\n")
+				}
+				// Writes are buffered, so the subscriber has disconnected
+				// once flushing fails.
+				if err := w.Flush(); err != nil {
+					return
+				}
+			}
+		})
+		return nil
+	}
+}
+
+// readBody reads the request body into data, returning a 400 error describing
+// expectedShape if the body is malformed so operators are not faced with an
+// opaque 500 error.
+func readBody(c *routing.Context, data interface{}, expectedShape string) error {
+	if err := c.Read(data); err != nil {
+		return routing.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("could not parse body: expected %s; got err = %v", expectedShape, err))
+	}
+	return nil
+}
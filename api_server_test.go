@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kcz17/dimmer/filters"
+	"github.com/kcz17/dimmer/logging"
+	"github.com/kcz17/dimmer/offlinetraining"
+	"github.com/kcz17/dimmer/onlinetraining"
+	"github.com/kcz17/dimmer/pid"
+	"github.com/kcz17/dimmer/responsetimecollector"
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+// doAPIRequest sends a request with a JSON body through the APIServer router.
+func doAPIRequest(api *APIServer, method string, uri string, body string) *fasthttp.RequestCtx {
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.Header.SetMethod(method)
+	ctx.Request.SetRequestURI(uri)
+	ctx.Request.Header.SetContentType("application/json")
+	ctx.Request.SetBodyString(body)
+	api.newRouter().HandleRequest(ctx)
+	return ctx
+}
+
+func TestAPIServer_MalformedBodiesReturnBadRequest(t *testing.T) {
+	api := &APIServer{Server: &Server{}}
+	tests := []struct {
+		name string
+		uri  string
+		body string
+	}{
+		{name: "Garbage mode", uri: "/mode", body: "garbage"},
+		{name: "Empty mode", uri: "/mode", body: ""},
+		{name: "Mode of wrong type", uri: "/mode", body: `{"mode": 1}`},
+		{name: "Unknown mode", uri: "/mode", body: `{"mode": "Foo"}`},
+		{name: "Garbage probabilities", uri: "/probabilities", body: "garbage"},
+		{name: "Probabilities not an array", uri: "/probabilities", body: `{"path": "/foo", "probability": 0.5}`},
+		{name: "Probability of wrong type", uri: "/probabilities", body: `[{"path": "/foo", "probability": "high"}]`},
+		{name: "Probability without path", uri: "/probabilities", body: `[{"probability": 0.5}]`},
+		{name: "Garbage collector window", uri: "/collector/window", body: "garbage"},
+		{name: "Non-positive collector window", uri: "/collector/window", body: `{"size": 0}`},
+		{name: "Garbage setpoint", uri: "/setpoint", body: "garbage"},
+		{name: "Setpoint missing", uri: "/setpoint", body: `{}`},
+		{name: "Garbage gains", uri: "/gains", body: "garbage"},
+		{name: "Gains missing kd", uri: "/gains", body: `{"kp": 1, "ki": 1}`},
+		{name: "Garbage maintenance", uri: "/maintenance", body: "garbage"},
+		{name: "Maintenance without enabled", uri: "/maintenance", body: `{"retryAfter": 60}`},
+		{name: "Negative maintenance retryAfter", uri: "/maintenance", body: `{"enabled": true, "retryAfter": -1}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := doAPIRequest(api, http.MethodPost, tt.uri, tt.body)
+			assert.Equalf(t, http.StatusBadRequest, ctx.Response.StatusCode(), "expected 400 for body %q; got body %q", tt.body, ctx.Response.Body())
+		})
+	}
+}
+
+func TestAPIServer_Ready(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nilf(t, err, "expected net.Listen(...) has no err; got %v", err)
+	defer backend.Close()
+
+	controlLoop, err := NewServerControlLoop(&ServerControlLoopOptions{
+		Logger:                        logging.NewNoopLogger(),
+		PID:                           newTestPIDController(t),
+		ResponseTimeCollector:         responsetimecollector.NewArrayCollector(),
+		ResponseTimePercentileWeights: map[string]float64{P95: 1},
+	})
+	assert.Nilf(t, err, "expected NewServerControlLoop(...) has no err; got %v", err)
+	api := &APIServer{Server: NewServer(&ServerOptions{
+		ControlLoop: controlLoop,
+		BackendAddr: backend.Addr().String(),
+	})}
+
+	ctx := doAPIRequest(api, http.MethodGet, "/ready", "")
+	assert.Equal(t, http.StatusServiceUnavailable, ctx.Response.StatusCode(), "expected not ready before the control loop starts")
+
+	// A fresh dimmer is ready without having proxied any requests.
+	assert.Nil(t, controlLoop.Start())
+	t.Cleanup(func() { _ = controlLoop.Stop() })
+	ctx = doAPIRequest(api, http.MethodGet, "/ready", "")
+	assert.Equal(t, http.StatusOK, ctx.Response.StatusCode())
+
+	assert.Nil(t, backend.Close())
+	ctx = doAPIRequest(api, http.MethodGet, "/ready", "")
+	assert.Equal(t, http.StatusServiceUnavailable, ctx.Response.StatusCode(), "expected not ready once the backend is unreachable")
+}
+
+func TestAPIServer_Maintenance(t *testing.T) {
+	s := NewServer(&ServerOptions{})
+	api := &APIServer{Server: s}
+
+	ctx := doAPIRequest(api, http.MethodPost, "/maintenance", `{"enabled": true, "retryAfter": 120}`)
+	assert.Equal(t, http.StatusOK, ctx.Response.StatusCode())
+
+	// All requests receive the maintenance response without being proxied.
+	ctx = &fasthttp.RequestCtx{}
+	ctx.Request.SetRequestURI("/any/path")
+	s.requestHandler()(ctx)
+	assert.Equal(t, http.StatusServiceUnavailable, ctx.Response.StatusCode())
+	assert.Equal(t, "120", string(ctx.Response.Header.Peek("Retry-After")))
+
+	ctx = doAPIRequest(api, http.MethodPost, "/maintenance", `{"enabled": false}`)
+	assert.Equal(t, http.StatusOK, ctx.Response.StatusCode())
+	assert.Equal(t, int32(0), s.isMaintenanceEnabled)
+}
+
+func TestAPIServer_FilterStats(t *testing.T) {
+	s := newTestServerWithBackend(t, &alwaysDimDecider{})
+	api := &APIServer{Server: s}
+
+	for _, path := range []string{"/path", "/other", "/other", "/other"} {
+		s.requestHandler()(newTestRequestCtx(http.MethodGet, path))
+	}
+
+	ctx := doAPIRequest(api, http.MethodGet, "/filter/stats", "")
+	assert.Equal(t, http.StatusOK, ctx.Response.StatusCode())
+	assert.JSONEq(t, `{"Total": 4, "Matched": 1, "Ratio": 0.25}`, string(ctx.Response.Body()))
+}
+
+func TestAPIServer_ApplyConfig(t *testing.T) {
+	s := newTestServerWithBackend(t, &alwaysDimDecider{})
+	s.offlineTraining = offlinetraining.NewOfflineTraining()
+	assert.Nil(t, s.dimming.ControlLoop.Start())
+	t.Cleanup(func() { _ = s.dimming.ControlLoop.Stop() })
+	s.isStarted = true
+	onlineTraining, err := onlinetraining.NewOnlineTraining(logging.NewNoopLogger(), []string{"/basket"}, s.dimming.PathProbabilities, 1, onlinetraining.Options{})
+	assert.Nil(t, err)
+	s.onlineTraining = onlineTraining
+	assert.Nil(t, s.dimming.PathProbabilities.Set(filters.PathProbabilityRule{Path: "/basket", Probability: 0.4}))
+	api := &APIServer{Server: s}
+
+	ctx := doAPIRequest(api, http.MethodPost, "/config/apply", `{
+		"mode": "ShadowDimming",
+		"probabilities": [{"path": "/catalogue", "probability": 0.6}],
+		"controller": {"setpoint": 0.5, "kp": 2, "ki": 0.5, "kd": 0}
+	}`)
+	assert.Equal(t, http.StatusOK, ctx.Response.StatusCode())
+	assert.JSONEq(t, `{
+		"Mode": "ShadowDimming",
+		"Probabilities": {"/basket": 0.4, "basket": 0.4, "/catalogue": 0.6, "catalogue": 0.6},
+		"Setpoint": 0.5,
+		"Gains": {"Kp": 2, "Ki": 0.5, "Kd": 0}
+	}`, string(ctx.Response.Body()))
+	assert.Equal(t, ShadowDimming, s.dimmingMode)
+
+	// Omitted fields are left unchanged.
+	ctx = doAPIRequest(api, http.MethodPost, "/config/apply", `{"controller": {"setpoint": 0.8}}`)
+	assert.Equal(t, http.StatusOK, ctx.Response.StatusCode())
+	assert.Equal(t, ShadowDimming, s.dimmingMode)
+	assert.Equal(t, 0.8, s.dimming.ControlLoop.Setpoint())
+	kp, ki, kd := s.dimming.ControlLoop.Gains()
+	assert.Equal(t, []float64{2, 0.5, 0}, []float64{kp, ki, kd})
+}
+
+func TestAPIServer_ApplyConfig_InvalidChangesApplyNothing(t *testing.T) {
+	s := newTestServerWithBackend(t, &alwaysDimDecider{})
+	s.offlineTraining = offlinetraining.NewOfflineTraining()
+	assert.Nil(t, s.dimming.ControlLoop.Start())
+	t.Cleanup(func() { _ = s.dimming.ControlLoop.Stop() })
+	s.isStarted = true
+	api := &APIServer{Server: s}
+
+	tests := []struct {
+		name string
+		body string
+	}{
+		{name: "Unknown mode", body: `{"mode": "Foo", "controller": {"setpoint": 0.5}}`},
+		{name: "Invalid probability", body: `{"mode": "Disabled", "probabilities": [{"path": "/catalogue", "probability": 1.5}]}`},
+		{name: "Probability without path", body: `{"mode": "Disabled", "probabilities": [{"probability": 0.5}]}`},
+		{name: "Negative setpoint", body: `{"mode": "Disabled", "controller": {"setpoint": -1}}`},
+		{name: "Missing gain", body: `{"mode": "Disabled", "controller": {"kp": 1, "ki": 1}}`},
+		{name: "Negative gain", body: `{"mode": "Disabled", "controller": {"kp": 1, "ki": -1, "kd": 0}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := doAPIRequest(api, http.MethodPost, "/config/apply", tt.body)
+			assert.Equal(t, http.StatusBadRequest, ctx.Response.StatusCode())
+			assert.Equal(t, Dimming, s.dimmingMode)
+			assert.Empty(t, s.dimming.PathProbabilities.List())
+			assert.Equal(t, 1.0, s.dimming.ControlLoop.Setpoint())
+		})
+	}
+}
+
+func TestAPIServer_ApplyConfig_FailedModeChangeAppliesNothing(t *testing.T) {
+	s := newTestServerWithBackend(t, &alwaysDimDecider{})
+	api := &APIServer{Server: s}
+
+	// The mode cannot be changed as the server has not started.
+	ctx := doAPIRequest(api, http.MethodPost, "/config/apply", `{
+		"mode": "Disabled",
+		"probabilities": [{"path": "/catalogue", "probability": 0.6}],
+		"controller": {"setpoint": 0.5, "kp": 2, "ki": 0.5, "kd": 0}
+	}`)
+	assert.Equal(t, http.StatusInternalServerError, ctx.Response.StatusCode())
+	assert.Equal(t, Dimming, s.dimmingMode)
+	assert.Empty(t, s.dimming.PathProbabilities.List())
+	assert.Equal(t, 1.0, s.dimming.ControlLoop.Setpoint())
+	kp, ki, kd := s.dimming.ControlLoop.Gains()
+	assert.Equal(t, []float64{1, 0, 0}, []float64{kp, ki, kd})
+}
+
+func TestAPIServer_ListPathProbabilities(t *testing.T) {
+	s := newTestServerWithBackend(t, &alwaysDimDecider{})
+	assert.Nil(t, s.dimming.PathProbabilities.Set(filters.PathProbabilityRule{Path: "/catalogue", Probability: 0.6}))
+	api := &APIServer{Server: s}
+
+	ctx := doAPIRequest(api, http.MethodGet, "/probabilities", "")
+	assert.Equal(t, http.StatusOK, ctx.Response.StatusCode())
+	assert.Equal(t, "probabilities:\nmap[/catalogue:0.6 catalogue:0.6]\n", string(ctx.Response.Body()))
+}
+
+func TestAPIServer_RemovePathProbability(t *testing.T) {
+	s := newTestServerWithBackend(t, &alwaysDimDecider{})
+	assert.Nil(t, s.dimming.PathProbabilities.Set(filters.PathProbabilityRule{Path: "/catalogue/items", Probability: 0.6}))
+	assert.Nil(t, s.dimming.PathProbabilities.Set(filters.PathProbabilityRule{Path: "/basket", Probability: 0.4}))
+	api := &APIServer{Server: s}
+
+	ctx := doAPIRequest(api, http.MethodDelete, "/probabilities/catalogue/items", "")
+	assert.Equal(t, http.StatusOK, ctx.Response.StatusCode())
+	assert.Equal(t, map[string]float64{"/basket": 0.4, "basket": 0.4}, s.dimming.PathProbabilities.List())
+
+	ctx = doAPIRequest(api, http.MethodDelete, "/probabilities/catalogue/items", "")
+	assert.Equal(t, http.StatusNotFound, ctx.Response.StatusCode())
+}
+
+func TestAPIServer_RemoveFilterRule(t *testing.T) {
+	s := newTestServerWithBackend(t, &alwaysDimDecider{})
+	s.dimming.RequestFilter.AddPathForAllMethods("/catalogue")
+	api := &APIServer{Server: s}
+
+	ctx := doAPIRequest(api, http.MethodDelete, "/filter/rules", `{"Path": "/path", "Method": "GET"}`)
+	assert.Equal(t, http.StatusOK, ctx.Response.StatusCode())
+	assert.False(t, s.dimming.RequestFilter.Matches("/path", http.MethodGet, "", nil))
+
+	ctx = doAPIRequest(api, http.MethodDelete, "/filter/rules", `{"Path": "/path", "Method": "GET"}`)
+	assert.Equal(t, http.StatusNotFound, ctx.Response.StatusCode())
+
+	ctx = doAPIRequest(api, http.MethodDelete, "/filter/rules", `{"Path": "catalogue"}`)
+	assert.Equal(t, http.StatusOK, ctx.Response.StatusCode())
+	assert.False(t, s.dimming.RequestFilter.Matches("/catalogue", http.MethodPost, "", nil))
+
+	ctx = doAPIRequest(api, http.MethodDelete, "/filter/rules", `{"Method": "GET"}`)
+	assert.Equal(t, http.StatusBadRequest, ctx.Response.StatusCode())
+}
+
+func TestAPIServer_DisableAndEnablePath(t *testing.T) {
+	s := newTestServerWithBackend(t, &alwaysDimDecider{})
+	assert.Nil(t, s.dimming.PathProbabilities.Set(filters.PathProbabilityRule{Path: "/path", Probability: 0.6}))
+	onlineTraining, err := onlinetraining.NewOnlineTraining(logging.NewNoopLogger(), []string{"/path"}, s.dimming.PathProbabilities, 1, onlinetraining.Options{})
+	assert.Nilf(t, err, "expected NewOnlineTraining(...) has no err; got %v", err)
+	s.onlineTraining = onlineTraining
+	api := &APIServer{Server: s}
+
+	ctx := doAPIRequest(api, http.MethodPost, "/probabilities/path/disable", "")
+	assert.Equal(t, http.StatusOK, ctx.Response.StatusCode())
+
+	ctx = doAPIRequest(api, http.MethodPost, "/probabilities/path/disable", "")
+	assert.Equal(t, http.StatusConflict, ctx.Response.StatusCode())
+
+	// Setting the probability of a disabled path is skipped, and the path is
+	// not dimmed whatever its probability.
+	ctx = doAPIRequest(api, http.MethodPost, "/probabilities", `[{"path": "/path", "probability": 1}]`)
+	assert.Equal(t, http.StatusOK, ctx.Response.StatusCode())
+	assert.Equal(t, 0.6, s.dimming.PathProbabilities.Get("/path"))
+	assert.Nil(t, s.dimming.PathProbabilities.Set(filters.PathProbabilityRule{Path: "/path", Probability: 1}))
+	ctx = newTestRequestCtx(http.MethodGet, "/path")
+	s.requestHandler()(ctx)
+	assert.Equal(t, http.StatusAccepted, ctx.Response.StatusCode(), "expected disabled path to be proxied")
+
+	ctx = doAPIRequest(api, http.MethodPost, "/probabilities/path/enable", "")
+	assert.Equal(t, http.StatusOK, ctx.Response.StatusCode())
+	ctx = newTestRequestCtx(http.MethodGet, "/path")
+	s.requestHandler()(ctx)
+	assert.NotEqual(t, http.StatusAccepted, ctx.Response.StatusCode(), "expected enabled path to be dimmed")
+
+	ctx = doAPIRequest(api, http.MethodPost, "/probabilities/path/enable", "")
+	assert.Equal(t, http.StatusConflict, ctx.Response.StatusCode())
+}
+
+func TestAPIServer_UnknownPathActionReturnsNotFound(t *testing.T) {
+	api := &APIServer{Server: newTestServerWithBackend(t, &alwaysDimDecider{})}
+
+	ctx := doAPIRequest(api, http.MethodPost, "/probabilities/catalogue/remove", "")
+	assert.Equal(t, http.StatusNotFound, ctx.Response.StatusCode())
+}
+
+func TestAPIServer_ProbabilityFloorsRequireForce(t *testing.T) {
+	s := newTestServerWithBackend(t, &alwaysDimDecider{})
+	assert.Nil(t, s.dimming.PathProbabilities.Set(filters.PathProbabilityRule{Path: "/checkout", Probability: 0.8}))
+	floors, err := filters.NewProbabilityFloors(0)
+	assert.Nil(t, err)
+	floors.SetCategory("/checkout", "critical")
+	assert.Nil(t, floors.SetFloor("critical", 0.5))
+	api := &APIServer{Server: s, ProbabilityFloors: floors}
+
+	ctx := doAPIRequest(api, http.MethodPost, "/probabilities/checkout/disable", "")
+	assert.Equal(t, http.StatusConflict, ctx.Response.StatusCode())
+	assert.False(t, s.disabledPaths.Contains("/checkout"))
+
+	ctx = doAPIRequest(api, http.MethodPost, "/probabilities/checkout/disable?force=true", "")
+	assert.Equal(t, http.StatusOK, ctx.Response.StatusCode())
+	assert.True(t, s.disabledPaths.Contains("/checkout"))
+
+	ctx = doAPIRequest(api, http.MethodPost, "/probabilities/checkout/enable", "")
+	assert.Equal(t, http.StatusOK, ctx.Response.StatusCode())
+	assert.False(t, s.disabledPaths.Contains("/checkout"))
+	assert.Equal(t, 0.8, s.dimming.PathProbabilities.Get("/checkout"))
+}
+
+type noopMetricsWriter struct{}
+
+func (noopMetricsWriter) WriteMetrics(w io.Writer) error {
+	return nil
+}
+
+func TestAPIServer_OpenAPIDocumentDescribesAllRoutes(t *testing.T) {
+	api := &APIServer{Server: &Server{}, Metrics: noopMetricsWriter{}, Events: logging.NewEventBroadcaster()}
+
+	specRoutes := map[string]bool{}
+	for _, spec := range api.routeSpecs() {
+		specRoutes[spec.Method+" "+spec.RouterPath] = true
+	}
+	routerRoutes := map[string]bool{}
+	for _, route := range api.newRouter().Routes() {
+		routerRoutes[route.Method()+" "+route.Path()] = true
+	}
+	assert.Equal(t, routerRoutes, specRoutes)
+}
+
+func TestAPIServer_OpenAPIDocument(t *testing.T) {
+	api := &APIServer{Server: &Server{}}
+
+	ctx := doAPIRequest(api, http.MethodGet, "/openapi.json", "")
+	assert.Equal(t, http.StatusOK, ctx.Response.StatusCode())
+	assert.Equal(t, "application/json", string(ctx.Response.Header.ContentType()))
+
+	var document struct {
+		OpenAPI string
+		Paths   map[string]map[string]interface{}
+	}
+	assert.Nil(t, json.Unmarshal(ctx.Response.Body(), &document))
+	assert.Equal(t, openAPIVersion, document.OpenAPI)
+	assert.Contains(t, document.Paths["/probabilities"], "post")
+	assert.Contains(t, document.Paths["/probabilities"], "delete")
+	assert.Contains(t, document.Paths["/probabilities/{path}/disable"], "post")
+	assert.NotContains(t, document.Paths, "/metrics")
+}
+
+func TestAPIServer_SetSetpoint(t *testing.T) {
+	s := newTestServerWithBackend(t, &alwaysDimDecider{})
+	api := &APIServer{Server: s}
+
+	ctx := doAPIRequest(api, http.MethodPost, "/setpoint", `{"setpoint": 0.25}`)
+	assert.Equal(t, http.StatusOK, ctx.Response.StatusCode())
+	assert.Equal(t, 0.25, s.dimming.ControlLoop.pid.(*pid.PIDController).Setpoint())
+	setpoint, _ := s.dimming.ControlLoop.readSetpointAndInput()
+	assert.Equal(t, 0.25, setpoint)
+
+	ctx = doAPIRequest(api, http.MethodPost, "/setpoint", `{"setpoint": 0}`)
+	assert.Equal(t, http.StatusBadRequest, ctx.Response.StatusCode())
+	assert.Equal(t, 0.25, s.dimming.ControlLoop.pid.(*pid.PIDController).Setpoint())
+}
+
+func TestAPIServer_SetCandidateProbability(t *testing.T) {
+	s := newTestServerWithBackend(t, &alwaysDimDecider{})
+	api := &APIServer{Server: s}
+
+	ctx := doAPIRequest(api, http.MethodPost, "/training/online/candidate-probability", `{"probability": 0.1}`)
+	assert.Equal(t, http.StatusNotFound, ctx.Response.StatusCode())
+
+	onlineTraining, err := onlinetraining.NewOnlineTraining(logging.NewNoopLogger(), []string{"/path"}, s.dimming.PathProbabilities, 1, onlinetraining.Options{})
+	assert.Nilf(t, err, "expected NewOnlineTraining(...) has no err; got %v", err)
+	s.onlineTraining = onlineTraining
+
+	ctx = doAPIRequest(api, http.MethodPost, "/training/online/candidate-probability", `{"probability": 0.1}`)
+	assert.Equal(t, http.StatusOK, ctx.Response.StatusCode())
+
+	ctx = doAPIRequest(api, http.MethodPost, "/training/online/candidate-probability", `{"probability": 1}`)
+	assert.Equal(t, http.StatusBadRequest, ctx.Response.StatusCode())
+
+	ctx = doAPIRequest(api, http.MethodGet, "/training/online/status", "")
+	assert.Equal(t, http.StatusOK, ctx.Response.StatusCode())
+	assert.JSONEq(t, `{
+		"Phase": "idle",
+		"PhaseValue": 0,
+		"IsIterationActive": false,
+		"CandidateProbability": 0.1,
+		"MinCandidateProbability": 0.01,
+		"MaxCandidateProbability": 0.2,
+		"ControlProbabilities": {"/path": 1},
+		"CandidateProbabilities": [{"/path": 1}],
+		"LastComparison": null
+	}`, string(ctx.Response.Body()))
+}
+
+func TestAPIServer_SetGains(t *testing.T) {
+	s := newTestServerWithBackend(t, &alwaysDimDecider{})
+	api := &APIServer{Server: s}
+
+	ctx := doAPIRequest(api, http.MethodPost, "/gains", `{"kp": 3, "ki": 0.5, "kd": 0.1}`)
+	assert.Equal(t, http.StatusOK, ctx.Response.StatusCode())
+	kp, ki, kd := s.dimming.ControlLoop.pid.(*pid.PIDController).Gains()
+	// The test controller is reversed, so its gains are negated.
+	assert.Equal(t, []float64{-3, -0.5, -0.1}, []float64{kp, ki, kd})
+
+	ctx = doAPIRequest(api, http.MethodPost, "/gains", `{"kp": -1, "ki": 0.5, "kd": 0.1}`)
+	assert.Equal(t, http.StatusBadRequest, ctx.Response.StatusCode())
+}
+
+func TestAPIServer_StreamsEvents(t *testing.T) {
+	api := &APIServer{Server: &Server{}, Events: logging.NewEventBroadcaster()}
+	ln := fasthttputil.NewInmemoryListener()
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		_ = fasthttp.Serve(ln, api.newRouter().HandleRequest)
+	}()
+	client := &http.Client{Transport: &http.Transport{
+		Dial: func(string, string) (net.Conn, error) { return ln.Dial() },
+	}}
+
+	resp, err := client.Get("http://api/events")
+	assert.Nilf(t, err, "expected GET /events has no err; got %v", err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	assert.Eventually(t, func() bool { return api.Events.Subscribers() == 1 }, time.Second, time.Millisecond)
+
+	api.Events.Publish(logging.Event{
+		Type:       logging.EventDimmingModeChanged,
+		Attributes: map[string]interface{}{"from": "Disabled", "to": "Dimming"},
+	})
+	body := bufio.NewReader(resp.Body)
+	line, err := body.ReadString('\n')
+	assert.Nil(t, err)
+	assert.Equal(t, "event: dimming_mode_changed\n", line)
+	line, err = body.ReadString('\n')
+	assert.Nil(t, err)
+	var event logging.Event
+	assert.Nil(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event))
+	assert.Equal(t, "Dimming", event.Attributes["to"])
+
+	// The subscriber is cleaned up once a write after disconnecting fails.
+	assert.Nil(t, resp.Body.Close())
+	assert.Eventually(t, func() bool {
+		api.Events.Publish(logging.Event{Type: logging.EventControlLoopTicked})
+		return api.Events.Subscribers() == 0
+	}, time.Second, time.Millisecond)
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/jackwhelpton/fasthttp-routing/v2"
+	"net/http"
+	"strings"
+)
+
+// openAPIVersion is the OpenAPI specification version the API document
+// conforms to.
+const openAPIVersion = "3.0.3"
+
+// openAPISchema is a JSON schema object, kept free-form as the API only
+// requires a small subset of JSON schema.
+type openAPISchema map[string]interface{}
+
+type openAPIParameter struct {
+	Name        string        `json:"name"`
+	In          string        `json:"in"`
+	Description string        `json:"description,omitempty"`
+	Required    bool          `json:"required"`
+	Schema      openAPISchema `json:"schema"`
+}
+
+type openAPIMediaType struct {
+	Schema openAPISchema `json:"schema"`
+}
+
+type openAPIRequestBody struct {
+	Required bool                        `json:"required"`
+	Content  map[string]openAPIMediaType `json:"content"`
+}
+
+type openAPIResponse struct {
+	Description string                      `json:"description"`
+	Content     map[string]openAPIMediaType `json:"content,omitempty"`
+}
+
+type openAPIOperation struct {
+	Summary     string                     `json:"summary"`
+	Parameters  []openAPIParameter         `json:"parameters,omitempty"`
+	RequestBody *openAPIRequestBody        `json:"requestBody,omitempty"`
+	Responses   map[string]openAPIResponse `json:"responses"`
+}
+
+// apiRouteSpec describes a single API route for the OpenAPI document.
+type apiRouteSpec struct {
+	Method string
+	// RouterPath is the path registered with the router, which differs from
+	// Path for routes dispatched manually, e.g. /probabilities/{path}/disable.
+	RouterPath string
+	// Path is the OpenAPI path template.
+	Path      string
+	Operation openAPIOperation
+}
+
+// routeSpecs describes every route registered by newRouter. It must be
+// updated alongside newRouter, which is enforced by tests.
+func (s *APIServer) routeSpecs() []apiRouteSpec {
+	pathActionRoute := "/probabilities/<pathAction:.*>"
+	pathParameter := openAPIParameter{
+		Name:        "path",
+		In:          "path",
+		Description: "Path of the component, which may contain slashes and need not have a leading slash.",
+		Required:    true,
+		Schema:      openAPISchema{"type": "string"},
+	}
+	forceParameter := openAPIParameter{
+		Name:        "force",
+		In:          "query",
+		Description: "Set to true to lower a probability below the floor of its category.",
+		Required:    false,
+		Schema:      openAPISchema{"type": "boolean"},
+	}
+
+	specs := []apiRouteSpec{
+		{
+			Method: http.MethodGet, RouterPath: "/ready", Path: "/ready",
+			Operation: openAPIOperation{
+				Summary: "Reports whether the control loop has warmed up and the backend is reachable.",
+				Responses: map[string]openAPIResponse{
+					"200": textResponse("The dimmer is ready."),
+					"503": textResponse("The control loop is warming up, or the backend is unreachable."),
+				},
+			},
+		},
+		{
+			Method: http.MethodPost, RouterPath: "/mode", Path: "/mode",
+			Operation: openAPIOperation{
+				Summary: "Sets the dimming mode. Default restores the mode the server started in.",
+				RequestBody: jsonRequestBody(objectSchema(map[string]openAPISchema{
+					"Mode": {"type": "string", "enum": []string{"Default", "Disabled", "OfflineTraining", "Dimming", "DimmingWithOnlineTraining", "DimmingWithProfiling", "ShadowDimming"}},
+				}, "Mode")),
+				Responses: map[string]openAPIResponse{
+					"200": textResponse("The mode was set."),
+					"400": textResponse("The body is malformed or the mode is unknown."),
+					"500": textResponse("The mode could not be set."),
+				},
+			},
+		},
+		{
+			Method: http.MethodPost, RouterPath: "/config/apply", Path: "/config/apply",
+			Operation: openAPIOperation{
+				Summary:    "Sets the mode, path probabilities and controller together, rolling back all changes if any fails. Omitted fields are unchanged, and gains must be set together.",
+				Parameters: []openAPIParameter{forceParameter},
+				RequestBody: jsonRequestBody(objectSchema(map[string]openAPISchema{
+					"Mode": {"type": "string", "enum": []string{"Default", "Disabled", "OfflineTraining", "Dimming", "DimmingWithOnlineTraining", "DimmingWithProfiling", "ShadowDimming"}},
+					"Probabilities": {
+						"type": "array",
+						"items": objectSchema(map[string]openAPISchema{
+							"Path":        {"type": "string"},
+							"Probability": {"type": "number", "minimum": 0, "maximum": 1},
+						}, "Path", "Probability"),
+					},
+					"Controller": objectSchema(map[string]openAPISchema{
+						"Setpoint": {"type": "number", "exclusiveMinimum": true, "minimum": 0},
+						"Kp":       {"type": "number", "minimum": 0},
+						"Ki":       {"type": "number", "minimum": 0},
+						"Kd":       {"type": "number", "minimum": 0},
+					}),
+				})),
+				Responses: map[string]openAPIResponse{
+					"200": jsonResponse("The effective configuration.", objectSchema(map[string]openAPISchema{
+						"Mode":          {"type": "string"},
+						"Probabilities": {"type": "object", "additionalProperties": openAPISchema{"type": "number"}},
+						"Setpoint":      {"type": "number"},
+						"Gains": objectSchema(map[string]openAPISchema{
+							"Kp": {"type": "number"},
+							"Ki": {"type": "number"},
+							"Kd": {"type": "number"},
+						}),
+					})),
+					"400": textResponse("The body is malformed or a change is invalid."),
+					"409": textResponse("A probability would be lowered below its floor without force."),
+					"500": textResponse("A change could not be applied, so all changes were rolled back."),
+				},
+			},
+		},
+		{
+			Method: http.MethodPost, RouterPath: "/maintenance", Path: "/maintenance",
+			Operation: openAPIOperation{
+				Summary: "Enables or disables maintenance mode, where all requests receive a 503.",
+				RequestBody: jsonRequestBody(objectSchema(map[string]openAPISchema{
+					"Enabled":    {"type": "boolean"},
+					"RetryAfter": {"type": "integer", "minimum": 0, "description": "Retry-After in seconds. Not set if 0."},
+				}, "Enabled")),
+				Responses: map[string]openAPIResponse{
+					"200": textResponse("Maintenance mode was enabled or disabled."),
+					"400": textResponse("The body is malformed."),
+				},
+			},
+		},
+		{
+			Method: http.MethodGet, RouterPath: "/probabilities", Path: "/probabilities",
+			Operation: openAPIOperation{
+				Summary: "Lists the dimming probability of each path.",
+				Responses: map[string]openAPIResponse{
+					"200": textResponse("The path probabilities."),
+				},
+			},
+		},
+		{
+			Method: http.MethodPost, RouterPath: "/probabilities", Path: "/probabilities",
+			Operation: openAPIOperation{
+				Summary:    "Sets the dimming probabilities of paths.",
+				Parameters: []openAPIParameter{forceParameter},
+				RequestBody: jsonRequestBody(openAPISchema{
+					"type": "array",
+					"items": objectSchema(map[string]openAPISchema{
+						"Path":        {"type": "string"},
+						"Probability": {"type": "number", "minimum": 0, "maximum": 1},
+					}, "Path", "Probability"),
+				}),
+				Responses: map[string]openAPIResponse{
+					"200": textResponse("The probabilities were written."),
+					"400": textResponse("The body is malformed."),
+					"409": textResponse("A probability would be lowered below its floor without force."),
+				},
+			},
+		},
+		{
+			Method: http.MethodDelete, RouterPath: "/probabilities", Path: "/probabilities",
+			Operation: openAPIOperation{
+				Summary: "Resets all paths to the default probability.",
+				Responses: map[string]openAPIResponse{
+					"200": textResponse("The probabilities were cleared."),
+				},
+			},
+		},
+		{
+			Method: http.MethodDelete, RouterPath: "/probabilities/<path:.*>", Path: "/probabilities/{path}",
+			Operation: openAPIOperation{
+				Summary:    "Resets a path to the default probability.",
+				Parameters: []openAPIParameter{pathParameter},
+				Responses: map[string]openAPIResponse{
+					"200": textResponse("The probability was removed."),
+					"404": textResponse("The path has no probability set."),
+				},
+			},
+		},
+		{
+			Method: http.MethodPost, RouterPath: pathActionRoute, Path: "/probabilities/{path}/disable",
+			Operation: openAPIOperation{
+				Summary:    "Stops a path from being dimmed, remembering its probability.",
+				Parameters: []openAPIParameter{pathParameter, forceParameter},
+				Responses: map[string]openAPIResponse{
+					"200": textResponse("The path was disabled."),
+					"409": textResponse("The path is already disabled, or its floor requires force."),
+				},
+			},
+		},
+		{
+			Method: http.MethodPost, RouterPath: pathActionRoute, Path: "/probabilities/{path}/enable",
+			Operation: openAPIOperation{
+				Summary:    "Restores the probability of a disabled path.",
+				Parameters: []openAPIParameter{pathParameter},
+				Responses: map[string]openAPIResponse{
+					"200": textResponse("The path was enabled."),
+					"409": textResponse("The path is not disabled."),
+				},
+			},
+		},
+		{
+			Method: http.MethodGet, RouterPath: "/training/stats", Path: "/training/stats",
+			Operation: openAPIOperation{
+				Summary: "Gets response time percentiles in seconds collected during offline training.",
+				Responses: map[string]openAPIResponse{
+					"200": jsonResponse("The response time percentiles.", objectSchema(map[string]openAPISchema{
+						"P50": {"type": "number"},
+						"P75": {"type": "number"},
+						"P95": {"type": "number"},
+					})),
+				},
+			},
+		},
+		{
+			Method: http.MethodGet, RouterPath: "/training/online/status", Path: "/training/online/status",
+			Operation: openAPIOperation{
+				Summary: "Gets the current phase of online training, the probabilities of each group and the last comparison.",
+				Responses: map[string]openAPIResponse{
+					"200": jsonResponse("The online training status.", objectSchema(map[string]openAPISchema{
+						"Phase":                   {"type": "string", "enum": []string{"idle", "adjusting", "measuring"}},
+						"PhaseValue":              {"type": "integer"},
+						"IsIterationActive":       {"type": "boolean"},
+						"CandidateProbability":    {"type": "number"},
+						"MinCandidateProbability": {"type": "number"},
+						"MaxCandidateProbability": {"type": "number"},
+						"ControlProbabilities":    {"type": "object", "additionalProperties": openAPISchema{"type": "number"}},
+						"CandidateProbabilities":  {"type": "array", "items": openAPISchema{"type": "object", "additionalProperties": openAPISchema{"type": "number"}}},
+						// LastComparison is null until a round has completed.
+						"LastComparison": objectSchema(map[string]openAPISchema{
+							"ControlP95":            {"type": "number"},
+							"CandidateP95s":         {"type": "array", "items": openAPISchema{"type": "number"}},
+							"IsSignificant":         {"type": "boolean"},
+							"AdoptedCandidateGroup": {"type": "integer"},
+							"CompletedAt":           {"type": "string", "format": "date-time"},
+						}),
+					})),
+					"404": textResponse("Online training is not configured."),
+				},
+			},
+		},
+		{
+			Method: http.MethodPost, RouterPath: "/training/online/candidate-probability", Path: "/training/online/candidate-probability",
+			Operation: openAPIOperation{
+				Summary: "Sets the probability of sessions being assigned to the online training candidate group.",
+				RequestBody: jsonRequestBody(objectSchema(map[string]openAPISchema{
+					"Probability": {"type": "number", "minimum": 0, "maximum": 1},
+				}, "Probability")),
+				Responses: map[string]openAPIResponse{
+					"200": textResponse("The candidate probability was set."),
+					"400": textResponse("The body is malformed or the probability is outside the configured range."),
+					"404": textResponse("Online training is not configured."),
+				},
+			},
+		},
+		{
+			Method: http.MethodGet, RouterPath: "/filter/stats", Path: "/filter/stats",
+			Operation: openAPIOperation{
+				Summary: "Gets the number of requests received and matched by the request filter.",
+				Responses: map[string]openAPIResponse{
+					"200": jsonResponse("The request filter counts.", objectSchema(map[string]openAPISchema{
+						"Total":   {"type": "integer"},
+						"Matched": {"type": "integer"},
+						"Ratio":   {"type": "number"},
+					})),
+				},
+			},
+		},
+		{
+			Method: http.MethodDelete, RouterPath: "/filter/rules", Path: "/filter/rules",
+			Operation: openAPIOperation{
+				Summary: "Removes the request filter rule for a path and method, or for all methods if no method is given.",
+				RequestBody: jsonRequestBody(objectSchema(map[string]openAPISchema{
+					"Path":   {"type": "string"},
+					"Method": {"type": "string"},
+				}, "Path")),
+				Responses: map[string]openAPIResponse{
+					"200": textResponse("The rule was removed."),
+					"400": textResponse("The body is malformed or the path is empty."),
+					"404": textResponse("The filter has no rule for the path and method."),
+				},
+			},
+		},
+		{
+			Method: http.MethodPost, RouterPath: "/collector/window", Path: "/collector/window",
+			Operation: openAPIOperation{
+				Summary: "Resizes the response time collector window used by the controller.",
+				RequestBody: jsonRequestBody(objectSchema(map[string]openAPISchema{
+					"Size": {"type": "integer", "minimum": 1},
+				}, "Size")),
+				Responses: map[string]openAPIResponse{
+					"200": textResponse("The window was resized."),
+					"400": textResponse("The body is malformed or the size is not positive."),
+					"409": textResponse("The collector has no sample-count window, e.g. the ewma or time-windowed collectors."),
+				},
+			},
+		},
+		{
+			Method: http.MethodPost, RouterPath: "/setpoint", Path: "/setpoint",
+			Operation: openAPIOperation{
+				Summary: "Sets the setpoint of the primary controller without a jump in output.",
+				RequestBody: jsonRequestBody(objectSchema(map[string]openAPISchema{
+					"Setpoint": {
+						"type": "number", "exclusiveMinimum": true, "minimum": 0,
+						"description": "A response time in seconds, or a ratio of response time to target latency if any dimmable component sets a targetLatency.",
+					},
+				}, "Setpoint")),
+				Responses: map[string]openAPIResponse{
+					"200": textResponse("The setpoint was set."),
+					"400": textResponse("The body is malformed or the setpoint is not positive."),
+				},
+			},
+		},
+		{
+			Method: http.MethodPost, RouterPath: "/gains", Path: "/gains",
+			Operation: openAPIOperation{
+				Summary: "Sets the gains of the controller and its tiers without a jump in output.",
+				RequestBody: jsonRequestBody(objectSchema(map[string]openAPISchema{
+					"Kp": {"type": "number", "minimum": 0},
+					"Ki": {"type": "number", "minimum": 0},
+					"Kd": {"type": "number", "minimum": 0},
+				}, "Kp", "Ki", "Kd")),
+				Responses: map[string]openAPIResponse{
+					"200": textResponse("The gains were set."),
+					"400": textResponse("The body is malformed or a gain is negative."),
+				},
+			},
+		},
+		{
+			Method: http.MethodGet, RouterPath: "/openapi.json", Path: "/openapi.json",
+			Operation: openAPIOperation{
+				Summary: "Gets this OpenAPI document.",
+				Responses: map[string]openAPIResponse{
+					"200": jsonResponse("The OpenAPI document.", openAPISchema{"type": "object"}),
+				},
+			},
+		},
+	}
+
+	if s.Metrics != nil {
+		specs = append(specs, apiRouteSpec{
+			Method: http.MethodGet, RouterPath: "/metrics", Path: "/metrics",
+			Operation: openAPIOperation{
+				Summary: "Gets metrics in the Prometheus text format.",
+				Responses: map[string]openAPIResponse{
+					"200": textResponse("The latest metrics."),
+				},
+			},
+		})
+	}
+	if s.Events != nil {
+		specs = append(specs, apiRouteSpec{
+			Method: http.MethodGet, RouterPath: "/events", Path: "/events",
+			Operation: openAPIOperation{
+				Summary: "Streams dimming events, such as each control loop tick and mode changes, as Server-Sent Events.",
+				Responses: map[string]openAPIResponse{
+					"200": {
+						Description: "A stream of events named by their type, with the event as JSON data.",
+						Content:     map[string]openAPIMediaType{"text/event-stream": {Schema: openAPISchema{"type": "string"}}},
+					},
+				},
+			},
+		})
+	}
+
+	return specs
+}
+
+// openAPIDocument generates an OpenAPI document from routeSpecs.
+func (s *APIServer) openAPIDocument() map[string]interface{} {
+	paths := map[string]map[string]openAPIOperation{}
+	for _, spec := range s.routeSpecs() {
+		if _, exists := paths[spec.Path]; !exists {
+			paths[spec.Path] = map[string]openAPIOperation{}
+		}
+		paths[spec.Path][strings.ToLower(spec.Method)] = spec.Operation
+	}
+
+	return map[string]interface{}{
+		"openapi": openAPIVersion,
+		"info": map[string]string{
+			"title":   "Dimmer API",
+			"version": "1.0.0",
+		},
+		"paths": paths,
+	}
+}
+
+func (s *APIServer) getOpenAPIHandler() routing.Handler {
+	return func(c *routing.Context) error {
+		b, err := json.Marshal(s.openAPIDocument())
+		if err != nil {
+			return fmt.Errorf("could not marshal OpenAPI document: err = %w", err)
+		}
+		c.SetContentType("application/json")
+		return c.Write(b)
+	}
+}
+
+func objectSchema(properties map[string]openAPISchema, required ...string) openAPISchema {
+	schema := openAPISchema{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+func jsonRequestBody(schema openAPISchema) *openAPIRequestBody {
+	return &openAPIRequestBody{
+		Required: true,
+		Content:  map[string]openAPIMediaType{"application/json": {Schema: schema}},
+	}
+}
+
+func jsonResponse(description string, schema openAPISchema) openAPIResponse {
+	return openAPIResponse{
+		Description: description,
+		Content:     map[string]openAPIMediaType{"application/json": {Schema: schema}},
+	}
+}
+
+func textResponse(description string) openAPIResponse {
+	return openAPIResponse{
+		Description: description,
+		Content:     map[string]openAPIMediaType{"text/plain": {Schema: openAPISchema{"type": "string"}}},
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// certificateReloader serves the frontend TLS certificate, which can be
+// reloaded from disk without restarting, e.g. after rotation by cert-manager.
+// Connections established before a reload keep their certificate.
+type certificateReloader struct {
+	certFile string
+	keyFile  string
+	// certificate is the most recently loaded certificate.
+	certificate *tls.Certificate
+	// certificateMux guards certificate, which is read during each handshake
+	// and replaced on reload.
+	certificateMux *sync.RWMutex
+}
+
+func newCertificateReloader(certFile string, keyFile string) (*certificateReloader, error) {
+	r := &certificateReloader{
+		certFile:       certFile,
+		keyFile:        keyFile,
+		certificateMux: &sync.RWMutex{},
+	}
+	if err := r.Reload(); err != nil {
+		return nil, fmt.Errorf("newCertificateReloader() expected Reload() returns nil err; got err = %w", err)
+	}
+	return r, nil
+}
+
+// Reload reads the certificate and key from disk, replacing the certificate
+// served to new connections. If either cannot be read or they do not match,
+// the previous certificate continues to be served.
+func (r *certificateReloader) Reload() error {
+	certificate, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("expected tls.LoadX509KeyPair(%s, %s) returns nil err; got err = %w", r.certFile, r.keyFile, err)
+	}
+
+	r.certificateMux.Lock()
+	r.certificate = &certificate
+	r.certificateMux.Unlock()
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (r *certificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.certificateMux.RLock()
+	defer r.certificateMux.RUnlock()
+	return r.certificate, nil
+}
+
+// TLSConfig returns a config serving the most recently loaded certificate.
+func (r *certificateReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: r.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+}
+
+// ReloadOnSIGHUP reloads the certificate each time the process receives
+// SIGHUP. Failing to reload is logged rather than fatal, as the previous
+// certificate remains valid until it expires.
+func (r *certificateReloader) ReloadOnSIGHUP() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			if err := r.Reload(); err != nil {
+				log.Printf("expected certificateReloader.Reload() returns nil err; got err = %v", err)
+				continue
+			}
+			log.Printf("reloaded TLS certificate from %s", r.certFile)
+		}
+	}()
+}
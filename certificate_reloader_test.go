@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeSelfSignedCertificate writes a self-signed certificate with the common
+// name to certFile and its key to keyFile.
+func writeSelfSignedCertificate(t *testing.T, commonName string, certFile string, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+
+	assert.Nil(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.Nil(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+}
+
+// dialCommonName returns the common name of the certificate served on addr.
+func dialCommonName(t *testing.T, addr string) string {
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if !assert.Nil(t, err) {
+		return ""
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func TestCertificateReloader_NewConnectionsUseReloadedCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certificates")
+	assert.Nil(t, err)
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeSelfSignedCertificate(t, "old", certFile, keyFile)
+
+	reloader, err := newCertificateReloader(certFile, keyFile)
+	assert.Nil(t, err)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", reloader.TLSConfig())
+	assert.Nil(t, err)
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.(*tls.Conn).Handshake()
+			_ = conn.Close()
+		}
+	}()
+
+	assert.Equal(t, "old", dialCommonName(t, ln.Addr().String()))
+
+	// Swapping the files alone does not change the certificate until reload.
+	writeSelfSignedCertificate(t, "new", certFile, keyFile)
+	assert.Equal(t, "old", dialCommonName(t, ln.Addr().String()))
+
+	assert.Nil(t, reloader.Reload())
+	assert.Equal(t, "new", dialCommonName(t, ln.Addr().String()))
+}
+
+func TestCertificateReloader_FailedReloadKeepsCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certificates")
+	assert.Nil(t, err)
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeSelfSignedCertificate(t, "old", certFile, keyFile)
+
+	reloader, err := newCertificateReloader(certFile, keyFile)
+	assert.Nil(t, err)
+
+	// A partially written certificate must not replace the valid one.
+	assert.Nil(t, ioutil.WriteFile(certFile, []byte("garbage"), 0600))
+	assert.NotNil(t, reloader.Reload())
+
+	certificate, err := reloader.GetCertificate(nil)
+	assert.Nil(t, err)
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	assert.Nil(t, err)
+	assert.Equal(t, "old", leaf.Subject.CommonName)
+}
+
+func TestNewCertificateReloader_MissingFiles(t *testing.T) {
+	_, err := newCertificateReloader("/nonexistent/tls.crt", "/nonexistent/tls.key")
+	assert.NotNil(t, err)
+}
@@ -3,8 +3,11 @@ package config
 import (
 	"fmt"
 	"github.com/go-playground/validator/v10"
+	"github.com/kcz17/dimmer/stats"
 	"github.com/spf13/viper"
+	"io/ioutil"
 	"log"
+	"math"
 	"os"
 	"reflect"
 	"strings"
@@ -21,10 +24,64 @@ type Connection struct {
 	BackendHost  *string `mapstructure:"backendHost" validate:"required"`
 	BackendPort  *int    `mapstructure:"backendPort" validate:"required"`
 	AdminPort    *int    `mapstructure:"adminPort" validate:"required"`
+	// FrontendSocketPath and BackendSocketPath are optional Unix domain socket
+	// paths which, if set, are used instead of FrontendPort and
+	// BackendHost:BackendPort respectively, e.g. in sidecar deployments.
+	FrontendSocketPath string `mapstructure:"frontendSocketPath"`
+	BackendSocketPath  string `mapstructure:"backendSocketPath"`
+	// TrustedProxies are CIDRs or IPs of proxies such as load balancers, from
+	// which the client IP is read from X-Forwarded-For.
+	TrustedProxies []string `mapstructure:"trustedProxies"`
+	// PerIPConcurrencyLimit caps the concurrent requests per client IP.
+	PerIPConcurrencyLimit PerIPConcurrencyLimit `mapstructure:"perIPConcurrencyLimit" validate:"required"`
+	// PathValidation rejects requests with malformed paths.
+	PathValidation PathValidation `mapstructure:"pathValidation" validate:"required"`
+	// DecompressGzipRequests decompresses request bodies with a
+	// Content-Encoding of gzip before proxying, for backends which cannot
+	// decompress them.
+	DecompressGzipRequests *bool `mapstructure:"decompressGzipRequests" validate:"required"`
+	// MaxRequestBodySize is the maximum size in bytes of request bodies, both
+	// as received and once decompressed. Larger bodies are rejected with a
+	// 413.
+	MaxRequestBodySize *int `mapstructure:"maxRequestBodySize" validate:"required,gt=0"`
+	// PreserveHTTP10KeepAlive forwards Connection: keep-alive from HTTP/1.0
+	// clients which explicitly request it, rather than stripping it with
+	// other hop-by-hop headers, as HTTP/1.0 connections are otherwise not
+	// persistent.
+	PreserveHTTP10KeepAlive *bool `mapstructure:"preserveHTTP10KeepAlive" validate:"required"`
+	// RequestTimeoutSeconds bounds the total time a request spends in the
+	// dimmer, returning a 504 if the backend has not responded in time. If 0,
+	// requests are not timed out.
+	RequestTimeoutSeconds *float64 `mapstructure:"requestTimeoutSeconds" validate:"required,gte=0"`
+	// TLS terminates TLS on the frontend port, or on FrontendSocketPath if
+	// set.
+	TLS TLS `mapstructure:"tls" validate:"required"`
+}
+
+// TLS serves the certificate and key at CertFile and KeyFile, which are
+// reloaded on SIGHUP so certificates can be rotated without a restart.
+type TLS struct {
+	Enabled  *bool   `mapstructure:"enabled" validate:"required"`
+	CertFile *string `mapstructure:"certFile" validate:"required_if=Enabled true"`
+	KeyFile  *string `mapstructure:"keyFile" validate:"required_if=Enabled true"`
+}
+
+type PathValidation struct {
+	Enabled   *bool `mapstructure:"enabled" validate:"required"`
+	MaxLength *int  `mapstructure:"maxLength" validate:"required,min=1"`
+	// AllowedCharacters restricts paths to alphanumeric characters and the
+	// given characters if non-empty. Otherwise, only ASCII control characters
+	// are rejected.
+	AllowedCharacters *string `mapstructure:"allowedCharacters" validate:"required"`
+}
+
+type PerIPConcurrencyLimit struct {
+	Enabled       *bool `mapstructure:"enabled" validate:"required"`
+	MaxConcurrent *int  `mapstructure:"maxConcurrent" validate:"required,min=1"`
 }
 
 type Logging struct {
-	Driver   *string  `mapstructure:"driver" validate:"oneof=noop stdout influxdb"`
+	Driver   *string  `mapstructure:"driver" validate:"oneof=noop stdout prometheus influxdb"`
 	InfluxDB InfluxDB `mapstructure:"influxdb" validate:"required_if=Driver influxdb"`
 }
 
@@ -33,6 +90,11 @@ type InfluxDB struct {
 	Token  *string `mapstructure:"token" validate:"required"`
 	Org    *string `mapstructure:"org" validate:"required"`
 	Bucket *string `mapstructure:"bucket" validate:"required"`
+	// MeasurementPrefix is prepended to all measurement names written, so
+	// several deployments can share a bucket with distinct namespaces. It
+	// defaults to dimmer_, except for profiling, where it defaults to empty
+	// so the request measurement matches what the profiler service reads.
+	MeasurementPrefix *string `mapstructure:"measurementPrefix"`
 }
 
 type Dimming struct {
@@ -40,6 +102,117 @@ type Dimming struct {
 	DimmableComponents []DimmableComponent `mapstructure:"dimmableComponents" validate:"required"`
 	Controller         Controller          `mapstructure:"controller" validate:"required"`
 	Profiler           Profiler            `mapstructure:"profiler" validate:"required"`
+	OnlineTraining     OnlineTraining      `mapstructure:"onlineTraining"`
+	// PruneZeroProbabilityComponents removes components with a probability of
+	// 0 from the request filter, as such components can never be dimmed.
+	PruneZeroProbabilityComponents *bool `mapstructure:"pruneZeroProbabilityComponents" validate:"required"`
+	// ContentTypeDimming dims responses after proxying based on their
+	// Content-Type, instead of before proxying based on their path.
+	ContentTypeDimming ContentTypeDimming `mapstructure:"contentTypeDimming" validate:"required"`
+	Budget             Budget             `mapstructure:"budget" validate:"required"`
+	OverloadProtection OverloadProtection `mapstructure:"overloadProtection" validate:"required"`
+	SurgeDetection     SurgeDetection     `mapstructure:"surgeDetection" validate:"required"`
+	ProbabilityFloors  ProbabilityFloors  `mapstructure:"probabilityFloors" validate:"required"`
+	// DimmedRateCapWindowSeconds is the rolling window over which the
+	// maxDimmedRate of each component is enforced.
+	DimmedRateCapWindowSeconds *float64 `mapstructure:"dimmedRateCapWindowSeconds" validate:"required,gt=0"`
+	// MaxRefererExclusionsPerRule caps the number of referer exclusions per
+	// component, as the exclusions are recompiled into a matcher each time one
+	// is added. A cap of 0 disables the cap.
+	MaxRefererExclusionsPerRule *int `mapstructure:"maxRefererExclusionsPerRule" validate:"required,gte=0"`
+	// FilterMode determines whether dimmableComponents are the only paths
+	// which are dimmed (allowlist), or the only paths which are never dimmed
+	// (denylist).
+	FilterMode *string `mapstructure:"filterMode" validate:"required,oneof=allowlist denylist"`
+	// Cookies are the attributes applied to all cookies the dimmer sets.
+	Cookies Cookies `mapstructure:"cookies" validate:"required"`
+	// MethodMultipliers scale path probabilities by request method, e.g.
+	// {GET: 1, POST: 0.1} so writes are dimmed less readily than reads.
+	// Methods without a multiplier have a multiplier of 1.
+	MethodMultipliers map[string]float64 `mapstructure:"methodMultipliers" validate:"omitempty,dive,gte=0"`
+	// DecisionSink exports the dimming decision for each dimmable request,
+	// keyed by the profiler session cookie, for joining against business
+	// metrics.
+	DecisionSink DecisionSink `mapstructure:"decisionSink" validate:"required"`
+	// Events publishes dimming mode changes, adopted online training
+	// probabilities and crossings of a dimming threshold to an event bus for
+	// downstream consumers.
+	Events Events `mapstructure:"events" validate:"required"`
+	// DimResponseStatusCode and DimResponseBody are returned in place of
+	// dimmed components without a dimmedResponse of their own, e.g. 503 for
+	// CDNs which retry 429s.
+	DimResponseStatusCode *int    `mapstructure:"dimResponseStatusCode" validate:"required,gte=200,lte=599"`
+	DimResponseBody       *string `mapstructure:"dimResponseBody" validate:"required"`
+	// DimResponseTemplatePath is the path of an HTML file returned as
+	// text/html in place of DimResponseBody. If empty, or the file cannot be
+	// read, DimResponseBody is returned.
+	DimResponseTemplatePath *string `mapstructure:"dimResponseTemplatePath" validate:"required"`
+	// DimRedirectURL redirects dimmed components without a dimmedResponse of
+	// their own with a 302 instead. If empty, requests are not redirected.
+	DimRedirectURL *string `mapstructure:"dimRedirectURL" validate:"required"`
+	// NavigationRedirect redirects dimmed top-level navigations, e.g. to a
+	// lite version of the page, in place of DimRedirectURL or the dim
+	// response.
+	NavigationRedirect NavigationRedirect `mapstructure:"navigationRedirect" validate:"required"`
+	// Vary sets the Vary header on dimmed responses and proxied responses
+	// which could have been dimmed, so CDN and browser caches do not serve
+	// dimmed responses to users who would not be dimmed, or vice versa.
+	Vary Vary `mapstructure:"vary" validate:"required"`
+	// DimRetryAfterBaseSeconds is the Retry-After delay set on 429 and 503
+	// dim responses at 0% dimming, rising to 10 times the delay at 100%
+	// dimming. If 0, Retry-After is not set.
+	DimRetryAfterBaseSeconds *float64 `mapstructure:"dimRetryAfterBaseSeconds" validate:"required,gte=0"`
+	// ExposeControlStateHeaders sets X-Dimmer-Setpoint, X-Dimmer-Input and
+	// X-Dimmer-Output on dimmed responses for client-side back-pressure, where
+	// the input is the control loop input in the setpoint's unit. As
+	// this leaks internal state, it should only be enabled for trusted
+	// clients.
+	ExposeControlStateHeaders *bool `mapstructure:"exposeControlStateHeaders" validate:"required"`
+}
+
+type DecisionSink struct {
+	Enabled *bool `mapstructure:"enabled" validate:"required"`
+	// InfluxDB is a pointer so it need not be configured unless enabled.
+	InfluxDB *InfluxDB `mapstructure:"influxdb" validate:"required_if=Enabled true"`
+}
+
+type Events struct {
+	Enabled *bool `mapstructure:"enabled" validate:"required"`
+	// DimmingThreshold is the dimming percentage whose crossing in either
+	// direction publishes an event, e.g. 0 to publish when dimming starts and
+	// stops.
+	DimmingThreshold *float64 `mapstructure:"dimmingThreshold" validate:"required,gte=0,lt=100"`
+	// Kafka is a pointer so it need not be configured unless enabled.
+	Kafka *Kafka `mapstructure:"kafka" validate:"required_if=Enabled true"`
+}
+
+// Kafka publishes events to a topic via a Kafka REST Proxy, batching events
+// sent within FlushIntervalSeconds.
+type Kafka struct {
+	// RESTProxyURL is the base URL of a Confluent-compatible Kafka REST Proxy
+	// serving the v2 API, e.g. http://kafka-rest:8082, which must be deployed
+	// in front of the brokers. Events are produced to
+	// {RESTProxyURL}/topics/{Topic} as JSON records; the dimmer does not
+	// connect to Kafka brokers directly.
+	RESTProxyURL         *string  `mapstructure:"restProxyURL" validate:"required,url"`
+	Topic                *string  `mapstructure:"topic" validate:"required"`
+	FlushIntervalSeconds *float64 `mapstructure:"flushIntervalSeconds" validate:"required,gt=0"`
+}
+
+type Cookies struct {
+	SameSite *string `mapstructure:"sameSite" validate:"required,oneof=disabled default lax strict none"`
+	Secure   *bool   `mapstructure:"secure" validate:"required"`
+	HTTPOnly *bool   `mapstructure:"httpOnly" validate:"required"`
+	// Path and Domain are omitted from cookies if empty.
+	Path   *string `mapstructure:"path" validate:"required"`
+	Domain *string `mapstructure:"domain" validate:"required"`
+}
+
+type ContentTypeDimming struct {
+	Enabled *bool `mapstructure:"enabled" validate:"required"`
+	// ContentTypes are prefixes matched against the response Content-Type,
+	// e.g. "image/" matches all images.
+	ContentTypes []string `mapstructure:"contentTypes" validate:"required_if=Enabled true"`
 }
 
 type DimmableComponent struct {
@@ -49,6 +222,53 @@ type DimmableComponent struct {
 	// default if it is nil.
 	Probability *float64     `mapstructure:"probability"`
 	Exclusions  []Exclusions `mapstructure:"exclusions"`
+	// Inclusions restrict dimming to requests whose referer contains at
+	// least one inclusion substring. Exclusions take precedence.
+	Inclusions []Inclusions `mapstructure:"inclusions"`
+	// Category groups components under the dimming budget. If nil, the
+	// component's path is used as its category.
+	Category *string `mapstructure:"category"`
+	// TargetLatency is the component's target response time in seconds. If
+	// any component sets a target, the controller is driven by the worst ratio
+	// of a component's response time to its target, so the controller uses
+	// dimming.controller.ratioSetpoint, a unitless ratio, in place of
+	// dimming.controller.setpoint, a response time in seconds.
+	TargetLatency *float64 `mapstructure:"targetLatency" validate:"omitempty,gt=0"`
+	// DimmedResponse is the response returned when the component is dimmed.
+	// If nil, a 429 is returned.
+	DimmedResponse *DimmedResponse `mapstructure:"dimmedResponse"`
+	// Transformer degrades the component by transforming the body of its
+	// proxied response when dimmed, instead of returning a dimmed response.
+	// If nil, the component is dimmed wholesale.
+	Transformer *ResponseTransformer `mapstructure:"transformer"`
+	// ObserveOnly measures the component's response times without dimming
+	// it, e.g. to understand its latency before deciding whether to make it
+	// dimmable. If nil, the component is dimmable.
+	ObserveOnly *bool `mapstructure:"observeOnly"`
+	// MaxDimmedRate caps the fraction of the component's requests which are
+	// dimmed within dimming.dimmedRateCapWindowSeconds, regardless of the
+	// dimming percentage. If nil, the dimmed rate is uncapped.
+	MaxDimmedRate *float64 `mapstructure:"maxDimmedRate" validate:"omitempty,gte=0,lte=1"`
+}
+
+// DimmedResponse allows a component to degrade silently, e.g. returning 200
+// with a body of [] for a JSON list endpoint, instead of returning a 429 which
+// the frontend may surface as an error.
+type DimmedResponse struct {
+	StatusCode *int    `mapstructure:"statusCode" validate:"required,gte=200,lte=599"`
+	Body       *string `mapstructure:"body"`
+	// ContentType is not set on the response if nil.
+	ContentType *string `mapstructure:"contentType"`
+}
+
+// ResponseTransformer allows a component to degrade to a reduced payload, e.g.
+// returning 3 recommendations instead of 20, rather than no payload at all.
+type ResponseTransformer struct {
+	// Type is the transformation applied. jsonArrayTruncation truncates a
+	// JSON array body to MaxItems items.
+	Type *string `mapstructure:"type" validate:"required,oneof=jsonArrayTruncation"`
+	// MaxItems must be set for jsonArrayTruncation.
+	MaxItems *int `mapstructure:"maxItems" validate:"omitempty,min=0"`
 }
 
 type MatchableMethod struct {
@@ -61,23 +281,309 @@ type MatchableMethod struct {
 type Exclusions struct {
 	Method    *string `mapstructure:"method" validate:"required"`
 	Substring *string `mapstructure:"substring" validate:"required"`
+	// Header is the request header the substring is matched against. If nil,
+	// the substring is matched against the Referer header.
+	Header *string `mapstructure:"header" validate:"omitempty,min=1"`
+}
+
+type Inclusions struct {
+	Method    *string `mapstructure:"method" validate:"required"`
+	Substring *string `mapstructure:"substring" validate:"required"`
 }
 
 type Controller struct {
 	SamplePeriod *float64 `mapstructure:"samplePeriod" validate:"required"`
-	Percentile   *string  `mapstructure:"percentile" validate:"oneof=p50 p75 p95"`
-	Setpoint     *float64 `mapstructure:"setpoint" validate:"required"`
-	Kp           *float64 `mapstructure:"kp" validate:"required"`
-	Ki           *float64 `mapstructure:"ki" validate:"required"`
-	Kd           *float64 `mapstructure:"kd" validate:"required"`
+	Percentile   *string  `mapstructure:"percentile" validate:"percentile"`
+	// Setpoint is the controller input's target response time in seconds.
+	// It is unused if any dimmable component sets a targetLatency.
+	Setpoint *float64 `mapstructure:"setpoint" validate:"required"`
+	// RatioSetpoint is the target ratio of a component's response time to
+	// its targetLatency, e.g. 1 to hold the worst component at its target.
+	// It replaces Setpoint if any dimmable component sets a targetLatency,
+	// so the setpoint's unit never changes implicitly.
+	RatioSetpoint *float64 `mapstructure:"ratioSetpoint" validate:"required,gt=0"`
+	Kp            *float64 `mapstructure:"kp" validate:"required"`
+	Ki            *float64 `mapstructure:"ki" validate:"required"`
+	Kd            *float64 `mapstructure:"kd" validate:"required"`
+	// DerivativeOn calculates the PID differential term from the rate of
+	// change of the measured response time (measurement), which avoids a
+	// spike when the setpoint changes, or of the error (error).
+	DerivativeOn *string `mapstructure:"derivativeOn" validate:"required,oneof=measurement error"`
+	// MaxSampleSeconds clamps response times recorded by the control loop so
+	// outliers such as hung requests do not cause prolonged dimming once
+	// latency normalises. This trades tail fidelity for responsiveness. If
+	// nil, response times are not clamped.
+	MaxSampleSeconds *float64 `mapstructure:"maxSampleSeconds" validate:"omitempty,gt=0"`
+	// PercentileWeights blends percentiles as the controller input, e.g.
+	// {p50: 0.3, p99.9: 0.7}. Weights must sum to 1. If set, PercentileWeights
+	// takes precedence over Percentile.
+	PercentileWeights map[string]float64 `mapstructure:"percentileWeights" validate:"omitempty,dive,keys,percentile,endkeys,gte=0,lte=1"`
+	// InterpolateOutput ramps the dimming percentage applied to requests
+	// between control loop ticks, rather than stepping at each tick.
+	InterpolateOutput *bool `mapstructure:"interpolateOutput" validate:"required"`
+	// ControlSignalPaths restricts the response times which drive the
+	// controller to the given paths for all methods, e.g. critical paths. All
+	// response times are still logged. If empty, all response times drive the
+	// controller.
+	ControlSignalPaths []string `mapstructure:"controlSignalPaths"`
+	// WarmupSeconds is the time after starting before the dimmer reports
+	// itself as ready, as the controller output is erratic on a cold start.
+	WarmupSeconds *float64 `mapstructure:"warmupSeconds" validate:"required,gte=0"`
+	// TickAlignment aligns control loop ticks and metric emission to
+	// wall-clock second or minute boundaries, or not at all (none).
+	TickAlignment *string `mapstructure:"tickAlignment" validate:"required,oneof=none second minute"`
+	// Collector calculates the controller input percentiles over a fixed
+	// window of response times (tachymeter), over the response times within
+	// WindowDuration (timeWindowed), or estimates them from an exponentially
+	// weighted moving average and variance (ewma), which reacts faster to
+	// sudden latency spikes. Only the tachymeter collector's window can be
+	// resized via the API.
+	Collector *string `mapstructure:"collector" validate:"required,oneof=tachymeter timeWindowed ewma"`
+	// EWMAAlpha is the weight of each new response time in the ewma
+	// collector. Higher values react faster but are noisier.
+	EWMAAlpha *float64 `mapstructure:"ewmaAlpha" validate:"required,gt=0,lte=1"`
+	// WindowDuration is the duration in seconds of response times retained by
+	// the timeWindowed collector, e.g. 10, so stale response times are
+	// discarded during low traffic rather than retaining the last 100
+	// requests however old they are. It must be set if and only if Collector
+	// is timeWindowed.
+	WindowDuration *float64 `mapstructure:"windowDuration" validate:"omitempty,gt=0"`
+	// RecencyWeight is the weight in [0, 1] of the percentile over the most
+	// recent RecentSamples response times, blended with the percentile over
+	// the whole window so the control loop reacts faster to changing load
+	// without shrinking the window. If 0, percentiles are calculated over the
+	// whole window only. Resizing the collector window via the API retains
+	// the weighting.
+	RecencyWeight *float64 `mapstructure:"recencyWeight" validate:"required,gte=0,lte=1"`
+	// RecentSamples is the number of most recent response times whose
+	// percentile is weighted by RecencyWeight.
+	RecentSamples *int `mapstructure:"recentSamples" validate:"required,min=1"`
+	// Tiers are additional controllers, each driven by a single percentile
+	// with its own setpoint and using the same gains as the primary
+	// controller. The dimming percentage is the maximum of the primary
+	// controller's output and each tier's output scaled by its contribution,
+	// e.g. a p50 tier with contribution 0.3 dims gently when the p50 exceeds
+	// its setpoint, while the primary p99 controller dims aggressively.
+	Tiers []ControllerTier `mapstructure:"tiers" validate:"omitempty,dive"`
+	// BackendUnavailableThreshold is the number of consecutive backend
+	// connection failures after which the dimming percentage is held, e.g.
+	// during a planned backend restart, until a backend request succeeds. If
+	// 0, the dimming percentage is never held.
+	BackendUnavailableThreshold *int `mapstructure:"backendUnavailableThreshold" validate:"required,gte=0"`
+	// ExcludedStatusCodes are status codes whose response times do not drive
+	// the controller, e.g. near-instant 304s and redirects which would
+	// otherwise bias the percentile downward. Defaults to all 3xx codes.
+	ExcludedStatusCodes []int `mapstructure:"excludedStatusCodes" validate:"omitempty,dive,min=100,max=599"`
+}
+
+type ControllerTier struct {
+	Percentile   *string  `mapstructure:"percentile" validate:"required,percentile"`
+	Setpoint     *float64 `mapstructure:"setpoint" validate:"required,gt=0"`
+	Contribution *float64 `mapstructure:"contribution" validate:"required,gt=0,lte=1"`
+}
+
+// Budget caps the number of distinct component categories dimmed for a
+// single session, identified by the profiler session cookie, within a window.
+// NavigationRedirect redirects dimmed requests whose Sec-Fetch-Mode is
+// navigate or which accept text/html. The original path is set as the
+// PathQueryParameter query parameter of URL.
+type NavigationRedirect struct {
+	Enabled            *bool   `mapstructure:"enabled" validate:"required"`
+	URL                *string `mapstructure:"url" validate:"required_if=Enabled true"`
+	StatusCode         *int    `mapstructure:"statusCode" validate:"required,oneof=302 307"`
+	PathQueryParameter *string `mapstructure:"pathQueryParameter" validate:"required,min=1"`
+}
+
+// Vary derives the headers set in the Vary header from the inputs to dimming
+// decisions: Cookie, as sessions are assigned to online training groups and
+// profiled by cookie, Accept and Sec-Fetch-Mode if navigations are
+// redirected, and the headers of component exclusions and inclusions.
+type Vary struct {
+	Enabled *bool `mapstructure:"enabled" validate:"required"`
+	// Headers are added to the derived headers, e.g. for headers a custom
+	// decider depends on.
+	Headers []string `mapstructure:"headers" validate:"omitempty,dive,min=1"`
+}
+
+type Budget struct {
+	Enabled       *bool    `mapstructure:"enabled" validate:"required"`
+	MaxCategories *int     `mapstructure:"maxCategories" validate:"required,min=1"`
+	WindowSeconds *float64 `mapstructure:"windowSeconds" validate:"required,gt=0"`
+}
+
+// OverloadProtection sheds a fraction of dimmable requests driven by the
+// backend error rate, e.g. while the backend is down, independently of the
+// latency-driven control loop.
+type OverloadProtection struct {
+	Enabled       *bool    `mapstructure:"enabled" validate:"required"`
+	WindowSeconds *float64 `mapstructure:"windowSeconds" validate:"required,gt=0"`
+	MinRequests   *int     `mapstructure:"minRequests" validate:"required,min=1"`
+	// OpenErrorRate is the backend error rate at which shedding starts, and
+	// CloseErrorRate is the error rate below which shedding ramps down.
+	OpenErrorRate  *float64 `mapstructure:"openErrorRate" validate:"required,gt=0,lte=1"`
+	CloseErrorRate *float64 `mapstructure:"closeErrorRate" validate:"required,gte=0,lte=1"`
+	// RampStep is the change in shed fraction per window, capped at
+	// MaxShedFraction.
+	RampStep        *float64 `mapstructure:"rampStep" validate:"required,gt=0,lte=1"`
+	MaxShedFraction *float64 `mapstructure:"maxShedFraction" validate:"required,gt=0,lte=1"`
+	// OverloadStatusCodes are backend status codes signalling overload, e.g.
+	// 529, which count towards the error rate alongside 502, 503 and 504.
+	OverloadStatusCodes []int `mapstructure:"overloadStatusCodes" validate:"omitempty,dive,min=100,max=599"`
+}
+
+// SurgeDetection gates dimming behind the request rate, so dimming is only
+// applied during traffic surges. Below MinRequestsPerSecond, the dimming
+// percentage is forced to 0 regardless of latency.
+type SurgeDetection struct {
+	Enabled       *bool    `mapstructure:"enabled" validate:"required"`
+	WindowSeconds *float64 `mapstructure:"windowSeconds" validate:"required,gt=0"`
+	// MinRequestsPerSecond is the request rate at which a surge starts, and
+	// HysteresisRequestsPerSecond is how far below it the rate must fall for
+	// the surge to end.
+	MinRequestsPerSecond        *float64 `mapstructure:"minRequestsPerSecond" validate:"required,gt=0"`
+	HysteresisRequestsPerSecond *float64 `mapstructure:"hysteresisRequestsPerSecond" validate:"required,gte=0"`
+}
+
+// ProbabilityFloors require operators to set ?force=true on API calls which
+// lower a path's probability below the floor of its category, guarding
+// critical paths against fat-fingered changes during incidents.
+type ProbabilityFloors struct {
+	Enabled      *bool    `mapstructure:"enabled" validate:"required"`
+	DefaultFloor *float64 `mapstructure:"defaultFloor" validate:"required,gte=0,lte=1"`
+	// Floors is a map from a component category to its floor. Components
+	// without a category are matched by their path.
+	Floors map[string]float64 `mapstructure:"floors" validate:"omitempty,dive,gte=0,lte=1"`
+}
+
+type OnlineTraining struct {
+	// Seed is a pointer as candidate sampling will be seeded from the current
+	// time if it is nil. Setting a seed makes training runs reproducible.
+	Seed *uint64 `mapstructure:"seed"`
+	// PinEpsilon is the distance from 0 or 1 within which a path probability
+	// is considered pinned at a bound.
+	PinEpsilon *float64 `mapstructure:"pinEpsilon" validate:"required,gte=0,lt=0.5"`
+	// PinnedPathHandling determines whether pinned paths are sampled as usual
+	// (none), skipped in the round-robin (skip), or explored around 0.5
+	// (recenter).
+	PinnedPathHandling *string `mapstructure:"pinnedPathHandling" validate:"required,oneof=none skip recenter"`
+	// LogRounds logs the control and candidate response times and verdict of
+	// each training round for offline analysis. As this can be high-volume,
+	// response times are downsampled to MaxLoggedResponseTimesPerGroup.
+	LogRounds                      *bool `mapstructure:"logRounds" validate:"required"`
+	MaxLoggedResponseTimesPerGroup *int  `mapstructure:"maxLoggedResponseTimesPerGroup" validate:"required,min=1"`
+	// MinCandidateResponseTimes is the number of candidate response times a
+	// round must collect for the candidate to be considered.
+	MinCandidateResponseTimes *int `mapstructure:"minCandidateResponseTimes" validate:"required,gte=0"`
+	// CompareErrorRates rejects candidates whose rate of non-2xx responses
+	// exceeds that of the control by more than ErrorRateTolerance, e.g. 0.01
+	// for one percentage point.
+	CompareErrorRates  *bool    `mapstructure:"compareErrorRates" validate:"required"`
+	ErrorRateTolerance *float64 `mapstructure:"errorRateTolerance" validate:"required,gte=0,lte=1"`
+	// MinimumImprovementRatio is the proportion by which a candidate must
+	// lower the control P95 to be accepted, e.g. 0.05 for 5%.
+	MinimumImprovementRatio *float64                `mapstructure:"minimumImprovementRatio" validate:"required,gte=0,lt=1"`
+	ImprovementRatioScaling ImprovementRatioScaling `mapstructure:"improvementRatioScaling" validate:"required"`
+	// CookieName is the name of the cookie assigning sessions to the control
+	// or candidate group.
+	CookieName *string `mapstructure:"cookieName" validate:"required"`
+	// CandidateProbability is the initial probability of a session being
+	// assigned to the candidate group. It can be changed at runtime within
+	// [MinCandidateProbability, MaxCandidateProbability], so the experiment
+	// cannot accidentally be exposed to all sessions.
+	CandidateProbability    *float64 `mapstructure:"candidateProbability" validate:"required,gt=0,lte=1"`
+	MinCandidateProbability *float64 `mapstructure:"minCandidateProbability" validate:"required,gte=0,lte=1"`
+	MaxCandidateProbability *float64 `mapstructure:"maxCandidateProbability" validate:"required,gt=0,lte=1"`
+	// TestDurationSeconds is the duration response times are collected for
+	// in each round. AdjustmentDurationSeconds is the duration the controller
+	// is given to adjust after training starts or candidate probabilities are
+	// adopted.
+	TestDurationSeconds       *float64 `mapstructure:"testDurationSeconds" validate:"required,gt=0"`
+	AdjustmentDurationSeconds *float64 `mapstructure:"adjustmentDurationSeconds" validate:"required,gt=0"`
+	// SamplingVariance is the variance of the truncated normal distribution
+	// candidate probabilities are sampled from around the control
+	// probability. Larger variances explore more widely.
+	SamplingVariance *float64 `mapstructure:"samplingVariance" validate:"required,gt=0"`
+	// Sampler determines how candidate probabilities are sampled: random
+	// samples around the control probability with samplingVariance, whereas
+	// gradient steps the probability by gradientStepSize in the direction
+	// which reduced the P95 in the last round, converging faster on smooth
+	// response time surfaces.
+	Sampler          *string  `mapstructure:"sampler" validate:"required,oneof=random gradient"`
+	GradientStepSize *float64 `mapstructure:"gradientStepSize" validate:"required,gt=0,lte=1"`
+	// SignificancePercentile is the percentile of the Kolmogorov-Smirnov test
+	// a candidate which increases probability must pass to be accepted.
+	// Lower percentiles accept candidates on weaker evidence.
+	SignificancePercentile *string `mapstructure:"significancePercentile" validate:"required,oneof=p90 p95 p97.5 p99 p99.5 p99.9"`
+	// ProbabilityStore persists adopted probabilities, which are restored on
+	// startup in place of the configured probabilities.
+	ProbabilityStore ProbabilityStore `mapstructure:"probabilityStore" validate:"required"`
+	// CandidateGroups is the number of candidate groups tested against the
+	// control group each round, between which candidateProbability is split
+	// evenly. The best significant candidate is adopted.
+	CandidateGroups *int `mapstructure:"candidateGroups" validate:"required,min=1,max=10"`
+}
+
+// ProbabilityStore persists the probabilities adopted by online training
+// across restarts. The none driver does not persist probabilities, and the
+// file driver persists them as JSON to FilePath.
+type ProbabilityStore struct {
+	Driver   *string `mapstructure:"driver" validate:"required,oneof=none file"`
+	FilePath *string `mapstructure:"filePath" validate:"required_if=Driver file"`
+}
+
+// ImprovementRatioScaling requires a larger improvement from candidates
+// tested with few response times. Below ReferenceResponseTimes candidate
+// response times, MinimumImprovementRatio is multiplied by
+// (ReferenceResponseTimes / n) ^ Exponent, capped at MaxMultiplier.
+type ImprovementRatioScaling struct {
+	Enabled                *bool    `mapstructure:"enabled" validate:"required"`
+	ReferenceResponseTimes *int     `mapstructure:"referenceResponseTimes" validate:"required,min=1"`
+	Exponent               *float64 `mapstructure:"exponent" validate:"required,gte=0"`
+	MaxMultiplier          *float64 `mapstructure:"maxMultiplier" validate:"required,gte=1"`
 }
 
 type Profiler struct {
-	Enabled       *bool         `mapstructure:"enabled" validate:"required"`
-	SessionCookie *string       `mapstructure:"sessionCookie" validate:"required"`
-	InfluxDB      InfluxDB      `mapstructure:"influxdb" validate:"required"`
-	Redis         Redis         `mapstructure:"redis" validate:"required"`
+	Enabled       *bool    `mapstructure:"enabled" validate:"required"`
+	SessionCookie *string  `mapstructure:"sessionCookie" validate:"required"`
+	InfluxDB      InfluxDB `mapstructure:"influxdb" validate:"required"`
+	// Driver determines where session priorities are fetched from: redis
+	// fetches priorities assigned by an external profiler service via Redis,
+	// http fetches them from a profiler service over HTTP, whereas memory
+	// profiles sessions in-process, for local testing and small deployments
+	// without Redis.
+	Driver *string        `mapstructure:"driver" validate:"required,oneof=redis memory http"`
+	Redis  Redis          `mapstructure:"redis" validate:"required_if=Driver redis"`
+	Memory MemoryProfiler `mapstructure:"memory" validate:"required_if=Driver memory"`
+	// HTTP is a pointer so it need not be configured unless used.
+	HTTP          *HTTPProfiler `mapstructure:"http" validate:"required_if=Driver http"`
 	Probabilities Probabilities `mapstructure:"probabilities" validate:"required"`
+	// Tiers are graduated priority tiers ordered from lowest to highest
+	// priority, e.g. bronze, silver, gold and platinum, each with its own
+	// dimming probability. Profiled sessions are assigned a tier by name. If
+	// empty, sessions are profiled into the low and high tiers with
+	// probabilities.
+	Tiers []ProfilerTier `mapstructure:"tiers" validate:"omitempty,dive"`
+	// AggregatorHalfLifeSeconds is the half-life of the visit counts of each
+	// configured tier name used to weight dimming decision probabilities.
+	AggregatorHalfLifeSeconds *float64 `mapstructure:"aggregatorHalfLifeSeconds" validate:"required,gt=0"`
+	// PersistAggregator saves the visit counts to Redis on shutdown and
+	// restores them on startup, so dimming decision probabilities are not
+	// cold after a restart. Counts are saved to AggregatorRedisKey in the
+	// priorities database.
+	PersistAggregator  *bool   `mapstructure:"persistAggregator" validate:"required"`
+	AggregatorRedisKey *string `mapstructure:"aggregatorRedisKey" validate:"required"`
+	// PriorityCookieName and DimmingDecisionCookieName are the names of the
+	// cookies storing a session's priority and long-term dimming decision.
+	PriorityCookieName        *string `mapstructure:"priorityCookieName" validate:"required"`
+	DimmingDecisionCookieName *string `mapstructure:"dimmingDecisionCookieName" validate:"required"`
+	// UnknownPriorityCookieExpirySeconds and PriorityCookieExpirySeconds are
+	// the lifetimes of the priority cookie for sessions of unknown and known
+	// priority. DimmingDecisionCookieExpirySeconds is the lifetime of the
+	// dimming decision cookie. Sites with long sessions, e.g. dashboards,
+	// should use longer lifetimes.
+	UnknownPriorityCookieExpirySeconds *float64 `mapstructure:"unknownPriorityCookieExpirySeconds" validate:"required,gt=0"`
+	PriorityCookieExpirySeconds        *float64 `mapstructure:"priorityCookieExpirySeconds" validate:"required,gt=0"`
+	DimmingDecisionCookieExpirySeconds *float64 `mapstructure:"dimmingDecisionCookieExpirySeconds" validate:"required,gt=0"`
 }
 
 type Redis struct {
@@ -87,6 +593,28 @@ type Redis struct {
 	QueueDB      *int    `mapstructure:"queueDB" validate:"required"`
 }
 
+// MemoryProfiler deterministically assigns LowPriorityFraction of sessions low
+// priority by hashing their session IDs.
+type MemoryProfiler struct {
+	LowPriorityFraction *float64 `mapstructure:"lowPriorityFraction" validate:"required,gte=0,lte=1"`
+}
+
+// ProfilerTier is a priority tier. Names are lowercase so they cannot collide
+// with other fields when persisted.
+type ProfilerTier struct {
+	Name        *string  `mapstructure:"name" validate:"required,alphanum,lowercase"`
+	Probability *float64 `mapstructure:"probability" validate:"required,gte=0,lte=1"`
+	Multiplier  *float64 `mapstructure:"multiplier" validate:"required"`
+}
+
+// HTTPProfiler fetches priorities from GET {baseURL}/priorities/{sessionID}
+// and enqueues sessions for profiling with POST {baseURL}/sessions. Requests
+// are bounded by TimeoutSeconds, which defaults to 1 second if unset.
+type HTTPProfiler struct {
+	BaseURL        *string  `mapstructure:"baseURL" validate:"required,url"`
+	TimeoutSeconds *float64 `mapstructure:"timeoutSeconds" validate:"omitempty,gt=0"`
+}
+
 type Probabilities struct {
 	High           *float64 `mapstructure:"high" validate:"required"`
 	HighMultiplier *float64 `mapstructure:"highMultiplier" validate:"required"`
@@ -97,45 +625,168 @@ type Probabilities struct {
 func setDefaults() {
 	viper.SetDefault("Proxying.BackendHost", "localhost")
 	viper.SetDefault("Logging.Driver", "noop")
+	viper.SetDefault("Logging.InfluxDB.MeasurementPrefix", "dimmer_")
+
+	viper.SetDefault("Connection.PerIPConcurrencyLimit.Enabled", false)
+	viper.SetDefault("Connection.PerIPConcurrencyLimit.MaxConcurrent", 100)
+	viper.SetDefault("Connection.PathValidation.Enabled", false)
+	viper.SetDefault("Connection.PathValidation.MaxLength", 2048)
+	viper.SetDefault("Connection.PathValidation.AllowedCharacters", "")
+	viper.SetDefault("Connection.DecompressGzipRequests", false)
+	viper.SetDefault("Connection.MaxRequestBodySize", 4*1024*1024)
+	viper.SetDefault("Connection.PreserveHTTP10KeepAlive", true)
+	viper.SetDefault("Connection.RequestTimeoutSeconds", 0)
+	viper.SetDefault("Connection.TLS.Enabled", false)
+
+	viper.SetDefault("Dimming.PruneZeroProbabilityComponents", false)
+	viper.SetDefault("Dimming.MaxRefererExclusionsPerRule", 100)
+	viper.SetDefault("Dimming.FilterMode", "allowlist")
+	viper.SetDefault("Dimming.DimResponseStatusCode", 429)
+	viper.SetDefault("Dimming.DimResponseBody", "Dimming!")
+	viper.SetDefault("Dimming.DimResponseTemplatePath", "")
+	viper.SetDefault("Dimming.DimRedirectURL", "")
+	viper.SetDefault("Dimming.NavigationRedirect.Enabled", false)
+	viper.SetDefault("Dimming.NavigationRedirect.StatusCode", 302)
+	viper.SetDefault("Dimming.NavigationRedirect.PathQueryParameter", "path")
+	viper.SetDefault("Dimming.Vary.Enabled", false)
+	viper.SetDefault("Dimming.DimRetryAfterBaseSeconds", 1)
+	viper.SetDefault("Dimming.ExposeControlStateHeaders", false)
+	viper.SetDefault("Dimming.ContentTypeDimming.Enabled", false)
+
+	viper.SetDefault("Dimming.DimmedRateCapWindowSeconds", 60)
+
+	viper.SetDefault("Dimming.Budget.Enabled", false)
+	viper.SetDefault("Dimming.Budget.MaxCategories", 2)
+	viper.SetDefault("Dimming.Budget.WindowSeconds", 10)
+
+	viper.SetDefault("Dimming.OverloadProtection.Enabled", false)
+	viper.SetDefault("Dimming.OverloadProtection.WindowSeconds", 1)
+	viper.SetDefault("Dimming.OverloadProtection.MinRequests", 20)
+	viper.SetDefault("Dimming.OverloadProtection.OpenErrorRate", 0.5)
+	viper.SetDefault("Dimming.OverloadProtection.CloseErrorRate", 0.1)
+	viper.SetDefault("Dimming.OverloadProtection.RampStep", 0.1)
+	viper.SetDefault("Dimming.OverloadProtection.MaxShedFraction", 0.9)
+	viper.SetDefault("Dimming.SurgeDetection.Enabled", false)
+	viper.SetDefault("Dimming.SurgeDetection.WindowSeconds", 10)
+	viper.SetDefault("Dimming.SurgeDetection.MinRequestsPerSecond", 100)
+	viper.SetDefault("Dimming.SurgeDetection.HysteresisRequestsPerSecond", 10)
+
+	viper.SetDefault("Dimming.ProbabilityFloors.Enabled", false)
+	viper.SetDefault("Dimming.ProbabilityFloors.DefaultFloor", 0)
 
 	viper.SetDefault("Dimming.Controller.SamplePeriod", 1)
 	viper.SetDefault("Dimming.Controller.Percentile", "p95")
 	viper.SetDefault("Dimming.Controller.Setpoint", 3)
+	viper.SetDefault("Dimming.Controller.RatioSetpoint", 1)
 	viper.SetDefault("Dimming.Controller.Kp", 2)
+	viper.SetDefault("Dimming.Controller.DerivativeOn", "measurement")
 	viper.SetDefault("Dimming.Controller.Ki", 0.2)
 	viper.SetDefault("Dimming.Controller.Kd", 0)
+	viper.SetDefault("Dimming.Controller.InterpolateOutput", false)
+	viper.SetDefault("Dimming.Controller.WarmupSeconds", 0)
+	viper.SetDefault("Dimming.Controller.TickAlignment", "none")
+	viper.SetDefault("Dimming.Controller.Collector", "tachymeter")
+	viper.SetDefault("Dimming.Controller.EWMAAlpha", 0.1)
+	viper.SetDefault("Dimming.Controller.RecencyWeight", 0)
+	viper.SetDefault("Dimming.Controller.RecentSamples", 20)
+	viper.SetDefault("Dimming.Controller.BackendUnavailableThreshold", 0)
+	viper.SetDefault("Dimming.Controller.ExcludedStatusCodes", []int{300, 301, 302, 303, 304, 305, 307, 308})
+
+	viper.SetDefault("Dimming.OnlineTraining.PinEpsilon", 0.01)
+	viper.SetDefault("Dimming.OnlineTraining.PinnedPathHandling", "none")
+	viper.SetDefault("Dimming.OnlineTraining.LogRounds", false)
+	viper.SetDefault("Dimming.OnlineTraining.MaxLoggedResponseTimesPerGroup", 1000)
+	viper.SetDefault("Dimming.OnlineTraining.MinCandidateResponseTimes", 0)
+	viper.SetDefault("Dimming.OnlineTraining.CompareErrorRates", false)
+	viper.SetDefault("Dimming.OnlineTraining.ErrorRateTolerance", 0.01)
+	viper.SetDefault("Dimming.OnlineTraining.MinimumImprovementRatio", 0)
+	viper.SetDefault("Dimming.OnlineTraining.CandidateProbability", 0.05)
+	viper.SetDefault("Dimming.OnlineTraining.MinCandidateProbability", 0.01)
+	viper.SetDefault("Dimming.OnlineTraining.MaxCandidateProbability", 0.2)
+	viper.SetDefault("Dimming.OnlineTraining.TestDurationSeconds", 180)
+	viper.SetDefault("Dimming.OnlineTraining.AdjustmentDurationSeconds", 120)
+	viper.SetDefault("Dimming.OnlineTraining.SamplingVariance", 0.8)
+	viper.SetDefault("Dimming.OnlineTraining.Sampler", "random")
+	viper.SetDefault("Dimming.OnlineTraining.GradientStepSize", 0.1)
+	viper.SetDefault("Dimming.OnlineTraining.SignificancePercentile", "p99")
+	viper.SetDefault("Dimming.OnlineTraining.ProbabilityStore.Driver", "none")
+	viper.SetDefault("Dimming.OnlineTraining.CandidateGroups", 1)
+	viper.SetDefault("Dimming.OnlineTraining.ImprovementRatioScaling.Enabled", false)
+	viper.SetDefault("Dimming.OnlineTraining.ImprovementRatioScaling.ReferenceResponseTimes", 1000)
+	viper.SetDefault("Dimming.OnlineTraining.ImprovementRatioScaling.Exponent", 0.5)
+	viper.SetDefault("Dimming.OnlineTraining.ImprovementRatioScaling.MaxMultiplier", 4)
+	viper.SetDefault("Dimming.OnlineTraining.CookieName", "ONLINE_TRAINING")
+
+	viper.SetDefault("Dimming.Cookies.SameSite", "lax")
+	viper.SetDefault("Dimming.Cookies.Secure", false)
+	viper.SetDefault("Dimming.Cookies.HTTPOnly", true)
+	viper.SetDefault("Dimming.Cookies.Path", "/")
+	viper.SetDefault("Dimming.Cookies.Domain", "")
+
+	viper.SetDefault("Dimming.DecisionSink.Enabled", false)
+	viper.SetDefault("Dimming.DecisionSink.InfluxDB.MeasurementPrefix", "dimmer_")
+	viper.SetDefault("Dimming.Events.Enabled", false)
+	viper.SetDefault("Dimming.Events.DimmingThreshold", 0)
 
 	viper.SetDefault("Dimming.Profiler.Enabled", false)
+	viper.SetDefault("Dimming.Profiler.InfluxDB.MeasurementPrefix", "")
+	viper.SetDefault("Dimming.Profiler.Driver", "redis")
+	viper.SetDefault("Dimming.Profiler.Memory.LowPriorityFraction", 0.5)
+	viper.SetDefault("Dimming.Profiler.AggregatorHalfLifeSeconds", 30)
+	viper.SetDefault("Dimming.Profiler.PersistAggregator", false)
+	viper.SetDefault("Dimming.Profiler.AggregatorRedisKey", "dimmer:profiling:aggregator")
+	viper.SetDefault("Dimming.Profiler.PriorityCookieName", "PRIORITY")
+	viper.SetDefault("Dimming.Profiler.DimmingDecisionCookieName", "DIMMING_DECISION")
+	viper.SetDefault("Dimming.Profiler.UnknownPriorityCookieExpirySeconds", 120)
+	viper.SetDefault("Dimming.Profiler.PriorityCookieExpirySeconds", 7200)
+	viper.SetDefault("Dimming.Profiler.DimmingDecisionCookieExpirySeconds", 60)
 	viper.SetDefault("Dimming.Profiler.Probabilities.High", 0.01)
 	viper.SetDefault("Dimming.Profiler.Probabilities.HighMultiplier", 1)
 	viper.SetDefault("Dimming.Profiler.Probabilities.Low", 0.99)
 	viper.SetDefault("Dimming.Profiler.Probabilities.LowMultiplier", 1)
 }
 
+// ReadConfig reads the config from config.yaml in the working directory. See
+// ReadConfigFile.
 func ReadConfig() *Config {
+	return ReadConfigFile("")
+}
+
+// ReadConfigFile reads the config from the YAML file at path, or config.yaml
+// in the working directory if path is empty, exiting with a non-zero status
+// if the config is invalid.
+func ReadConfigFile(path string) *Config {
 	// Dots are not valid identifiers for environment variables.
 	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
 	viper.AutomaticEnv()
 	setDefaults()
 
 	viper.SetConfigType("yaml")
-	viper.SetConfigName("config")
-	viper.AddConfigPath(".")
+	if path != "" {
+		viper.SetConfigFile(path)
+	} else {
+		viper.SetConfigName("config")
+		viper.AddConfigPath(".")
+	}
 	if err := viper.ReadInConfig(); err != nil {
 		if _, ok := err.(viper.ConfigFileNotFoundError); ok {
 			log.Fatalf("error: /app/config.yaml not found. Are you sure you have configured the ConfigMap?\nerr = %s", err)
 		} else {
-			log.Fatalf("error when reading config file at /app/config.yaml: err = %s", err)
+			log.Fatalf("error when reading config file at %s: err = %s", viper.ConfigFileUsed(), err)
 		}
 	}
 
+	if err := readSecretFiles(); err != nil {
+		log.Fatalf("error occured while reading secret files: err = %s", err)
+	}
+
 	var config Config
 	bindEnvs(config)
 	if err := viper.Unmarshal(&config); err != nil {
 		log.Fatalf("error occured while reading configuration file: err = %s", err)
 	}
 
-	validate := validator.New()
+	validate := newValidator()
 	err := validate.Struct(&config)
 	if err != nil {
 		if _, ok := err.(*validator.InvalidValidationError); ok {
@@ -152,9 +803,192 @@ func ReadConfig() *Config {
 		os.Exit(1)
 	}
 
+	if errs := validateCrossFields(&config); len(errs) != 0 {
+		log.Printf("encountered validation errors:\n")
+
+		for _, err := range errs {
+			fmt.Printf("\t%s\n", err.Error())
+		}
+
+		fmt.Println("Check your configuration file and try again.")
+		os.Exit(1)
+	}
+
 	return &config
 }
 
+// newValidator returns a validator which additionally validates percentiles
+// with the "percentile" tag, in the format "p<p>" with 0 < p < 100, e.g. p95
+// or p99.9.
+func newValidator() *validator.Validate {
+	validate := validator.New()
+	if err := validate.RegisterValidation("percentile", isValidPercentile); err != nil {
+		log.Fatalf("expected RegisterValidation(percentile) returns nil err; got err = %s", err)
+	}
+	return validate
+}
+
+func isValidPercentile(fl validator.FieldLevel) bool {
+	_, err := stats.ParsePercentileRank(fl.Field().String())
+	return err == nil
+}
+
+// PercentileWeightsSumTolerance is the tolerance allowed when checking that
+// percentile weights sum to 1, shared with the control loop so a config which
+// passes validation is never rejected at startup.
+const PercentileWeightsSumTolerance = 1e-6
+
+// validateCrossFields performs checks which cannot be expressed using
+// validator tags, returning all errors found. The config must have passed
+// struct validation so required fields are non-nil.
+func validateCrossFields(config *Config) []error {
+	var errs []error
+
+	paths := map[string]bool{}
+	for i, component := range config.Dimming.DimmableComponents {
+		if paths[*component.Path] {
+			errs = append(errs, fmt.Errorf("dimming.dimmableComponents[%d]: duplicate path %s", i, *component.Path))
+		}
+		paths[*component.Path] = true
+
+		if component.Probability != nil && !(*component.Probability >= 0 && *component.Probability <= 1) {
+			errs = append(errs, fmt.Errorf("dimming.dimmableComponents[%d]: expected probability in [0, 1]; got %v", i, *component.Probability))
+		}
+		if component.ObserveOnly != nil && *component.ObserveOnly && component.Probability != nil {
+			errs = append(errs, fmt.Errorf("dimming.dimmableComponents[%d]: expected probability unset as observeOnly components are never dimmed; got %v", i, *component.Probability))
+		}
+		if transformer := component.Transformer; transformer != nil {
+			if component.DimmedResponse != nil {
+				errs = append(errs, fmt.Errorf("dimming.dimmableComponents[%d]: expected at most one of dimmedResponse and transformer; got both", i))
+			}
+			if transformer.Type != nil && *transformer.Type == "jsonArrayTruncation" && transformer.MaxItems == nil {
+				errs = append(errs, fmt.Errorf("dimming.dimmableComponents[%d].transformer: expected maxItems set for jsonArrayTruncation; got nil", i))
+			}
+		}
+	}
+
+	if weights := config.Dimming.Controller.PercentileWeights; len(weights) != 0 {
+		var sum float64
+		for _, weight := range weights {
+			sum += weight
+		}
+		if math.Abs(sum-1) > PercentileWeightsSumTolerance {
+			errs = append(errs, fmt.Errorf("dimming.controller.percentileWeights: expected weights to sum to 1; got %v", sum))
+		}
+	}
+
+	if controller := config.Dimming.Controller; controller.Collector != nil {
+		if *controller.Collector == "timeWindowed" && controller.WindowDuration == nil {
+			errs = append(errs, fmt.Errorf("dimming.controller.windowDuration: expected set for the timeWindowed collector; got nil"))
+		}
+		if *controller.Collector != "timeWindowed" && controller.WindowDuration != nil {
+			errs = append(errs, fmt.Errorf("dimming.controller.windowDuration: expected unset as only the timeWindowed collector uses it; got %v with collector %s", *controller.WindowDuration, *controller.Collector))
+		}
+	}
+
+	profiler := config.Dimming.Profiler
+	if profiler.Driver != nil && *profiler.Driver != "redis" && profiler.PersistAggregator != nil && *profiler.PersistAggregator {
+		errs = append(errs, fmt.Errorf("dimming.profiler.persistAggregator: expected false as visit counts are persisted to Redis; got true with driver %s", *profiler.Driver))
+	}
+
+	tierNames := map[string]bool{}
+	for i, tier := range profiler.Tiers {
+		if tier.Name == nil {
+			continue
+		}
+		if *tier.Name == "unknown" {
+			errs = append(errs, fmt.Errorf("dimming.profiler.tiers[%d]: expected name other than unknown, which is reserved for unprofiled sessions; got unknown", i))
+		}
+		if tierNames[*tier.Name] {
+			errs = append(errs, fmt.Errorf("dimming.profiler.tiers[%d]: duplicate name %s", i, *tier.Name))
+		}
+		tierNames[*tier.Name] = true
+	}
+	if len(profiler.Tiers) != 0 && profiler.Driver != nil && *profiler.Driver == "memory" && !(tierNames["low"] && tierNames["high"]) {
+		errs = append(errs, fmt.Errorf("dimming.profiler.tiers: expected low and high tiers as the memory driver profiles sessions into them; got %d tiers", len(profiler.Tiers)))
+	}
+
+	probabilities := config.Dimming.Profiler.Probabilities
+	if !(*probabilities.High >= 0 && *probabilities.High <= 1) {
+		errs = append(errs, fmt.Errorf("dimming.profiler.probabilities.high: expected probability in [0, 1]; got %v", *probabilities.High))
+	}
+	if !(*probabilities.Low >= 0 && *probabilities.Low <= 1) {
+		errs = append(errs, fmt.Errorf("dimming.profiler.probabilities.low: expected probability in [0, 1]; got %v", *probabilities.Low))
+	}
+
+	// Shedding would flap around a single threshold if it ramped down at a
+	// higher error rate than it ramped up.
+	training := config.Dimming.OnlineTraining
+	if training.CandidateProbability != nil && training.MinCandidateProbability != nil && training.MaxCandidateProbability != nil &&
+		!(*training.MinCandidateProbability <= *training.CandidateProbability && *training.CandidateProbability <= *training.MaxCandidateProbability) {
+		errs = append(errs, fmt.Errorf("dimming.onlineTraining.candidateProbability: expected within [minCandidateProbability %v, maxCandidateProbability %v]; got %v", *training.MinCandidateProbability, *training.MaxCandidateProbability, *training.CandidateProbability))
+	}
+
+	overload := config.Dimming.OverloadProtection
+	if overload.OpenErrorRate != nil && overload.CloseErrorRate != nil && *overload.CloseErrorRate > *overload.OpenErrorRate {
+		errs = append(errs, fmt.Errorf("dimming.overloadProtection.closeErrorRate: expected at most openErrorRate %v; got %v", *overload.OpenErrorRate, *overload.CloseErrorRate))
+	}
+
+	surge := config.Dimming.SurgeDetection
+	if surge.MinRequestsPerSecond != nil && surge.HysteresisRequestsPerSecond != nil && *surge.HysteresisRequestsPerSecond > *surge.MinRequestsPerSecond {
+		errs = append(errs, fmt.Errorf("dimming.surgeDetection.hysteresisRequestsPerSecond: expected at most minRequestsPerSecond %v; got %v", *surge.MinRequestsPerSecond, *surge.HysteresisRequestsPerSecond))
+	}
+
+	// The dimmer's cookies would overwrite each other if their names
+	// collided.
+	cookieNames := map[string]string{}
+	for field, name := range map[string]*string{
+		"dimming.onlineTraining.cookieName":          config.Dimming.OnlineTraining.CookieName,
+		"dimming.profiler.priorityCookieName":        config.Dimming.Profiler.PriorityCookieName,
+		"dimming.profiler.dimmingDecisionCookieName": config.Dimming.Profiler.DimmingDecisionCookieName,
+	} {
+		if name == nil {
+			continue
+		}
+		if other, ok := cookieNames[*name]; ok {
+			errs = append(errs, fmt.Errorf("%s: cookie name %s is also used by %s", field, *name, other))
+		}
+		cookieNames[*name] = field
+	}
+
+	return errs
+}
+
+// secretKeys are the keys of secrets which can be read from files.
+var secretKeys = []string{
+	"Logging.InfluxDB.Token",
+	"Dimming.Profiler.InfluxDB.Token",
+	"Dimming.Profiler.Redis.Password",
+	"Dimming.DecisionSink.InfluxDB.Token",
+}
+
+// secretFileEnv returns the environment variable which names the file a
+// secret is read from, e.g. LOGGING_INFLUXDB_TOKEN_FILE for
+// Logging.InfluxDB.Token.
+func secretFileEnv(key string) string {
+	return strings.ToUpper(strings.ReplaceAll(key, ".", "_")) + "_FILE"
+}
+
+// readSecretFiles sets each secret whose file environment variable is set to
+// the contents of the named file, taking precedence over inline config, so
+// secrets mounted as files by a secret manager need not be put in the config.
+// Trailing newlines are trimmed.
+func readSecretFiles() error {
+	for _, key := range secretKeys {
+		filename, ok := os.LookupEnv(secretFileEnv(key))
+		if !ok || filename == "" {
+			continue
+		}
+
+		secret, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return fmt.Errorf("expected %s to name a readable file; got err = %w", secretFileEnv(key), err)
+		}
+		viper.Set(key, strings.TrimRight(string(secret), "\r\n"))
+	}
+	return nil
+}
+
 // bindEnvs binds all environment variables automatically.
 // See: https://github.com/spf13/viper/issues/188#issuecomment-399884438
 func bindEnvs(iface interface{}, parts ...string) {
@@ -0,0 +1,200 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func float64Ptr(f float64) *float64 {
+	return &f
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
+
+func newValidConfig() *Config {
+	var config Config
+	config.Dimming.DimmableComponents = []DimmableComponent{
+		{Path: stringPtr("/a"), Probability: float64Ptr(0.5)},
+		{Path: stringPtr("/b")},
+	}
+	config.Dimming.Profiler.Probabilities = Probabilities{
+		High:           float64Ptr(0.01),
+		HighMultiplier: float64Ptr(1),
+		Low:            float64Ptr(0.99),
+		LowMultiplier:  float64Ptr(1),
+	}
+	return &config
+}
+
+func TestValidateCrossFields_Valid(t *testing.T) {
+	assert.Empty(t, validateCrossFields(newValidConfig()))
+}
+
+func TestValidateCrossFields_DuplicatePaths(t *testing.T) {
+	config := newValidConfig()
+	config.Dimming.DimmableComponents = append(config.Dimming.DimmableComponents, DimmableComponent{Path: stringPtr("/a")})
+
+	assert.Len(t, validateCrossFields(config), 1)
+}
+
+func TestValidateCrossFields_ProbabilityRanges(t *testing.T) {
+	config := newValidConfig()
+	config.Dimming.DimmableComponents[0].Probability = float64Ptr(1.5)
+	config.Dimming.Profiler.Probabilities.Low = float64Ptr(-0.1)
+
+	assert.Len(t, validateCrossFields(config), 2)
+}
+
+func TestValidateCrossFields_ObserveOnlyWithProbability(t *testing.T) {
+	config := newValidConfig()
+	observeOnly := true
+	config.Dimming.DimmableComponents[0].ObserveOnly = &observeOnly
+	config.Dimming.DimmableComponents[1].ObserveOnly = &observeOnly
+
+	assert.Len(t, validateCrossFields(config), 1)
+}
+
+func TestValidateCrossFields_Transformer(t *testing.T) {
+	config := newValidConfig()
+	statusCode := 200
+	config.Dimming.DimmableComponents[0].DimmedResponse = &DimmedResponse{StatusCode: &statusCode}
+	config.Dimming.DimmableComponents[0].Transformer = &ResponseTransformer{Type: stringPtr("jsonArrayTruncation"), MaxItems: new(int)}
+	config.Dimming.DimmableComponents[1].Transformer = &ResponseTransformer{Type: stringPtr("jsonArrayTruncation")}
+
+	assert.Len(t, validateCrossFields(config), 2)
+}
+
+func TestValidateCrossFields_PersistAggregatorWithoutRedis(t *testing.T) {
+	config := newValidConfig()
+	persistAggregator := true
+	config.Dimming.Profiler.PersistAggregator = &persistAggregator
+	config.Dimming.Profiler.Driver = stringPtr("redis")
+	assert.Empty(t, validateCrossFields(config))
+
+	config.Dimming.Profiler.Driver = stringPtr("memory")
+	assert.Len(t, validateCrossFields(config), 1)
+}
+
+func TestValidateCrossFields_ProfilerTiers(t *testing.T) {
+	config := newValidConfig()
+	config.Dimming.Profiler.Tiers = []ProfilerTier{
+		{Name: stringPtr("bronze")},
+		{Name: stringPtr("gold")},
+		{Name: stringPtr("gold")},
+		{Name: stringPtr("unknown")},
+	}
+	assert.Len(t, validateCrossFields(config), 2)
+
+	// The memory driver only profiles sessions into the low and high tiers.
+	config.Dimming.Profiler.Tiers = config.Dimming.Profiler.Tiers[:2]
+	config.Dimming.Profiler.Driver = stringPtr("memory")
+	assert.Len(t, validateCrossFields(config), 1)
+}
+
+func TestValidateCrossFields_PercentileWeights(t *testing.T) {
+	config := newValidConfig()
+	config.Dimming.Controller.PercentileWeights = map[string]float64{"p50": 0.3, "p95": 0.6}
+
+	assert.Len(t, validateCrossFields(config), 1)
+
+	config.Dimming.Controller.PercentileWeights["p95"] = 0.7
+	assert.Empty(t, validateCrossFields(config))
+
+	// Weights within the control loop's tolerance of 1 are valid.
+	config.Dimming.Controller.PercentileWeights["p95"] = 0.7 + PercentileWeightsSumTolerance/2
+	assert.Empty(t, validateCrossFields(config))
+}
+
+func TestValidateCrossFields_WindowDuration(t *testing.T) {
+	config := newValidConfig()
+	config.Dimming.Controller.Collector = stringPtr("tachymeter")
+	config.Dimming.Controller.WindowDuration = float64Ptr(10)
+	assert.Len(t, validateCrossFields(config), 1)
+
+	config.Dimming.Controller.Collector = stringPtr("timeWindowed")
+	assert.Empty(t, validateCrossFields(config))
+
+	config.Dimming.Controller.WindowDuration = nil
+	assert.Len(t, validateCrossFields(config), 1)
+}
+
+func TestNewValidator_Percentile(t *testing.T) {
+	validate := newValidator()
+	for _, percentile := range []string{"p50", "p95", "p99", "p90", "p99.9"} {
+		assert.Nilf(t, validate.Var(percentile, "percentile"), "expected percentile %s to be valid", percentile)
+	}
+	for _, percentile := range []string{"", "95", "p", "p0", "p100", "pmax", "p-1"} {
+		assert.NotNilf(t, validate.Var(percentile, "percentile"), "expected percentile %s to be invalid", percentile)
+	}
+}
+
+func TestReadSecretFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets")
+	assert.Nil(t, err)
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	t.Cleanup(viper.Reset)
+
+	filename := filepath.Join(dir, "token")
+	assert.Nil(t, ioutil.WriteFile(filename, []byte("secret-token\n"), 0600))
+
+	assert.Equal(t, "LOGGING_INFLUXDB_TOKEN_FILE", secretFileEnv("Logging.InfluxDB.Token"))
+	assert.Nil(t, os.Setenv("LOGGING_INFLUXDB_TOKEN_FILE", filename))
+	t.Cleanup(func() { _ = os.Unsetenv("LOGGING_INFLUXDB_TOKEN_FILE") })
+
+	viper.Set("Logging.InfluxDB.Token", "inline-token")
+	assert.Nil(t, readSecretFiles())
+	assert.Equal(t, "secret-token", viper.GetString("Logging.InfluxDB.Token"))
+
+	assert.Nil(t, os.Setenv("LOGGING_INFLUXDB_TOKEN_FILE", filepath.Join(dir, "missing")))
+	assert.NotNil(t, readSecretFiles())
+}
+
+func TestValidateCrossFields_CookieNameCollision(t *testing.T) {
+	config := newValidConfig()
+	config.Dimming.OnlineTraining.CookieName = stringPtr("DIMMER")
+	config.Dimming.Profiler.PriorityCookieName = stringPtr("PRIORITY")
+	config.Dimming.Profiler.DimmingDecisionCookieName = stringPtr("DIMMER")
+
+	assert.Len(t, validateCrossFields(config), 1)
+}
+
+func TestValidateCrossFields_OverloadProtectionErrorRates(t *testing.T) {
+	config := newValidConfig()
+	config.Dimming.OverloadProtection.OpenErrorRate = float64Ptr(0.2)
+	config.Dimming.OverloadProtection.CloseErrorRate = float64Ptr(0.3)
+
+	assert.Len(t, validateCrossFields(config), 1)
+}
+
+func TestValidateCrossFields_SurgeDetectionHysteresis(t *testing.T) {
+	config := newValidConfig()
+	config.Dimming.SurgeDetection.MinRequestsPerSecond = float64Ptr(10)
+	config.Dimming.SurgeDetection.HysteresisRequestsPerSecond = float64Ptr(20)
+
+	assert.Len(t, validateCrossFields(config), 1)
+}
+
+func TestValidateCrossFields_CandidateProbabilityOutsideRange(t *testing.T) {
+	config := newValidConfig()
+	config.Dimming.OnlineTraining.CandidateProbability = float64Ptr(0.5)
+	config.Dimming.OnlineTraining.MinCandidateProbability = float64Ptr(0.01)
+	config.Dimming.OnlineTraining.MaxCandidateProbability = float64Ptr(0.2)
+
+	assert.Len(t, validateCrossFields(config), 1)
+}
+
+func TestValidateCrossFields_TLSWithFrontendSocket(t *testing.T) {
+	config := newValidConfig()
+	isEnabled := true
+	config.Connection.TLS.Enabled = &isEnabled
+	config.Connection.FrontendSocketPath = "/run/dimmer.sock"
+
+	assert.Empty(t, validateCrossFields(config))
+}
@@ -3,20 +3,115 @@ package main
 import (
 	"errors"
 	"fmt"
+	"github.com/kcz17/dimmer/config"
+	"github.com/kcz17/dimmer/filters"
 	"github.com/kcz17/dimmer/logging"
 	"github.com/kcz17/dimmer/pid"
 	"github.com/kcz17/dimmer/responsetimecollector"
+	"github.com/kcz17/dimmer/stats"
+	"log"
+	"math"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// Percentiles the developer can choose as response time input.
+// Percentiles the developer can choose as response time input. Any other
+// percentile can be chosen in the same format, e.g. "p90" or "p99.9", but is
+// calculated from the collector's response times rather than its aggregation.
 const (
 	P50 = "p50"
 	P75 = "p75"
 	P95 = "p95"
+	P99 = "p99"
 )
 
+// controlLoopInterval is the interval at which the dimming percentage is
+// recalculated.
+const controlLoopInterval = time.Second * 1
+
+// PathResponseTimeTarget collects the response times of a single path so they
+// can be normalised by the path's target response time.
+type PathResponseTimeTarget struct {
+	Target    time.Duration
+	Collector responsetimecollector.Collector
+}
+
+// ControlTier is an additional controller driven by a single percentile,
+// allowing layered SLOs with escalating dimming aggressiveness, e.g. gentle
+// dimming when the P50 exceeds its setpoint and aggressive dimming when the
+// P99 exceeds its higher setpoint.
+//
+// Each tier's output is scaled by its Contribution, in (0, 1], so a tier with
+// a Contribution of 0.3 dims at most 30% of the primary controller's maximum
+// output. The dimming percentage is the maximum of the primary controller's
+// output and each tier's scaled output, so the most aggressive violated tier
+// dominates while tiers never counteract each other. As each tier has its own
+// controller, integral terms accumulate independently, and tiers whose
+// percentile is within its setpoint wind down to 0 without affecting others.
+type ControlTier struct {
+	Percentile   string
+	PID          pid.Controller
+	Contribution float64
+}
+
+// ServerControlLoopOptions configures a ServerControlLoop.
+type ServerControlLoopOptions struct {
+	Logger logging.Logger
+	// PID is the controller which outputs the dimming percentage, usually a
+	// *pid.PIDController. Any pid.Controller can be supplied, though the
+	// setpoint and gains can only be changed at runtime if it is a
+	// pid.TunableController.
+	PID                   pid.Controller
+	ResponseTimeCollector responsetimecollector.Collector
+	// ResponseTimePercentileWeights maps percentiles to weights which sum to
+	// 1. See ServerControlLoop.
+	ResponseTimePercentileWeights map[string]float64
+	// MaxResponseTime clamps recorded response times. A MaxResponseTime of 0
+	// disables clamping.
+	MaxResponseTime time.Duration
+	// ShouldInterpolateDimmingPercentage ramps the dimming percentage exposed
+	// to requests between control loop ticks instead of stepping.
+	ShouldInterpolateDimmingPercentage bool
+	// ObservabilityResponseTimeCollector records all response times for
+	// logging, while ResponseTimeCollector only records those which drive the
+	// PID controller. If nil, ResponseTimeCollector is used for both.
+	ObservabilityResponseTimeCollector responsetimecollector.Collector
+	// WarmupPeriod is the duration after starting before the control loop is
+	// considered ready. See ServerControlLoop.IsReady.
+	WarmupPeriod time.Duration
+	// PathResponseTimeTargets maps paths to their target response times. If
+	// set, the PID controller input is the worst ratio of a path's response
+	// time to its target, rather than the response time of all requests.
+	PathResponseTimeTargets map[string]*PathResponseTimeTarget
+	// FilterMatchCounter is optional. If set, its counts are logged on each
+	// tick.
+	FilterMatchCounter *filters.MatchCounter
+	// TickAlignment aligns control loop ticks to wall-clock boundaries, e.g.
+	// time.Minute for the first tick to occur at the start of the next
+	// minute. A TickAlignment of 0 disables alignment.
+	TickAlignment time.Duration
+	// Tiers are optional additional controllers. See ControlTier.
+	Tiers []ControlTier
+	// EventSink is optional. If set, an event is published each time the
+	// dimming percentage crosses EventThreshold in either direction.
+	EventSink      logging.EventSink
+	EventThreshold float64
+	// TickEventSink is optional. If set, an event is published each tick with
+	// the dimming percentage and controller state, e.g. for streaming to
+	// dashboards. It is separate from EventSink as ticks are high-volume.
+	TickEventSink logging.EventSink
+	// BackendUnavailableThreshold is the number of consecutive backend
+	// connection failures after which the dimming percentage is held until a
+	// backend request succeeds. A BackendUnavailableThreshold of 0 disables
+	// holding.
+	BackendUnavailableThreshold int
+	// SurgeDetector is optional. If set, the dimming percentage is forced to
+	// 0 unless traffic is surging.
+	SurgeDetector *filters.SurgeDetector
+}
+
 // ServerControlLoop handles the interval-based dimming percentage calculation.
 // The control loop is interval-based as recalculating the dimming percentage
 // based on an aggregate percentile response time would be computationally
@@ -24,21 +119,112 @@ const (
 type ServerControlLoop struct {
 	logger logging.Logger
 
-	// pid is a naive PID controller which outputs a percentage given response
-	// time input.
-	pid *pid.PIDController
+	// pid outputs a percentage given response time input. It is a naive PID
+	// controller unless an alternative pid.Controller is supplied.
+	pid pid.Controller
 
 	// responseTimeCollector aggregates response times, allowing for calculation
-	// of a percentile response time.
-	responseTimeCollector responsetimecollector.Collector
-	// responseTimePercentile is the response time percentile the dimmer will
-	// pass to the PID controller as input.
-	responseTimePercentile string
+	// of a percentile response time. It is protected by
+	// responseTimeCollectorMux as the collector can be swapped at runtime when
+	// its window is resized. responseTimeCollectorMux is held for reading
+	// while response times are added to any collector, and for writing while
+	// collectors are swapped or reset, so each response time is added wholly
+	// before or wholly after a reset.
+	responseTimeCollector    responsetimecollector.Collector
+	responseTimeCollectorMux *sync.RWMutex
+	// observabilityResponseTimeCollector aggregates all response times for
+	// logging, decoupling what the dimmer measures from what it acts on. If
+	// nil, responseTimeCollector is logged instead. It is also protected by
+	// responseTimeCollectorMux.
+	observabilityResponseTimeCollector responsetimecollector.Collector
+	// pathResponseTimeTargets allows paths with differentiated SLOs to share a
+	// single PID controller. Each path's response time is normalised by its
+	// target, so a path at its target contributes 1, and the worst normalised
+	// ratio is passed to the PID controller as input, in which case the PID
+	// setpoint is a ratio rather than a response time. Paths are stored with a
+	// leading slash. If empty, the response time of all requests is used.
+	pathResponseTimeTargets map[string]*PathResponseTimeTarget
+	// filterMatchCounter counts the requests matched by the request filter,
+	// which are logged each tick so the proportion of dimmable traffic can be
+	// monitored. If nil, the counts are not logged.
+	filterMatchCounter *filters.MatchCounter
+	// responseTimePercentileWeights maps response time percentiles to weights.
+	// The dimmer passes the weighted blend of percentiles to the PID
+	// controller as input, e.g. {p50: 0.3, p95: 0.7} for 0.3*p50 + 0.7*p95.
+	// Weights sum to 1.
+	responseTimePercentileWeights map[string]float64
+	// tiers escalate the dimming percentage beyond the primary controller's
+	// output. See ControlTier.
+	tiers []ControlTier
+	// maxResponseTime clamps response times added to responseTimeCollector,
+	// so a single hung request does not dominate the percentile long after
+	// latency normalises. This trades tail fidelity for control loop
+	// responsiveness. A maxResponseTime of 0 disables clamping.
+	maxResponseTime time.Duration
+	// eventSink is published to when the PID output crosses eventThreshold,
+	// e.g. when dimming starts and stops for a threshold of 0. If nil, events
+	// are not published. isAboveEventThreshold is only accessed by tick.
+	eventSink             logging.EventSink
+	eventThreshold        float64
+	isAboveEventThreshold bool
+	// tickEventSink is published to each tick. If nil, ticks are not
+	// published.
+	tickEventSink logging.EventSink
+	// backendUnavailableThreshold is the number of consecutive backend
+	// connection failures after which the backend is considered unavailable,
+	// e.g. while restarting. The dimming percentage is then held, as latency
+	// briefly spikes around a restart and the PID controller would otherwise
+	// ramp dimming up then down in a visible wave. Response times are not
+	// collected while held, and control resumes once a backend request
+	// succeeds. A backendUnavailableThreshold of 0 disables holding.
+	backendUnavailableThreshold int
+	// consecutiveBackendFailures is protected by backendAvailabilityMux.
+	// isHoldingForBackend is 1 while held and is accessed atomically as it is
+	// read on every response time added.
+	consecutiveBackendFailures int
+	backendAvailabilityMux     *sync.Mutex
+	isHoldingForBackend        int32
+	// surgeDetector gates dimming behind the request rate, so the backend
+	// handles all traffic during normal load however slow it is. While
+	// traffic is not surging, the dimming percentage is 0 and the controllers
+	// are reset, so they do not integrate latency they cannot act on. If nil,
+	// dimming is never gated.
+	surgeDetector *filters.SurgeDetector
 
 	// dimmingPercentage is the output of the PID controller, protected from
 	// race conditions by dimmingPercentageMux.
 	dimmingPercentage    float64
 	dimmingPercentageMux *sync.RWMutex
+	// If shouldInterpolateDimmingPercentage is true, the dimming percentage
+	// exposed to requests ramps linearly from previousDimmingPercentage to
+	// dimmingPercentage over the control loop interval following
+	// dimmingPercentageUpdatedAt, so the effective dimming rate changes
+	// smoothly rather than in steps at tick boundaries. These fields are also
+	// protected by dimmingPercentageMux.
+	shouldInterpolateDimmingPercentage bool
+	previousDimmingPercentage          float64
+	dimmingPercentageUpdatedAt         time.Time
+	// latestSetpoint and latestInput are the PID setpoint and input at the
+	// latest tick, exposed to requests by readSetpointAndInput. The input is
+	// in the setpoint's unit, which is seconds unless pathResponseTimeTargets
+	// is set, in which case it is a ratio. These fields are also protected by
+	// dimmingPercentageMux.
+	latestSetpoint float64
+	latestInput    float64
+	// now allows time to be controlled in tests.
+	now func() time.Time
+
+	// tickAlignment delays the first tick to the next wall-clock boundary of
+	// the alignment, so ticks and metric emission line up with time-bucketed
+	// data elsewhere. A tickAlignment of 0 disables alignment.
+	tickAlignment time.Duration
+
+	// warmupPeriod is the duration after startedAt during which the control
+	// loop is not ready, as its output is erratic until enough response times
+	// are collected. These fields are protected by readinessMux.
+	warmupPeriod time.Duration
+	startedAt    time.Time
+	readinessMux *sync.RWMutex
 
 	// loopStarted is used so the control loop can be started and stopped.
 	// Stopping the control loop is needed when resetting the controller as
@@ -53,25 +239,99 @@ type ServerControlLoop struct {
 }
 
 // NewServerControlLoop initialises the control loop.
-func NewServerControlLoop(
-	pid *pid.PIDController,
-	responseTimeCollector responsetimecollector.Collector,
-	responseTimePercentile string,
-	logger logging.Logger,
-) (*ServerControlLoop, error) {
-	if responseTimePercentile != P50 &&
-		responseTimePercentile != P75 &&
-		responseTimePercentile != P95 {
-		return nil, errors.New(fmt.Sprintf("NewServerControlLoop() expected responseTimePercentile to be one of {p50|p75|p95}; got %s", responseTimePercentile))
+func NewServerControlLoop(options *ServerControlLoopOptions) (*ServerControlLoop, error) {
+	responseTimePercentileWeights := options.ResponseTimePercentileWeights
+	maxResponseTime := options.MaxResponseTime
+
+	if len(responseTimePercentileWeights) == 0 {
+		return nil, errors.New("NewServerControlLoop() expected at least one responseTimePercentileWeights entry; got none")
+	}
+
+	weights := make(map[string]float64, len(responseTimePercentileWeights))
+	var sum float64
+	for percentile, weight := range responseTimePercentileWeights {
+		if _, err := stats.ParsePercentileRank(percentile); err != nil {
+			return nil, errors.New(fmt.Sprintf("NewServerControlLoop() expected responseTimePercentileWeights keys to be percentiles such as p95 or p99.9; got %s", percentile))
+		}
+		if weight < 0 {
+			return nil, errors.New(fmt.Sprintf("NewServerControlLoop() expected non-negative weight for percentile %s; got %v", percentile, weight))
+		}
+		weights[percentile] = weight
+		sum += weight
+	}
+
+	// Allow for floating point error in weights such as 0.1 + 0.2 + 0.7.
+	if math.Abs(sum-1) > config.PercentileWeightsSumTolerance {
+		return nil, errors.New(fmt.Sprintf("NewServerControlLoop() expected responseTimePercentileWeights to sum to 1; got %v", sum))
+	}
+
+	pathResponseTimeTargets := make(map[string]*PathResponseTimeTarget, len(options.PathResponseTimeTargets))
+	for path, target := range options.PathResponseTimeTargets {
+		if target.Target <= 0 {
+			return nil, errors.New(fmt.Sprintf("NewServerControlLoop() expected positive target response time for path %s; got %v", path, target.Target))
+		}
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+		pathResponseTimeTargets[path] = target
+	}
+
+	if options.WarmupPeriod < 0 {
+		return nil, errors.New(fmt.Sprintf("NewServerControlLoop() expected non-negative warmupPeriod; got %v", options.WarmupPeriod))
+	}
+
+	if options.TickAlignment < 0 {
+		return nil, errors.New(fmt.Sprintf("NewServerControlLoop() expected non-negative tickAlignment; got %v", options.TickAlignment))
+	}
+
+	if options.BackendUnavailableThreshold < 0 {
+		return nil, errors.New(fmt.Sprintf("NewServerControlLoop() expected non-negative backendUnavailableThreshold; got %d", options.BackendUnavailableThreshold))
+	}
+
+	if maxResponseTime < 0 {
+		return nil, errors.New(fmt.Sprintf("NewServerControlLoop() expected non-negative maxResponseTime; got %v", maxResponseTime))
+	}
+
+	if options.PID == nil {
+		return nil, errors.New("NewServerControlLoop() expected a controller; got nil")
+	}
+
+	for i, tier := range options.Tiers {
+		if _, err := stats.ParsePercentileRank(tier.Percentile); err != nil {
+			return nil, errors.New(fmt.Sprintf("NewServerControlLoop() expected tiers[%d] percentile to be a percentile such as p95 or p99.9; got %s", i, tier.Percentile))
+		}
+		if tier.PID == nil {
+			return nil, errors.New(fmt.Sprintf("NewServerControlLoop() expected tiers[%d] to have a PID controller; got nil", i))
+		}
+		if !(tier.Contribution > 0 && tier.Contribution <= 1) {
+			return nil, errors.New(fmt.Sprintf("NewServerControlLoop() expected tiers[%d] contribution in (0, 1]; got %v", i, tier.Contribution))
+		}
 	}
 
 	c := &ServerControlLoop{
-		pid:                    pid,
-		responseTimeCollector:  responseTimeCollector,
-		responseTimePercentile: responseTimePercentile,
-		logger:                 logger,
-		dimmingPercentage:      0.0,
-		dimmingPercentageMux:   &sync.RWMutex{},
+		pid:                                options.PID,
+		responseTimeCollector:              options.ResponseTimeCollector,
+		responseTimeCollectorMux:           &sync.RWMutex{},
+		observabilityResponseTimeCollector: options.ObservabilityResponseTimeCollector,
+		pathResponseTimeTargets:            pathResponseTimeTargets,
+		filterMatchCounter:                 options.FilterMatchCounter,
+		responseTimePercentileWeights:      weights,
+		tiers:                              options.Tiers,
+		eventSink:                          options.EventSink,
+		eventThreshold:                     options.EventThreshold,
+		tickEventSink:                      options.TickEventSink,
+		backendUnavailableThreshold:        options.BackendUnavailableThreshold,
+		backendAvailabilityMux:             &sync.Mutex{},
+		surgeDetector:                      options.SurgeDetector,
+		maxResponseTime:                    maxResponseTime,
+		logger:                             options.Logger,
+		dimmingPercentage:                  0.0,
+		dimmingPercentageMux:               &sync.RWMutex{},
+		shouldInterpolateDimmingPercentage: options.ShouldInterpolateDimmingPercentage,
+		now:                                time.Now,
+		warmupPeriod:                       options.WarmupPeriod,
+		tickAlignment:                      options.TickAlignment,
+		readinessMux:                       &sync.RWMutex{},
 	}
 
 	return c, nil
@@ -82,6 +342,10 @@ func (c *ServerControlLoop) Start() error {
 		return errors.New("ServerControlLoop.Start() failed: control loop already started")
 	}
 
+	c.readinessMux.Lock()
+	c.startedAt = c.now()
+	c.readinessMux.Unlock()
+
 	c.loopStop = make(chan bool, 1)
 	c.loopWaiter = &sync.WaitGroup{}
 	c.loopWaiter.Add(1)
@@ -91,21 +355,63 @@ func (c *ServerControlLoop) Start() error {
 	return nil
 }
 
-func (c *ServerControlLoop) Reset() error {
+// IsReady returns true once the control loop has started and the warmup
+// period has elapsed. Readiness does not depend on response times having been
+// collected, as a dimmer which is not ready receives no traffic to collect
+// them from. Readiness is not lost on Reset.
+func (c *ServerControlLoop) IsReady() bool {
+	c.readinessMux.RLock()
+	defer c.readinessMux.RUnlock()
+
+	return !c.startedAt.IsZero() && c.now().Sub(c.startedAt) >= c.warmupPeriod
+}
+
+// Stop gracefully stops the control loop, waiting for its goroutine to exit.
+// The control loop can be started again with Start.
+func (c *ServerControlLoop) Stop() error {
 	if !c.loopStarted {
 		return errors.New("ServerControlLoop.Stop() failed: control loop not running")
 	}
 
+	close(c.loopStop)
+	c.loopWaiter.Wait()
+
+	c.loopStarted = false
+	return nil
+}
+
+func (c *ServerControlLoop) Reset() error {
+	if !c.loopStarted {
+		return errors.New("ServerControlLoop.Reset() failed: control loop not running")
+	}
+
 	// ResetCollector the control loop, response time collector and PID controller
 	// in this order to ensure stale data is not written between each reset.
 	close(c.loopStop)
 	c.loopWaiter.Wait()
+	// The collectors, PID controller and dimming percentage are reset while
+	// holding both locks, so concurrent requests either add response times
+	// and read the dimming percentage entirely before the reset or entirely
+	// after it. Otherwise, a response time could be added to one collector
+	// after it is reset but to another before it is reset.
+	c.responseTimeCollectorMux.Lock()
+	c.dimmingPercentageMux.Lock()
 	c.responseTimeCollector.Reset()
+	if c.observabilityResponseTimeCollector != nil {
+		c.observabilityResponseTimeCollector.Reset()
+	}
+	for _, target := range c.pathResponseTimeTargets {
+		target.Collector.Reset()
+	}
 	c.pid.Reset()
-
-	c.dimmingPercentageMux.Lock()
+	for _, tier := range c.tiers {
+		tier.PID.Reset()
+	}
 	c.dimmingPercentage = 0.0
+	c.previousDimmingPercentage = 0.0
+	c.latestInput = 0.0
 	c.dimmingPercentageMux.Unlock()
+	c.responseTimeCollectorMux.Unlock()
 
 	// Start a new control loop.
 	c.loopStop = make(chan bool, 1)
@@ -123,54 +429,486 @@ func (c *ServerControlLoop) readDimmingPercentage() float64 {
 	// runs and overwrites the dimming percentage.
 	c.dimmingPercentageMux.RLock()
 	defer c.dimmingPercentageMux.RUnlock()
-	return c.dimmingPercentage
+
+	if !c.shouldInterpolateDimmingPercentage {
+		return c.dimmingPercentage
+	}
+
+	progress := float64(c.now().Sub(c.dimmingPercentageUpdatedAt)) / float64(controlLoopInterval)
+	if progress >= 1 {
+		return c.dimmingPercentage
+	}
+	if progress < 0 {
+		progress = 0
+	}
+	return c.previousDimmingPercentage + (c.dimmingPercentage-c.previousDimmingPercentage)*progress
+}
+
+// setDimmingPercentage applies a new PID output.
+func (c *ServerControlLoop) setDimmingPercentage(percentage float64) {
+	c.dimmingPercentageMux.Lock()
+	defer c.dimmingPercentageMux.Unlock()
+
+	// Interpolation continues from the currently exposed percentage so that
+	// there is no step if a tick arrives before the previous ramp finishes.
+	if c.shouldInterpolateDimmingPercentage {
+		now := c.now()
+		progress := float64(now.Sub(c.dimmingPercentageUpdatedAt)) / float64(controlLoopInterval)
+		if progress < 1 && progress >= 0 {
+			c.previousDimmingPercentage += (c.dimmingPercentage - c.previousDimmingPercentage) * progress
+		} else {
+			c.previousDimmingPercentage = c.dimmingPercentage
+		}
+		c.dimmingPercentageUpdatedAt = now
+	}
+	c.dimmingPercentage = percentage
+}
+
+// SetSetpoint changes the setpoint of the primary PID controller at runtime,
+// e.g. to tighten the target response time during an incident. The setpoint
+// is a ratio if pathResponseTimeTargets is set. Tier
+// setpoints are unchanged. The change is bumpless, see
+// pid.PIDController.SetSetpoint. An error is returned if the controller is not
+// a pid.TunableController.
+func (c *ServerControlLoop) SetSetpoint(setpoint float64) error {
+	if !(setpoint > 0) || math.IsInf(setpoint, 1) {
+		return errors.New(fmt.Sprintf("ServerControlLoop.SetSetpoint() expected positive finite setpoint; got setpoint = %v", setpoint))
+	}
+	controller, isTunable := c.pid.(pid.TunableController)
+	if !isTunable {
+		return errors.New(fmt.Sprintf("ServerControlLoop.SetSetpoint() expected a pid.TunableController; got %T", c.pid))
+	}
+
+	controller.SetSetpoint(setpoint)
+	c.dimmingPercentageMux.Lock()
+	c.latestSetpoint = setpoint
+	c.dimmingPercentageMux.Unlock()
+	return nil
+}
+
+// Setpoint returns the setpoint of the PID controller, or 0 if the controller
+// is not a pid.TunableController.
+func (c *ServerControlLoop) Setpoint() float64 {
+	controller, isTunable := c.pid.(pid.TunableController)
+	if !isTunable {
+		return 0
+	}
+	return controller.Setpoint()
+}
+
+// Gains returns the gain constants of the PID controller as passed to
+// SetGains, i.e. not negated if the controller is reversed, or 0 if the
+// controller is not a pid.TunableController.
+func (c *ServerControlLoop) Gains() (kp float64, ki float64, kd float64) {
+	controller, isTunable := c.pid.(pid.TunableController)
+	if !isTunable {
+		return 0, 0, 0
+	}
+	kp, ki, kd = controller.Gains()
+	return math.Abs(kp), math.Abs(ki), math.Abs(kd)
+}
+
+// SetGains changes the gain constants of the PID controller and of each
+// tunable tier, which share the primary controller's gains, e.g. to tune the
+// controller without restarting and losing accumulated state. The change is
+// bumpless, see pid.PIDController.SetGains. An error is returned if the
+// primary controller is not a pid.TunableController.
+func (c *ServerControlLoop) SetGains(kp float64, ki float64, kd float64) error {
+	controller, isTunable := c.pid.(pid.TunableController)
+	if !isTunable {
+		return errors.New(fmt.Sprintf("ServerControlLoop.SetGains() expected a pid.TunableController; got %T", c.pid))
+	}
+	if err := controller.SetGains(kp, ki, kd); err != nil {
+		return fmt.Errorf("expected PIDController.SetGains() returns nil err; got err = %w", err)
+	}
+	for _, tier := range c.tiers {
+		tierController, isTunable := tier.PID.(pid.TunableController)
+		if !isTunable {
+			continue
+		}
+		if err := tierController.SetGains(kp, ki, kd); err != nil {
+			return fmt.Errorf("expected tier PIDController.SetGains() returns nil err; got err = %w", err)
+		}
+	}
+	return nil
+}
+
+// setSetpointAndInput records the PID setpoint and input at the latest tick.
+func (c *ServerControlLoop) setSetpointAndInput(setpoint float64, input float64) {
+	c.dimmingPercentageMux.Lock()
+	c.latestSetpoint = setpoint
+	c.latestInput = input
+	c.dimmingPercentageMux.Unlock()
+}
+
+// readSetpointAndInput retrieves the PID setpoint and input at the latest
+// tick, which is the weighted blend of the configured percentiles rather than
+// a fixed percentile. The PID controller is not read directly as it is only
+// safe to use from the control loop.
+func (c *ServerControlLoop) readSetpointAndInput() (setpoint float64, input float64) {
+	c.dimmingPercentageMux.RLock()
+	defer c.dimmingPercentageMux.RUnlock()
+	return c.latestSetpoint, c.latestInput
 }
 
 // addResponseTime adds a new response time to the response time collector,
-// likely changing the input at the next control loop.
+// likely changing the input at the next control loop. The response time is
+// clamped to maxResponseTime if set. The response time is also observed as
+// per addObservedResponseTime.
 func (c *ServerControlLoop) addResponseTime(t time.Duration) {
+	// The read lock is held while adding so that no response times are added
+	// to a collector which has been swapped out.
+	c.responseTimeCollectorMux.RLock()
+	defer c.responseTimeCollectorMux.RUnlock()
+
+	// Observed response times are not clamped as they do not affect the
+	// responsiveness of the control loop.
+	if c.observabilityResponseTimeCollector != nil {
+		c.observabilityResponseTimeCollector.Add(t)
+	}
+
+	if c.isHoldingForBackendRecovery() {
+		return
+	}
+	if c.maxResponseTime > 0 && t > c.maxResponseTime {
+		t = c.maxResponseTime
+	}
 	c.responseTimeCollector.Add(t)
 }
 
+// addPathResponseTime adds a response time to the collector for path if the
+// path has a target response time. The response time is clamped to
+// maxResponseTime if set.
+func (c *ServerControlLoop) addPathResponseTime(path string, t time.Duration) {
+	target, ok := c.pathResponseTimeTargets[path]
+	if !ok || c.isHoldingForBackendRecovery() {
+		return
+	}
+
+	c.responseTimeCollectorMux.RLock()
+	defer c.responseTimeCollectorMux.RUnlock()
+
+	if c.maxResponseTime > 0 && t > c.maxResponseTime {
+		t = c.maxResponseTime
+	}
+	target.Collector.Add(t)
+}
+
+// worstPathResponseTimeRatio returns the highest ratio of a path's weighted
+// response time to its target response time. Paths without response times are
+// ignored, so 0 is returned if no paths have response times.
+func (c *ServerControlLoop) worstPathResponseTimeRatio() float64 {
+	var worst float64
+	for _, target := range c.pathResponseTimeTargets {
+		if target.Collector.Len() == 0 {
+			continue
+		}
+
+		ratio := c.weightedResponseTime(target.Collector.Aggregate(), target.Collector) / target.Target.Seconds()
+		if ratio > worst {
+			worst = ratio
+		}
+	}
+	return worst
+}
+
+// weightedResponseTime returns the weighted blend of percentiles in seconds,
+// where aggregation is the aggregation of collector.
+func (c *ServerControlLoop) weightedResponseTime(aggregation *responsetimecollector.Aggregation, collector responsetimecollector.Collector) float64 {
+	var input float64
+	for percentile, weight := range c.responseTimePercentileWeights {
+		input += weight * percentileSeconds(aggregation, collector, percentile)
+	}
+	return input
+}
+
+// percentileSeconds returns the given percentile in seconds. Percentiles
+// included in aggregation are read from it, and other percentiles are
+// calculated from collector, which aggregation must be the aggregation of.
+func percentileSeconds(aggregation *responsetimecollector.Aggregation, collector responsetimecollector.Collector, percentile string) float64 {
+	switch percentile {
+	case P50:
+		return aggregation.P50.Seconds()
+	case P75:
+		return aggregation.P75.Seconds()
+	case P95:
+		return aggregation.P95.Seconds()
+	case P99:
+		return aggregation.P99.Seconds()
+	}
+
+	p, err := stats.ParsePercentileRank(percentile)
+	if err != nil {
+		panic(fmt.Errorf("unexpected percentile %s in percentileSeconds(): %w", percentile, err))
+	}
+	return collector.Percentile(p).Seconds()
+}
+
+// escalateByTiers returns the maximum of output and each tier's output scaled
+// by its contribution. Every tier's PID controller is updated on each call,
+// even if it does not dominate, so its state tracks its percentile.
+func (c *ServerControlLoop) escalateByTiers(output float64, aggregation *responsetimecollector.Aggregation, collector responsetimecollector.Collector) float64 {
+	for _, tier := range c.tiers {
+		tierOutput := tier.Contribution * tier.PID.Output(percentileSeconds(aggregation, collector, tier.Percentile))
+		if tierOutput > output {
+			output = tierOutput
+		}
+	}
+	return output
+}
+
+// recordBackendAvailability records whether a backend request connected to the
+// backend, holding the dimming percentage once backendUnavailableThreshold
+// consecutive requests fail to connect and resuming control once a request
+// succeeds.
+func (c *ServerControlLoop) recordBackendAvailability(isAvailable bool) {
+	if c.backendUnavailableThreshold == 0 {
+		return
+	}
+
+	c.backendAvailabilityMux.Lock()
+	defer c.backendAvailabilityMux.Unlock()
+
+	if isAvailable {
+		c.consecutiveBackendFailures = 0
+		if atomic.CompareAndSwapInt32(&c.isHoldingForBackend, 1, 0) {
+			log.Printf("backend available; resuming dimming control")
+		}
+		return
+	}
+
+	c.consecutiveBackendFailures++
+	if c.consecutiveBackendFailures >= c.backendUnavailableThreshold &&
+		atomic.CompareAndSwapInt32(&c.isHoldingForBackend, 0, 1) {
+		log.Printf("backend unavailable after %d consecutive connection failures; holding dimming percentage at %.2f", c.consecutiveBackendFailures, c.readDimmingPercentage())
+	}
+}
+
+// isHoldingForBackendRecovery returns true while the dimming percentage is
+// held as the backend is unavailable.
+func (c *ServerControlLoop) isHoldingForBackendRecovery() bool {
+	return atomic.LoadInt32(&c.isHoldingForBackend) == 1
+}
+
+// recordRequest records a request received by the server for surge
+// detection.
+func (c *ServerControlLoop) recordRequest() {
+	if c.surgeDetector != nil {
+		c.surgeDetector.AddRequest()
+	}
+}
+
+// addObservedResponseTime adds a response time which is logged but does not
+// drive the PID controller. It is a no-op without a separate observability
+// collector, as all recorded response times then drive the PID controller.
+func (c *ServerControlLoop) addObservedResponseTime(t time.Duration) {
+	c.responseTimeCollectorMux.RLock()
+	defer c.responseTimeCollectorMux.RUnlock()
+
+	if c.observabilityResponseTimeCollector != nil {
+		c.observabilityResponseTimeCollector.Add(t)
+	}
+}
+
+// ResizeResponseTimeCollectorWindow resizes the response time collector's
+// window, allowing the window to be tuned to the traffic rate without a
+// restart. Up to size existing samples are migrated to the resized collector
+// so the control loop input does not reset. An error is returned if the
+// collector has no sample-count window, e.g. the EWMA or time-windowed
+// collectors, rather than replacing the configured collector.
+func (c *ServerControlLoop) ResizeResponseTimeCollectorWindow(size int) error {
+	if size <= 0 {
+		return errors.New(fmt.Sprintf("ServerControlLoop.ResizeResponseTimeCollectorWindow() expected positive size; got %d", size))
+	}
+
+	c.responseTimeCollectorMux.Lock()
+	defer c.responseTimeCollectorMux.Unlock()
+
+	resizer, ok := c.responseTimeCollector.(responsetimecollector.WindowResizer)
+	if !ok {
+		return errors.New(fmt.Sprintf("ServerControlLoop.ResizeResponseTimeCollectorWindow() expected collector with a sample-count window; got %T", c.responseTimeCollector))
+	}
+	collector, err := resizer.ResizeWindow(size)
+	if err != nil {
+		return err
+	}
+
+	c.responseTimeCollector = collector
+	return nil
+}
+
 func (c *ServerControlLoop) controlLoop() {
-	ticker := time.NewTicker(time.Second * 1)
-	defer ticker.Stop()
 	defer c.loopWaiter.Done()
 
+	// If aligned, the first tick is delayed until the next boundary so that
+	// subsequent ticks, and hence logged metrics, fall on wall-clock
+	// boundaries rather than relative to when the control loop started.
+	if c.tickAlignment > 0 {
+		select {
+		case <-time.After(durationUntilAlignedBoundary(c.now(), c.tickAlignment)):
+			c.tick()
+		case <-c.loopStop:
+			return
+		}
+	}
+
+	ticker := time.NewTicker(controlLoopInterval)
+	defer ticker.Stop()
+
 	// This for-select pattern allows the control loop to run at the ticker
 	// interval, while also listening for the loopStop channel to indicate
 	// that the control loop should stop.
 	for {
 		select {
 		case <-ticker.C:
-			aggregation := c.responseTimeCollector.Aggregate()
-
-			// PID controller and logger operate with seconds.
-			p50 := float64(aggregation.P50) / float64(time.Second)
-			p75 := float64(aggregation.P75) / float64(time.Second)
-			p95 := float64(aggregation.P95) / float64(time.Second)
-			c.logger.LogAggregateResponseTimes(p50, p75, p95)
-
-			// Retrieve the PID output.
-			var pidOutput float64
-			if c.responseTimePercentile == P50 {
-				pidOutput = c.pid.Output(p50)
-			} else if c.responseTimePercentile == P75 {
-				pidOutput = c.pid.Output(p75)
-			} else if c.responseTimePercentile == P95 {
-				pidOutput = c.pid.Output(p95)
-			} else {
-				panic(fmt.Sprintf("ServerControlLoop.controlLoop() expected responseTimePercentile to be one of {50|75|95}; got %s", c.responseTimePercentile))
-			}
-			c.logger.LogDimmerOutput(pidOutput)
-			c.logger.LogPIDControllerState(c.pid.DebugP, c.pid.DebugI, c.pid.DebugD, c.pid.DebugErr)
-
-			// Apply the PID output.
-			c.dimmingPercentageMux.Lock()
-			c.dimmingPercentage = pidOutput
-			c.dimmingPercentageMux.Unlock()
+			c.tick()
 		case <-c.loopStop:
 			return
 		}
 	}
 }
+
+// tick calculates and applies a new dimming percentage.
+func (c *ServerControlLoop) tick() {
+	c.responseTimeCollectorMux.RLock()
+	// The collector is retained so percentiles outside the aggregation can be
+	// calculated from it, even if it is replaced by a resize after unlocking.
+	collector := c.responseTimeCollector
+	count := c.responseTimeCollector.Len()
+	utilization := c.responseTimeCollector.Utilization()
+	timeSpan := c.responseTimeCollector.TimeSpan()
+	aggregation := c.responseTimeCollector.Aggregate()
+	observedAggregation := aggregation
+	if c.observabilityResponseTimeCollector != nil {
+		observedAggregation = c.observabilityResponseTimeCollector.Aggregate()
+	}
+	c.responseTimeCollectorMux.RUnlock()
+
+	// PID controller and logger operate with seconds.
+	c.logger.LogAggregateResponseTimes(
+		float64(observedAggregation.P50)/float64(time.Second),
+		float64(observedAggregation.P75)/float64(time.Second),
+		float64(observedAggregation.P95)/float64(time.Second),
+	)
+	c.logger.LogResponseTimeCollector(count, utilization, timeSpan.Seconds())
+
+	// The PID controllers are paused while held, so they do not integrate
+	// over the hold once control resumes.
+	if c.isHoldingForBackendRecovery() {
+		discardElapsed(c.pid)
+		for _, tier := range c.tiers {
+			discardElapsed(tier.PID)
+		}
+		c.logger.LogDimmerOutput(c.readDimmingPercentage())
+		c.publishTick(c.readDimmingPercentage(), true)
+		return
+	}
+
+	// Retrieve the PID output using the weighted blend of percentiles,
+	// normalised per path if paths have target response times. Outside a
+	// traffic surge, the output is 0 and the controllers are reset so dimming
+	// starts afresh once a surge is detected.
+	var input float64
+	if len(c.pathResponseTimeTargets) != 0 {
+		input = c.worstPathResponseTimeRatio()
+	} else {
+		input = c.weightedResponseTime(aggregation, collector)
+	}
+	var pidOutput float64
+	if c.surgeDetector == nil || c.surgeDetector.IsSurging() {
+		pidOutput = c.escalateByTiers(c.pid.Output(input), aggregation, collector)
+	} else {
+		c.pid.Reset()
+		for _, tier := range c.tiers {
+			tier.PID.Reset()
+		}
+	}
+	c.logger.LogDimmerOutput(pidOutput)
+	// Only PID controllers expose the terms of their latest output.
+	if controller, isPID := c.pid.(*pid.PIDController); isPID {
+		c.logger.LogPIDControllerState(controller.DebugP, controller.DebugI, controller.DebugD, controller.DebugErr)
+	}
+	if controller, isTunable := c.pid.(pid.TunableController); isTunable {
+		kp, ki, kd := controller.Gains()
+		c.logger.LogPIDControllerParameters(controller.Setpoint(), kp, ki, kd)
+	}
+	if c.filterMatchCounter != nil {
+		c.logger.LogFilterMatches(c.filterMatchCounter.Counts())
+	}
+
+	// Apply the PID output.
+	c.setDimmingPercentage(pidOutput)
+	c.publishThresholdCrossing(pidOutput)
+	c.publishTick(pidOutput, false)
+	c.setSetpointAndInput(c.Setpoint(), input)
+}
+
+// discardElapsed discards the time elapsed for the controller if it is a
+// pid.PausableController. Other controllers are left to handle the pause
+// themselves.
+func discardElapsed(controller pid.Controller) {
+	if controller, isPausable := controller.(pid.PausableController); isPausable {
+		controller.DiscardElapsed()
+	}
+}
+
+// publishThresholdCrossing publishes an event if the PID output has crossed
+// the event threshold since the previous tick.
+func (c *ServerControlLoop) publishThresholdCrossing(pidOutput float64) {
+	if c.eventSink == nil {
+		return
+	}
+
+	isAbove := pidOutput > c.eventThreshold
+	if isAbove == c.isAboveEventThreshold {
+		return
+	}
+	c.isAboveEventThreshold = isAbove
+
+	direction := "below"
+	if isAbove {
+		direction = "above"
+	}
+	c.eventSink.Publish(logging.Event{
+		Timestamp: c.now(),
+		Type:      logging.EventDimmingThresholdCrossed,
+		Attributes: map[string]interface{}{
+			"threshold":         c.eventThreshold,
+			"dimmingPercentage": pidOutput,
+			"direction":         direction,
+		},
+	})
+}
+
+// publishTick publishes the dimming percentage and controller state of a tick.
+func (c *ServerControlLoop) publishTick(dimmingPercentage float64, isHeld bool) {
+	if c.tickEventSink == nil {
+		return
+	}
+
+	attributes := map[string]interface{}{
+		"dimmingPercentage": dimmingPercentage,
+		"isHeld":            isHeld,
+	}
+	if controller, isPID := c.pid.(*pid.PIDController); isPID {
+		attributes["p"] = controller.DebugP
+		attributes["i"] = controller.DebugI
+		attributes["d"] = controller.DebugD
+		attributes["error"] = controller.DebugErr
+	}
+	if controller, isTunable := c.pid.(pid.TunableController); isTunable {
+		attributes["setpoint"] = controller.Setpoint()
+	}
+	c.tickEventSink.Publish(logging.Event{
+		Timestamp:  c.now(),
+		Type:       logging.EventControlLoopTicked,
+		Attributes: attributes,
+	})
+}
+
+// durationUntilAlignedBoundary returns the duration from now until the next
+// multiple of alignment since the zero time, e.g. the start of the next
+// minute for an alignment of a minute.
+func durationUntilAlignedBoundary(now time.Time, alignment time.Duration) time.Duration {
+	return now.Truncate(alignment).Add(alignment).Sub(now)
+}
@@ -0,0 +1,735 @@
+package main
+
+import (
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kcz17/dimmer/filters"
+	"github.com/kcz17/dimmer/logging"
+	"github.com/kcz17/dimmer/pid"
+	"github.com/kcz17/dimmer/responsetimecollector"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestPIDController(t *testing.T) *pid.PIDController {
+	c, err := pid.NewPIDController(pid.NewRealtimeClock(), 1, 1, 0, 0, true, 0, 99, 1, true)
+	assert.Nilf(t, err, "expected NewPIDController(...) has no err; got %v", err)
+	return c
+}
+
+func TestServerControlLoop_addResponseTime_ClampsToMaxResponseTime(t *testing.T) {
+	collector := responsetimecollector.NewArrayCollector()
+	c, err := NewServerControlLoop(&ServerControlLoopOptions{
+		Logger:                        logging.NewNoopLogger(),
+		PID:                           newTestPIDController(t),
+		ResponseTimeCollector:         collector,
+		ResponseTimePercentileWeights: map[string]float64{P95: 1},
+		MaxResponseTime:               5 * time.Second,
+	})
+	assert.Nilf(t, err, "expected NewServerControlLoop(...) has no err; got %v", err)
+
+	c.addResponseTime(100 * time.Millisecond)
+	c.addResponseTime(5 * time.Second)
+	c.addResponseTime(120 * time.Second)
+
+	assert.Equal(t, []float64{0.1, 5, 5}, collector.All())
+}
+
+func TestServerControlLoop_addResponseTime_DoesNotClampWhenDisabled(t *testing.T) {
+	collector := responsetimecollector.NewArrayCollector()
+	c, err := NewServerControlLoop(&ServerControlLoopOptions{
+		Logger:                        logging.NewNoopLogger(),
+		PID:                           newTestPIDController(t),
+		ResponseTimeCollector:         collector,
+		ResponseTimePercentileWeights: map[string]float64{P95: 1},
+	})
+	assert.Nilf(t, err, "expected NewServerControlLoop(...) has no err; got %v", err)
+
+	c.addResponseTime(120 * time.Second)
+
+	assert.Equal(t, []float64{120}, collector.All())
+}
+
+func TestServerControlLoop_addResponseTime_SeparatesObservabilitySignal(t *testing.T) {
+	collector := responsetimecollector.NewArrayCollector()
+	observabilityCollector := responsetimecollector.NewArrayCollector()
+	c, err := NewServerControlLoop(&ServerControlLoopOptions{
+		Logger:                             logging.NewNoopLogger(),
+		PID:                                newTestPIDController(t),
+		ResponseTimeCollector:              collector,
+		ResponseTimePercentileWeights:      map[string]float64{P95: 1},
+		MaxResponseTime:                    5 * time.Second,
+		ObservabilityResponseTimeCollector: observabilityCollector,
+	})
+	assert.Nilf(t, err, "expected NewServerControlLoop(...) has no err; got %v", err)
+
+	c.addResponseTime(120 * time.Second)
+	c.addObservedResponseTime(1 * time.Second)
+
+	assert.Equal(t, []float64{5}, collector.All())
+	assert.Equal(t, []float64{120, 1}, observabilityCollector.All())
+}
+
+func TestServerControlLoop_worstPathResponseTimeRatio(t *testing.T) {
+	c, err := NewServerControlLoop(&ServerControlLoopOptions{
+		Logger:                        logging.NewNoopLogger(),
+		PID:                           newTestPIDController(t),
+		ResponseTimeCollector:         responsetimecollector.NewArrayCollector(),
+		ResponseTimePercentileWeights: map[string]float64{P50: 1},
+		PathResponseTimeTargets: map[string]*PathResponseTimeTarget{
+			"/fast": {Target: 100 * time.Millisecond, Collector: responsetimecollector.NewArrayCollector()},
+			"slow":  {Target: 2 * time.Second, Collector: responsetimecollector.NewArrayCollector()},
+			"/idle": {Target: time.Millisecond, Collector: responsetimecollector.NewArrayCollector()},
+		},
+	})
+	assert.Nilf(t, err, "expected NewServerControlLoop(...) has no err; got %v", err)
+
+	assert.Equal(t, 0.0, c.worstPathResponseTimeRatio(), "expected 0 without response times")
+
+	c.addPathResponseTime("/fast", 150*time.Millisecond)
+	c.addPathResponseTime("/slow", 1*time.Second)
+	c.addPathResponseTime("/untargeted", 10*time.Second)
+	assert.InDelta(t, 1.5, c.worstPathResponseTimeRatio(), 1e-9)
+
+	c.addPathResponseTime("/slow", 8*time.Second)
+	c.addPathResponseTime("/slow", 8*time.Second)
+	assert.InDelta(t, 4, c.worstPathResponseTimeRatio(), 1e-9)
+}
+
+func TestNewServerControlLoop_RejectsNonPositivePathTarget(t *testing.T) {
+	_, err := NewServerControlLoop(&ServerControlLoopOptions{
+		Logger:                        logging.NewNoopLogger(),
+		PID:                           newTestPIDController(t),
+		ResponseTimeCollector:         responsetimecollector.NewArrayCollector(),
+		ResponseTimePercentileWeights: map[string]float64{P50: 1},
+		PathResponseTimeTargets: map[string]*PathResponseTimeTarget{
+			"/path": {Target: 0, Collector: responsetimecollector.NewArrayCollector()},
+		},
+	})
+	assert.NotNil(t, err, "expected err for non-positive target")
+}
+
+func TestNewServerControlLoop_PercentileWeights(t *testing.T) {
+	tests := []struct {
+		name    string
+		weights map[string]float64
+		wantErr bool
+	}{
+		{name: "Single percentile", weights: map[string]float64{P95: 1}, wantErr: false},
+		{name: "Blend summing to 1", weights: map[string]float64{P50: 0.3, P95: 0.7}, wantErr: false},
+		{name: "Blend summing to 1 with floating point error", weights: map[string]float64{P50: 0.1, P75: 0.2, P95: 0.7}, wantErr: false},
+		{name: "No weights", weights: map[string]float64{}, wantErr: true},
+		{name: "Blend not summing to 1", weights: map[string]float64{P50: 0.3, P95: 0.3}, wantErr: true},
+		{name: "Negative weight", weights: map[string]float64{P50: -0.5, P95: 1.5}, wantErr: true},
+		{name: "Arbitrary percentiles", weights: map[string]float64{"p42": 0.5, "p99.9": 0.5}, wantErr: false},
+		{name: "Percentile of 100", weights: map[string]float64{"p100": 1}, wantErr: true},
+		{name: "Percentile of 0", weights: map[string]float64{"p0": 1}, wantErr: true},
+		{name: "Malformed percentile", weights: map[string]float64{"95": 1}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewServerControlLoop(&ServerControlLoopOptions{
+				Logger:                        logging.NewNoopLogger(),
+				PID:                           newTestPIDController(t),
+				ResponseTimeCollector:         responsetimecollector.NewArrayCollector(),
+				ResponseTimePercentileWeights: tt.weights,
+			})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewServerControlLoop() err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestServerControlLoop_ResizeResponseTimeCollectorWindow(t *testing.T) {
+	recencyWeighted, err := responsetimecollector.NewRecencyWeightedCollector(responsetimecollector.NewTachymeterCollector(100), 2, 0.5)
+	assert.Nilf(t, err, "expected NewRecencyWeightedCollector(...) has no err; got %v", err)
+
+	for _, collector := range []responsetimecollector.Collector{
+		responsetimecollector.NewTachymeterCollector(100),
+		recencyWeighted,
+	} {
+		c, err := NewServerControlLoop(&ServerControlLoopOptions{
+			Logger:                        logging.NewNoopLogger(),
+			PID:                           newTestPIDController(t),
+			ResponseTimeCollector:         collector,
+			ResponseTimePercentileWeights: map[string]float64{P95: 1},
+		})
+		assert.Nilf(t, err, "expected NewServerControlLoop(...) has no err; got %v", err)
+
+		for i := 1; i <= 5; i++ {
+			c.addResponseTime(time.Duration(i) * time.Second)
+		}
+
+		assert.NotNil(t, c.ResizeResponseTimeCollectorWindow(0), "expected err for non-positive size")
+
+		err = c.ResizeResponseTimeCollectorWindow(3)
+		assert.Nilf(t, err, "expected ResizeResponseTimeCollectorWindow(3) has no err; got %v", err)
+		assert.ElementsMatch(t, []float64{3, 4, 5}, c.responseTimeCollector.All())
+		assert.IsType(t, collector, c.responseTimeCollector, "expected resizing retains the collector type")
+
+		c.addResponseTime(6 * time.Second)
+		assert.Len(t, c.responseTimeCollector.All(), 3)
+	}
+}
+
+func TestServerControlLoop_ResizeResponseTimeCollectorWindow_RejectsCollectorsWithoutSampleWindow(t *testing.T) {
+	ewma, err := responsetimecollector.NewEWMACollector(100, 0.5)
+	assert.Nilf(t, err, "expected NewEWMACollector(...) has no err; got %v", err)
+	timeWindowed, err := responsetimecollector.NewTimeWindowedCollector(10 * time.Second)
+	assert.Nilf(t, err, "expected NewTimeWindowedCollector(...) has no err; got %v", err)
+	recencyWeightedEWMA, err := responsetimecollector.NewRecencyWeightedCollector(ewma, 2, 0.5)
+	assert.Nilf(t, err, "expected NewRecencyWeightedCollector(...) has no err; got %v", err)
+
+	for _, collector := range []responsetimecollector.Collector{ewma, timeWindowed, recencyWeightedEWMA} {
+		c, err := NewServerControlLoop(&ServerControlLoopOptions{
+			Logger:                        logging.NewNoopLogger(),
+			PID:                           newTestPIDController(t),
+			ResponseTimeCollector:         collector,
+			ResponseTimePercentileWeights: map[string]float64{P95: 1},
+		})
+		assert.Nilf(t, err, "expected NewServerControlLoop(...) has no err; got %v", err)
+
+		assert.NotNil(t, c.ResizeResponseTimeCollectorWindow(3), "expected err for %T", collector)
+		assert.Same(t, collector, c.responseTimeCollector, "expected collector %T is not replaced", collector)
+	}
+}
+
+func TestServerControlLoop_readDimmingPercentage_Interpolates(t *testing.T) {
+	c, err := NewServerControlLoop(&ServerControlLoopOptions{
+		Logger:                             logging.NewNoopLogger(),
+		PID:                                newTestPIDController(t),
+		ResponseTimeCollector:              responsetimecollector.NewArrayCollector(),
+		ResponseTimePercentileWeights:      map[string]float64{P95: 1},
+		ShouldInterpolateDimmingPercentage: true,
+	})
+	assert.Nilf(t, err, "expected NewServerControlLoop(...) has no err; got %v", err)
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	c.now = func() time.Time { return now }
+
+	c.setDimmingPercentage(40)
+	assert.InDelta(t, 0, c.readDimmingPercentage(), 1e-9)
+
+	now = now.Add(controlLoopInterval / 4)
+	assert.InDelta(t, 10, c.readDimmingPercentage(), 1e-9)
+
+	now = now.Add(controlLoopInterval)
+	assert.InDelta(t, 40, c.readDimmingPercentage(), 1e-9)
+
+	// A new output ramps from the currently exposed percentage.
+	c.setDimmingPercentage(20)
+	now = now.Add(controlLoopInterval / 2)
+	assert.InDelta(t, 30, c.readDimmingPercentage(), 1e-9)
+}
+
+func TestServerControlLoop_IsReady(t *testing.T) {
+	c, err := NewServerControlLoop(&ServerControlLoopOptions{
+		Logger:                        logging.NewNoopLogger(),
+		PID:                           newTestPIDController(t),
+		ResponseTimeCollector:         responsetimecollector.NewArrayCollector(),
+		ResponseTimePercentileWeights: map[string]float64{P95: 1},
+		WarmupPeriod:                  10 * time.Second,
+	})
+	assert.Nilf(t, err, "expected NewServerControlLoop(...) has no err; got %v", err)
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	c.now = func() time.Time { return now }
+
+	assert.False(t, c.IsReady(), "expected not ready before starting")
+
+	c.readinessMux.Lock()
+	c.startedAt = now
+	c.readinessMux.Unlock()
+	assert.False(t, c.IsReady(), "expected not ready during warmup period")
+
+	// No response times have been collected, as a dimmer which is not ready
+	// receives no traffic.
+	now = now.Add(10 * time.Second)
+	assert.True(t, c.IsReady(), "expected ready once warmup period elapses")
+}
+
+func TestServerControlLoop_readDimmingPercentage_StepsWithoutInterpolation(t *testing.T) {
+	c, err := NewServerControlLoop(&ServerControlLoopOptions{
+		Logger:                        logging.NewNoopLogger(),
+		PID:                           newTestPIDController(t),
+		ResponseTimeCollector:         responsetimecollector.NewArrayCollector(),
+		ResponseTimePercentileWeights: map[string]float64{P95: 1},
+	})
+	assert.Nilf(t, err, "expected NewServerControlLoop(...) has no err; got %v", err)
+
+	c.setDimmingPercentage(40)
+	assert.Equal(t, 40.0, c.readDimmingPercentage())
+}
+
+func TestServerControlLoop_Reset_IsAtomicUnderConcurrentTraffic(t *testing.T) {
+	collector := responsetimecollector.NewArrayCollector()
+	observabilityCollector := responsetimecollector.NewArrayCollector()
+	c, err := NewServerControlLoop(&ServerControlLoopOptions{
+		Logger:                             logging.NewNoopLogger(),
+		PID:                                newTestPIDController(t),
+		ResponseTimeCollector:              collector,
+		ResponseTimePercentileWeights:      map[string]float64{P95: 1},
+		ObservabilityResponseTimeCollector: observabilityCollector,
+		PathResponseTimeTargets: map[string]*PathResponseTimeTarget{
+			"/path": {Target: time.Second, Collector: responsetimecollector.NewArrayCollector()},
+		},
+	})
+	assert.Nilf(t, err, "expected NewServerControlLoop(...) has no err; got %v", err)
+	assert.Nil(t, c.Start())
+
+	// Simulate request handlers adding response times and reading the
+	// dimming percentage while the control loop is reset.
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					_ = c.readDimmingPercentage()
+					c.addResponseTime(10 * time.Millisecond)
+					c.addPathResponseTime("/path", 10*time.Millisecond)
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 20; i++ {
+		assert.Nil(t, c.Reset())
+
+		// Each response time is added to both collectors either before or
+		// after the reset, so the collectors never diverge.
+		c.responseTimeCollectorMux.Lock()
+		assert.Equal(t, collector.Len(), observabilityCollector.Len())
+		c.responseTimeCollectorMux.Unlock()
+	}
+
+	close(stop)
+	wg.Wait()
+}
+
+func TestServerControlLoop_StartResetStop_DoesNotLeakGoroutines(t *testing.T) {
+	c, err := NewServerControlLoop(&ServerControlLoopOptions{
+		Logger:                        logging.NewNoopLogger(),
+		PID:                           newTestPIDController(t),
+		ResponseTimeCollector:         responsetimecollector.NewArrayCollector(),
+		ResponseTimePercentileWeights: map[string]float64{P95: 1},
+		TickAlignment:                 time.Hour,
+	})
+	assert.Nilf(t, err, "expected NewServerControlLoop(...) has no err; got %v", err)
+
+	baseline := runtime.NumGoroutine()
+	for i := 0; i < 50; i++ {
+		assert.Nil(t, c.Start())
+		assert.Nil(t, c.Reset())
+		assert.Nil(t, c.Reset())
+		assert.Nil(t, c.Stop())
+	}
+	assert.NotNil(t, c.Stop(), "expected err stopping a stopped control loop")
+	assert.NotNil(t, c.Reset(), "expected err resetting a stopped control loop")
+
+	// Goroutines may take a moment to exit after signalling the wait group.
+	// assert.Eventually is not used as it checks its condition in a new
+	// goroutine.
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > baseline && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	assert.LessOrEqualf(t, runtime.NumGoroutine(), baseline, "expected goroutine count to return to baseline %d", baseline)
+}
+
+func TestDurationUntilAlignedBoundary(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 42, int(250*time.Millisecond), time.UTC)
+
+	assert.Equal(t, 750*time.Millisecond, durationUntilAlignedBoundary(now, time.Second))
+	assert.Equal(t, 17750*time.Millisecond, durationUntilAlignedBoundary(now, time.Minute))
+
+	// A time on a boundary is aligned to the following boundary.
+	assert.Equal(t, time.Minute, durationUntilAlignedBoundary(time.Date(2020, 1, 1, 12, 1, 0, 0, time.UTC), time.Minute))
+}
+
+// collectorRecordingLogger records the response time collector state logged.
+type collectorRecordingLogger struct {
+	logging.Logger
+	count       int
+	utilization float64
+	timeSpan    float64
+}
+
+func (l *collectorRecordingLogger) LogResponseTimeCollector(count int, utilization float64, timeSpan float64) {
+	l.count, l.utilization, l.timeSpan = count, utilization, timeSpan
+}
+
+func TestServerControlLoop_tick_LogsCollectorState(t *testing.T) {
+	logger := &collectorRecordingLogger{Logger: logging.NewNoopLogger()}
+	c, err := NewServerControlLoop(&ServerControlLoopOptions{
+		Logger:                        logger,
+		PID:                           newTestPIDController(t),
+		ResponseTimeCollector:         responsetimecollector.NewTachymeterCollector(4),
+		ResponseTimePercentileWeights: map[string]float64{P95: 1},
+	})
+	assert.Nilf(t, err, "expected NewServerControlLoop(...) has no err; got %v", err)
+
+	c.addResponseTime(100 * time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	c.addResponseTime(100 * time.Millisecond)
+	c.tick()
+
+	assert.Equal(t, 2, logger.count)
+	assert.Equal(t, 0.5, logger.utilization)
+	assert.GreaterOrEqual(t, logger.timeSpan, 0.01)
+}
+
+func TestServerControlLoop_tick_RecordsControlLoopInput(t *testing.T) {
+	c, err := NewServerControlLoop(&ServerControlLoopOptions{
+		Logger:                        logging.NewNoopLogger(),
+		PID:                           newTestPIDController(t),
+		ResponseTimeCollector:         responsetimecollector.NewArrayCollector(),
+		ResponseTimePercentileWeights: map[string]float64{P50: 1},
+	})
+	assert.Nilf(t, err, "expected NewServerControlLoop(...) has no err; got %v", err)
+
+	for i := 1; i <= 100; i++ {
+		c.addResponseTime(time.Duration(i) * time.Millisecond)
+	}
+	c.tick()
+
+	// The input is the configured percentile rather than the P95.
+	_, input := c.readSetpointAndInput()
+	assert.InDelta(t, 0.05, input, 1e-3)
+}
+
+func TestServerControlLoop_weightedResponseTime_ArbitraryPercentiles(t *testing.T) {
+	collector := responsetimecollector.NewArrayCollector()
+	for i := 1; i <= 1000; i++ {
+		collector.Add(time.Duration(i) * time.Millisecond)
+	}
+
+	tests := []struct {
+		name       string
+		percentile string
+		want       float64
+	}{
+		{name: "Standard percentile", percentile: P95, want: 0.95},
+		{name: "Whole percentile", percentile: "p90", want: 0.9},
+		{name: "Fractional percentile", percentile: "p99.9", want: 0.999},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := NewServerControlLoop(&ServerControlLoopOptions{
+				Logger:                        logging.NewNoopLogger(),
+				PID:                           newTestPIDController(t),
+				ResponseTimeCollector:         collector,
+				ResponseTimePercentileWeights: map[string]float64{tt.percentile: 1},
+			})
+			assert.Nilf(t, err, "expected NewServerControlLoop(...) has no err; got %v", err)
+
+			assert.InDelta(t, tt.want, c.weightedResponseTime(collector.Aggregate(), collector), 1e-6)
+		})
+	}
+}
+
+// simulatedClock is advanced manually so PID controllers can be simulated.
+type simulatedClock struct {
+	t time.Time
+}
+
+func (c *simulatedClock) Now() time.Time { return c.t }
+
+func TestServerControlLoop_tick_TiersEscalateDimming(t *testing.T) {
+	clock := &simulatedClock{t: time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)}
+	newPID := func(setpoint float64) *pid.PIDController {
+		c, err := pid.NewPIDController(clock, setpoint, 50, 10, 0, true, 0, 99, 1, true)
+		assert.Nilf(t, err, "expected NewPIDController(...) has no err; got %v", err)
+		return c
+	}
+
+	collector := responsetimecollector.NewArrayCollector()
+	c, err := NewServerControlLoop(&ServerControlLoopOptions{
+		Logger:                        logging.NewNoopLogger(),
+		PID:                           newPID(2),
+		ResponseTimeCollector:         collector,
+		ResponseTimePercentileWeights: map[string]float64{P99: 1},
+		Tiers: []ControlTier{
+			{Percentile: P50, PID: newPID(0.2), Contribution: 0.3},
+		},
+	})
+	assert.Nilf(t, err, "expected NewServerControlLoop(...) has no err; got %v", err)
+
+	// simulate ticks for the given duration, returning the final dimming
+	// percentage.
+	simulate := func(seconds int) float64 {
+		for i := 0; i < seconds; i++ {
+			clock.t = clock.t.Add(time.Second)
+			c.tick()
+		}
+		return c.readDimmingPercentage()
+	}
+
+	// Only the P50 exceeds its setpoint, so the P50 tier dims gently, capped
+	// by its contribution.
+	for i := 0; i < 100; i++ {
+		collector.Add(500 * time.Millisecond)
+	}
+	gentle := simulate(60)
+	assert.Greater(t, gentle, 0.0)
+	assert.LessOrEqual(t, gentle, 0.3*99)
+
+	// Once the P99 also exceeds its setpoint, the primary controller dims
+	// aggressively beyond the P50 tier's cap.
+	for i := 0; i < 10; i++ {
+		collector.Add(10 * time.Second)
+	}
+	aggressive := simulate(60)
+	assert.Greater(t, aggressive, 0.3*99)
+
+	// Once latency recovers, both controllers wind down.
+	collector.Reset()
+	for i := 0; i < 100; i++ {
+		collector.Add(50 * time.Millisecond)
+	}
+	assert.Equal(t, 0.0, simulate(120))
+}
+
+func TestServerControlLoop_tick_PublishesThresholdCrossings(t *testing.T) {
+	clock := &simulatedClock{t: time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)}
+	p, err := pid.NewPIDController(clock, 1, 50, 10, 0, true, 0, 99, 1, true)
+	assert.Nilf(t, err, "expected NewPIDController(...) has no err; got %v", err)
+
+	sink := &recordingEventSink{}
+	collector := responsetimecollector.NewArrayCollector()
+	c, err := NewServerControlLoop(&ServerControlLoopOptions{
+		Logger:                        logging.NewNoopLogger(),
+		PID:                           p,
+		ResponseTimeCollector:         collector,
+		ResponseTimePercentileWeights: map[string]float64{P95: 1},
+		EventSink:                     sink,
+		EventThreshold:                0,
+	})
+	assert.Nilf(t, err, "expected NewServerControlLoop(...) has no err; got %v", err)
+	tick := func() {
+		clock.t = clock.t.Add(time.Second)
+		c.tick()
+	}
+
+	// No event is published while the output remains below the threshold.
+	collector.Add(time.Millisecond)
+	tick()
+	tick()
+	assert.Empty(t, sink.events)
+
+	// Response times above the setpoint of 1s start dimming.
+	collector.Reset()
+	collector.Add(10 * time.Second)
+	tick()
+	tick()
+	if assert.Len(t, sink.events, 1) {
+		assert.Equal(t, logging.EventDimmingThresholdCrossed, sink.events[0].Type)
+		assert.Equal(t, "above", sink.events[0].Attributes["direction"])
+	}
+
+	// Response times below the setpoint stop dimming once the PID output
+	// winds down.
+	collector.Reset()
+	collector.Add(time.Millisecond)
+	for i := 0; i < 100 && len(sink.events) < 2; i++ {
+		tick()
+	}
+	if assert.Len(t, sink.events, 2) {
+		assert.Equal(t, "below", sink.events[1].Attributes["direction"])
+	}
+}
+
+func TestServerControlLoop_tick_PublishesTicks(t *testing.T) {
+	sink := &recordingEventSink{}
+	collector := responsetimecollector.NewArrayCollector()
+	c, err := NewServerControlLoop(&ServerControlLoopOptions{
+		Logger:                        logging.NewNoopLogger(),
+		PID:                           newTestPIDController(t),
+		ResponseTimeCollector:         collector,
+		ResponseTimePercentileWeights: map[string]float64{P95: 1},
+		TickEventSink:                 sink,
+	})
+	assert.Nilf(t, err, "expected NewServerControlLoop(...) has no err; got %v", err)
+
+	collector.Add(time.Second)
+	c.tick()
+	if assert.Len(t, sink.events, 1) {
+		event := sink.events[0]
+		assert.Equal(t, logging.EventControlLoopTicked, event.Type)
+		assert.Equal(t, c.readDimmingPercentage(), event.Attributes["dimmingPercentage"])
+		assert.Equal(t, false, event.Attributes["isHeld"])
+		assert.Equal(t, c.Setpoint(), event.Attributes["setpoint"])
+		assert.Contains(t, event.Attributes, "error")
+	}
+}
+
+func TestServerControlLoop_tick_DimsOnlyDuringSurge(t *testing.T) {
+	detector, err := filters.NewSurgeDetector(filters.SurgeDetectorOptions{
+		Window:               time.Minute,
+		MinRequestsPerSecond: 1,
+	})
+	assert.Nilf(t, err, "expected NewSurgeDetector(...) has no err; got %v", err)
+	collector := responsetimecollector.NewArrayCollector()
+	c, err := NewServerControlLoop(&ServerControlLoopOptions{
+		Logger:                        logging.NewNoopLogger(),
+		PID:                           newTestPIDController(t),
+		ResponseTimeCollector:         collector,
+		ResponseTimePercentileWeights: map[string]float64{P95: 1},
+		SurgeDetector:                 detector,
+	})
+	assert.Nilf(t, err, "expected NewServerControlLoop(...) has no err; got %v", err)
+
+	// Response times far above the setpoint are not dimmed below the surge
+	// threshold. The controller smooths its input, so the response time must
+	// be high enough to exceed the setpoint on the first tick.
+	collector.Add(50 * time.Second)
+	c.recordRequest()
+	c.tick()
+	assert.Equal(t, 0.0, c.readDimmingPercentage())
+
+	for i := 0; i < 60; i++ {
+		c.recordRequest()
+	}
+	c.tick()
+	assert.Greater(t, c.readDimmingPercentage(), 0.0)
+}
+
+func TestNewServerControlLoop_InvalidTiers(t *testing.T) {
+	tests := []struct {
+		name string
+		tier ControlTier
+	}{
+		{name: "Invalid percentile", tier: ControlTier{Percentile: "pmax", PID: newTestPIDController(t), Contribution: 1}},
+		{name: "Nil PID", tier: ControlTier{Percentile: P50, Contribution: 1}},
+		{name: "Zero contribution", tier: ControlTier{Percentile: P50, PID: newTestPIDController(t), Contribution: 0}},
+		{name: "Contribution above 1", tier: ControlTier{Percentile: P50, PID: newTestPIDController(t), Contribution: 1.5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewServerControlLoop(&ServerControlLoopOptions{
+				Logger:                        logging.NewNoopLogger(),
+				PID:                           newTestPIDController(t),
+				ResponseTimeCollector:         responsetimecollector.NewArrayCollector(),
+				ResponseTimePercentileWeights: map[string]float64{P95: 1},
+				Tiers:                         []ControlTier{tt.tier},
+			})
+			assert.NotNil(t, err)
+		})
+	}
+}
+
+func TestServerControlLoop_HoldsWhileBackendUnavailable(t *testing.T) {
+	clock := &simulatedClock{t: time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)}
+	p, err := pid.NewPIDController(clock, 1, 0, 1, 0, true, 0, 1000, 1, true)
+	assert.Nilf(t, err, "expected NewPIDController(...) has no err; got %v", err)
+
+	collector := responsetimecollector.NewArrayCollector()
+	c, err := NewServerControlLoop(&ServerControlLoopOptions{
+		Logger:                        logging.NewNoopLogger(),
+		PID:                           p,
+		ResponseTimeCollector:         collector,
+		ResponseTimePercentileWeights: map[string]float64{P95: 1},
+		BackendUnavailableThreshold:   3,
+	})
+	assert.Nilf(t, err, "expected NewServerControlLoop(...) has no err; got %v", err)
+	tick := func() {
+		clock.t = clock.t.Add(time.Second)
+		c.tick()
+	}
+
+	// Response times above the setpoint of 1s start dimming. The ticks allow
+	// the low-pass filtered input to settle at 20s.
+	c.addResponseTime(20 * time.Second)
+	for i := 0; i < 50; i++ {
+		tick()
+	}
+	held := c.readDimmingPercentage()
+	assert.Greater(t, held, 0.0)
+
+	// Failures below the threshold do not hold the dimming percentage.
+	c.recordBackendAvailability(false)
+	c.recordBackendAvailability(false)
+	c.recordBackendAvailability(true)
+	c.recordBackendAvailability(false)
+	c.recordBackendAvailability(false)
+	assert.False(t, c.isHoldingForBackendRecovery())
+
+	// Once held, the dimming percentage is unchanged and response times are
+	// not collected, even though latency has recovered.
+	c.recordBackendAvailability(false)
+	assert.True(t, c.isHoldingForBackendRecovery())
+	collector.Reset()
+	c.addResponseTime(time.Millisecond)
+	assert.Equal(t, 0, collector.Len())
+	for i := 0; i < 10; i++ {
+		tick()
+	}
+	assert.Equal(t, held, c.readDimmingPercentage())
+
+	// Control resumes once the backend is available. The integral of the
+	// error of about 19s grows over the tick, rather than over the hold.
+	c.recordBackendAvailability(true)
+	assert.False(t, c.isHoldingForBackendRecovery())
+	c.addResponseTime(20 * time.Second)
+	tick()
+	assert.InDelta(t, held+19, c.readDimmingPercentage(), 0.5)
+}
+
+// constantController is a pid.Controller which always outputs the same
+// percentage, standing in for an alternative controller implementation.
+type constantController struct {
+	output  float64
+	inputs  []float64
+	isReset bool
+}
+
+func (c *constantController) Output(input float64) float64 {
+	c.inputs = append(c.inputs, input)
+	return c.output
+}
+
+func (c *constantController) Reset() {
+	c.isReset = true
+}
+
+func TestServerControlLoop_AlternativeController(t *testing.T) {
+	controller := &constantController{output: 42}
+	c, err := NewServerControlLoop(&ServerControlLoopOptions{
+		Logger:                        logging.NewNoopLogger(),
+		PID:                           controller,
+		ResponseTimeCollector:         responsetimecollector.NewArrayCollector(),
+		ResponseTimePercentileWeights: map[string]float64{P50: 1},
+	})
+	assert.Nilf(t, err, "expected NewServerControlLoop(...) has no err; got %v", err)
+
+	c.addResponseTime(2 * time.Second)
+	c.tick()
+	assert.Equal(t, []float64{2}, controller.inputs)
+	assert.Equal(t, 42.0, c.readDimmingPercentage())
+
+	// The setpoint and gains cannot be changed as the controller is not a
+	// pid.TunableController.
+	assert.NotNil(t, c.SetSetpoint(1))
+	assert.NotNil(t, c.SetGains(1, 1, 1))
+	assert.Equal(t, 0.0, c.Setpoint())
+
+	assert.Nil(t, c.Start())
+	assert.Nil(t, c.Reset())
+	assert.Nil(t, c.Stop())
+	assert.True(t, controller.isReset)
+}
+
+func TestNewServerControlLoop_RejectsNilController(t *testing.T) {
+	_, err := NewServerControlLoop(&ServerControlLoopOptions{
+		Logger:                        logging.NewNoopLogger(),
+		ResponseTimeCollector:         responsetimecollector.NewArrayCollector(),
+		ResponseTimePercentileWeights: map[string]float64{P95: 1},
+	})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,42 @@
+package cookies
+
+import "github.com/valyala/fasthttp"
+
+// Attributes are applied consistently to every cookie the dimmer sets, so
+// the dimmer's cookies can satisfy security policies such as requiring
+// SameSite and HttpOnly.
+type Attributes struct {
+	SameSite   fasthttp.CookieSameSite
+	IsSecure   bool
+	IsHTTPOnly bool
+	// Path and Domain are not set on the cookie if empty. Without a Path,
+	// browsers scope the cookie to the directory of the request path.
+	Path   string
+	Domain string
+}
+
+// DefaultAttributes returns attributes suitable for most deployments.
+func DefaultAttributes() Attributes {
+	return Attributes{
+		SameSite:   fasthttp.CookieSameSiteLaxMode,
+		IsHTTPOnly: true,
+		Path:       "/",
+	}
+}
+
+// Apply sets the attributes on cookie.
+func (a Attributes) Apply(cookie *fasthttp.Cookie) {
+	// SetSameSite must be called before SetSecure as SameSite=None also sets
+	// Secure.
+	cookie.SetSameSite(a.SameSite)
+	if a.IsSecure {
+		cookie.SetSecure(true)
+	}
+	cookie.SetHTTPOnly(a.IsHTTPOnly)
+	if a.Path != "" {
+		cookie.SetPath(a.Path)
+	}
+	if a.Domain != "" {
+		cookie.SetDomain(a.Domain)
+	}
+}
@@ -0,0 +1,59 @@
+package cookies
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestAttributes_Apply(t *testing.T) {
+	tests := []struct {
+		name       string
+		attributes Attributes
+		want       []string
+		wantAbsent []string
+	}{
+		{
+			name:       "default",
+			attributes: DefaultAttributes(),
+			want:       []string{"SameSite=Lax", "HttpOnly", "path=/"},
+			wantAbsent: []string{"secure", "domain="},
+		},
+		{
+			name: "secure with domain",
+			attributes: Attributes{
+				SameSite: fasthttp.CookieSameSiteStrictMode,
+				IsSecure: true,
+				Path:     "/shop",
+				Domain:   "example.com",
+			},
+			want:       []string{"SameSite=Strict", "secure", "path=/shop", "domain=example.com"},
+			wantAbsent: []string{"HttpOnly"},
+		},
+		{
+			name:       "SameSite none implies secure",
+			attributes: Attributes{SameSite: fasthttp.CookieSameSiteNoneMode},
+			want:       []string{"SameSite=None", "secure"},
+		},
+	}
+
+	for _, tt := range tests {
+		cookie := &fasthttp.Cookie{}
+		cookie.SetKey("KEY")
+		cookie.SetValue("value")
+		tt.attributes.Apply(cookie)
+		got := cookie.String()
+
+		for _, want := range tt.want {
+			if !strings.Contains(got, want) {
+				t.Errorf("%s: Apply() cookie = %s, want to contain %s", tt.name, got, want)
+			}
+		}
+		for _, wantAbsent := range tt.wantAbsent {
+			if strings.Contains(got, wantAbsent) {
+				t.Errorf("%s: Apply() cookie = %s, want not to contain %s", tt.name, got, wantAbsent)
+			}
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"github.com/kcz17/dimmer/profiling"
+	"github.com/valyala/fasthttp"
+	"math/rand"
+)
+
+// RequestInfo describes a dimmable request to a DimDecider.
+type RequestInfo struct {
+	Path        string
+	Method      string
+	Referer     string
+	DimmingMode DimmingMode
+	Request     *fasthttp.Request
+	// SetResponseCookie sets a cookie on the response whether the request is
+	// dimmed or proxied. Cookies cannot be set on the response directly as
+	// they would be reset during proxying.
+	SetResponseCookie func(cookie *fasthttp.Cookie)
+}
+
+// DimDecider decides whether a request matched by the RequestFilter, or a
+// response matched by Content-Type dimming, should be dimmed, allowing bespoke dimming logic which cannot be expressed using path
+// probabilities. If skipPathProbabilities is false, the decision is further
+// weighted by path probabilities.
+type DimDecider interface {
+	ShouldDim(ctx RequestInfo, pidPercentage float64) (shouldDim bool, skipPathProbabilities bool)
+}
+
+// defaultDimDecider dims requests with a probability of the PID output, or
+// always when offline training. When profiling, sessions have a long-term
+// dimming decision sampled according to their priority.
+type defaultDimDecider struct {
+	isProfilingEnabled     bool
+	profiling              *profiling.Profiler
+	profilingSessionCookie string
+}
+
+func NewDefaultDimDecider(isProfilingEnabled bool, profiler *profiling.Profiler, profilingSessionCookie string) *defaultDimDecider {
+	return &defaultDimDecider{
+		isProfilingEnabled:     isProfilingEnabled,
+		profiling:              profiler,
+		profilingSessionCookie: profilingSessionCookie,
+	}
+}
+
+func (d *defaultDimDecider) ShouldDim(ctx RequestInfo, pidPercentage float64) (bool, bool) {
+	req := ctx.Request
+
+	// If offline training is enabled, we always dim.
+	shouldDim := ctx.DimmingMode == OfflineTraining ||
+		rand.Float64()*100 < pidPercentage
+
+	// Profiled sessions which are dimmed as a result of their priority
+	// will have all optional components uniformly dimmed irrespective
+	// of path probabilities.
+	skipPathProbabilities := false
+
+	// Profiling should only occur when the session cookie is set.
+	if d.isProfilingEnabled && ctx.DimmingMode == DimmingWithProfiling &&
+		len(req.Header.Cookie(d.profilingSessionCookie)) != 0 {
+		if d.profiling.HasDimmingDecisionCookie(req) {
+			// If the session is dimmed as a result of its priority, we
+			// override the dimmer to always dim optional components.
+			skipPathProbabilities = true
+			shouldDim = d.profiling.ReadDimmingDecisionCookie(req)
+		} else if d.profiling.RequestHasTierPriorityCookie(req) {
+			// Sample a long-term dimming decision as the session has a
+			// priority profiled but its dimming decision has not been
+			// made. We use the current PID output to achieve
+			// responsiveness to changes in PID output, even if not
+			// instant due to the cookie expiry time.
+			dimmingDecision := rand.Float64()*100 < pidPercentage*
+				d.profiling.DimmingDecisionProbabilityForPriorityCookie(req)
+
+			// Persist the dimming decision.
+			ctx.SetResponseCookie(d.profiling.CookieForDimmingDecision(dimmingDecision))
+
+			// Actuate the dimming decision for the current request.
+			skipPathProbabilities = dimmingDecision
+			shouldDim = shouldDim || dimmingDecision
+		}
+	}
+
+	return shouldDim, skipPathProbabilities
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/kcz17/dimmer/filters"
+	"github.com/kcz17/dimmer/logging"
+	"github.com/kcz17/dimmer/responsetimecollector"
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+)
+
+func TestDefaultDimDecider_ShouldDim(t *testing.T) {
+	d := NewDefaultDimDecider(false, nil, "")
+	tests := []struct {
+		name          string
+		mode          DimmingMode
+		pidPercentage float64
+		want          bool
+	}{
+		{name: "Always dims when offline training", mode: OfflineTraining, pidPercentage: 0, want: true},
+		{name: "Dims at 100% PID output", mode: Dimming, pidPercentage: 100, want: true},
+		{name: "Does not dim at 0% PID output", mode: Dimming, pidPercentage: 0, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shouldDim, skipPathProbabilities := d.ShouldDim(RequestInfo{
+				Path:        "/path",
+				Method:      http.MethodGet,
+				DimmingMode: tt.mode,
+				Request:     &fasthttp.Request{},
+			}, tt.pidPercentage)
+			assert.Equal(t, tt.want, shouldDim)
+			assert.False(t, skipPathProbabilities, "expected path probabilities to apply without profiling")
+		})
+	}
+}
+
+// alwaysDimDecider dims every request, recording the requests it was asked
+// about.
+type alwaysDimDecider struct {
+	paths []string
+}
+
+func (d *alwaysDimDecider) ShouldDim(ctx RequestInfo, _ float64) (bool, bool) {
+	d.paths = append(d.paths, ctx.Path)
+	return true, true
+}
+
+func TestServer_requestHandler_ConsultsCustomDimDecider(t *testing.T) {
+	controlLoop, err := NewServerControlLoop(&ServerControlLoopOptions{
+		Logger:                        logging.NewNoopLogger(),
+		PID:                           newTestPIDController(t),
+		ResponseTimeCollector:         responsetimecollector.NewArrayCollector(),
+		ResponseTimePercentileWeights: map[string]float64{P95: 1},
+	})
+	assert.Nilf(t, err, "expected NewServerControlLoop(...) has no err; got %v", err)
+	pathProbabilities, err := filters.NewPathProbabilities(0)
+	assert.Nilf(t, err, "expected NewPathProbabilities(...) has no err; got %v", err)
+	requestFilter := filters.NewRequestFilter(filters.FilterModeAllowlist, 0)
+	requestFilter.AddPath("/path", http.MethodGet)
+
+	decider := &alwaysDimDecider{}
+	s := NewServer(&ServerOptions{
+		ControlLoop:       controlLoop,
+		RequestFilter:     requestFilter,
+		PathProbabilities: pathProbabilities,
+		IsDimmingEnabled:  true,
+		DimDecider:        decider,
+	})
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.Header.SetMethod(http.MethodGet)
+	ctx.Request.SetRequestURI("/path")
+	s.requestHandler()(ctx)
+
+	// Path probabilities of 0 would otherwise prevent dimming.
+	assert.Equal(t, http.StatusTooManyRequests, ctx.Response.StatusCode())
+	assert.Equal(t, []string{"/path"}, decider.paths)
+}
@@ -0,0 +1,76 @@
+package filters
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ClientIPResolver resolves the IP of the client which sent a request. If the
+// request was received from a trusted proxy such as a load balancer, the
+// client IP is taken from the X-Forwarded-For header instead, as the remote IP
+// is then that of the proxy. X-Forwarded-For is otherwise ignored as it can be
+// set arbitrarily by clients.
+type ClientIPResolver struct {
+	trustedProxies []*net.IPNet
+}
+
+// NewClientIPResolver parses trustedProxies as CIDRs, e.g. "10.0.0.0/8", or
+// single IPs.
+func NewClientIPResolver(trustedProxies []string) (*ClientIPResolver, error) {
+	r := &ClientIPResolver{}
+	for _, trustedProxy := range trustedProxies {
+		proxy := trustedProxy
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+
+		_, ipNet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("NewClientIPResolver() expected trusted proxy to be a CIDR or IP; got %s", trustedProxy))
+		}
+		r.trustedProxies = append(r.trustedProxies, ipNet)
+	}
+	return r, nil
+}
+
+// Resolve returns the client IP for a request with the given remote IP and
+// X-Forwarded-For header. Proxies append the IP they received a request from
+// to X-Forwarded-For, so the header is walked from right to left and the first
+// IP which is not a trusted proxy is the client IP.
+func (r *ClientIPResolver) Resolve(remoteIP net.IP, xForwardedFor string) string {
+	if !r.isTrusted(remoteIP) || xForwardedFor == "" {
+		return remoteIP.String()
+	}
+
+	ips := strings.Split(xForwardedFor, ",")
+	clientIP := remoteIP
+	for i := len(ips) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(ips[i]))
+		// A malformed entry cannot be attributed, so the last trusted hop is
+		// used instead.
+		if ip == nil {
+			break
+		}
+
+		clientIP = ip
+		if !r.isTrusted(ip) {
+			break
+		}
+	}
+	return clientIP.String()
+}
+
+func (r *ClientIPResolver) isTrusted(ip net.IP) bool {
+	for _, ipNet := range r.trustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
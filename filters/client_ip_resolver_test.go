@@ -0,0 +1,43 @@
+package filters
+
+import (
+	"net"
+	"testing"
+)
+
+func TestClientIPResolver_Resolve(t *testing.T) {
+	r, err := NewClientIPResolver([]string{"10.0.0.0/8", "192.168.1.1"})
+	if err != nil {
+		t.Fatalf("expected NewClientIPResolver() returns nil err; got err = %v", err)
+	}
+
+	tests := []struct {
+		name          string
+		remoteIP      string
+		xForwardedFor string
+		want          string
+	}{
+		{name: "Untrusted remote without header", remoteIP: "1.2.3.4", want: "1.2.3.4"},
+		{name: "Untrusted remote ignores spoofed header", remoteIP: "1.2.3.4", xForwardedFor: "5.6.7.8", want: "1.2.3.4"},
+		{name: "Trusted remote without header", remoteIP: "10.0.0.1", want: "10.0.0.1"},
+		{name: "Trusted remote uses header", remoteIP: "10.0.0.1", xForwardedFor: "5.6.7.8", want: "5.6.7.8"},
+		{name: "Trusted single IP uses header", remoteIP: "192.168.1.1", xForwardedFor: "5.6.7.8", want: "5.6.7.8"},
+		{name: "Skips trusted hops", remoteIP: "10.0.0.1", xForwardedFor: "5.6.7.8, 10.0.0.2", want: "5.6.7.8"},
+		{name: "Ignores spoofed entries left of client", remoteIP: "10.0.0.1", xForwardedFor: "9.9.9.9, 5.6.7.8", want: "5.6.7.8"},
+		{name: "All hops trusted", remoteIP: "10.0.0.1", xForwardedFor: "10.0.0.3, 10.0.0.2", want: "10.0.0.3"},
+		{name: "Malformed entry", remoteIP: "10.0.0.1", xForwardedFor: "5.6.7.8, garbage", want: "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := r.Resolve(net.ParseIP(tt.remoteIP), tt.xForwardedFor); got != tt.want {
+				t.Errorf("Resolve() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewClientIPResolver_InvalidTrustedProxy(t *testing.T) {
+	if _, err := NewClientIPResolver([]string{"garbage"}); err == nil {
+		t.Errorf("expected err for invalid trusted proxy; got nil")
+	}
+}
@@ -0,0 +1,55 @@
+package filters
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ConcurrencyLimiter caps the number of concurrent requests for each key, such
+// as a client IP, so a single client cannot monopolise the proxy.
+type ConcurrencyLimiter struct {
+	maxConcurrent int
+	// inFlight counts concurrent requests per key. Keys are removed once they
+	// have no requests in flight so inFlight does not grow unboundedly.
+	inFlight map[string]int
+	// mux guards inFlight.
+	mux *sync.Mutex
+}
+
+func NewConcurrencyLimiter(maxConcurrent int) (*ConcurrencyLimiter, error) {
+	if maxConcurrent < 1 {
+		return nil, errors.New(fmt.Sprintf("NewConcurrencyLimiter() expected maxConcurrent >= 1; got maxConcurrent = %d", maxConcurrent))
+	}
+
+	return &ConcurrencyLimiter{
+		maxConcurrent: maxConcurrent,
+		inFlight:      map[string]int{},
+		mux:           &sync.Mutex{},
+	}, nil
+}
+
+// Acquire returns true if a request for key is within the limit, in which case
+// Release must be called for key once the request completes.
+func (l *ConcurrencyLimiter) Acquire(key string) bool {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	if l.inFlight[key] >= l.maxConcurrent {
+		return false
+	}
+	l.inFlight[key]++
+	return true
+}
+
+// Release marks a request acquired for key as complete.
+func (l *ConcurrencyLimiter) Release(key string) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	if l.inFlight[key] <= 1 {
+		delete(l.inFlight, key)
+		return
+	}
+	l.inFlight[key]--
+}
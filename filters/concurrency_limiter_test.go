@@ -0,0 +1,38 @@
+package filters
+
+import "testing"
+
+func TestConcurrencyLimiter_AcquireRelease(t *testing.T) {
+	l, err := NewConcurrencyLimiter(2)
+	if err != nil {
+		t.Fatalf("expected NewConcurrencyLimiter() returns nil err; got err = %v", err)
+	}
+
+	if !l.Acquire("a") || !l.Acquire("a") {
+		t.Errorf("expected requests within limit to be acquired")
+	}
+	if l.Acquire("a") {
+		t.Errorf("expected request exceeding limit not to be acquired")
+	}
+	if !l.Acquire("b") {
+		t.Errorf("expected limit to be tracked per key")
+	}
+
+	l.Release("a")
+	if !l.Acquire("a") {
+		t.Errorf("expected request to be acquired once another is released")
+	}
+
+	l.Release("a")
+	l.Release("a")
+	l.Release("b")
+	if len(l.inFlight) != 0 {
+		t.Errorf("expected keys without requests in flight to be removed; got %v", l.inFlight)
+	}
+}
+
+func TestNewConcurrencyLimiter_InvalidArguments(t *testing.T) {
+	if _, err := NewConcurrencyLimiter(0); err == nil {
+		t.Errorf("expected err for maxConcurrent = 0; got nil")
+	}
+}
@@ -0,0 +1,37 @@
+package filters
+
+import "strings"
+
+// ContentTypeFilter checks whether a response Content-Type matches any of a
+// set of prefixes, e.g. "image/" matches "image/png". Unlike RequestFilter,
+// ContentTypeFilter can only be evaluated once a response has been proxied.
+type ContentTypeFilter struct {
+	// prefixes are lowercase Content-Type prefixes, as media types are
+	// case-insensitive.
+	prefixes []string
+}
+
+func NewContentTypeFilter(prefixes []string) *ContentTypeFilter {
+	lowercasePrefixes := make([]string, len(prefixes))
+	for i, prefix := range prefixes {
+		lowercasePrefixes[i] = strings.ToLower(strings.TrimSpace(prefix))
+	}
+
+	return &ContentTypeFilter{prefixes: lowercasePrefixes}
+}
+
+// Matches returns true if the media type of contentType begins with any of
+// the filter's prefixes. Parameters such as charset are ignored.
+func (f *ContentTypeFilter) Matches(contentType string) bool {
+	if i := strings.IndexByte(contentType, ';'); i != -1 {
+		contentType = contentType[:i]
+	}
+	contentType = strings.ToLower(strings.TrimSpace(contentType))
+
+	for _, prefix := range f.prefixes {
+		if prefix != "" && strings.HasPrefix(contentType, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,60 @@
+package filters
+
+import "testing"
+
+func TestContentTypeFilter_Matches(t *testing.T) {
+	type args struct {
+		contentType string
+	}
+	tests := []struct {
+		name     string
+		prefixes []string
+		args     args
+		want     bool
+	}{
+		{
+			name:     "Matches prefix",
+			prefixes: []string{"image/"},
+			args:     args{contentType: "image/png"},
+			want:     true,
+		},
+		{
+			name:     "Matches prefix ignoring parameters",
+			prefixes: []string{"text/html"},
+			args:     args{contentType: "text/html; charset=utf-8"},
+			want:     true,
+		},
+		{
+			name:     "Matches prefix case-insensitively",
+			prefixes: []string{"Image/"},
+			args:     args{contentType: "IMAGE/JPEG"},
+			want:     true,
+		},
+		{
+			name:     "Does not match other content type",
+			prefixes: []string{"image/"},
+			args:     args{contentType: "application/json"},
+			want:     false,
+		},
+		{
+			name:     "Does not match with no prefixes",
+			prefixes: nil,
+			args:     args{contentType: "image/png"},
+			want:     false,
+		},
+		{
+			name:     "Does not match empty prefix",
+			prefixes: []string{""},
+			args:     args{contentType: "image/png"},
+			want:     false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := NewContentTypeFilter(tt.prefixes)
+			if got := f.Matches(tt.args.contentType); got != tt.want {
+				t.Errorf("Matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package filters
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// dimmedRateBuckets is the number of buckets each path's window is divided
+// into. Counts roll out of the window a bucket at a time, so the window
+// effectively spans between window * (1 - 1/dimmedRateBuckets) and window.
+const dimmedRateBuckets = 10
+
+// DimmedRateCaps caps the fraction of a path's requests which are dimmed
+// within a rolling window, regardless of the dimming percentage, e.g. to
+// guarantee a revenue-critical component is never dimmed for more than 5% of
+// its requests. It is a business-level guardrail layered on top of the
+// statistical dimming decision.
+//
+// All requests to a capped path are recorded with AddRequest. TryDim refuses a
+// dim once it would take the dimmed rate within the window above the cap, and
+// otherwise records it, so the cap is never exceeded. Paths are insensitive of
+// their leading slash, using the same approach as RequestFilter.
+type DimmedRateCaps struct {
+	// bucketDuration is the window divided into dimmedRateBuckets.
+	bucketDuration time.Duration
+	// rates is a map from a path to its cap and counts. Paths are inserted
+	// with and without their leading slash, sharing the same dimmedRate.
+	rates map[string]*dimmedRate
+	// ratesMux guards rates from concurrent reads and writes.
+	ratesMux *sync.RWMutex
+	// now allows time to be controlled in tests.
+	now func() time.Time
+}
+
+// dimmedRate counts the requests and dims of a path in a ring of buckets
+// spanning the window. current is the index of the bucket starting at
+// bucketStart.
+type dimmedRate struct {
+	maxRate     float64
+	requests    [dimmedRateBuckets]int
+	dimmed      [dimmedRateBuckets]int
+	current     int
+	bucketStart time.Time
+	// mux guards all fields other than maxRate.
+	mux *sync.Mutex
+}
+
+func NewDimmedRateCaps(window time.Duration) (*DimmedRateCaps, error) {
+	if window/dimmedRateBuckets <= 0 {
+		return nil, errors.New(fmt.Sprintf("NewDimmedRateCaps() expected window of at least %dns; got window = %v", dimmedRateBuckets, window))
+	}
+
+	return &DimmedRateCaps{
+		bucketDuration: window / dimmedRateBuckets,
+		rates:          map[string]*dimmedRate{},
+		ratesMux:       &sync.RWMutex{},
+		now:            time.Now,
+	}, nil
+}
+
+// SetCap caps the fraction of the path's requests dimmed within the window to
+// maxRate, resetting the path's counts.
+func (c *DimmedRateCaps) SetCap(path string, maxRate float64) error {
+	if !(maxRate >= 0 && maxRate <= 1) {
+		return errors.New(fmt.Sprintf("DimmedRateCaps.SetCap() expected maxRate in [0, 1]; got maxRate = %v", maxRate))
+	}
+
+	rate := &dimmedRate{maxRate: maxRate, mux: &sync.Mutex{}}
+	path = prependLeadingSlashIfMissing(path)
+	c.ratesMux.Lock()
+	c.rates[path] = rate
+	c.rates[path[1:]] = rate
+	c.ratesMux.Unlock()
+	return nil
+}
+
+// AddRequest records a request to the path, whether or not it is dimmed.
+// Requests to paths without a cap are ignored.
+func (c *DimmedRateCaps) AddRequest(path string) {
+	rate := c.rateOf(path)
+	if rate == nil {
+		return
+	}
+
+	rate.mux.Lock()
+	rate.advance(c.now(), c.bucketDuration)
+	rate.requests[rate.current]++
+	rate.mux.Unlock()
+}
+
+// TryDim returns true and records a dim of the path if the path can be dimmed
+// without the dimmed rate within the window exceeding its cap. The check and
+// the record are made under the same lock, so concurrent requests cannot all
+// pass the check before any dim is recorded, and buckets cannot roll out of
+// the window between them. The request must already have been recorded with
+// AddRequest. Paths without a cap are always allowed, and their dims are not
+// recorded.
+func (c *DimmedRateCaps) TryDim(path string) bool {
+	rate := c.rateOf(path)
+	if rate == nil {
+		return true
+	}
+
+	rate.mux.Lock()
+	defer rate.mux.Unlock()
+
+	rate.advance(c.now(), c.bucketDuration)
+	var requests, dimmed int
+	for i := 0; i < dimmedRateBuckets; i++ {
+		requests += rate.requests[i]
+		dimmed += rate.dimmed[i]
+	}
+	if float64(dimmed+1) > rate.maxRate*float64(requests) {
+		return false
+	}
+	rate.dimmed[rate.current]++
+	return true
+}
+
+// rateOf returns the dimmedRate of the path, or nil if it has no cap.
+func (c *DimmedRateCaps) rateOf(path string) *dimmedRate {
+	c.ratesMux.RLock()
+	defer c.ratesMux.RUnlock()
+	return c.rates[path]
+}
+
+// advance clears the buckets which have rolled out of the window by now, so
+// the current bucket contains now. The caller must hold mux.
+func (r *dimmedRate) advance(now time.Time, bucketDuration time.Duration) {
+	if r.bucketStart.IsZero() {
+		r.bucketStart = now
+		return
+	}
+
+	elapsed := now.Sub(r.bucketStart) / bucketDuration
+	if elapsed <= 0 {
+		return
+	}
+	r.bucketStart = r.bucketStart.Add(elapsed * bucketDuration)
+
+	// Buckets are only cleared once each, even if the whole window elapsed.
+	if elapsed > dimmedRateBuckets {
+		elapsed = dimmedRateBuckets
+	}
+	for i := 0; i < int(elapsed); i++ {
+		r.current = (r.current + 1) % dimmedRateBuckets
+		r.requests[r.current] = 0
+		r.dimmed[r.current] = 0
+	}
+}
@@ -0,0 +1,139 @@
+package filters
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestDimmedRateCaps(t *testing.T, now *time.Time) *DimmedRateCaps {
+	c, err := NewDimmedRateCaps(10 * time.Second)
+	if err != nil {
+		t.Fatalf("expected NewDimmedRateCaps() returns nil err; got err = %v", err)
+	}
+	c.now = func() time.Time { return *now }
+	return c
+}
+
+// dimWhereAllowed records requests to path, dimming each which is allowed,
+// and returns the number dimmed.
+func dimWhereAllowed(c *DimmedRateCaps, path string, requests int) int {
+	dimmed := 0
+	for i := 0; i < requests; i++ {
+		c.AddRequest(path)
+		if c.TryDim(path) {
+			dimmed++
+		}
+	}
+	return dimmed
+}
+
+func TestDimmedRateCaps_CapsDimmedRate(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	c := newTestDimmedRateCaps(t, &now)
+	if err := c.SetCap("checkout", 0.1); err != nil {
+		t.Fatalf("SetCap() expected nil err; got err = %v", err)
+	}
+
+	if got := dimWhereAllowed(c, "/checkout", 100); got != 10 {
+		t.Errorf("expected 10 of 100 requests dimmed; got %d", got)
+	}
+	// Uncapped paths are always allowed.
+	if got := dimWhereAllowed(c, "/catalogue", 100); got != 100 {
+		t.Errorf("expected all requests to an uncapped path dimmed; got %d", got)
+	}
+}
+
+func TestDimmedRateCaps_ZeroCap(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	c := newTestDimmedRateCaps(t, &now)
+	if err := c.SetCap("/checkout", 0); err != nil {
+		t.Fatalf("SetCap() expected nil err; got err = %v", err)
+	}
+
+	if got := dimWhereAllowed(c, "/checkout", 100); got != 0 {
+		t.Errorf("expected no requests dimmed; got %d", got)
+	}
+}
+
+func TestDimmedRateCaps_WindowRolls(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	c := newTestDimmedRateCaps(t, &now)
+	if err := c.SetCap("/checkout", 0.5); err != nil {
+		t.Fatalf("SetCap() expected nil err; got err = %v", err)
+	}
+
+	// Dims within the window count towards the cap, even if the requests
+	// which allowed them were earlier in the window.
+	c.AddRequest("/checkout")
+	c.AddRequest("/checkout")
+	if !c.TryDim("/checkout") {
+		t.Fatalf("TryDim() expected dim allowed within the cap; got not allowed")
+	}
+	now = now.Add(5 * time.Second)
+	if got := dimWhereAllowed(c, "/checkout", 2); got != 1 {
+		t.Errorf("expected 1 of 2 requests dimmed within the window; got %d", got)
+	}
+
+	// Once the first requests roll out of the window, only the later
+	// requests and dims remain.
+	now = now.Add(6 * time.Second)
+	c.AddRequest("/checkout")
+	c.AddRequest("/checkout")
+	if !c.TryDim("/checkout") {
+		t.Errorf("TryDim() expected dim allowed once earlier dims roll out of the window; got not allowed")
+	}
+
+	// Once the whole window elapses, no requests remain.
+	now = now.Add(time.Minute)
+	if c.TryDim("/checkout") {
+		t.Errorf("TryDim() expected dim not allowed without requests in the window; got allowed")
+	}
+}
+
+func TestDimmedRateCaps_TryDim_ConcurrentRequestsNeverExceedCap(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	c := newTestDimmedRateCaps(t, &now)
+	if err := c.SetCap("/checkout", 0.1); err != nil {
+		t.Fatalf("SetCap() expected nil err; got err = %v", err)
+	}
+
+	// All requests are recorded before any dim is attempted, so concurrent
+	// attempts race for the same headroom.
+	const requests = 1000
+	for i := 0; i < requests; i++ {
+		c.AddRequest("/checkout")
+	}
+
+	var dimmed int64
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if c.TryDim("/checkout") {
+				atomic.AddInt64(&dimmed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if dimmed != 100 {
+		t.Errorf("expected exactly 100 of %d concurrent requests dimmed with a cap of 0.1; got %d", requests, dimmed)
+	}
+}
+
+func TestDimmedRateCaps_InvalidArguments(t *testing.T) {
+	if _, err := NewDimmedRateCaps(0); err == nil {
+		t.Errorf("NewDimmedRateCaps() expected err for zero window; got nil")
+	}
+
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	c := newTestDimmedRateCaps(t, &now)
+	for _, maxRate := range []float64{-0.1, 1.1} {
+		if err := c.SetCap("/checkout", maxRate); err == nil {
+			t.Errorf("SetCap() expected err for maxRate = %v; got nil", maxRate)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package filters
+
+import (
+	"errors"
+	"fmt"
+)
+
+// DimmedResponse is the response returned in place of a dimmed component.
+type DimmedResponse struct {
+	StatusCode int
+	Body       string
+	// ContentType is not set on the response if empty.
+	ContentType string
+}
+
+// DimmedResponses stores per-path dimmed responses, so that, for example, a
+// JSON list endpoint can return 200 with [] and silently render empty rather
+// than return an error which the frontend surfaces to the user. Get is
+// insensitive of a path's leading slash. DimmedResponses is immutable so it
+// can be read concurrently by requests.
+type DimmedResponses struct {
+	// responses maps paths with a leading slash to their responses.
+	responses map[string]DimmedResponse
+	// defaultResponse is returned for paths without a response.
+	defaultResponse DimmedResponse
+}
+
+func NewDimmedResponses(defaultResponse DimmedResponse, responses map[string]DimmedResponse) (*DimmedResponses, error) {
+	if err := validateDimmedResponse(defaultResponse); err != nil {
+		return nil, fmt.Errorf("NewDimmedResponses() expected valid default response: %w", err)
+	}
+
+	r := &DimmedResponses{
+		responses:       make(map[string]DimmedResponse, len(responses)),
+		defaultResponse: defaultResponse,
+	}
+	for path, response := range responses {
+		if err := validateDimmedResponse(response); err != nil {
+			return nil, fmt.Errorf("NewDimmedResponses() expected valid response for path %s: %w", path, err)
+		}
+		r.responses[prependLeadingSlashIfMissing(path)] = response
+	}
+	return r, nil
+}
+
+func validateDimmedResponse(response DimmedResponse) error {
+	if response.StatusCode < 200 || response.StatusCode > 599 {
+		return errors.New(fmt.Sprintf("expected status code between 200 and 599; got %d", response.StatusCode))
+	}
+	return nil
+}
+
+// Get returns the dimmed response for path, or the default response if path
+// has none.
+func (r *DimmedResponses) Get(path string) DimmedResponse {
+	response, exists := r.Lookup(path)
+	if !exists {
+		return r.defaultResponse
+	}
+	return response
+}
+
+// Lookup returns the dimmed response for path, or false if path has none.
+func (r *DimmedResponses) Lookup(path string) (DimmedResponse, bool) {
+	response, exists := r.responses[prependLeadingSlashIfMissing(path)]
+	return response, exists
+}
@@ -0,0 +1,33 @@
+package filters
+
+import "testing"
+
+func TestDimmedResponses_Get(t *testing.T) {
+	defaultResponse := DimmedResponse{StatusCode: 429, Body: "Dimming!"}
+	listResponse := DimmedResponse{StatusCode: 200, Body: "[]", ContentType: "application/json"}
+	r, err := NewDimmedResponses(defaultResponse, map[string]DimmedResponse{"recommendations": listResponse})
+	if err != nil {
+		t.Fatalf("expected NewDimmedResponses() returns nil err; got err = %v", err)
+	}
+
+	tests := []struct {
+		path string
+		want DimmedResponse
+	}{
+		{path: "/recommendations", want: listResponse},
+		{path: "recommendations", want: listResponse},
+		{path: "/other", want: defaultResponse},
+	}
+	for _, tt := range tests {
+		if got := r.Get(tt.path); got != tt.want {
+			t.Errorf("Get(%s) = %+v, want %+v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestNewDimmedResponses_InvalidStatusCode(t *testing.T) {
+	defaultResponse := DimmedResponse{StatusCode: 429, Body: "Dimming!"}
+	if _, err := NewDimmedResponses(defaultResponse, map[string]DimmedResponse{"/path": {StatusCode: 100}}); err == nil {
+		t.Errorf("expected err for status code 100; got nil")
+	}
+}
@@ -0,0 +1,114 @@
+package filters
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DimmingBudget caps how many distinct component categories can be dimmed for
+// a single session within a window, e.g. a page load. This coordinates
+// otherwise-independent per-request dimming decisions so a page is not
+// rendered with every optional component dimmed at once.
+//
+// Paths are mapped to categories insensitive of their leading slash, using the
+// same approach as RequestFilter. Paths without a category are their own
+// category.
+type DimmingBudget struct {
+	// maxCategories is the number of distinct categories which can be dimmed
+	// per session within window.
+	maxCategories int
+	window        time.Duration
+	// categories is a map from a path to a category. Paths are inserted with
+	// and without their leading slash.
+	categories map[string]string
+	// sessions tracks the categories dimmed for each session within the
+	// current window.
+	sessions map[string]*sessionBudget
+	// lastSweep is used to periodically remove expired sessions so sessions
+	// does not grow unboundedly.
+	lastSweep time.Time
+	// mux guards categories, sessions and lastSweep.
+	mux *sync.Mutex
+	// now allows time to be controlled in tests.
+	now func() time.Time
+}
+
+type sessionBudget struct {
+	windowStart time.Time
+	categories  map[string]bool
+}
+
+func NewDimmingBudget(maxCategories int, window time.Duration) (*DimmingBudget, error) {
+	if maxCategories < 1 {
+		return nil, errors.New(fmt.Sprintf("NewDimmingBudget() expected maxCategories >= 1; got maxCategories = %d", maxCategories))
+	}
+	if window <= 0 {
+		return nil, errors.New(fmt.Sprintf("NewDimmingBudget() expected positive window; got window = %v", window))
+	}
+
+	return &DimmingBudget{
+		maxCategories: maxCategories,
+		window:        window,
+		categories:    map[string]string{},
+		sessions:      map[string]*sessionBudget{},
+		mux:           &sync.Mutex{},
+		now:           time.Now,
+	}, nil
+}
+
+// SetCategory assigns a path to a category.
+func (b *DimmingBudget) SetCategory(path string, category string) {
+	path = prependLeadingSlashIfMissing(path)
+	b.mux.Lock()
+	b.categories[path] = category
+	b.categories[path[1:]] = category
+	b.mux.Unlock()
+}
+
+// Allow returns true if dimming path for sessionID stays within the budget,
+// recording the path's category as dimmed if so. Categories already dimmed
+// within the window can always be dimmed again.
+func (b *DimmingBudget) Allow(sessionID string, path string) bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	now := b.now()
+	b.sweepExpiredSessions(now)
+
+	category, exists := b.categories[path]
+	if !exists {
+		category = prependLeadingSlashIfMissing(path)
+	}
+
+	session, exists := b.sessions[sessionID]
+	if !exists || now.Sub(session.windowStart) >= b.window {
+		session = &sessionBudget{windowStart: now, categories: map[string]bool{}}
+		b.sessions[sessionID] = session
+	}
+
+	if session.categories[category] {
+		return true
+	}
+	if len(session.categories) >= b.maxCategories {
+		return false
+	}
+	session.categories[category] = true
+	return true
+}
+
+// sweepExpiredSessions removes sessions whose window has elapsed at most once
+// per window. The caller must hold mux.
+func (b *DimmingBudget) sweepExpiredSessions(now time.Time) {
+	if now.Sub(b.lastSweep) < b.window {
+		return
+	}
+
+	for sessionID, session := range b.sessions {
+		if now.Sub(session.windowStart) >= b.window {
+			delete(b.sessions, sessionID)
+		}
+	}
+	b.lastSweep = now
+}
@@ -0,0 +1,51 @@
+package filters
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDimmingBudget_Allow(t *testing.T) {
+	b, err := NewDimmingBudget(2, 10*time.Second)
+	if err != nil {
+		t.Fatalf("expected NewDimmingBudget() returns nil err; got err = %v", err)
+	}
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	b.now = func() time.Time { return now }
+
+	b.SetCategory("/images/a", "images")
+	b.SetCategory("images/b", "images")
+
+	if !b.Allow("session", "/images/a") {
+		t.Errorf("expected first category to be allowed")
+	}
+	if !b.Allow("session", "/images/b") {
+		t.Errorf("expected path in an already dimmed category to be allowed")
+	}
+	if !b.Allow("session", "reviews") {
+		t.Errorf("expected second category to be allowed")
+	}
+	if !b.Allow("session", "/reviews") {
+		t.Errorf("expected uncategorised path to be insensitive of leading slash")
+	}
+	if b.Allow("session", "/recommendations") {
+		t.Errorf("expected third category to exceed budget")
+	}
+	if !b.Allow("other session", "/recommendations") {
+		t.Errorf("expected budget to be tracked per session")
+	}
+
+	now = now.Add(10 * time.Second)
+	if !b.Allow("session", "/recommendations") {
+		t.Errorf("expected budget to reset once window elapses")
+	}
+}
+
+func TestNewDimmingBudget_InvalidArguments(t *testing.T) {
+	if _, err := NewDimmingBudget(0, time.Second); err == nil {
+		t.Errorf("expected err for maxCategories = 0; got nil")
+	}
+	if _, err := NewDimmingBudget(1, 0); err == nil {
+		t.Errorf("expected err for window = 0; got nil")
+	}
+}
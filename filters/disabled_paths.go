@@ -0,0 +1,65 @@
+package filters
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// DisabledPaths is the set of paths whose dimming has been disabled at
+// runtime, e.g. if dimming is found to break a component during an incident.
+// It is kept separate from PathProbabilities so that disabling a path is not
+// undone when probabilities are overwritten by online training or the API.
+//
+// Paths are matched insensitive of their leading slash, using the same
+// approach as PathProbabilities.
+type DisabledPaths struct {
+	// paths is a set of paths with a leading slash.
+	paths map[string]bool
+	// mux guards paths.
+	mux *sync.RWMutex
+}
+
+func NewDisabledPaths() *DisabledPaths {
+	return &DisabledPaths{
+		paths: map[string]bool{},
+		mux:   &sync.RWMutex{},
+	}
+}
+
+// Disable adds path to the set, returning an error if it is already disabled.
+func (d *DisabledPaths) Disable(path string) error {
+	path = prependLeadingSlashIfMissing(path)
+
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	if d.paths[path] {
+		return errors.New(fmt.Sprintf("DisabledPaths.Disable() expected path %s to be enabled; path already disabled", path))
+	}
+	d.paths[path] = true
+	return nil
+}
+
+// Enable removes path from the set, returning an error if it is not disabled.
+func (d *DisabledPaths) Enable(path string) error {
+	path = prependLeadingSlashIfMissing(path)
+
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	if !d.paths[path] {
+		return errors.New(fmt.Sprintf("DisabledPaths.Enable() expected path %s to be disabled; path not disabled", path))
+	}
+	delete(d.paths, path)
+	return nil
+}
+
+// Contains returns true if dimming is disabled for path.
+func (d *DisabledPaths) Contains(path string) bool {
+	path = prependLeadingSlashIfMissing(path)
+
+	d.mux.RLock()
+	defer d.mux.RUnlock()
+	return d.paths[path]
+}
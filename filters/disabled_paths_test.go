@@ -0,0 +1,30 @@
+package filters
+
+import "testing"
+
+func TestDisabledPaths(t *testing.T) {
+	d := NewDisabledPaths()
+	if d.Contains("/catalogue") {
+		t.Errorf("expected Contains() = false before Disable()")
+	}
+
+	if err := d.Disable("catalogue"); err != nil {
+		t.Fatalf("expected Disable() returns nil err; got err = %v", err)
+	}
+	if !d.Contains("/catalogue") || !d.Contains("catalogue") {
+		t.Errorf("expected Contains() = true with and without a leading slash after Disable()")
+	}
+	if err := d.Disable("/catalogue"); err == nil {
+		t.Errorf("expected Disable() of a disabled path returns non-nil err")
+	}
+
+	if err := d.Enable("/catalogue"); err != nil {
+		t.Fatalf("expected Enable() returns nil err; got err = %v", err)
+	}
+	if d.Contains("/catalogue") {
+		t.Errorf("expected Contains() = false after Enable()")
+	}
+	if err := d.Enable("/catalogue"); err == nil {
+		t.Errorf("expected Enable() of an enabled path returns non-nil err")
+	}
+}
@@ -0,0 +1,43 @@
+package filters
+
+import "sync/atomic"
+
+// MatchCounter counts the requests seen and those matched by a filter, so the
+// proportion of traffic eligible for dimming can be reported. It is safe for
+// concurrent use.
+type MatchCounter struct {
+	// total and matched are accessed atomically. MatchCounter must be
+	// allocated with NewMatchCounter so they are 64-bit aligned.
+	total   uint64
+	matched uint64
+}
+
+func NewMatchCounter() *MatchCounter {
+	return &MatchCounter{}
+}
+
+// Add counts a request, which is matched if isMatched is true.
+func (c *MatchCounter) Add(isMatched bool) {
+	atomic.AddUint64(&c.total, 1)
+	if isMatched {
+		atomic.AddUint64(&c.matched, 1)
+	}
+}
+
+// Counts returns the number of requests counted and the number matched.
+func (c *MatchCounter) Counts() (total uint64, matched uint64) {
+	// matched is loaded first so it never exceeds total.
+	matched = atomic.LoadUint64(&c.matched)
+	total = atomic.LoadUint64(&c.total)
+	return total, matched
+}
+
+// Ratio returns the proportion of requests matched, or 0 if no requests have
+// been counted.
+func (c *MatchCounter) Ratio() float64 {
+	total, matched := c.Counts()
+	if total == 0 {
+		return 0
+	}
+	return float64(matched) / float64(total)
+}
@@ -0,0 +1,23 @@
+package filters
+
+import "testing"
+
+func TestMatchCounter(t *testing.T) {
+	c := NewMatchCounter()
+	if got := c.Ratio(); got != 0 {
+		t.Errorf("Ratio() = %v, want 0 with no requests", got)
+	}
+
+	c.Add(true)
+	c.Add(false)
+	c.Add(false)
+	c.Add(true)
+
+	total, matched := c.Counts()
+	if total != 4 || matched != 2 {
+		t.Errorf("Counts() = (%d, %d), want (4, 2)", total, matched)
+	}
+	if got := c.Ratio(); got != 0.5 {
+		t.Errorf("Ratio() = %v, want 0.5", got)
+	}
+}
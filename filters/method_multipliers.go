@@ -0,0 +1,39 @@
+package filters
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// MethodMultipliers scales path probabilities by the request method, so that,
+// for example, GET requests to a path are dimmed more readily than POST
+// requests to the same path. Methods without a multiplier have a multiplier of
+// 1. MethodMultipliers is immutable so it can be read concurrently by
+// requests.
+type MethodMultipliers struct {
+	// multipliers maps upper case methods to their multipliers.
+	multipliers map[string]float64
+}
+
+func NewMethodMultipliers(multipliers map[string]float64) (*MethodMultipliers, error) {
+	m := &MethodMultipliers{multipliers: make(map[string]float64, len(multipliers))}
+	for method, multiplier := range multipliers {
+		// The negated check also rejects NaN.
+		if !(multiplier >= 0) {
+			return nil, errors.New(fmt.Sprintf("NewMethodMultipliers() expected non-negative multiplier for method %s; got multiplier = %v", method, multiplier))
+		}
+		m.multipliers[strings.ToUpper(method)] = multiplier
+	}
+	return m, nil
+}
+
+// Get returns the multiplier for method, or 1 if method has no multiplier.
+// method must be upper case, as request methods are.
+func (m *MethodMultipliers) Get(method string) float64 {
+	multiplier, exists := m.multipliers[method]
+	if !exists {
+		return 1
+	}
+	return multiplier
+}
@@ -0,0 +1,30 @@
+package filters
+
+import "testing"
+
+func TestMethodMultipliers_Get(t *testing.T) {
+	m, err := NewMethodMultipliers(map[string]float64{"get": 1, "POST": 0.1})
+	if err != nil {
+		t.Fatalf("expected NewMethodMultipliers() returns nil err; got err = %v", err)
+	}
+
+	tests := []struct {
+		method string
+		want   float64
+	}{
+		{method: "GET", want: 1},
+		{method: "POST", want: 0.1},
+		{method: "DELETE", want: 1},
+	}
+	for _, tt := range tests {
+		if got := m.Get(tt.method); got != tt.want {
+			t.Errorf("Get(%s) = %v, want %v", tt.method, got, tt.want)
+		}
+	}
+}
+
+func TestNewMethodMultipliers_NegativeMultiplier(t *testing.T) {
+	if _, err := NewMethodMultipliers(map[string]float64{"POST": -0.1}); err == nil {
+		t.Errorf("expected err for negative multiplier; got nil")
+	}
+}
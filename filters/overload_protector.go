@@ -0,0 +1,184 @@
+package filters
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// OverloadProtectorOptions configures an OverloadProtector.
+type OverloadProtectorOptions struct {
+	// Window is the period over which the backend error rate is measured.
+	Window time.Duration
+	// MinRequests is the number of backend responses required within a
+	// window for its error rate to be acted upon, preventing a handful of
+	// errors during quiet periods from triggering shedding.
+	MinRequests int
+	// OpenErrorRate is the error rate at or above which the circuit opens and
+	// the shed fraction ramps up.
+	OpenErrorRate float64
+	// CloseErrorRate is the error rate below which the shed fraction ramps
+	// down while the circuit is open. It must not exceed OpenErrorRate, so
+	// the circuit does not flap around a single threshold.
+	CloseErrorRate float64
+	// RampStep is the amount the shed fraction changes by each window.
+	RampStep float64
+	// MaxShedFraction caps the fraction of requests shed. It should be below
+	// 1 so some requests still reach the backend to detect its recovery.
+	MaxShedFraction float64
+	// OverloadStatusCodes are status codes which the backend returns to
+	// signal it is overloaded, e.g. a custom 529, so an increasing rate of
+	// them sheds requests as errors do. They are optional.
+	OverloadStatusCodes []int
+}
+
+// OverloadProtector sheds a fraction of requests when the backend error rate
+// rises, e.g. because the backend is down. Latency-driven dimming does not
+// react to this as failed requests are fast, so requests would otherwise
+// continue to hammer a recovering backend.
+//
+// The protector acts as a circuit breaker: once the error rate within a
+// window reaches OpenErrorRate, the circuit opens and the shed fraction ramps
+// up by RampStep each window while the error rate stays above CloseErrorRate.
+// Once the error rate drops below CloseErrorRate, the shed fraction ramps down
+// and the circuit closes when it reaches 0. Transitions are logged.
+type OverloadProtector struct {
+	options OverloadProtectorOptions
+	// overloadStatusCodes is a set of OverloadStatusCodes for O(1) lookup.
+	overloadStatusCodes map[int]bool
+	// windowStart, total and errors track backend responses within the
+	// current window.
+	windowStart time.Time
+	total       int
+	errors      int
+	// isOpen is true while requests are being shed.
+	isOpen       bool
+	shedFraction float64
+	// mux guards windowStart, total, errors, isOpen and shedFraction.
+	mux *sync.Mutex
+	// now allows time to be controlled in tests.
+	now func() time.Time
+}
+
+func NewOverloadProtector(options OverloadProtectorOptions) (*OverloadProtector, error) {
+	if options.Window <= 0 {
+		return nil, errors.New(fmt.Sprintf("NewOverloadProtector() expected positive Window; got Window = %v", options.Window))
+	}
+	if options.MinRequests < 1 {
+		return nil, errors.New(fmt.Sprintf("NewOverloadProtector() expected MinRequests >= 1; got MinRequests = %d", options.MinRequests))
+	}
+	if !(options.OpenErrorRate > 0 && options.OpenErrorRate <= 1) {
+		return nil, errors.New(fmt.Sprintf("NewOverloadProtector() expected OpenErrorRate in (0, 1]; got OpenErrorRate = %v", options.OpenErrorRate))
+	}
+	if !(options.CloseErrorRate >= 0 && options.CloseErrorRate <= options.OpenErrorRate) {
+		return nil, errors.New(fmt.Sprintf("NewOverloadProtector() expected CloseErrorRate in [0, OpenErrorRate]; got CloseErrorRate = %v", options.CloseErrorRate))
+	}
+	if !(options.RampStep > 0 && options.RampStep <= 1) {
+		return nil, errors.New(fmt.Sprintf("NewOverloadProtector() expected RampStep in (0, 1]; got RampStep = %v", options.RampStep))
+	}
+	if !(options.MaxShedFraction > 0 && options.MaxShedFraction <= 1) {
+		return nil, errors.New(fmt.Sprintf("NewOverloadProtector() expected MaxShedFraction in (0, 1]; got MaxShedFraction = %v", options.MaxShedFraction))
+	}
+
+	overloadStatusCodes := map[int]bool{}
+	for _, statusCode := range options.OverloadStatusCodes {
+		if !(statusCode >= 100 && statusCode <= 599) {
+			return nil, errors.New(fmt.Sprintf("NewOverloadProtector() expected OverloadStatusCodes in [100, 599]; got status code = %d", statusCode))
+		}
+		overloadStatusCodes[statusCode] = true
+	}
+
+	return &OverloadProtector{
+		options:             options,
+		overloadStatusCodes: overloadStatusCodes,
+		mux:                 &sync.Mutex{},
+		now:                 time.Now,
+	}, nil
+}
+
+// IsOverloadStatusCode returns true if the status code is one of
+// OverloadStatusCodes, so it should be added as an error.
+func (p *OverloadProtector) IsOverloadStatusCode(statusCode int) bool {
+	return p.overloadStatusCodes[statusCode]
+}
+
+// Add records whether a backend response was an error, e.g. the backend was
+// unreachable or returned a gateway error.
+func (p *OverloadProtector) Add(isError bool) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	p.evaluateElapsedWindow(p.now())
+	p.total++
+	if isError {
+		p.errors++
+	}
+}
+
+// SampleShouldShed returns true with probability equal to the shed fraction.
+func (p *OverloadProtector) SampleShouldShed() bool {
+	shedFraction := p.ShedFraction()
+	return shedFraction > 0 && rand.Float64() < shedFraction
+}
+
+// ShedFraction returns the fraction of requests currently being shed.
+func (p *OverloadProtector) ShedFraction() float64 {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	p.evaluateElapsedWindow(p.now())
+	return p.shedFraction
+}
+
+// evaluateElapsedWindow adjusts the shed fraction using the error rate of the
+// current window once it has elapsed, then starts a new window. Windows with
+// fewer than MinRequests responses leave the shed fraction unchanged, as while
+// shedding heavily, few requests reach the backend. The caller must hold mux.
+func (p *OverloadProtector) evaluateElapsedWindow(now time.Time) {
+	if p.windowStart.IsZero() {
+		p.windowStart = now
+		return
+	}
+	if now.Sub(p.windowStart) < p.options.Window {
+		return
+	}
+
+	if p.total >= p.options.MinRequests {
+		errorRate := float64(p.errors) / float64(p.total)
+		if errorRate >= p.options.OpenErrorRate || (p.isOpen && errorRate >= p.options.CloseErrorRate) {
+			p.rampUp(errorRate)
+		} else if p.isOpen {
+			p.rampDown(errorRate)
+		}
+	}
+
+	p.windowStart = now
+	p.total = 0
+	p.errors = 0
+}
+
+// rampUp increases the shed fraction, opening the circuit if closed. The
+// caller must hold mux.
+func (p *OverloadProtector) rampUp(errorRate float64) {
+	if !p.isOpen {
+		p.isOpen = true
+		log.Printf("overload protection opened: backend error rate = %.3f", errorRate)
+	}
+	p.shedFraction = math.Min(p.shedFraction+p.options.RampStep, p.options.MaxShedFraction)
+}
+
+// rampDown decreases the shed fraction, closing the circuit once no requests
+// are shed. The caller must hold mux.
+func (p *OverloadProtector) rampDown(errorRate float64) {
+	p.shedFraction = math.Max(p.shedFraction-p.options.RampStep, 0)
+	// Guard against floating point error leaving a negligible fraction.
+	if p.shedFraction < 1e-9 {
+		p.shedFraction = 0
+		p.isOpen = false
+		log.Printf("overload protection closed: backend error rate = %.3f", errorRate)
+	}
+}
@@ -0,0 +1,139 @@
+package filters
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func newTestOverloadProtector(t *testing.T, now *time.Time) *OverloadProtector {
+	p, err := NewOverloadProtector(OverloadProtectorOptions{
+		Window:          time.Second,
+		MinRequests:     10,
+		OpenErrorRate:   0.5,
+		CloseErrorRate:  0.1,
+		RampStep:        0.25,
+		MaxShedFraction: 0.5,
+	})
+	if err != nil {
+		t.Fatalf("expected NewOverloadProtector() returns nil err; got err = %v", err)
+	}
+	p.now = func() time.Time { return *now }
+	return p
+}
+
+// addWindow adds responses with the given number of errors then advances
+// time to the end of the window.
+func addWindow(p *OverloadProtector, now *time.Time, total int, errors int) {
+	for i := 0; i < total; i++ {
+		p.Add(i < errors)
+	}
+	*now = now.Add(time.Second)
+}
+
+func TestOverloadProtector_RampsUpAndDown(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	p := newTestOverloadProtector(t, &now)
+
+	tests := []struct {
+		name             string
+		total            int
+		errors           int
+		wantShedFraction float64
+	}{
+		{name: "Error rate below open threshold", total: 10, errors: 4, wantShedFraction: 0},
+		{name: "Error rate reaches open threshold", total: 10, errors: 5, wantShedFraction: 0.25},
+		{name: "Error rate above close threshold while open", total: 10, errors: 2, wantShedFraction: 0.5},
+		{name: "Shed fraction capped", total: 10, errors: 10, wantShedFraction: 0.5},
+		{name: "Too few requests", total: 9, errors: 0, wantShedFraction: 0.5},
+		{name: "Error rate below close threshold", total: 10, errors: 0, wantShedFraction: 0.25},
+		{name: "Circuit closes", total: 10, errors: 0, wantShedFraction: 0},
+	}
+	for _, tt := range tests {
+		addWindow(p, &now, tt.total, tt.errors)
+		if got := p.ShedFraction(); math.Abs(got-tt.wantShedFraction) > 1e-9 {
+			t.Errorf("%s: expected ShedFraction() = %v; got %v", tt.name, tt.wantShedFraction, got)
+		}
+	}
+	if p.isOpen {
+		t.Errorf("expected circuit to be closed once shed fraction reaches 0")
+	}
+}
+
+func TestOverloadProtector_SampleShouldShed(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	p := newTestOverloadProtector(t, &now)
+
+	for i := 0; i < 100; i++ {
+		if p.SampleShouldShed() {
+			t.Fatalf("expected no requests to be shed while circuit is closed")
+		}
+	}
+
+	addWindow(p, &now, 10, 10)
+	addWindow(p, &now, 10, 10)
+	shed := 0
+	for i := 0; i < 10000; i++ {
+		if p.SampleShouldShed() {
+			shed++
+		}
+	}
+	if shed < 4500 || shed > 5500 {
+		t.Errorf("expected approximately half of requests to be shed; got %d of 10000", shed)
+	}
+}
+
+func TestOverloadProtector_IsOverloadStatusCode(t *testing.T) {
+	p, err := NewOverloadProtector(OverloadProtectorOptions{
+		Window:              time.Second,
+		MinRequests:         1,
+		OpenErrorRate:       0.5,
+		CloseErrorRate:      0.1,
+		RampStep:            0.1,
+		MaxShedFraction:     0.9,
+		OverloadStatusCodes: []int{429, 529},
+	})
+	if err != nil {
+		t.Fatalf("expected NewOverloadProtector() returns nil err; got err = %v", err)
+	}
+
+	for statusCode, want := range map[int]bool{429: true, 529: true, 200: false, 503: false} {
+		if got := p.IsOverloadStatusCode(statusCode); got != want {
+			t.Errorf("expected IsOverloadStatusCode(%d) = %v; got %v", statusCode, want, got)
+		}
+	}
+}
+
+func TestNewOverloadProtector_InvalidOptions(t *testing.T) {
+	valid := OverloadProtectorOptions{
+		Window:          time.Second,
+		MinRequests:     1,
+		OpenErrorRate:   0.5,
+		CloseErrorRate:  0.1,
+		RampStep:        0.1,
+		MaxShedFraction: 0.9,
+	}
+	if _, err := NewOverloadProtector(valid); err != nil {
+		t.Fatalf("expected NewOverloadProtector() returns nil err; got err = %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(o *OverloadProtectorOptions)
+	}{
+		{name: "Zero window", modify: func(o *OverloadProtectorOptions) { o.Window = 0 }},
+		{name: "Zero min requests", modify: func(o *OverloadProtectorOptions) { o.MinRequests = 0 }},
+		{name: "Zero open error rate", modify: func(o *OverloadProtectorOptions) { o.OpenErrorRate = 0 }},
+		{name: "Close error rate above open error rate", modify: func(o *OverloadProtectorOptions) { o.CloseErrorRate = 0.6 }},
+		{name: "Zero ramp step", modify: func(o *OverloadProtectorOptions) { o.RampStep = 0 }},
+		{name: "Max shed fraction above 1", modify: func(o *OverloadProtectorOptions) { o.MaxShedFraction = 1.1 }},
+		{name: "Invalid overload status code", modify: func(o *OverloadProtectorOptions) { o.OverloadStatusCodes = []int{529, 1000} }},
+	}
+	for _, tt := range tests {
+		options := valid
+		tt.modify(&options)
+		if _, err := NewOverloadProtector(options); err == nil {
+			t.Errorf("%s: expected err; got nil", tt.name)
+		}
+	}
+}
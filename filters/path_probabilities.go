@@ -34,7 +34,7 @@ type PathProbabilityRule struct {
 }
 
 func NewPathProbabilities(defaultValue float64) (*PathProbabilities, error) {
-	if defaultValue < 0 || defaultValue > 1 {
+	if !(defaultValue >= 0 && defaultValue <= 1) {
 		return nil, errors.New(fmt.Sprintf("NewPathProbabilities() expected defaultValue between 0 and 1; got probability = %v", defaultValue))
 	}
 
@@ -45,10 +45,18 @@ func NewPathProbabilities(defaultValue float64) (*PathProbabilities, error) {
 	}, nil
 }
 
+// List returns a copy of all rules, including both the leading slash inclusive
+// and exclusive path of each rule. The copy is made while holding the lock, so
+// callers may read or modify it while rules are set concurrently.
 func (p *PathProbabilities) List() map[string]float64 {
 	p.probabilitiesMux.RLock()
 	defer p.probabilitiesMux.RUnlock()
-	return p.probabilities
+
+	probabilities := make(map[string]float64, len(p.probabilities))
+	for path, probability := range p.probabilities {
+		probabilities[path] = probability
+	}
+	return probabilities
 }
 
 func (p *PathProbabilities) ListForPaths(paths []string) map[string]float64 {
@@ -74,7 +82,9 @@ func (p *PathProbabilities) Get(path string) float64 {
 }
 
 func (p *PathProbabilities) Set(rule PathProbabilityRule) error {
-	if rule.Probability < 0 || rule.Probability > 1 {
+	// The negated range check also rejects NaN, for which all comparisons
+	// are false.
+	if !(rule.Probability >= 0 && rule.Probability <= 1) {
 		return errors.New(fmt.Sprintf("PathProbabilities.Set() with path %s expected probability between 0 and 1; got probability = %v", rule.Path, rule.Probability))
 	}
 
@@ -97,6 +107,35 @@ func (p *PathProbabilities) SetAll(rules []PathProbabilityRule) error {
 	return nil
 }
 
+// Remove deletes the rule for a path so it falls back to the default value.
+func (p *PathProbabilities) Remove(path string) error {
+	// Rules exist for the path both with and without a leading slash.
+	path = prependLeadingSlashIfMissing(path)
+	p.probabilitiesMux.Lock()
+	defer p.probabilitiesMux.Unlock()
+
+	if _, exists := p.probabilities[path]; !exists {
+		return errors.New(fmt.Sprintf("PathProbabilities.Remove() expected rule for path %s; got no rule", path))
+	}
+	delete(p.probabilities, path)
+	delete(p.probabilities, path[1:])
+	return nil
+}
+
+// Restore replaces all rules with a copy of rules returned by List, e.g. to
+// roll back changes. Unlike Clear followed by SetAll, no intermediate state is
+// observable.
+func (p *PathProbabilities) Restore(probabilities map[string]float64) {
+	restored := make(map[string]float64, len(probabilities))
+	for path, probability := range probabilities {
+		restored[path] = probability
+	}
+
+	p.probabilitiesMux.Lock()
+	p.probabilities = restored
+	p.probabilitiesMux.Unlock()
+}
+
 func (p *PathProbabilities) Clear() {
 	p.probabilitiesMux.Lock()
 	p.probabilities = map[string]float64{}
@@ -106,3 +145,9 @@ func (p *PathProbabilities) Clear() {
 func (p *PathProbabilities) SampleShouldDim(path string) bool {
 	return rand.Float64() < p.Get(path)
 }
+
+// SampleShouldDimWithMultiplier samples whether to dim using the path's
+// probability multiplied by multiplier, e.g. a method multiplier.
+func (p *PathProbabilities) SampleShouldDimWithMultiplier(path string, multiplier float64) bool {
+	return rand.Float64() < p.Get(path)*multiplier
+}
@@ -0,0 +1,129 @@
+package filters
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestPathProbabilities_ListReturnsCopy(t *testing.T) {
+	probabilities, err := NewPathProbabilities(0)
+	if err != nil {
+		t.Fatalf("expected NewPathProbabilities() returns nil err; got err = %v", err)
+	}
+	if err := probabilities.Set(PathProbabilityRule{Path: "/catalogue", Probability: 0.5}); err != nil {
+		t.Fatalf("expected Set() returns nil err; got err = %v", err)
+	}
+
+	list := probabilities.List()
+	if len(list) != 2 || list["/catalogue"] != 0.5 || list["catalogue"] != 0.5 {
+		t.Errorf("expected List() returns /catalogue and catalogue with probability 0.5; got %v", list)
+	}
+
+	list["/catalogue"] = 1
+	delete(list, "catalogue")
+	if got := probabilities.Get("/catalogue"); got != 0.5 {
+		t.Errorf("expected Get(/catalogue) = 0.5 after modifying List() result; got %v", got)
+	}
+	if got := probabilities.Get("catalogue"); got != 0.5 {
+		t.Errorf("expected Get(catalogue) = 0.5 after modifying List() result; got %v", got)
+	}
+}
+
+// TestPathProbabilities_ConcurrentListAndSet is intended to be run with -race,
+// which reports reads of the rules not guarded by the lock.
+func TestPathProbabilities_ConcurrentListAndSet(t *testing.T) {
+	probabilities, err := NewPathProbabilities(0)
+	if err != nil {
+		t.Fatalf("expected NewPathProbabilities() returns nil err; got err = %v", err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			rule := PathProbabilityRule{Path: fmt.Sprintf("/path%d", i%10), Probability: 0.5}
+			if err := probabilities.Set(rule); err != nil {
+				t.Errorf("expected Set() returns nil err; got err = %v", err)
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			for path, probability := range probabilities.List() {
+				if probability != 0.5 {
+					t.Errorf("expected List() returns probability 0.5 for %s; got %v", path, probability)
+					return
+				}
+			}
+		}
+	}()
+	wg.Wait()
+}
+
+func TestPathProbabilities_Remove(t *testing.T) {
+	probabilities, err := NewPathProbabilities(1)
+	if err != nil {
+		t.Fatalf("expected NewPathProbabilities() returns nil err; got err = %v", err)
+	}
+	rules := []PathProbabilityRule{
+		{Path: "/catalogue", Probability: 0.2},
+		{Path: "basket", Probability: 0.3},
+		{Path: "/news", Probability: 0.4},
+	}
+	if err := probabilities.SetAll(rules); err != nil {
+		t.Fatalf("expected SetAll() returns nil err; got err = %v", err)
+	}
+
+	if err := probabilities.Remove("/basket"); err != nil {
+		t.Fatalf("expected Remove(/basket) returns nil err; got err = %v", err)
+	}
+
+	tests := []struct {
+		path string
+		want float64
+	}{
+		{path: "/catalogue", want: 0.2},
+		{path: "catalogue", want: 0.2},
+		{path: "/basket", want: 1},
+		{path: "basket", want: 1},
+		{path: "/news", want: 0.4},
+		{path: "news", want: 0.4},
+	}
+	for _, tt := range tests {
+		if got := probabilities.Get(tt.path); got != tt.want {
+			t.Errorf("expected Get(%s) = %v after Remove(/basket); got %v", tt.path, tt.want, got)
+		}
+	}
+}
+
+func TestPathProbabilities_RemoveWithoutLeadingSlash(t *testing.T) {
+	probabilities, err := NewPathProbabilities(1)
+	if err != nil {
+		t.Fatalf("expected NewPathProbabilities() returns nil err; got err = %v", err)
+	}
+	if err := probabilities.Set(PathProbabilityRule{Path: "/catalogue", Probability: 0.2}); err != nil {
+		t.Fatalf("expected Set() returns nil err; got err = %v", err)
+	}
+
+	if err := probabilities.Remove("catalogue"); err != nil {
+		t.Fatalf("expected Remove(catalogue) returns nil err; got err = %v", err)
+	}
+	if list := probabilities.List(); len(list) != 0 {
+		t.Errorf("expected List() returns no rules after Remove(catalogue); got %v", list)
+	}
+}
+
+func TestPathProbabilities_RemoveMissingPath(t *testing.T) {
+	probabilities, err := NewPathProbabilities(1)
+	if err != nil {
+		t.Fatalf("expected NewPathProbabilities() returns nil err; got err = %v", err)
+	}
+
+	if err := probabilities.Remove("/catalogue"); err == nil {
+		t.Errorf("expected Remove(/catalogue) returns err for path without a rule; got nil")
+	}
+}
@@ -0,0 +1,65 @@
+package filters
+
+import (
+	"errors"
+	"fmt"
+)
+
+// PathValidator rejects malformed request paths, e.g. those sent by scanners
+// containing null bytes or control characters, before they are used as keys
+// in the filter and probability structures.
+type PathValidator struct {
+	maxLength int
+	// allowedCharacters restricts paths to alphanumeric characters and the
+	// characters in the set. If nil, all characters except ASCII control
+	// characters are allowed.
+	allowedCharacters map[rune]bool
+}
+
+// NewPathValidator returns a PathValidator rejecting paths longer than
+// maxLength bytes. If allowedCharacters is non-empty, paths may only contain
+// alphanumeric characters and allowedCharacters, e.g. "/-_.~%".
+func NewPathValidator(maxLength int, allowedCharacters string) (*PathValidator, error) {
+	if maxLength < 1 {
+		return nil, errors.New(fmt.Sprintf("NewPathValidator() expected maxLength >= 1; got maxLength = %d", maxLength))
+	}
+
+	var allowed map[rune]bool
+	if allowedCharacters != "" {
+		allowed = map[rune]bool{}
+		for _, c := range allowedCharacters {
+			allowed[c] = true
+		}
+	}
+
+	return &PathValidator{
+		maxLength:         maxLength,
+		allowedCharacters: allowed,
+	}, nil
+}
+
+// Validate returns an error describing why path is malformed, or nil if it is
+// valid.
+func (v *PathValidator) Validate(path string) error {
+	if len(path) > v.maxLength {
+		return errors.New(fmt.Sprintf("expected path length <= %d; got length %d", v.maxLength, len(path)))
+	}
+
+	for i, c := range path {
+		if isASCIIControlCharacter(c) {
+			return errors.New(fmt.Sprintf("unexpected control character %U at index %d", c, i))
+		}
+		if v.allowedCharacters != nil && !isASCIIAlphanumeric(c) && !v.allowedCharacters[c] {
+			return errors.New(fmt.Sprintf("unexpected character %q at index %d", c, i))
+		}
+	}
+	return nil
+}
+
+func isASCIIControlCharacter(c rune) bool {
+	return c < 0x20 || c == 0x7f
+}
+
+func isASCIIAlphanumeric(c rune) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
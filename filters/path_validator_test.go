@@ -0,0 +1,47 @@
+package filters
+
+import "testing"
+
+func TestPathValidator_Validate(t *testing.T) {
+	defaultValidator, err := NewPathValidator(16, "")
+	if err != nil {
+		t.Fatalf("expected NewPathValidator() returns nil err; got err = %v", err)
+	}
+	allowlistValidator, err := NewPathValidator(16, "/-_.")
+	if err != nil {
+		t.Fatalf("expected NewPathValidator() returns nil err; got err = %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		validator *PathValidator
+		path      string
+		wantValid bool
+	}{
+		{name: "Valid path", validator: defaultValidator, path: "/catalogue/a b", wantValid: true},
+		{name: "Path at max length", validator: defaultValidator, path: "/aaaaaaaaaaaaaaa", wantValid: true},
+		{name: "Overlong path", validator: defaultValidator, path: "/aaaaaaaaaaaaaaaa", wantValid: false},
+		{name: "Null byte", validator: defaultValidator, path: "/cata\x00logue", wantValid: false},
+		{name: "Control character", validator: defaultValidator, path: "/cata\nlogue", wantValid: false},
+		{name: "Delete character", validator: defaultValidator, path: "/cata\x7flogue", wantValid: false},
+		{name: "Allowlisted characters", validator: allowlistValidator, path: "/cat-1_a.html", wantValid: true},
+		{name: "Character outside allowlist", validator: allowlistValidator, path: "/cat a", wantValid: false},
+		{name: "Control character with allowlist", validator: allowlistValidator, path: "/cat\x00", wantValid: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.validator.Validate(tt.path)
+			if tt.wantValid && err != nil {
+				t.Errorf("expected Validate(%q) returns nil err; got err = %v", tt.path, err)
+			} else if !tt.wantValid && err == nil {
+				t.Errorf("expected Validate(%q) returns err; got nil", tt.path)
+			}
+		})
+	}
+}
+
+func TestNewPathValidator_InvalidMaxLength(t *testing.T) {
+	if _, err := NewPathValidator(0, ""); err == nil {
+		t.Errorf("expected err for maxLength = 0; got nil")
+	}
+}
@@ -0,0 +1,86 @@
+package filters
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ProbabilityFloors guards the control plane against fat-fingered changes,
+// e.g. an operator disabling dimming for a critical path in a single call
+// during an incident. Each path category has a floor, and lowering a path's
+// probability below its floor must be explicitly forced.
+//
+// Paths are mapped to categories insensitive of their leading slash, using
+// the same approach as DimmingBudget. Paths without a category are their own
+// category.
+type ProbabilityFloors struct {
+	// defaultFloor applies to categories without a floor.
+	defaultFloor float64
+	// categories is a map from a path with a leading slash to a category.
+	categories map[string]string
+	// floors is a map from a category to its floor.
+	floors map[string]float64
+	// mux guards categories and floors.
+	mux *sync.RWMutex
+}
+
+func NewProbabilityFloors(defaultFloor float64) (*ProbabilityFloors, error) {
+	if !(defaultFloor >= 0 && defaultFloor <= 1) {
+		return nil, errors.New(fmt.Sprintf("NewProbabilityFloors() expected defaultFloor between 0 and 1; got defaultFloor = %v", defaultFloor))
+	}
+
+	return &ProbabilityFloors{
+		defaultFloor: defaultFloor,
+		categories:   map[string]string{},
+		floors:       map[string]float64{},
+		mux:          &sync.RWMutex{},
+	}, nil
+}
+
+// SetCategory assigns a path to a category.
+func (f *ProbabilityFloors) SetCategory(path string, category string) {
+	f.mux.Lock()
+	f.categories[prependLeadingSlashIfMissing(path)] = category
+	f.mux.Unlock()
+}
+
+// SetFloor sets the floor of a category.
+func (f *ProbabilityFloors) SetFloor(category string, floor float64) error {
+	if !(floor >= 0 && floor <= 1) {
+		return errors.New(fmt.Sprintf("ProbabilityFloors.SetFloor() with category %s expected floor between 0 and 1; got floor = %v", category, floor))
+	}
+
+	f.mux.Lock()
+	f.floors[category] = floor
+	f.mux.Unlock()
+	return nil
+}
+
+// Floor returns the floor of the path's category.
+func (f *ProbabilityFloors) Floor(path string) float64 {
+	path = prependLeadingSlashIfMissing(path)
+
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	category, hasCategory := f.categories[path]
+	if !hasCategory {
+		category = path
+	}
+	if floor, hasFloor := f.floors[category]; hasFloor {
+		return floor
+	}
+	return f.defaultFloor
+}
+
+// Check returns an error if changing a path's probability from current to
+// next lowers it below the path's floor. Raising a probability which is
+// already below the floor is allowed.
+func (f *ProbabilityFloors) Check(path string, current float64, next float64) error {
+	floor := f.Floor(path)
+	if next < floor && next < current {
+		return errors.New(fmt.Sprintf("expected probability for path %s at least floor %v; got probability = %v", path, floor, next))
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package filters
+
+import "testing"
+
+func TestProbabilityFloors_Check(t *testing.T) {
+	floors, err := NewProbabilityFloors(0.1)
+	if err != nil {
+		t.Fatalf("expected NewProbabilityFloors() returns nil err; got err = %v", err)
+	}
+	floors.SetCategory("checkout", "critical")
+	floors.SetCategory("/basket", "critical")
+	if err := floors.SetFloor("critical", 0.5); err != nil {
+		t.Fatalf("expected SetFloor() returns nil err; got err = %v", err)
+	}
+	if err := floors.SetFloor("/news", 0); err != nil {
+		t.Fatalf("expected SetFloor() returns nil err; got err = %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		path      string
+		current   float64
+		next      float64
+		wantAllow bool
+	}{
+		{name: "Category floor respected", path: "/checkout", current: 0.9, next: 0.5, wantAllow: true},
+		{name: "Category floor violated", path: "/checkout", current: 0.9, next: 0.4, wantAllow: false},
+		{name: "Category floor without leading slash", path: "basket", current: 0.9, next: 0.4, wantAllow: false},
+		{name: "Raising below floor", path: "/checkout", current: 0.1, next: 0.2, wantAllow: true},
+		{name: "Uncategorised path uses its own floor", path: "/news", current: 0.9, next: 0, wantAllow: true},
+		{name: "Default floor violated", path: "/catalogue", current: 0.9, next: 0.05, wantAllow: false},
+		{name: "Default floor respected", path: "/catalogue", current: 0.9, next: 0.1, wantAllow: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := floors.Check(tt.path, tt.current, tt.next)
+			if tt.wantAllow && err != nil {
+				t.Errorf("expected Check() returns nil err; got err = %v", err)
+			} else if !tt.wantAllow && err == nil {
+				t.Errorf("expected Check() returns err; got nil")
+			}
+		})
+	}
+}
+
+func TestProbabilityFloors_InvalidFloor(t *testing.T) {
+	if _, err := NewProbabilityFloors(1.1); err == nil {
+		t.Errorf("expected err for defaultFloor = 1.1; got nil")
+	}
+
+	floors, err := NewProbabilityFloors(0)
+	if err != nil {
+		t.Fatalf("expected NewProbabilityFloors() returns nil err; got err = %v", err)
+	}
+	if err := floors.SetFloor("critical", -0.1); err == nil {
+		t.Errorf("expected err for floor = -0.1; got nil")
+	}
+}
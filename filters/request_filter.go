@@ -4,48 +4,194 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	gopath "path"
 	"strings"
+	"sync"
 )
 
 // RequestFilterRule is formatted by "[METHOD] [PATH]".
 type RequestFilterRule = string
 
+// HeaderAccessor returns the value of a request header, or nil if the header
+// is not set, e.g. fasthttp's RequestHeader.Peek.
+type HeaderAccessor func(name string) []byte
+
+// FilterMode determines whether the rules of a RequestFilter list the requests
+// which are dimmable or the requests which are not.
+type FilterMode int
+
+const (
+	// FilterModeAllowlist matches only requests which match a rule.
+	FilterModeAllowlist FilterMode = iota
+	// FilterModeDenylist matches all requests except those which match a
+	// rule, avoiding the need to enumerate every dimmable path.
+	FilterModeDenylist
+)
+
 // RequestFilter checks whether a given request path-method-referer combination
 // matches a rule within its rules set. Matches can be excluded if the referer
 // for matching rule contains an exclusion from refererExclusions. The filter
 // is insensitive to the leading slash of a path.
 //
+// In FilterModeDenylist, the result of Matches is inverted, so rules specify
+// requests which are never dimmed. Referer exclusions still exempt requests
+// from a rule, so an excluded request is then dimmable.
+//
+// Referer exclusions for a rule are compiled into a substringMatcher, so
+// Matches costs O(r) for a referer of length r regardless of the number of
+// exclusions. Compiling is instead O(e) in the total length of the exclusions
+// on each AddRefererExclusion, as is the memory held for each rule. The number
+// of exclusions per rule is therefore capped by maxRefererExclusionsPerRule to
+// protect against pathological configurations.
+//
 // A key invariant is that Matches operations must be insensitive of a path's
 // leading slash. To keep Matches lookup O(1), AddPath is responsible for O(n)
 // string operations which add both leading slash inclusive and exclusive paths
 // to the map, enabling O(1) Matches lookup.
+//
+// Conversely, referer inclusions restrict a rule to requests whose referer
+// contains an inclusion, e.g. to only dim product images loaded from search
+// results. A rule without inclusions matches any referer. Exclusions take
+// precedence over inclusions. Inclusions are compiled as for exclusions.
+//
+// Matches can also be excluded by substrings of other request headers added by
+// AddHeaderExclusion, e.g. to exempt requests with X-Client-Type: mobile. As
+// requests rarely have header exclusions, they are scanned rather than
+// compiled, costing O(h) in the total length of the substrings for a rule.
+//
+// Rules may also be glob patterns added by AddPathPattern. Patterns are only
+// scanned if no exact rule exists for the request, so exact rules take
+// priority and requests matching exact rules remain O(1).
+//
+// Rules may be added and removed while requests are being matched.
 type RequestFilter struct {
+	// mode determines whether Matches returns requests which match rules, or
+	// requests which do not.
+	mode FilterMode
 	// rules are a set of Method-Path combinations which
 	rules map[RequestFilterRule]bool
-	// refererExclusions specifies substrings which should exclude a request
+	// refererExclusions matches substrings which should exclude a request
 	// from the filter if they occur inside a Referer header.
-	refererExclusions map[RequestFilterRule][]string
+	refererExclusions map[RequestFilterRule]*substringMatcher
+	// refererInclusions matches substrings, at least one of which must occur
+	// inside a Referer header for a request to match the filter. Rules without
+	// refererInclusions match regardless of the Referer header.
+	refererInclusions map[RequestFilterRule]*substringMatcher
+	// headerExclusions maps rules to canonical header names to substrings
+	// which exclude a request from the filter if they occur inside the
+	// header.
+	headerExclusions map[RequestFilterRule]map[string][]string
+	// maxRefererExclusionsPerRule caps the number of substrings of each
+	// refererExclusions and refererInclusions entry, and of each header of
+	// each headerExclusions entry. A maxRefererExclusionsPerRule of 0 disables the cap.
+	maxRefererExclusionsPerRule int
+	// patterns are glob pattern rules in the order they were added, whose
+	// referer exclusions are keyed by the rule of the pattern and method.
+	patterns []pathPattern
+	// mux guards rules, exclusions and patterns from concurrent reads
+	// and writes, where reads occur while requests are being served and
+	// writes can be made at runtime.
+	mux *sync.RWMutex
+}
+
+// pathPattern is a glob pattern rule with a leading slash. A final segment of
+// ** matches one or more trailing segments, in which case prefix is the
+// pattern without the final segment.
+type pathPattern struct {
+	method   string
+	pattern  string
+	prefix   string
+	isPrefix bool
 }
 
-func NewRequestFilter() *RequestFilter {
+// matches returns true if the path, which must have a leading slash, matches
+// the pattern.
+func (p pathPattern) matches(path string) bool {
+	if !p.isPrefix {
+		isMatch, _ := gopath.Match(p.pattern, path)
+		return isMatch
+	}
+
+	// Match the prefix against as many leading segments of the path as it
+	// has, requiring at least one trailing segment.
+	segments := strings.Count(p.prefix, "/")
+	end := 0
+	for i := 0; i < segments; i++ {
+		next := strings.IndexByte(path[end+1:], '/')
+		if next == -1 {
+			return false
+		}
+		end += next + 1
+	}
+	if end == len(path)-1 {
+		return false
+	}
+	isMatch, _ := gopath.Match(p.prefix, path[:end])
+	return isMatch
+}
+
+func NewRequestFilter(mode FilterMode, maxRefererExclusionsPerRule int) *RequestFilter {
 	return &RequestFilter{
-		rules:             map[RequestFilterRule]bool{},
-		refererExclusions: map[RequestFilterRule][]string{},
+		mode:                        mode,
+		rules:                       map[RequestFilterRule]bool{},
+		refererExclusions:           map[RequestFilterRule]*substringMatcher{},
+		refererInclusions:           map[RequestFilterRule]*substringMatcher{},
+		headerExclusions:            map[RequestFilterRule]map[string][]string{},
+		maxRefererExclusionsPerRule: maxRefererExclusionsPerRule,
+		mux:                         &sync.RWMutex{},
+	}
+}
+
+// Matches returns true if the request matches the filter. header is used to
+// read headers for header exclusions, and may be nil if the request has no
+// headers other than the referer.
+func (r *RequestFilter) Matches(path string, method string, referer string, header HeaderAccessor) bool {
+	if r.mode == FilterModeDenylist {
+		return !r.matchesRule(path, method, referer, header)
 	}
+	return r.matchesRule(path, method, referer, header)
 }
 
-func (r *RequestFilter) Matches(path string, method string, referer string) bool {
+// matchesRule returns true if the request matches a rule, is included by the
+// rule's referer inclusions if any, and is not excluded by the rule's referer
+// or header exclusions.
+func (r *RequestFilter) matchesRule(path string, method string, referer string, header HeaderAccessor) bool {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
 	rule := toRequestFilterRule(path, method)
 
-	// No rule found.
+	// Fall back to scanning patterns if no exact rule is found.
 	if !r.rules[rule] {
-		return false
+		pattern, isFound := r.matchingPattern(path, method)
+		if !isFound {
+			return false
+		}
+		rule = toRequestFilterRule(pattern, method)
 	}
 
 	// Enforce referer exclusions.
-	for _, substring := range r.refererExclusions[rule] {
-		if strings.Contains(referer, substring) {
-			return false
+	if exclusions := r.refererExclusions[rule]; exclusions != nil && exclusions.containsAny(referer) {
+		return false
+	}
+
+	// Enforce referer inclusions.
+	if inclusions := r.refererInclusions[rule]; inclusions != nil && !inclusions.containsAny(referer) {
+		return false
+	}
+
+	// Enforce header exclusions.
+	if header != nil {
+		for name, substrings := range r.headerExclusions[rule] {
+			value := header(name)
+			if value == nil {
+				continue
+			}
+			for _, substring := range substrings {
+				if strings.Contains(string(value), substring) {
+					return false
+				}
+			}
 		}
 	}
 
@@ -57,18 +203,125 @@ func (r *RequestFilter) Matches(path string, method string, referer string) bool
 // the path's leading slash. Both are added to the set at AddPath-time so that
 // Matches does not require string manipulation.
 func (r *RequestFilter) AddPath(path string, method string) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.addPathLocked(path, method)
+}
+
+// addPathLocked adds rules for the path and method. mux must be held.
+func (r *RequestFilter) addPathLocked(path string, method string) {
 	path = prependLeadingSlashIfMissing(path)
 	r.rules[toRequestFilterRule(path[1:], method)] = true
 	r.rules[toRequestFilterRule(path, method)] = true
 }
 
+// matchingPattern returns the first pattern added which matches the request.
+func (r *RequestFilter) matchingPattern(path string, method string) (string, bool) {
+	if len(r.patterns) == 0 {
+		return "", false
+	}
+
+	path = prependLeadingSlashIfMissing(path)
+	for _, pattern := range r.patterns {
+		if pattern.method == method && pattern.matches(path) {
+			return pattern.pattern, true
+		}
+	}
+	return "", false
+}
+
+// AddPathPattern adds a rule for paths matching a glob pattern and method,
+// insensitive of the leading slash of both. Patterns use the syntax of
+// path.Match, so * matches any characters within a single segment, e.g.
+// /products/* matches /products/123 but not /products/123/reviews. A final
+// segment of ** matches one or more trailing segments, e.g. /products/**
+// matches both.
+func (r *RequestFilter) AddPathPattern(pattern string, method string) error {
+	pattern = prependLeadingSlashIfMissing(pattern)
+	p := pathPattern{method: method, pattern: pattern}
+	if strings.HasSuffix(pattern, "/**") {
+		p.prefix = strings.TrimSuffix(pattern, "/**")
+		p.isPrefix = true
+	}
+
+	// path.Match reports malformed patterns, so the pattern is validated by
+	// matching it against itself.
+	if _, err := gopath.Match(strings.TrimSuffix(pattern, "/**"), pattern); err != nil {
+		return fmt.Errorf("AddPathPattern() expected valid pattern; got pattern %s with err = %w", pattern, err)
+	}
+
+	r.mux.Lock()
+	r.patterns = append(r.patterns, p)
+	r.mux.Unlock()
+	return nil
+}
+
+// allMethods are the methods for which AddPathForAllMethods and
+// RemovePathForAllMethods add and remove rules.
+var allMethods = []string{http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
+
 func (r *RequestFilter) AddPathForAllMethods(path string) {
-	methods := []string{http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
-	for _, method := range methods {
-		r.AddPath(path, method)
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	for _, method := range allMethods {
+		r.addPathLocked(path, method)
 	}
 }
 
+// RemovePath removes the rules for a given path and method both inclusive and
+// exclusive of the path's leading slash, along with their exclusions and
+// inclusions, returning an error if no rule exists.
+func (r *RequestFilter) RemovePath(path string, method string) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if !r.removePathLocked(path, method) {
+		return errors.New(fmt.Sprintf("RemovePath() expected rules contains rule %v; none found", toRequestFilterRule(prependLeadingSlashIfMissing(path), method)))
+	}
+	return nil
+}
+
+// RemovePathForAllMethods removes the rules for a given path for each method
+// added by AddPathForAllMethods, along with their exclusions and inclusions,
+// returning an error if no rule exists for any method.
+func (r *RequestFilter) RemovePathForAllMethods(path string) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	isRemoved := false
+	for _, method := range allMethods {
+		if r.removePathLocked(path, method) {
+			isRemoved = true
+		}
+	}
+	if !isRemoved {
+		return errors.New(fmt.Sprintf("RemovePathForAllMethods() expected rules contains a rule for path %v; none found", prependLeadingSlashIfMissing(path)))
+	}
+	return nil
+}
+
+// removePathLocked removes the rules, exclusions and inclusions for the path
+// and method, returning false if no rule exists. mux must be held.
+func (r *RequestFilter) removePathLocked(path string, method string) bool {
+	path = prependLeadingSlashIfMissing(path)
+	rule := toRequestFilterRule(path, method)
+	ruleWithoutPrependingSlash := toRequestFilterRule(path[1:], method)
+
+	if !r.rules[rule] {
+		return false
+	}
+
+	delete(r.rules, rule)
+	delete(r.rules, ruleWithoutPrependingSlash)
+	delete(r.refererExclusions, rule)
+	delete(r.refererExclusions, ruleWithoutPrependingSlash)
+	delete(r.refererInclusions, rule)
+	delete(r.refererInclusions, ruleWithoutPrependingSlash)
+	delete(r.headerExclusions, rule)
+	delete(r.headerExclusions, ruleWithoutPrependingSlash)
+	return true
+}
+
 // AddRefererExclusion adds refererExclusions for an existing rule both
 // inclusive and exclusive of the given path's leading slash.
 func (r *RequestFilter) AddRefererExclusion(path string, method string, substring string) error {
@@ -76,22 +329,113 @@ func (r *RequestFilter) AddRefererExclusion(path string, method string, substrin
 	rule := toRequestFilterRule(path, method)
 	ruleWithoutPrependingSlash := toRequestFilterRule(path[1:], method)
 
-	if !r.rules[rule] {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if !r.rules[rule] && !r.hasPattern(path, method) {
 		return errors.New(fmt.Sprintf("AddRefererExclusion() expected rules contains rule %v; none found", rule))
 	}
 
-	if r.refererExclusions[rule] == nil {
-		r.refererExclusions[rule] = []string{}
-		r.refererExclusions[ruleWithoutPrependingSlash] = []string{}
+	exclusions := r.refererExclusions[rule]
+	if exclusions == nil {
+		exclusions = newSubstringMatcher(nil)
+	}
 
+	if r.maxRefererExclusionsPerRule > 0 && len(exclusions.substrings) >= r.maxRefererExclusionsPerRule {
+		return errors.New(fmt.Sprintf("AddRefererExclusion() expected at most %d referer exclusions for rule %v; cap exceeded", r.maxRefererExclusionsPerRule, rule))
 	}
-	r.refererExclusions[rule] = append(r.refererExclusions[rule], substring)
-	r.refererExclusions[ruleWithoutPrependingSlash] =
-		append(r.refererExclusions[ruleWithoutPrependingSlash], substring)
+
+	// Both rules share the same matcher as their exclusions are identical.
+	exclusions = exclusions.withSubstring(substring)
+	r.refererExclusions[rule] = exclusions
+	r.refererExclusions[ruleWithoutPrependingSlash] = exclusions
 
 	return nil
 }
 
+// AddRefererInclusion adds refererInclusions for an existing rule both
+// inclusive and exclusive of the given path's leading slash. Once a rule has
+// an inclusion, requests only match the rule if their referer contains at
+// least one of its inclusions.
+func (r *RequestFilter) AddRefererInclusion(path string, method string, substring string) error {
+	path = prependLeadingSlashIfMissing(path)
+	rule := toRequestFilterRule(path, method)
+	ruleWithoutPrependingSlash := toRequestFilterRule(path[1:], method)
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if !r.rules[rule] && !r.hasPattern(path, method) {
+		return errors.New(fmt.Sprintf("AddRefererInclusion() expected rules contains rule %v; none found", rule))
+	}
+
+	inclusions := r.refererInclusions[rule]
+	if inclusions == nil {
+		inclusions = newSubstringMatcher(nil)
+	}
+
+	if r.maxRefererExclusionsPerRule > 0 && len(inclusions.substrings) >= r.maxRefererExclusionsPerRule {
+		return errors.New(fmt.Sprintf("AddRefererInclusion() expected at most %d referer inclusions for rule %v; cap exceeded", r.maxRefererExclusionsPerRule, rule))
+	}
+
+	// Both rules share the same matcher as their inclusions are identical.
+	inclusions = inclusions.withSubstring(substring)
+	r.refererInclusions[rule] = inclusions
+	r.refererInclusions[ruleWithoutPrependingSlash] = inclusions
+
+	return nil
+}
+
+// AddHeaderExclusion adds an exclusion for an existing rule both inclusive and
+// exclusive of the given path's leading slash, so requests whose header
+// contains the substring do not match the rule. The header name is case
+// insensitive. Exclusions of the Referer header are better added with
+// AddRefererExclusion, which is faster to match.
+func (r *RequestFilter) AddHeaderExclusion(path string, method string, headerName string, substring string) error {
+	path = prependLeadingSlashIfMissing(path)
+	rule := toRequestFilterRule(path, method)
+	ruleWithoutPrependingSlash := toRequestFilterRule(path[1:], method)
+	headerName = http.CanonicalHeaderKey(headerName)
+
+	if headerName == "" {
+		return errors.New("AddHeaderExclusion() expected non-empty headerName; got empty headerName")
+	}
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if !r.rules[rule] && !r.hasPattern(path, method) {
+		return errors.New(fmt.Sprintf("AddHeaderExclusion() expected rules contains rule %v; none found", rule))
+	}
+
+	exclusions := r.headerExclusions[rule]
+	if exclusions == nil {
+		exclusions = map[string][]string{}
+	}
+
+	if r.maxRefererExclusionsPerRule > 0 && len(exclusions[headerName]) >= r.maxRefererExclusionsPerRule {
+		return errors.New(fmt.Sprintf("AddHeaderExclusion() expected at most %d exclusions of header %s for rule %v; cap exceeded", r.maxRefererExclusionsPerRule, headerName, rule))
+	}
+
+	// Both rules share the same map as their exclusions are identical.
+	exclusions[headerName] = append(exclusions[headerName], substring)
+	r.headerExclusions[rule] = exclusions
+	r.headerExclusions[ruleWithoutPrependingSlash] = exclusions
+
+	return nil
+}
+
+// hasPattern returns true if the pattern, which must have a leading slash, has
+// been added for the method. mux must be held.
+func (r *RequestFilter) hasPattern(pattern string, method string) bool {
+	for _, p := range r.patterns {
+		if p.method == method && p.pattern == pattern {
+			return true
+		}
+	}
+	return false
+}
+
 func toRequestFilterRule(path string, method string) RequestFilterRule {
 	return method + " " + path
 }
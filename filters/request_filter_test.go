@@ -2,6 +2,7 @@ package filters
 
 import (
 	"net/http"
+	"sync"
 	"testing"
 )
 
@@ -51,17 +52,17 @@ func TestRequestFilter_Matches(t *testing.T) {
 		toRequestFilterRule("/pathWithRefererExclusions", http.MethodGet): true,
 		toRequestFilterRule("pathWithRefererExclusions", http.MethodGet):  true,
 	}
-	refererExclusions := map[RequestFilterRule][]string{
-		toRequestFilterRule("/pathWithRefererExclusions", http.MethodGet): {
+	refererExclusions := map[RequestFilterRule]*substringMatcher{
+		toRequestFilterRule("/pathWithRefererExclusions", http.MethodGet): newSubstringMatcher([]string{
 			"foo", "bar",
-		},
-		toRequestFilterRule("pathWithRefererExclusions", http.MethodGet): {
+		}),
+		toRequestFilterRule("pathWithRefererExclusions", http.MethodGet): newSubstringMatcher([]string{
 			"foo", "bar",
-		},
+		}),
 	}
 	type fields struct {
 		rules             map[RequestFilterRule]bool
-		refererExclusions map[RequestFilterRule][]string
+		refererExclusions map[RequestFilterRule]*substringMatcher
 	}
 	type args struct {
 		path    string
@@ -150,10 +151,430 @@ func TestRequestFilter_Matches(t *testing.T) {
 			r := &RequestFilter{
 				rules:             tt.fields.rules,
 				refererExclusions: tt.fields.refererExclusions,
+				mux:               &sync.RWMutex{},
 			}
-			if got := r.Matches(tt.args.path, tt.args.method, tt.args.referer); got != tt.want {
+			if got := r.Matches(tt.args.path, tt.args.method, tt.args.referer, nil); got != tt.want {
 				t.Errorf("Matches() = %v, want %v", got, tt.want)
 			}
 		})
 	}
 }
+
+func TestRequestFilter_Matches_FilterModes(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    string
+		method  string
+		referer string
+		want    map[FilterMode]bool
+	}{
+		{
+			name:   "Path matching rule",
+			path:   "/path",
+			method: http.MethodGet,
+			want:   map[FilterMode]bool{FilterModeAllowlist: true, FilterModeDenylist: false},
+		},
+		{
+			name:   "Path matching rule without leading slash",
+			path:   "path",
+			method: http.MethodGet,
+			want:   map[FilterMode]bool{FilterModeAllowlist: true, FilterModeDenylist: false},
+		},
+		{
+			name:   "Path matching rule but not method",
+			path:   "/path",
+			method: http.MethodPost,
+			want:   map[FilterMode]bool{FilterModeAllowlist: false, FilterModeDenylist: true},
+		},
+		{
+			name:   "Path not matching any rule",
+			path:   "/other",
+			method: http.MethodGet,
+			want:   map[FilterMode]bool{FilterModeAllowlist: false, FilterModeDenylist: true},
+		},
+		{
+			name:    "Path matching rule with excluded referer",
+			path:    "/path",
+			method:  http.MethodGet,
+			referer: "http://localhost/foo",
+			want:    map[FilterMode]bool{FilterModeAllowlist: false, FilterModeDenylist: true},
+		},
+	}
+	for _, mode := range []FilterMode{FilterModeAllowlist, FilterModeDenylist} {
+		r := NewRequestFilter(mode, 0)
+		r.AddPath("/path", http.MethodGet)
+		if err := r.AddRefererExclusion("/path", http.MethodGet, "foo"); err != nil {
+			t.Fatalf("AddRefererExclusion() expected nil err; got err = %v", err)
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				if got := r.Matches(tt.path, tt.method, tt.referer, nil); got != tt.want[mode] {
+					t.Errorf("Matches() with mode = %v = %v, want %v", mode, got, tt.want[mode])
+				}
+			})
+		}
+	}
+}
+
+func TestRequestFilter_AddRefererExclusion_EnforcesCap(t *testing.T) {
+	r := NewRequestFilter(FilterModeAllowlist, 2)
+	r.AddPath("/path", http.MethodGet)
+
+	for _, substring := range []string{"foo", "bar"} {
+		if err := r.AddRefererExclusion("/path", http.MethodGet, substring); err != nil {
+			t.Fatalf("AddRefererExclusion(substring = %s) expected nil err; got err = %v", substring, err)
+		}
+	}
+	if err := r.AddRefererExclusion("path", http.MethodGet, "baz"); err == nil {
+		t.Errorf("AddRefererExclusion() expected err once cap exceeded; got nil")
+	}
+
+	if r.Matches("/path", http.MethodGet, "baz", nil) != true {
+		t.Errorf("Matches() expected exclusion exceeding cap to not be added")
+	}
+}
+
+func TestRequestFilter_AddRefererExclusion_NoCap(t *testing.T) {
+	r := NewRequestFilter(FilterModeAllowlist, 0)
+	r.AddPath("/path", http.MethodGet)
+
+	for i := 0; i < 1000; i++ {
+		if err := r.AddRefererExclusion("/path", http.MethodGet, "foo"); err != nil {
+			t.Fatalf("AddRefererExclusion() expected nil err with no cap; got err = %v", err)
+		}
+	}
+}
+
+func TestRequestFilter_AddPathPattern(t *testing.T) {
+	r := NewRequestFilter(FilterModeAllowlist, 0)
+	for _, pattern := range []string{"/products/*", "catalogue/*/reviews", "/static/**", "/images/*.png"} {
+		if err := r.AddPathPattern(pattern, http.MethodGet); err != nil {
+			t.Fatalf("AddPathPattern(pattern = %s) expected nil err; got err = %v", pattern, err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		path   string
+		method string
+		want   bool
+	}{
+		{name: "Segment wildcard", path: "/products/123", method: http.MethodGet, want: true},
+		{name: "Segment wildcard without leading slash", path: "products/456", method: http.MethodGet, want: true},
+		{name: "Segment wildcard does not match deeper paths", path: "/products/123/reviews", method: http.MethodGet, want: false},
+		{name: "Segment wildcard does not match parent", path: "/products", method: http.MethodGet, want: false},
+		{name: "Segment wildcard within path", path: "/catalogue/socks/reviews", method: http.MethodGet, want: true},
+		{name: "Segment wildcard within path not matching suffix", path: "/catalogue/socks/images", method: http.MethodGet, want: false},
+		{name: "Partial segment wildcard", path: "/images/logo.png", method: http.MethodGet, want: true},
+		{name: "Partial segment wildcard not matching", path: "/images/logo.jpg", method: http.MethodGet, want: false},
+		{name: "Trailing wildcard single segment", path: "/static/app.js", method: http.MethodGet, want: true},
+		{name: "Trailing wildcard multiple segments", path: "/static/css/app.css", method: http.MethodGet, want: true},
+		{name: "Trailing wildcard does not match parent", path: "/static", method: http.MethodGet, want: false},
+		{name: "Trailing wildcard does not match empty segment", path: "/static/", method: http.MethodGet, want: false},
+		{name: "Trailing wildcard does not match sibling", path: "/statics/app.js", method: http.MethodGet, want: false},
+		{name: "Method not matching", path: "/products/123", method: http.MethodPost, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := r.Matches(tt.path, tt.method, "", nil); got != tt.want {
+				t.Errorf("Matches(path = %s, method = %s) = %v, want %v", tt.path, tt.method, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequestFilter_AddPathPattern_ExactRulesTakePriority(t *testing.T) {
+	r := NewRequestFilter(FilterModeAllowlist, 0)
+	if err := r.AddPathPattern("/products/*", http.MethodGet); err != nil {
+		t.Fatalf("AddPathPattern() expected nil err; got err = %v", err)
+	}
+	r.AddPath("/products/featured", http.MethodGet)
+	if err := r.AddRefererExclusion("/products/featured", http.MethodGet, "checkout"); err != nil {
+		t.Fatalf("AddRefererExclusion() expected nil err; got err = %v", err)
+	}
+
+	// The exact rule's exclusion applies rather than falling through to the
+	// pattern, which has no exclusions.
+	if r.Matches("/products/featured", http.MethodGet, "http://localhost/checkout", nil) {
+		t.Errorf("Matches() expected exact rule exclusion to apply; got match")
+	}
+	if !r.Matches("/products/123", http.MethodGet, "http://localhost/checkout", nil) {
+		t.Errorf("Matches() expected pattern to match; got no match")
+	}
+}
+
+func TestRequestFilter_AddPathPattern_RefererExclusion(t *testing.T) {
+	r := NewRequestFilter(FilterModeAllowlist, 0)
+	if err := r.AddPathPattern("products/*", http.MethodGet); err != nil {
+		t.Fatalf("AddPathPattern() expected nil err; got err = %v", err)
+	}
+	if err := r.AddRefererExclusion("/products/*", http.MethodGet, "checkout"); err != nil {
+		t.Fatalf("AddRefererExclusion() expected nil err for pattern; got err = %v", err)
+	}
+
+	if r.Matches("/products/123", http.MethodGet, "http://localhost/checkout", nil) {
+		t.Errorf("Matches() expected pattern exclusion to apply; got match")
+	}
+	if !r.Matches("/products/123", http.MethodGet, "http://localhost/catalogue", nil) {
+		t.Errorf("Matches() expected pattern to match; got no match")
+	}
+}
+
+func TestRequestFilter_AddPathPattern_InvalidPattern(t *testing.T) {
+	r := NewRequestFilter(FilterModeAllowlist, 0)
+	if err := r.AddPathPattern("/products/[", http.MethodGet); err == nil {
+		t.Errorf("AddPathPattern() expected err for malformed pattern; got nil")
+	}
+}
+
+func TestRequestFilter_RemovePath(t *testing.T) {
+	r := NewRequestFilter(FilterModeAllowlist, 0)
+	r.AddPath("/catalogue", http.MethodGet)
+	r.AddPath("/catalogue", http.MethodPost)
+	if err := r.AddRefererExclusion("/catalogue", http.MethodGet, "checkout"); err != nil {
+		t.Fatalf("AddRefererExclusion() expected nil err; got err = %v", err)
+	}
+
+	if err := r.RemovePath("catalogue", http.MethodGet); err != nil {
+		t.Fatalf("RemovePath() expected nil err; got err = %v", err)
+	}
+
+	for _, path := range []string{"/catalogue", "catalogue"} {
+		if r.Matches(path, http.MethodGet, "", nil) {
+			t.Errorf("Matches(%q) expected no match after removal; got match", path)
+		}
+		if _, exists := r.refererExclusions[toRequestFilterRule(path, http.MethodGet)]; exists {
+			t.Errorf("RemovePath() expected referer exclusions for %q removed; got exclusions", path)
+		}
+	}
+	// Rules for other methods are unaffected.
+	if !r.Matches("/catalogue", http.MethodPost, "", nil) {
+		t.Errorf("Matches() expected POST rule to remain; got no match")
+	}
+}
+
+func TestRequestFilter_RemovePath_MissingRule(t *testing.T) {
+	r := NewRequestFilter(FilterModeAllowlist, 0)
+	r.AddPath("/catalogue", http.MethodGet)
+	if err := r.RemovePath("/catalogue", http.MethodPost); err == nil {
+		t.Errorf("RemovePath() expected err for missing rule; got nil")
+	}
+}
+
+func TestRequestFilter_RemovePathForAllMethods(t *testing.T) {
+	r := NewRequestFilter(FilterModeAllowlist, 0)
+	r.AddPathForAllMethods("/catalogue")
+	r.AddPath("/cart", http.MethodGet)
+	if err := r.AddRefererExclusion("/catalogue", http.MethodPost, "checkout"); err != nil {
+		t.Fatalf("AddRefererExclusion() expected nil err; got err = %v", err)
+	}
+
+	if err := r.RemovePathForAllMethods("/catalogue"); err != nil {
+		t.Fatalf("RemovePathForAllMethods() expected nil err; got err = %v", err)
+	}
+
+	for _, method := range allMethods {
+		if r.Matches("catalogue", method, "", nil) {
+			t.Errorf("Matches() expected no match for %s after removal; got match", method)
+		}
+	}
+	if len(r.refererExclusions) != 0 {
+		t.Errorf("RemovePathForAllMethods() expected referer exclusions removed; got %v", r.refererExclusions)
+	}
+	if !r.Matches("/cart", http.MethodGet, "", nil) {
+		t.Errorf("Matches() expected other paths to remain; got no match")
+	}
+
+	if err := r.RemovePathForAllMethods("/catalogue"); err == nil {
+		t.Errorf("RemovePathForAllMethods() expected err once removed; got nil")
+	}
+}
+
+func TestRequestFilter_RemovePath_Denylist(t *testing.T) {
+	r := NewRequestFilter(FilterModeDenylist, 0)
+	r.AddPath("/checkout", http.MethodGet)
+	if r.Matches("/checkout", http.MethodGet, "", nil) {
+		t.Fatalf("Matches() expected denylisted path not to match; got match")
+	}
+
+	if err := r.RemovePath("/checkout", http.MethodGet); err != nil {
+		t.Fatalf("RemovePath() expected nil err; got err = %v", err)
+	}
+	if !r.Matches("/checkout", http.MethodGet, "", nil) {
+		t.Errorf("Matches() expected path to be dimmable after removal from denylist; got no match")
+	}
+}
+
+// newTestHeaderAccessor returns a HeaderAccessor for the given headers, whose
+// names must be canonical.
+func newTestHeaderAccessor(headers map[string]string) HeaderAccessor {
+	return func(name string) []byte {
+		value, exists := headers[name]
+		if !exists {
+			return nil
+		}
+		return []byte(value)
+	}
+}
+
+func TestRequestFilter_AddHeaderExclusion(t *testing.T) {
+	r := NewRequestFilter(FilterModeAllowlist, 0)
+	r.AddPath("/catalogue", http.MethodGet)
+	exclusions := []struct {
+		header    string
+		substring string
+	}{
+		{header: "x-client-type", substring: "mobile"},
+		{header: "X-Client-Type", substring: "tablet"},
+		{header: "User-Agent", substring: "bot"},
+	}
+	for _, exclusion := range exclusions {
+		if err := r.AddHeaderExclusion("catalogue", http.MethodGet, exclusion.header, exclusion.substring); err != nil {
+			t.Fatalf("AddHeaderExclusion() expected nil err; got err = %v", err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		headers map[string]string
+		want    bool
+	}{
+		{name: "No headers", path: "/catalogue", headers: nil, want: true},
+		{name: "Non-excluded header values", path: "/catalogue", headers: map[string]string{"X-Client-Type": "desktop", "User-Agent": "Mozilla"}, want: true},
+		{name: "First substring of header", path: "/catalogue", headers: map[string]string{"X-Client-Type": "mobile"}, want: false},
+		{name: "Second substring of header", path: "catalogue", headers: map[string]string{"X-Client-Type": "tablet"}, want: false},
+		{name: "Second header", path: "/catalogue", headers: map[string]string{"X-Client-Type": "desktop", "User-Agent": "googlebot"}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := r.Matches(tt.path, http.MethodGet, "", newTestHeaderAccessor(tt.headers)); got != tt.want {
+				t.Errorf("Matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// A nil accessor skips header exclusions.
+	if !r.Matches("/catalogue", http.MethodGet, "", nil) {
+		t.Errorf("Matches() expected match with nil header accessor; got no match")
+	}
+}
+
+func TestRequestFilter_AddHeaderExclusion_WithRefererExclusion(t *testing.T) {
+	r := NewRequestFilter(FilterModeAllowlist, 0)
+	r.AddPath("/catalogue", http.MethodGet)
+	if err := r.AddRefererExclusion("/catalogue", http.MethodGet, "checkout"); err != nil {
+		t.Fatalf("AddRefererExclusion() expected nil err; got err = %v", err)
+	}
+	if err := r.AddHeaderExclusion("/catalogue", http.MethodGet, "X-Client-Type", "mobile"); err != nil {
+		t.Fatalf("AddHeaderExclusion() expected nil err; got err = %v", err)
+	}
+
+	header := newTestHeaderAccessor(map[string]string{"X-Client-Type": "desktop"})
+	if r.Matches("/catalogue", http.MethodGet, "http://localhost/checkout", header) {
+		t.Errorf("Matches() expected referer exclusion to apply; got match")
+	}
+	if !r.Matches("/catalogue", http.MethodGet, "http://localhost/", header) {
+		t.Errorf("Matches() expected match; got no match")
+	}
+}
+
+func TestRequestFilter_AddHeaderExclusion_Errors(t *testing.T) {
+	r := NewRequestFilter(FilterModeAllowlist, 1)
+	r.AddPath("/catalogue", http.MethodGet)
+
+	if err := r.AddHeaderExclusion("/cart", http.MethodGet, "X-Client-Type", "mobile"); err == nil {
+		t.Errorf("AddHeaderExclusion() expected err for missing rule; got nil")
+	}
+	if err := r.AddHeaderExclusion("/catalogue", http.MethodGet, "", "mobile"); err == nil {
+		t.Errorf("AddHeaderExclusion() expected err for empty header name; got nil")
+	}
+	if err := r.AddHeaderExclusion("/catalogue", http.MethodGet, "X-Client-Type", "mobile"); err != nil {
+		t.Fatalf("AddHeaderExclusion() expected nil err; got err = %v", err)
+	}
+	if err := r.AddHeaderExclusion("/catalogue", http.MethodGet, "X-Client-Type", "tablet"); err == nil {
+		t.Errorf("AddHeaderExclusion() expected err once cap exceeded; got nil")
+	}
+}
+
+func TestRequestFilter_RemovePath_RemovesHeaderExclusions(t *testing.T) {
+	r := NewRequestFilter(FilterModeAllowlist, 0)
+	r.AddPath("/catalogue", http.MethodGet)
+	if err := r.AddHeaderExclusion("/catalogue", http.MethodGet, "X-Client-Type", "mobile"); err != nil {
+		t.Fatalf("AddHeaderExclusion() expected nil err; got err = %v", err)
+	}
+
+	if err := r.RemovePath("/catalogue", http.MethodGet); err != nil {
+		t.Fatalf("RemovePath() expected nil err; got err = %v", err)
+	}
+	if len(r.headerExclusions) != 0 {
+		t.Errorf("RemovePath() expected header exclusions removed; got %v", r.headerExclusions)
+	}
+}
+
+func TestRequestFilter_AddRefererInclusion(t *testing.T) {
+	r := NewRequestFilter(FilterModeAllowlist, 0)
+	r.AddPath("/images", http.MethodGet)
+	r.AddPath("/catalogue", http.MethodGet)
+	for _, substring := range []string{"/search", "/category"} {
+		if err := r.AddRefererInclusion("images", http.MethodGet, substring); err != nil {
+			t.Fatalf("AddRefererInclusion() expected nil err; got err = %v", err)
+		}
+	}
+	if err := r.AddRefererExclusion("/images", http.MethodGet, "/search?internal"); err != nil {
+		t.Fatalf("AddRefererExclusion() expected nil err; got err = %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		referer string
+		want    bool
+	}{
+		{name: "First inclusion", path: "/images", referer: "http://localhost/search?q=socks", want: true},
+		{name: "Second inclusion", path: "images", referer: "http://localhost/category/socks", want: true},
+		{name: "No inclusion", path: "/images", referer: "http://localhost/basket", want: false},
+		{name: "Empty referer", path: "/images", referer: "", want: false},
+		{name: "Exclusion takes precedence over inclusion", path: "/images", referer: "http://localhost/search?internal", want: false},
+		{name: "Rule without inclusions", path: "/catalogue", referer: "http://localhost/basket", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := r.Matches(tt.path, http.MethodGet, tt.referer, nil); got != tt.want {
+				t.Errorf("Matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequestFilter_AddRefererInclusion_Errors(t *testing.T) {
+	r := NewRequestFilter(FilterModeAllowlist, 1)
+	r.AddPath("/images", http.MethodGet)
+
+	if err := r.AddRefererInclusion("/catalogue", http.MethodGet, "/search"); err == nil {
+		t.Errorf("AddRefererInclusion() expected err for missing rule; got nil")
+	}
+	if err := r.AddRefererInclusion("/images", http.MethodGet, "/search"); err != nil {
+		t.Fatalf("AddRefererInclusion() expected nil err; got err = %v", err)
+	}
+	if err := r.AddRefererInclusion("/images", http.MethodGet, "/category"); err == nil {
+		t.Errorf("AddRefererInclusion() expected err once cap exceeded; got nil")
+	}
+}
+
+func TestRequestFilter_AddRefererInclusion_Denylist(t *testing.T) {
+	r := NewRequestFilter(FilterModeDenylist, 0)
+	r.AddPath("/images", http.MethodGet)
+	if err := r.AddRefererInclusion("/images", http.MethodGet, "/checkout"); err != nil {
+		t.Fatalf("AddRefererInclusion() expected nil err; got err = %v", err)
+	}
+
+	// Only images loaded from the checkout are never dimmed.
+	if r.Matches("/images", http.MethodGet, "http://localhost/checkout", nil) {
+		t.Errorf("Matches() expected included referer to match the denylist; got match")
+	}
+	if !r.Matches("/images", http.MethodGet, "http://localhost/search", nil) {
+		t.Errorf("Matches() expected other referers to be dimmable; got no match")
+	}
+}
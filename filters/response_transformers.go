@@ -0,0 +1,75 @@
+package filters
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ResponseTransformer reduces the body of a proxied response, allowing a
+// component to degrade to a smaller payload rather than being dimmed
+// wholesale, e.g. returning 3 recommendations instead of 20.
+type ResponseTransformer interface {
+	// Transform returns the transformed body, or an error if the body cannot
+	// be transformed, in which case the response is returned unchanged.
+	Transform(body []byte) ([]byte, error)
+}
+
+// JSONArrayTruncator truncates a JSON array body to at most maxItems items.
+// Items are kept as-is, so they are not re-encoded.
+type JSONArrayTruncator struct {
+	maxItems int
+}
+
+func NewJSONArrayTruncator(maxItems int) (*JSONArrayTruncator, error) {
+	if maxItems < 0 {
+		return nil, errors.New(fmt.Sprintf("NewJSONArrayTruncator() expected non-negative maxItems; got maxItems = %d", maxItems))
+	}
+	return &JSONArrayTruncator{maxItems: maxItems}, nil
+}
+
+func (t *JSONArrayTruncator) Transform(body []byte) ([]byte, error) {
+	var items []json.RawMessage
+	if err := json.Unmarshal(body, &items); err != nil {
+		return nil, fmt.Errorf("expected body to be a JSON array; got err = %w", err)
+	}
+	// A body of null unmarshals to a nil slice, and is returned unchanged.
+	if items == nil || len(items) <= t.maxItems {
+		return body, nil
+	}
+
+	// The items are joined rather than marshalled, as marshalling would
+	// escape HTML characters within them.
+	kept := make([][]byte, t.maxItems)
+	for i := range kept {
+		kept[i] = items[i]
+	}
+	return append(append([]byte{'['}, bytes.Join(kept, []byte{','})...), ']'), nil
+}
+
+// ResponseTransformers stores per-path response transformers. Lookup is
+// insensitive of a path's leading slash. ResponseTransformers is immutable so
+// it can be read concurrently by requests.
+type ResponseTransformers struct {
+	// transformers maps paths with a leading slash to their transformers.
+	transformers map[string]ResponseTransformer
+}
+
+func NewResponseTransformers(transformers map[string]ResponseTransformer) (*ResponseTransformers, error) {
+	t := &ResponseTransformers{transformers: make(map[string]ResponseTransformer, len(transformers))}
+	for path, transformer := range transformers {
+		if transformer == nil {
+			return nil, errors.New(fmt.Sprintf("NewResponseTransformers() expected a transformer for path %s; got nil", path))
+		}
+		t.transformers[prependLeadingSlashIfMissing(path)] = transformer
+	}
+	return t, nil
+}
+
+// Lookup returns the response transformer for path, or false if path has
+// none.
+func (t *ResponseTransformers) Lookup(path string) (ResponseTransformer, bool) {
+	transformer, exists := t.transformers[prependLeadingSlashIfMissing(path)]
+	return transformer, exists
+}
@@ -0,0 +1,60 @@
+package filters
+
+import "testing"
+
+func TestJSONArrayTruncator_Transform(t *testing.T) {
+	truncator, err := NewJSONArrayTruncator(2)
+	if err != nil {
+		t.Fatalf("expected NewJSONArrayTruncator() returns nil err; got err = %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		body    string
+		want    string
+		wantErr bool
+	}{
+		{name: "Array longer than max items", body: `[{"id": 1}, {"id": 2}, {"id": 3}]`, want: `[{"id": 1},{"id": 2}]`},
+		{name: "Array within max items", body: `[1, 2]`, want: `[1, 2]`},
+		{name: "Null", body: `null`, want: `null`},
+		{name: "Object", body: `{"items": [1, 2, 3]}`, wantErr: true},
+		{name: "Malformed", body: `[1, 2`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := truncator.Transform([]byte(tt.body))
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected Transform(%s) returns non-nil err", tt.body)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected Transform(%s) returns nil err; got err = %v", tt.body, err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("Transform(%s) = %s, want %s", tt.body, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResponseTransformers_Lookup(t *testing.T) {
+	truncator, err := NewJSONArrayTruncator(3)
+	if err != nil {
+		t.Fatalf("expected NewJSONArrayTruncator() returns nil err; got err = %v", err)
+	}
+	transformers, err := NewResponseTransformers(map[string]ResponseTransformer{"recommendations": truncator})
+	if err != nil {
+		t.Fatalf("expected NewResponseTransformers() returns nil err; got err = %v", err)
+	}
+
+	for _, path := range []string{"/recommendations", "recommendations"} {
+		if _, exists := transformers.Lookup(path); !exists {
+			t.Errorf("expected Lookup(%s) to find a transformer", path)
+		}
+	}
+	if _, exists := transformers.Lookup("/other"); exists {
+		t.Errorf("expected Lookup(/other) to find no transformer")
+	}
+}
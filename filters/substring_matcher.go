@@ -0,0 +1,115 @@
+package filters
+
+// substringMatcher checks whether a string contains any of a set of
+// substrings in a single pass using an Aho-Corasick automaton. The automaton is
+// compiled into a DFA when the matcher is created, so containsAny is O(n) in
+// the length of the input regardless of the number of substrings.
+//
+// A substringMatcher is immutable so it can be read concurrently by requests.
+// Adding a substring creates a new matcher via withSubstring.
+type substringMatcher struct {
+	substrings []string
+
+	// byteClasses maps each byte to a class. Bytes which do not occur in any
+	// substring share class 0, keeping the transition table narrow.
+	byteClasses [256]int32
+	numClasses  int32
+	// transitions is a numStates x numClasses table, where the next state from
+	// state s on byte b is transitions[s*numClasses+byteClasses[b]].
+	transitions []int32
+	// accepting[s] is true if any substring ends at state s, including
+	// substrings which are suffixes of the path to s.
+	accepting []bool
+}
+
+func newSubstringMatcher(substrings []string) *substringMatcher {
+	m := &substringMatcher{
+		substrings: substrings,
+		numClasses: 1,
+	}
+
+	for _, substring := range substrings {
+		for i := 0; i < len(substring); i++ {
+			if m.byteClasses[substring[i]] == 0 {
+				m.byteClasses[substring[i]] = m.numClasses
+				m.numClasses++
+			}
+		}
+	}
+
+	// Build the trie, using -1 for transitions which are not yet known.
+	m.addState()
+	for _, substring := range substrings {
+		state := int32(0)
+		for i := 0; i < len(substring); i++ {
+			idx := state*m.numClasses + m.byteClasses[substring[i]]
+			if m.transitions[idx] == -1 {
+				m.transitions[idx] = m.addState()
+			}
+			state = m.transitions[idx]
+		}
+		m.accepting[state] = true
+	}
+
+	// Breadth-first, replace unknown transitions with those of the failure
+	// state, converting the trie into a DFA. The failure state of each state is
+	// its longest proper suffix which is also in the trie.
+	fail := make([]int32, len(m.accepting))
+	queue := make([]int32, 0, len(m.accepting))
+	for c := int32(0); c < m.numClasses; c++ {
+		if next := m.transitions[c]; next == -1 {
+			m.transitions[c] = 0
+		} else {
+			queue = append(queue, next)
+		}
+	}
+	for len(queue) != 0 {
+		state := queue[0]
+		queue = queue[1:]
+		m.accepting[state] = m.accepting[state] || m.accepting[fail[state]]
+
+		for c := int32(0); c < m.numClasses; c++ {
+			idx := state*m.numClasses + c
+			fallback := m.transitions[fail[state]*m.numClasses+c]
+			if next := m.transitions[idx]; next == -1 {
+				m.transitions[idx] = fallback
+			} else {
+				fail[next] = fallback
+				queue = append(queue, next)
+			}
+		}
+	}
+
+	return m
+}
+
+func (m *substringMatcher) addState() int32 {
+	state := int32(len(m.accepting))
+	m.accepting = append(m.accepting, false)
+	for c := int32(0); c < m.numClasses; c++ {
+		m.transitions = append(m.transitions, -1)
+	}
+	return state
+}
+
+// withSubstring returns a new matcher which additionally matches substring.
+func (m *substringMatcher) withSubstring(substring string) *substringMatcher {
+	substrings := make([]string, len(m.substrings), len(m.substrings)+1)
+	copy(substrings, m.substrings)
+	return newSubstringMatcher(append(substrings, substring))
+}
+
+// containsAny returns true if s contains any of the matcher's substrings.
+func (m *substringMatcher) containsAny(s string) bool {
+	state := int32(0)
+	if m.accepting[state] {
+		return true
+	}
+	for i := 0; i < len(s); i++ {
+		state = m.transitions[state*m.numClasses+m.byteClasses[s[i]]]
+		if m.accepting[state] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+package filters
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func Test_substringMatcher_containsAny(t *testing.T) {
+	tests := []struct {
+		name       string
+		substrings []string
+		s          string
+	}{
+		{name: "No substrings", substrings: nil, s: "foo"},
+		{name: "Empty substring matches anything", substrings: []string{""}, s: "foo"},
+		{name: "Empty input", substrings: []string{"foo"}, s: ""},
+		{name: "Exact match", substrings: []string{"foo"}, s: "foo"},
+		{name: "Match in middle", substrings: []string{"bar"}, s: "foobarbaz"},
+		{name: "No match", substrings: []string{"bar", "baz"}, s: "foo"},
+		{name: "Partial match only", substrings: []string{"barn"}, s: "foobar"},
+		{name: "Match via failure link", substrings: []string{"abcd", "bc"}, s: "xabcx"},
+		{name: "Suffix of another substring", substrings: []string{"shers", "he"}, s: "ushe"},
+		{name: "Overlapping prefixes", substrings: []string{"aab", "ab"}, s: "aaab"},
+		{name: "Repeated characters", substrings: []string{"aaaa"}, s: "aaabaaa"},
+		{name: "Referer URL", substrings: []string{"/catalogue", "/basket.html"}, s: "http://localhost/basket.html?x=1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := false
+			for _, substring := range tt.substrings {
+				if strings.Contains(tt.s, substring) {
+					want = true
+				}
+			}
+
+			if got := newSubstringMatcher(tt.substrings).containsAny(tt.s); got != want {
+				t.Errorf("containsAny() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func Test_substringMatcher_withSubstring(t *testing.T) {
+	m := newSubstringMatcher([]string{"foo"})
+	n := m.withSubstring("bar")
+
+	if m.containsAny("bar") {
+		t.Errorf("withSubstring() expected original matcher to be unchanged")
+	}
+	if !n.containsAny("bar") || !n.containsAny("foo") {
+		t.Errorf("withSubstring() expected new matcher to match original and added substrings")
+	}
+}
+
+// benchmarkRefererExclusions returns 50 referer exclusions and a referer which
+// matches none of them, the worst case as every exclusion must be checked.
+func benchmarkRefererExclusions() ([]string, string) {
+	var exclusions []string
+	for i := 0; i < 50; i++ {
+		exclusions = append(exclusions, fmt.Sprintf("/catalogue/item-%d", i))
+	}
+	return exclusions, "http://frontend.example.com/catalogue/item-none?size=5&tags=brown,formal"
+}
+
+func BenchmarkRefererExclusions_StringsContains(b *testing.B) {
+	exclusions, referer := benchmarkRefererExclusions()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, substring := range exclusions {
+			if strings.Contains(referer, substring) {
+				b.Fatalf("expected referer not to be excluded")
+			}
+		}
+	}
+}
+
+func BenchmarkRefererExclusions_RequestFilter(b *testing.B) {
+	exclusions, referer := benchmarkRefererExclusions()
+	r := NewRequestFilter(FilterModeAllowlist, 0)
+	r.AddPath("/path", http.MethodGet)
+	for _, substring := range exclusions {
+		if err := r.AddRefererExclusion("/path", http.MethodGet, substring); err != nil {
+			b.Fatalf("expected AddRefererExclusion() returns nil err; got err = %v", err)
+		}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if !r.Matches("/path", http.MethodGet, referer, nil) {
+			b.Fatalf("expected referer not to be excluded")
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package filters
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+// surgeDetectorBuckets is the number of buckets the window is divided into.
+// Requests roll out of the window a bucket at a time.
+const surgeDetectorBuckets = 10
+
+// SurgeDetectorOptions configures a SurgeDetector.
+type SurgeDetectorOptions struct {
+	// Window is the period over which the request rate is measured.
+	Window time.Duration
+	// MinRequestsPerSecond is the request rate at or above which traffic is
+	// surging.
+	MinRequestsPerSecond float64
+	// Hysteresis is the amount the request rate must fall below
+	// MinRequestsPerSecond for a surge to end, so dimming does not flap while
+	// traffic hovers around the threshold.
+	Hysteresis float64
+}
+
+// SurgeDetector monitors the request rate to detect traffic surges, allowing
+// dimming to be gated behind load rather than latency alone: below the
+// threshold, the backend is expected to handle all traffic, so slow responses
+// are not worth dimming. Transitions are logged.
+type SurgeDetector struct {
+	options SurgeDetectorOptions
+	// bucketDuration is the window divided into surgeDetectorBuckets.
+	bucketDuration time.Duration
+	// requests counts requests in a ring of buckets spanning the window.
+	// current is the index of the bucket starting at bucketStart.
+	requests    [surgeDetectorBuckets]int
+	current     int
+	bucketStart time.Time
+	// isSurging is true from the rate reaching MinRequestsPerSecond until it
+	// falls below MinRequestsPerSecond - Hysteresis.
+	isSurging bool
+	// mux guards all fields other than options and bucketDuration.
+	mux *sync.Mutex
+	// now allows time to be controlled in tests.
+	now func() time.Time
+}
+
+func NewSurgeDetector(options SurgeDetectorOptions) (*SurgeDetector, error) {
+	if options.Window/surgeDetectorBuckets <= 0 {
+		return nil, errors.New(fmt.Sprintf("NewSurgeDetector() expected Window of at least %dns; got Window = %v", surgeDetectorBuckets, options.Window))
+	}
+	if !(options.MinRequestsPerSecond > 0 && !math.IsInf(options.MinRequestsPerSecond, 1)) {
+		return nil, errors.New(fmt.Sprintf("NewSurgeDetector() expected positive MinRequestsPerSecond; got MinRequestsPerSecond = %v", options.MinRequestsPerSecond))
+	}
+	if !(options.Hysteresis >= 0 && options.Hysteresis <= options.MinRequestsPerSecond) {
+		return nil, errors.New(fmt.Sprintf("NewSurgeDetector() expected Hysteresis in [0, MinRequestsPerSecond]; got Hysteresis = %v", options.Hysteresis))
+	}
+
+	return &SurgeDetector{
+		options:        options,
+		bucketDuration: options.Window / surgeDetectorBuckets,
+		mux:            &sync.Mutex{},
+		now:            time.Now,
+	}, nil
+}
+
+// AddRequest records a request.
+func (d *SurgeDetector) AddRequest() {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	d.advance(d.now())
+	d.requests[d.current]++
+}
+
+// IsSurging returns true if traffic is surging, updating whether it is
+// surging from the current request rate.
+func (d *SurgeDetector) IsSurging() bool {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	d.advance(d.now())
+	rate := d.rate()
+	if !d.isSurging && rate >= d.options.MinRequestsPerSecond {
+		d.isSurging = true
+		log.Printf("traffic surge detected at %.2f requests per second; enabling dimming", rate)
+	} else if d.isSurging && rate < d.options.MinRequestsPerSecond-d.options.Hysteresis {
+		d.isSurging = false
+		log.Printf("traffic surge ended at %.2f requests per second; disabling dimming", rate)
+	}
+	return d.isSurging
+}
+
+// RequestsPerSecond returns the request rate within the window.
+func (d *SurgeDetector) RequestsPerSecond() float64 {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	d.advance(d.now())
+	return d.rate()
+}
+
+// rate returns the request rate within the window. The caller must hold mux.
+func (d *SurgeDetector) rate() float64 {
+	var requests int
+	for i := 0; i < surgeDetectorBuckets; i++ {
+		requests += d.requests[i]
+	}
+	return float64(requests) / d.options.Window.Seconds()
+}
+
+// advance clears the buckets which have rolled out of the window by now, so
+// the current bucket contains now. The caller must hold mux.
+func (d *SurgeDetector) advance(now time.Time) {
+	if d.bucketStart.IsZero() {
+		d.bucketStart = now
+		return
+	}
+
+	elapsed := now.Sub(d.bucketStart) / d.bucketDuration
+	if elapsed <= 0 {
+		return
+	}
+	d.bucketStart = d.bucketStart.Add(elapsed * d.bucketDuration)
+
+	// Buckets are only cleared once each, even if the whole window elapsed.
+	if elapsed > surgeDetectorBuckets {
+		elapsed = surgeDetectorBuckets
+	}
+	for i := 0; i < int(elapsed); i++ {
+		d.current = (d.current + 1) % surgeDetectorBuckets
+		d.requests[d.current] = 0
+	}
+}
@@ -0,0 +1,61 @@
+package filters
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSurgeDetector_IsSurgingWithHysteresis(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	d, err := NewSurgeDetector(SurgeDetectorOptions{
+		Window:               time.Second,
+		MinRequestsPerSecond: 10,
+		Hysteresis:           4,
+	})
+	if err != nil {
+		t.Fatalf("expected NewSurgeDetector() returns nil err; got err = %v", err)
+	}
+	d.now = func() time.Time { return now }
+
+	tests := []struct {
+		name          string
+		requests      int
+		wantIsSurging bool
+	}{
+		{name: "Rate below threshold", requests: 9, wantIsSurging: false},
+		{name: "Rate reaches threshold", requests: 10, wantIsSurging: true},
+		{name: "Rate within hysteresis band", requests: 6, wantIsSurging: true},
+		{name: "Rate below hysteresis band", requests: 5, wantIsSurging: false},
+		{name: "Rate within hysteresis band while not surging", requests: 8, wantIsSurging: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < tt.requests; i++ {
+				d.AddRequest()
+			}
+			if got := d.IsSurging(); got != tt.wantIsSurging {
+				t.Errorf("expected IsSurging() = %v at %v requests per second; got %v", tt.wantIsSurging, d.RequestsPerSecond(), got)
+			}
+			// Roll all requests out of the window.
+			now = now.Add(time.Second)
+		})
+	}
+}
+
+func TestNewSurgeDetector_InvalidOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		options SurgeDetectorOptions
+	}{
+		{name: "Window too short", options: SurgeDetectorOptions{Window: 1, MinRequestsPerSecond: 10}},
+		{name: "Non-positive threshold", options: SurgeDetectorOptions{Window: time.Second, MinRequestsPerSecond: 0}},
+		{name: "Hysteresis exceeds threshold", options: SurgeDetectorOptions{Window: time.Second, MinRequestsPerSecond: 10, Hysteresis: 11}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewSurgeDetector(tt.options); err == nil {
+				t.Errorf("expected NewSurgeDetector(%+v) returns non-nil err", tt.options)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package logging
+
+import (
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	"log"
+	"time"
+)
+
+// Decision is a dimming decision made for a dimmable request.
+type Decision struct {
+	Timestamp time.Time
+	// SessionID is empty if the request has no session cookie.
+	SessionID string
+	Method    string
+	Path      string
+	IsDimmed  bool
+}
+
+// DecisionSink exports dimming decisions to an analytics sink, so the business
+// impact of dimming can be measured by joining decisions against business
+// metrics such as conversions. Record is called while serving requests, so
+// implementations must not block.
+type DecisionSink interface {
+	Record(decision Decision)
+}
+
+// InfluxDBDecisionSink writes decisions to InfluxDB in batches.
+type InfluxDBDecisionSink struct {
+	client      influxdb2.Client
+	asyncWriter api.WriteAPI
+	// measurementPrefix is prepended to the decision measurement name.
+	measurementPrefix string
+}
+
+func NewInfluxDBDecisionSink(addr, authToken, org, bucket, measurementPrefix string) *InfluxDBDecisionSink {
+	options := influxdb2.DefaultOptions()
+	options.WriteOptions().SetBatchSize(1000)
+	options.WriteOptions().SetFlushInterval(1000)
+
+	client := influxdb2.NewClientWithOptions(addr, authToken, options)
+	writeAPI := client.WriteAPI(org, bucket)
+
+	// Create a goroutine for reading and logging async write errors.
+	errorsCh := writeAPI.Errors()
+	go func() {
+		for err := range errorsCh {
+			log.Printf("influxdb2 decision sink async write error: %v\n", err)
+		}
+	}()
+
+	return &InfluxDBDecisionSink{
+		client:            client,
+		asyncWriter:       writeAPI,
+		measurementPrefix: measurementPrefix,
+	}
+}
+
+// Close flushes buffered decisions and closes the client, so decisions are not
+// lost on shutdown.
+func (s *InfluxDBDecisionSink) Close() {
+	s.client.Close()
+}
+
+// Record writes the decision as a point tagged by method and path, which are
+// bounded by the dimmable components. The session ID is a field rather than a
+// tag, as a tag per session would grow the series cardinality without bound.
+func (s *InfluxDBDecisionSink) Record(decision Decision) {
+	p := influxdb2.NewPointWithMeasurement(s.measurementPrefix+"decision").
+		AddTag("method", decision.Method).
+		AddTag("path", decision.Path).
+		AddField("session_id", decision.SessionID).
+		AddField("dimmed", decision.IsDimmed).
+		SetTime(decision.Timestamp)
+	s.asyncWriter.WritePoint(p)
+}
@@ -0,0 +1,54 @@
+package logging
+
+import (
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingWriteAPI records points written in memory. Other methods of
+// api.WriteAPI are not implemented.
+type recordingWriteAPI struct {
+	api.WriteAPI
+	points []*write.Point
+}
+
+func (w *recordingWriteAPI) WritePoint(point *write.Point) {
+	w.points = append(w.points, point)
+}
+
+func TestInfluxDBDecisionSink_Record(t *testing.T) {
+	writeAPI := &recordingWriteAPI{}
+	sink := &InfluxDBDecisionSink{asyncWriter: writeAPI, measurementPrefix: "dimmer_"}
+
+	timestamp := time.Unix(1600000000, 0)
+	sink.Record(Decision{
+		Timestamp: timestamp,
+		SessionID: "abc",
+		Method:    "GET",
+		Path:      "/path",
+		IsDimmed:  true,
+	})
+
+	if !assert.Len(t, writeAPI.points, 1) {
+		return
+	}
+	point := writeAPI.points[0]
+	assert.Equal(t, "dimmer_decision", point.Name())
+	assert.Equal(t, timestamp, point.Time())
+
+	tags := map[string]string{}
+	for _, tag := range point.TagList() {
+		tags[tag.Key] = tag.Value
+	}
+	assert.Equal(t, map[string]string{"method": "GET", "path": "/path"}, tags)
+
+	fields := map[string]interface{}{}
+	for _, field := range point.FieldList() {
+		fields[field.Key] = field.Value
+	}
+	assert.Equal(t, map[string]interface{}{"session_id": "abc", "dimmed": true}, fields)
+}
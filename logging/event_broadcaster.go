@@ -0,0 +1,64 @@
+package logging
+
+import (
+	"sync"
+)
+
+// eventSubscriberBufferSize is the number of events buffered for each
+// subscriber before further events are dropped for that subscriber, so a slow
+// subscriber does not block publishing or other subscribers.
+const eventSubscriberBufferSize = 100
+
+// EventBroadcaster fans out events to any number of subscribers, e.g. clients
+// streaming events from the API. Events published while there are no
+// subscribers are dropped.
+type EventBroadcaster struct {
+	subscribers map[chan Event]bool
+	// mux guards subscribers.
+	mux *sync.Mutex
+}
+
+func NewEventBroadcaster() *EventBroadcaster {
+	return &EventBroadcaster{
+		subscribers: map[chan Event]bool{},
+		mux:         &sync.Mutex{},
+	}
+}
+
+func (b *EventBroadcaster) Publish(event Event) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	for subscriber := range b.subscribers {
+		select {
+		case subscriber <- event:
+		default:
+		}
+	}
+}
+
+// Subscribe returns a channel receiving the events published from now on, and
+// a function which unsubscribes it. The function must be called once the
+// subscriber is done, e.g. on disconnect, and closes the channel.
+func (b *EventBroadcaster) Subscribe() (<-chan Event, func()) {
+	subscriber := make(chan Event, eventSubscriberBufferSize)
+	b.mux.Lock()
+	b.subscribers[subscriber] = true
+	b.mux.Unlock()
+
+	once := &sync.Once{}
+	return subscriber, func() {
+		once.Do(func() {
+			b.mux.Lock()
+			delete(b.subscribers, subscriber)
+			b.mux.Unlock()
+			close(subscriber)
+		})
+	}
+}
+
+// Subscribers returns the number of subscribers.
+func (b *EventBroadcaster) Subscribers() int {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return len(b.subscribers)
+}
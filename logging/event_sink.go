@@ -0,0 +1,227 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EventType identifies a dimming state change.
+type EventType string
+
+const (
+	// EventDimmingModeChanged is published when the dimming mode changes, with
+	// the previous and new modes as attributes from and to.
+	EventDimmingModeChanged EventType = "dimming_mode_changed"
+	// EventOnlineTrainingRulesAdopted is published when online training
+	// adopts candidate path probabilities, with the adopted probabilities as
+	// the attribute probabilities.
+	EventOnlineTrainingRulesAdopted EventType = "online_training_rules_adopted"
+	// EventDimmingThresholdCrossed is published when the dimming percentage
+	// crosses the configured threshold, with the attributes threshold,
+	// dimmingPercentage and direction, which is one of above or below.
+	EventDimmingThresholdCrossed EventType = "dimming_threshold_crossed"
+	// EventControlLoopTicked is published each control loop tick with the
+	// attributes dimmingPercentage and isHeld, which is true while the
+	// dimming percentage is held for the backend to recover. PID controllers
+	// also report the attributes p, i, d and error, and tunable controllers
+	// the attribute setpoint.
+	EventControlLoopTicked EventType = "control_loop_ticked"
+)
+
+// Event is a dimming state change published for downstream consumers.
+type Event struct {
+	Timestamp  time.Time              `json:"timestamp"`
+	Type       EventType              `json:"type"`
+	Attributes map[string]interface{} `json:"attributes"`
+}
+
+// EventSink publishes dimming state changes to an event bus. Publish is called
+// from the control loop and while changing state, so implementations must not
+// block.
+type EventSink interface {
+	Publish(event Event)
+}
+
+// MultiEventSink publishes events to each of its sinks.
+type MultiEventSink []EventSink
+
+func (s MultiEventSink) Publish(event Event) {
+	for _, sink := range s {
+		sink.Publish(event)
+	}
+}
+
+const (
+	// kafkaEventBufferSize is the number of events buffered before further
+	// events are dropped, e.g. while the REST proxy is unreachable.
+	kafkaEventBufferSize = 1000
+	// kafkaEventBatchSize is the maximum number of events sent per request.
+	kafkaEventBatchSize = 100
+	// kafkaRequestTimeout bounds each request to the REST proxy so a slow
+	// proxy delays batches rather than stalling them indefinitely.
+	kafkaRequestTimeout = 5 * time.Second
+)
+
+// KafkaRESTEventSink publishes events as JSON records to a Kafka topic via a
+// Kafka REST Proxy, which avoids a dependency on a native Kafka client. A
+// Confluent-compatible REST Proxy serving the v2 API must therefore be
+// deployed in front of the brokers; the sink cannot connect to brokers
+// directly. Events are buffered and sent in batches by a background goroutine,
+// and are dropped if the buffer is full, so publishing never blocks.
+type KafkaRESTEventSink struct {
+	// dropped is the number of events dropped since the last flush. It must
+	// be accessed atomically, and is first in the struct for 64-bit
+	// alignment on 32-bit platforms.
+	dropped       uint64
+	topicURL      string
+	client        *http.Client
+	events        chan Event
+	flushInterval time.Duration
+	// done is closed by Close to stop the background goroutine, which closes
+	// stopped once buffered events are sent.
+	done      chan struct{}
+	stopped   chan struct{}
+	closeOnce *sync.Once
+}
+
+func NewKafkaRESTEventSink(restProxyURL string, topic string, flushInterval time.Duration) (*KafkaRESTEventSink, error) {
+	if _, err := url.ParseRequestURI(restProxyURL); err != nil {
+		return nil, fmt.Errorf("NewKafkaRESTEventSink() expected valid restProxyURL; got err = %w", err)
+	}
+	if topic == "" {
+		return nil, errors.New("NewKafkaRESTEventSink() expected non-empty topic; got empty topic")
+	}
+	if flushInterval <= 0 {
+		return nil, errors.New(fmt.Sprintf("NewKafkaRESTEventSink() expected positive flushInterval; got flushInterval = %v", flushInterval))
+	}
+
+	s := &KafkaRESTEventSink{
+		topicURL:      strings.TrimSuffix(restProxyURL, "/") + "/topics/" + url.PathEscape(topic),
+		client:        &http.Client{Timeout: kafkaRequestTimeout},
+		events:        make(chan Event, kafkaEventBufferSize),
+		flushInterval: flushInterval,
+		done:          make(chan struct{}),
+		stopped:       make(chan struct{}),
+		closeOnce:     &sync.Once{},
+	}
+	go s.run()
+	return s, nil
+}
+
+// Publish buffers the event, dropping it if the buffer is full. Drops are
+// counted and logged once per flush rather than per event, so an unreachable
+// REST proxy does not flood the log.
+func (s *KafkaRESTEventSink) Publish(event Event) {
+	select {
+	case s.events <- event:
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+	}
+}
+
+// Close sends buffered events and stops the background goroutine, so events
+// are not lost on shutdown. Events published after Close are not sent.
+func (s *KafkaRESTEventSink) Close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+	<-s.stopped
+}
+
+// run sends buffered events once a batch is full or the flush interval
+// elapses, whichever is sooner, until Close is called.
+func (s *KafkaRESTEventSink) run() {
+	defer close(s.stopped)
+
+	ticker := time.NewTicker(s.flushInterval)
+	defer ticker.Stop()
+
+	var batch []Event
+	for {
+		select {
+		case event := <-s.events:
+			batch = append(batch, event)
+			if len(batch) < kafkaEventBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		case <-s.done:
+			s.drain(batch)
+			return
+		}
+
+		s.flush(batch)
+		batch = nil
+	}
+}
+
+// drain sends the batch and all buffered events, in batches.
+func (s *KafkaRESTEventSink) drain(batch []Event) {
+	for {
+		select {
+		case event := <-s.events:
+			batch = append(batch, event)
+			if len(batch) == kafkaEventBatchSize {
+				s.flush(batch)
+				batch = nil
+			}
+		default:
+			s.flush(batch)
+			return
+		}
+	}
+}
+
+// flush sends the batch if non-empty, and logs the number of events dropped
+// since the last flush.
+func (s *KafkaRESTEventSink) flush(batch []Event) {
+	if dropped := atomic.SwapUint64(&s.dropped, 0); dropped > 0 {
+		log.Printf("dropped %d events as the Kafka event buffer was full", dropped)
+	}
+	if len(batch) == 0 {
+		return
+	}
+	if err := s.send(batch); err != nil {
+		log.Printf("expected KafkaRESTEventSink.send() returns nil err; dropping %d events; got err = %v", len(batch), err)
+	}
+}
+
+// kafkaRecords is the request body of the Kafka REST Proxy v2 API for
+// producing JSON records.
+type kafkaRecords struct {
+	Records []kafkaRecord `json:"records"`
+}
+
+type kafkaRecord struct {
+	Value Event `json:"value"`
+}
+
+func (s *KafkaRESTEventSink) send(batch []Event) error {
+	records := kafkaRecords{Records: make([]kafkaRecord, len(batch))}
+	for i, event := range batch {
+		records.Records[i] = kafkaRecord{Value: event}
+	}
+	body, err := json.Marshal(records)
+	if err != nil {
+		return fmt.Errorf("expected json.Marshal() returns nil err; got err = %w", err)
+	}
+
+	resp, err := s.client.Post(s.topicURL, "application/vnd.kafka.json.v2+json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("expected POST %s returns nil err; got err = %w", s.topicURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(fmt.Sprintf("expected POST %s returns status 200; got status %d", s.topicURL, resp.StatusCode))
+	}
+	return nil
+}
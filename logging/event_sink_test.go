@@ -0,0 +1,132 @@
+package logging
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// kafkaRESTProxy is a fake Kafka REST Proxy recording the records produced.
+type kafkaRESTProxy struct {
+	*httptest.Server
+	// batches holds the records of each request received.
+	batches [][]kafkaRecord
+	mux     *sync.Mutex
+}
+
+func newKafkaRESTProxy(t *testing.T, handler func(w http.ResponseWriter, r *http.Request)) *kafkaRESTProxy {
+	proxy := &kafkaRESTProxy{mux: &sync.Mutex{}}
+	proxy.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		assert.Nil(t, err)
+		var records kafkaRecords
+		assert.Nilf(t, json.Unmarshal(body, &records), "expected JSON body; got %s", body)
+
+		proxy.mux.Lock()
+		proxy.batches = append(proxy.batches, records.Records)
+		proxy.mux.Unlock()
+
+		if handler != nil {
+			handler(w, r)
+		}
+	}))
+	t.Cleanup(proxy.Close)
+	return proxy
+}
+
+func (p *kafkaRESTProxy) batchSizes() []int {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	var sizes []int
+	for _, batch := range p.batches {
+		sizes = append(sizes, len(batch))
+	}
+	return sizes
+}
+
+func TestKafkaRESTEventSink_Publish_PayloadFormat(t *testing.T) {
+	var path, contentType string
+	proxy := newKafkaRESTProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		contentType = r.Header.Get("Content-Type")
+	})
+
+	sink, err := NewKafkaRESTEventSink(proxy.URL+"/", "dimmer-events", time.Hour)
+	assert.Nilf(t, err, "expected NewKafkaRESTEventSink(...) has no err; got %v", err)
+	timestamp := time.Unix(1600000000, 0).UTC()
+	sink.Publish(Event{
+		Timestamp:  timestamp,
+		Type:       EventDimmingModeChanged,
+		Attributes: map[string]interface{}{"from": "Dimming", "to": "ShadowDimming"},
+	})
+	sink.Close()
+
+	assert.Equal(t, "/topics/dimmer-events", path)
+	assert.Equal(t, "application/vnd.kafka.json.v2+json", contentType)
+	if assert.Equal(t, []int{1}, proxy.batchSizes()) {
+		event := proxy.batches[0][0].Value
+		assert.True(t, timestamp.Equal(event.Timestamp))
+		assert.Equal(t, EventDimmingModeChanged, event.Type)
+		assert.Equal(t, map[string]interface{}{"from": "Dimming", "to": "ShadowDimming"}, event.Attributes)
+	}
+}
+
+func TestKafkaRESTEventSink_Publish_Batches(t *testing.T) {
+	proxy := newKafkaRESTProxy(t, nil)
+
+	// The flush interval does not elapse, so full batches are sent as they
+	// fill and the remainder is sent on Close.
+	sink, err := NewKafkaRESTEventSink(proxy.URL, "dimmer-events", time.Hour)
+	assert.Nilf(t, err, "expected NewKafkaRESTEventSink(...) has no err; got %v", err)
+	for i := 0; i < 2*kafkaEventBatchSize+50; i++ {
+		sink.Publish(Event{Type: EventControlLoopTicked})
+	}
+	sink.Close()
+
+	assert.Equal(t, []int{kafkaEventBatchSize, kafkaEventBatchSize, 50}, proxy.batchSizes())
+}
+
+func TestKafkaRESTEventSink_Publish_DropsWhenBufferFull(t *testing.T) {
+	received := make(chan struct{}, 1)
+	release := make(chan struct{})
+	var releaseOnce sync.Once
+	proxy := newKafkaRESTProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case received <- struct{}{}:
+		default:
+		}
+		<-release
+	})
+	t.Cleanup(func() { releaseOnce.Do(func() { close(release) }) })
+
+	sink, err := NewKafkaRESTEventSink(proxy.URL, "dimmer-events", 10*time.Millisecond)
+	assert.Nilf(t, err, "expected NewKafkaRESTEventSink(...) has no err; got %v", err)
+
+	// The first event is sent once the flush interval elapses, and the
+	// background goroutine then blocks until the proxy is released.
+	sink.Publish(Event{Type: EventControlLoopTicked})
+	<-received
+
+	for i := 0; i < kafkaEventBufferSize+3; i++ {
+		sink.Publish(Event{Type: EventControlLoopTicked})
+	}
+	assert.Equal(t, uint64(3), atomic.LoadUint64(&sink.dropped))
+
+	releaseOnce.Do(func() { close(release) })
+	sink.Close()
+
+	var sent int
+	for _, size := range proxy.batchSizes() {
+		sent += size
+	}
+	assert.Equal(t, 1+kafkaEventBufferSize, sent)
+	assert.Equal(t, uint64(0), atomic.LoadUint64(&sink.dropped), "expected drops are reset once logged")
+}
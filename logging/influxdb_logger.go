@@ -3,6 +3,7 @@ package logging
 import (
 	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
 	"github.com/influxdata/influxdb-client-go/v2/api"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
 	"log"
 	"time"
 )
@@ -11,9 +12,12 @@ import (
 type influxDBLogger struct {
 	client      influxdb2.Client
 	asyncWriter api.WriteAPI
+	// measurementPrefix is prepended to all measurement names, so several
+	// deployments can share a bucket with distinct namespaces.
+	measurementPrefix string
 }
 
-func NewInfluxDBLogger(baseURL, authToken, org, bucket string) *influxDBLogger {
+func NewInfluxDBLogger(baseURL, authToken, org, bucket, measurementPrefix string) *influxDBLogger {
 	options := influxdb2.DefaultOptions()
 	options.WriteOptions().SetBatchSize(1000)
 	options.WriteOptions().SetFlushInterval(250)
@@ -30,20 +34,32 @@ func NewInfluxDBLogger(baseURL, authToken, org, bucket string) *influxDBLogger {
 	}()
 
 	return &influxDBLogger{
-		client:      client,
-		asyncWriter: writeAPI,
+		client:            client,
+		asyncWriter:       writeAPI,
+		measurementPrefix: measurementPrefix,
 	}
 }
 
+// Close flushes buffered points and closes the client, so points are not lost
+// on shutdown.
+func (l *influxDBLogger) Close() {
+	l.client.Close()
+}
+
+// newPoint returns a point for measurement prefixed by measurementPrefix.
+func (l *influxDBLogger) newPoint(measurement string) *write.Point {
+	return influxdb2.NewPointWithMeasurement(l.measurementPrefix + measurement)
+}
+
 func (l *influxDBLogger) LogResponseTime(t float64) {
-	p := influxdb2.NewPointWithMeasurement("dimmer_individual_response_time").
+	p := l.newPoint("individual_response_time").
 		AddField("t", t).
 		SetTime(time.Now())
 	l.asyncWriter.WritePoint(p)
 }
 
 func (l *influxDBLogger) LogAggregateResponseTimes(p50 float64, p75 float64, p95 float64) {
-	p := influxdb2.NewPointWithMeasurement("dimmer_response_time").
+	p := l.newPoint("response_time").
 		AddField("p50", p50).
 		AddField("p75", p75).
 		AddField("p95", p95).
@@ -52,14 +68,14 @@ func (l *influxDBLogger) LogAggregateResponseTimes(p50 float64, p75 float64, p95
 }
 
 func (l *influxDBLogger) LogDimmerOutput(pidOutput float64) {
-	p := influxdb2.NewPointWithMeasurement("dimmer_output").
+	p := l.newPoint("output").
 		AddField("output", pidOutput).
 		SetTime(time.Now())
 	l.asyncWriter.WritePoint(p)
 }
 
 func (l *influxDBLogger) LogPIDControllerState(p float64, i float64, d float64, errorTerm float64) {
-	point := influxdb2.NewPointWithMeasurement("dimmer_pid_controller_state").
+	point := l.newPoint("pid_controller_state").
 		AddField("p", p).
 		AddField("i", i).
 		AddField("d", d).
@@ -68,19 +84,80 @@ func (l *influxDBLogger) LogPIDControllerState(p float64, i float64, d float64,
 	l.asyncWriter.WritePoint(point)
 }
 
+func (l *influxDBLogger) LogPIDControllerParameters(setpoint float64, kp float64, ki float64, kd float64) {
+	point := l.newPoint("pid_controller_parameters").
+		AddField("setpoint", setpoint).
+		AddField("kp", kp).
+		AddField("ki", ki).
+		AddField("kd", kd).
+		SetTime(time.Now())
+	l.asyncWriter.WritePoint(point)
+}
+
 func (l *influxDBLogger) LogOnlineTrainingProbabilities(control map[string]float64, candidate map[string]float64) {
 	timestamp := time.Now()
-	controlPoint := influxdb2.NewPointWithMeasurement("dimmer_online_training_control").
+	controlPoint := l.newPoint("online_training_control").
 		SetTime(timestamp)
 	for path, probability := range control {
 		controlPoint.AddField(path, probability)
 	}
 	l.asyncWriter.WritePoint(controlPoint)
 
-	candidatePoint := influxdb2.NewPointWithMeasurement("dimmer_online_training_candidate").
+	candidatePoint := l.newPoint("online_training_candidate").
 		SetTime(timestamp)
 	for path, probability := range candidate {
 		candidatePoint.AddField(path, probability)
 	}
 	l.asyncWriter.WritePoint(candidatePoint)
 }
+
+// LogOnlineTrainingRound writes each response time as a point tagged by group,
+// along with a point holding the verdict, so rounds can be analysed post-hoc.
+// As InfluxDB overwrites points with identical tags and timestamps, each
+// response time is offset from the round's timestamp by its index in
+// nanoseconds.
+func (l *influxDBLogger) LogOnlineTrainingRound(control []float64, candidate []float64, hasProbabilityDecreased bool, isAccepted bool) {
+	timestamp := time.Now()
+	for group, responseTimes := range map[string][]float64{"control": control, "candidate": candidate} {
+		for i, t := range responseTimes {
+			p := l.newPoint("online_training_round").
+				AddTag("group", group).
+				AddField("t", t).
+				SetTime(timestamp.Add(time.Duration(i)))
+			l.asyncWriter.WritePoint(p)
+		}
+	}
+
+	p := l.newPoint("online_training_round").
+		AddTag("group", "verdict").
+		AddField("probability_decreased", hasProbabilityDecreased).
+		AddField("accepted", isAccepted).
+		AddField("control_count", len(control)).
+		AddField("candidate_count", len(candidate)).
+		SetTime(timestamp)
+	l.asyncWriter.WritePoint(p)
+}
+
+func (l *influxDBLogger) LogOnlineTrainingPhase(phase int) {
+	p := l.newPoint("online_training_phase").
+		AddField("phase", phase).
+		SetTime(time.Now())
+	l.asyncWriter.WritePoint(p)
+}
+
+func (l *influxDBLogger) LogResponseTimeCollector(count int, utilization float64, timeSpan float64) {
+	p := l.newPoint("response_time_collector").
+		AddField("count", count).
+		AddField("utilization", utilization).
+		AddField("time_span", timeSpan).
+		SetTime(time.Now())
+	l.asyncWriter.WritePoint(p)
+}
+
+func (l *influxDBLogger) LogFilterMatches(total uint64, matched uint64) {
+	p := l.newPoint("filter_matches").
+		AddField("total", total).
+		AddField("matched", matched).
+		SetTime(time.Now())
+	l.asyncWriter.WritePoint(p)
+}
@@ -5,7 +5,12 @@ type Logger interface {
 	LogAggregateResponseTimes(p50 float64, p75 float64, p95 float64) // Takes in percentiles in seconds.
 	LogDimmerOutput(pidOutput float64)
 	LogPIDControllerState(p float64, i float64, d float64, errorTerm float64)
+	LogPIDControllerParameters(setpoint float64, kp float64, ki float64, kd float64) // Takes in effective gains.
 	LogOnlineTrainingProbabilities(control map[string]float64, candidate map[string]float64)
+	LogOnlineTrainingRound(control []float64, candidate []float64, hasProbabilityDecreased bool, isAccepted bool) // Takes in response times in seconds.
+	LogFilterMatches(total uint64, matched uint64)                                                                // Takes in cumulative request counts.
+	LogResponseTimeCollector(count int, utilization float64, timeSpan float64)                                    // Takes in time span in seconds.
+	LogOnlineTrainingPhase(phase int)                                                                             // Takes in an onlinetraining.Phase.
 }
 
 // noopLogger does not perform any logging.
@@ -31,6 +36,26 @@ func (*noopLogger) LogPIDControllerState(float64, float64, float64, float64) {
 	return
 }
 
+func (*noopLogger) LogPIDControllerParameters(float64, float64, float64, float64) {
+	return
+}
+
 func (*noopLogger) LogOnlineTrainingProbabilities(map[string]float64, map[string]float64) {
 	return
 }
+
+func (*noopLogger) LogOnlineTrainingRound([]float64, []float64, bool, bool) {
+	return
+}
+
+func (*noopLogger) LogFilterMatches(uint64, uint64) {
+	return
+}
+
+func (*noopLogger) LogResponseTimeCollector(int, float64, float64) {
+	return
+}
+
+func (*noopLogger) LogOnlineTrainingPhase(int) {
+	return
+}
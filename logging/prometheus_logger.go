@@ -0,0 +1,228 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// MetricsWriter is implemented by loggers which expose metrics to be scraped
+// rather than pushing them to an external service.
+type MetricsWriter interface {
+	// WriteMetrics writes the latest logged values to w.
+	WriteMetrics(w io.Writer) error
+}
+
+// prometheusLogger holds the latest logged values as gauges, which are written
+// in the Prometheus text exposition format when scraped.
+type prometheusLogger struct {
+	// mux guards all fields as values are logged from the control loop and
+	// online training while metrics are scraped from the API server.
+	mux *sync.Mutex
+
+	p50, p75, p95              float64
+	pidOutput                  float64
+	pidP, pidI, pidD, pidErr   float64
+	setpoint, kp, ki, kd       float64
+	hasPIDControllerParameters bool
+	controlProbabilities       map[string]float64
+	candidateProbabilities     map[string]float64
+	totalRequests              uint64
+	filterMatchedRequests      uint64
+	onlineTrainingPhase        int
+	collectorCount             int
+	collectorUtilization       float64
+	collectorTimeSpan          float64
+}
+
+func NewPrometheusLogger() *prometheusLogger {
+	return &prometheusLogger{
+		mux:                    &sync.Mutex{},
+		controlProbabilities:   map[string]float64{},
+		candidateProbabilities: map[string]float64{},
+	}
+}
+
+func (*prometheusLogger) LogResponseTime(_ float64) {
+	// Individual response times are not exposed as gauges.
+	return
+}
+
+func (l *prometheusLogger) LogAggregateResponseTimes(p50 float64, p75 float64, p95 float64) {
+	l.mux.Lock()
+	l.p50, l.p75, l.p95 = p50, p75, p95
+	l.mux.Unlock()
+}
+
+func (l *prometheusLogger) LogDimmerOutput(pidOutput float64) {
+	l.mux.Lock()
+	l.pidOutput = pidOutput
+	l.mux.Unlock()
+}
+
+func (l *prometheusLogger) LogPIDControllerState(p float64, i float64, d float64, errorTerm float64) {
+	l.mux.Lock()
+	l.pidP, l.pidI, l.pidD, l.pidErr = p, i, d, errorTerm
+	l.mux.Unlock()
+}
+
+func (l *prometheusLogger) LogPIDControllerParameters(setpoint float64, kp float64, ki float64, kd float64) {
+	l.mux.Lock()
+	l.setpoint, l.kp, l.ki, l.kd = setpoint, kp, ki, kd
+	l.hasPIDControllerParameters = true
+	l.mux.Unlock()
+}
+
+func (l *prometheusLogger) LogOnlineTrainingProbabilities(control map[string]float64, candidate map[string]float64) {
+	l.mux.Lock()
+	l.controlProbabilities = copyProbabilities(control)
+	l.candidateProbabilities = copyProbabilities(candidate)
+	l.mux.Unlock()
+}
+
+func (*prometheusLogger) LogOnlineTrainingRound(_ []float64, _ []float64, _ bool, _ bool) {
+	// Response time samples are not exposed as gauges.
+	return
+}
+
+func (l *prometheusLogger) LogFilterMatches(total uint64, matched uint64) {
+	l.mux.Lock()
+	l.totalRequests, l.filterMatchedRequests = total, matched
+	l.mux.Unlock()
+}
+
+func (l *prometheusLogger) LogOnlineTrainingPhase(phase int) {
+	l.mux.Lock()
+	l.onlineTrainingPhase = phase
+	l.mux.Unlock()
+}
+
+func (l *prometheusLogger) LogResponseTimeCollector(count int, utilization float64, timeSpan float64) {
+	l.mux.Lock()
+	l.collectorCount, l.collectorUtilization, l.collectorTimeSpan = count, utilization, timeSpan
+	l.mux.Unlock()
+}
+
+func (l *prometheusLogger) WriteMetrics(w io.Writer) error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	var b strings.Builder
+
+	writeMetricHeader(&b, "dimmer_response_time_seconds", "Aggregate response time percentiles observed by the dimmer.")
+	writeSample(&b, "dimmer_response_time_seconds", map[string]string{"quantile": "0.5"}, l.p50)
+	writeSample(&b, "dimmer_response_time_seconds", map[string]string{"quantile": "0.75"}, l.p75)
+	writeSample(&b, "dimmer_response_time_seconds", map[string]string{"quantile": "0.95"}, l.p95)
+
+	// The collector's data sufficiency indicates how far the percentiles can
+	// be trusted, e.g. a sparse window after a reset is noisy.
+	writeMetricHeader(&b, "dimmer_response_time_collector_count", "Response times held by the collector driving the PID controller.")
+	writeSample(&b, "dimmer_response_time_collector_count", nil, float64(l.collectorCount))
+	writeMetricHeader(&b, "dimmer_response_time_collector_utilization_ratio", "Proportion of the collector window filled.")
+	writeSample(&b, "dimmer_response_time_collector_utilization_ratio", nil, l.collectorUtilization)
+	writeMetricHeader(&b, "dimmer_response_time_collector_time_span_seconds", "Time between the oldest and newest response times held by the collector.")
+	writeSample(&b, "dimmer_response_time_collector_time_span_seconds", nil, l.collectorTimeSpan)
+
+	writeMetricHeader(&b, "dimmer_output_percent", "Dimming percentage output by the PID controller.")
+	writeSample(&b, "dimmer_output_percent", nil, l.pidOutput)
+
+	// The PID terms allow alerting on integral windup and derivative spikes.
+	writeMetricHeader(&b, "dimmer_pid_term", "PID controller terms calculated during the last control loop.")
+	writeSample(&b, "dimmer_pid_term", map[string]string{"term": "p"}, l.pidP)
+	writeSample(&b, "dimmer_pid_term", map[string]string{"term": "i"}, l.pidI)
+	writeSample(&b, "dimmer_pid_term", map[string]string{"term": "d"}, l.pidD)
+	writeSample(&b, "dimmer_pid_term", map[string]string{"term": "error"}, l.pidErr)
+
+	if l.hasPIDControllerParameters {
+		writeMetricHeader(&b, "dimmer_pid_info", "PID controller setpoint and effective gains.")
+		writeSample(&b, "dimmer_pid_info", map[string]string{
+			"setpoint": formatFloat(l.setpoint),
+			"kp":       formatFloat(l.kp),
+			"ki":       formatFloat(l.ki),
+			"kd":       formatFloat(l.kd),
+		}, 1)
+	}
+
+	writeMetricHeader(&b, "dimmer_online_training_probability", "Path probabilities for online training groups.")
+	writeProbabilities(&b, "control", l.controlProbabilities)
+	writeProbabilities(&b, "candidate", l.candidateProbabilities)
+	writeMetricHeader(&b, "dimmer_online_training_phase", "Online training phase: 0 idle, 1 adjusting, 2 measuring.")
+	writeSample(&b, "dimmer_online_training_phase", nil, float64(l.onlineTrainingPhase))
+
+	writeMetricHeaderWithType(&b, "dimmer_requests_total", "Requests received by the dimmer.", "counter")
+	writeSample(&b, "dimmer_requests_total", nil, float64(l.totalRequests))
+	writeMetricHeaderWithType(&b, "dimmer_filter_matched_requests_total", "Requests matched by the request filter and hence eligible for dimming.", "counter")
+	writeSample(&b, "dimmer_filter_matched_requests_total", nil, float64(l.filterMatchedRequests))
+	var filterMatchedRatio float64
+	if l.totalRequests != 0 {
+		filterMatchedRatio = float64(l.filterMatchedRequests) / float64(l.totalRequests)
+	}
+	writeMetricHeader(&b, "dimmer_filter_matched_ratio", "Proportion of requests matched by the request filter.")
+	writeSample(&b, "dimmer_filter_matched_ratio", nil, filterMatchedRatio)
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func copyProbabilities(probabilities map[string]float64) map[string]float64 {
+	c := make(map[string]float64, len(probabilities))
+	for path, probability := range probabilities {
+		c[path] = probability
+	}
+	return c
+}
+
+func writeProbabilities(b *strings.Builder, group string, probabilities map[string]float64) {
+	// Paths are sorted so the output is stable between scrapes.
+	paths := make([]string, 0, len(probabilities))
+	for path := range probabilities {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		writeSample(b, "dimmer_online_training_probability", map[string]string{"group": group, "path": path}, probabilities[path])
+	}
+}
+
+func writeMetricHeader(b *strings.Builder, name string, help string) {
+	writeMetricHeaderWithType(b, name, help, "gauge")
+}
+
+func writeMetricHeaderWithType(b *strings.Builder, name string, help string, metricType string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+func writeSample(b *strings.Builder, name string, labels map[string]string, value float64) {
+	b.WriteString(name)
+	if len(labels) != 0 {
+		keys := make([]string, 0, len(labels))
+		for key := range labels {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		b.WriteByte('{')
+		for i, key := range keys {
+			if i != 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(b, "%s=\"%s\"", key, escapeLabelValue(labels[key]))
+		}
+		b.WriteByte('}')
+	}
+	fmt.Fprintf(b, " %s\n", formatFloat(value))
+}
+
+// escapeLabelValue escapes backslashes, double quotes and line feeds per the
+// Prometheus text exposition format.
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
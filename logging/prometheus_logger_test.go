@@ -0,0 +1,78 @@
+package logging
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeMetrics returns the lines written by WriteMetrics.
+func writeMetrics(t *testing.T, l *prometheusLogger) []string {
+	var b strings.Builder
+	assert.Nil(t, l.WriteMetrics(&b))
+	return strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+}
+
+func TestPrometheusLogger_WriteMetrics_ReportsLoggedValues(t *testing.T) {
+	l := NewPrometheusLogger()
+	l.LogAggregateResponseTimes(0.1, 0.25, 0.5)
+	l.LogDimmerOutput(40)
+	l.LogPIDControllerState(1, 2, 3, -0.5)
+	l.LogPIDControllerParameters(0.3, 10, 0.5, 0)
+	l.LogOnlineTrainingProbabilities(map[string]float64{"/b": 0.5, "/a": 1}, map[string]float64{"/a": 0.75})
+	l.LogOnlineTrainingPhase(2)
+	l.LogFilterMatches(200, 50)
+	l.LogResponseTimeCollector(80, 0.8, 12.5)
+
+	lines := writeMetrics(t, l)
+	for _, sample := range []string{
+		`dimmer_response_time_seconds{quantile="0.5"} 0.1`,
+		`dimmer_response_time_seconds{quantile="0.75"} 0.25`,
+		`dimmer_response_time_seconds{quantile="0.95"} 0.5`,
+		`dimmer_response_time_collector_count 80`,
+		`dimmer_response_time_collector_utilization_ratio 0.8`,
+		`dimmer_response_time_collector_time_span_seconds 12.5`,
+		`dimmer_output_percent 40`,
+		`dimmer_pid_term{term="p"} 1`,
+		`dimmer_pid_term{term="i"} 2`,
+		`dimmer_pid_term{term="d"} 3`,
+		`dimmer_pid_term{term="error"} -0.5`,
+		`dimmer_pid_info{kd="0",ki="0.5",kp="10",setpoint="0.3"} 1`,
+		`dimmer_online_training_probability{group="control",path="/a"} 1`,
+		`dimmer_online_training_probability{group="control",path="/b"} 0.5`,
+		`dimmer_online_training_probability{group="candidate",path="/a"} 0.75`,
+		`dimmer_online_training_phase 2`,
+		`dimmer_requests_total 200`,
+		`dimmer_filter_matched_requests_total 50`,
+		`dimmer_filter_matched_ratio 0.25`,
+	} {
+		assert.Contains(t, lines, sample)
+	}
+
+	assert.Contains(t, lines, "# TYPE dimmer_requests_total counter")
+	assert.Contains(t, lines, "# TYPE dimmer_output_percent gauge")
+}
+
+func TestPrometheusLogger_WriteMetrics_OmitsPIDInfoUntilLogged(t *testing.T) {
+	lines := writeMetrics(t, NewPrometheusLogger())
+
+	for _, line := range lines {
+		assert.NotContains(t, line, "dimmer_pid_info")
+	}
+	// The ratio is 0 rather than NaN before any requests are received.
+	assert.Contains(t, lines, "dimmer_filter_matched_ratio 0")
+}
+
+func TestPrometheusLogger_LogOnlineTrainingProbabilities_CopiesMaps(t *testing.T) {
+	l := NewPrometheusLogger()
+	control := map[string]float64{"/a": 1}
+	l.LogOnlineTrainingProbabilities(control, map[string]float64{})
+	control["/a"] = 0
+
+	assert.Contains(t, writeMetrics(t, l), `dimmer_online_training_probability{group="control",path="/a"} 1`)
+}
+
+func TestEscapeLabelValue(t *testing.T) {
+	assert.Equal(t, `a\\b\"c\nd`, escapeLabelValue("a\\b\"c\nd"))
+}
@@ -28,6 +28,29 @@ func (*stdoutLogger) LogPIDControllerState(p float64, i float64, d float64, erro
 	log.Printf("p: %.3f, i: %.3f, d: %.3f, e(t): %.3f\n", p, i, d, errorTerm)
 }
 
+func (*stdoutLogger) LogPIDControllerParameters(_ float64, _ float64, _ float64, _ float64) {
+	// Do not log unchanging parameters to stdout on every control loop.
+	return
+}
+
 func (*stdoutLogger) LogOnlineTrainingProbabilities(control map[string]float64, candidate map[string]float64) {
 	log.Printf("online training probabilities:\n\tcontrol: %+v\n\tcandidate: %+v\n", control, candidate)
 }
+
+func (*stdoutLogger) LogOnlineTrainingRound(control []float64, candidate []float64, hasProbabilityDecreased bool, isAccepted bool) {
+	log.Printf("online training round: %d control and %d candidate response times, probability decreased: %v, accepted: %v\n", len(control), len(candidate), hasProbabilityDecreased, isAccepted)
+}
+
+func (*stdoutLogger) LogFilterMatches(_ uint64, _ uint64) {
+	// Do not log cumulative counts to stdout on every control loop.
+	return
+}
+
+func (*stdoutLogger) LogOnlineTrainingPhase(_ int) {
+	// Phase transitions are already logged by the training loop.
+	return
+}
+
+func (*stdoutLogger) LogResponseTimeCollector(count int, utilization float64, timeSpan float64) {
+	log.Printf("response time collector: %d samples, %.1f%% of window, spanning %.3fs\n", count, utilization*100, timeSpan)
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"crypto/tls"
+	"flag"
 	"fmt"
 	"github.com/kcz17/dimmer/config"
+	"github.com/kcz17/dimmer/cookies"
 	"github.com/kcz17/dimmer/filters"
 	"github.com/kcz17/dimmer/logging"
 	"github.com/kcz17/dimmer/offlinetraining"
@@ -10,7 +13,15 @@ import (
 	"github.com/kcz17/dimmer/pid"
 	"github.com/kcz17/dimmer/profiling"
 	"github.com/kcz17/dimmer/responsetimecollector"
+	"github.com/kcz17/dimmer/stats"
+	"github.com/valyala/fasthttp"
 	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 // ResponseTimeCollectorRequestsWindow defines the number of requests from which
@@ -22,41 +33,115 @@ import (
 const ResponseTimeCollectorRequestsWindow = 100
 
 func main() {
+	validateConfigPath := flag.String("validate-config", "", "validate the config file at this path and exit without starting the dimmer")
+	flag.Parse()
+
+	// ReadConfigFile exits with a non-zero status if the config is invalid.
+	if *validateConfigPath != "" {
+		config.ReadConfigFile(*validateConfigPath)
+		fmt.Println("Config is valid.")
+		os.Exit(0)
+	}
 	conf := config.ReadConfig()
 
 	logger := initLogger(conf)
 
+	// filterMatchCounter is shared so the control loop can log the counts
+	// incremented by the server.
+	filterMatchCounter := filters.NewMatchCounter()
+	// Events are always streamed to API subscribers, and are also published
+	// to Kafka if enabled.
+	eventStream := logging.NewEventBroadcaster()
+	var eventSink logging.EventSink = eventStream
+	kafkaSink := initEventSink(conf)
+	if kafkaSink != nil {
+		eventSink = logging.MultiEventSink{kafkaSink, eventStream}
+	}
 	controlLoop := initControlLoop(
 		conf,
 		initPIDController(conf),
-		responsetimecollector.NewTachymeterCollector(ResponseTimeCollectorRequestsWindow),
+		initResponseTimeCollector(conf),
 		logger,
+		filterMatchCounter,
+		eventSink,
+		eventStream,
 	)
+	controlSignalFilter := initControlSignalFilter(conf)
 
 	// Filters used to selectively dim routes.
 	requestFilter := initRequestFilter(conf)
 	pathProbabilities := initPathProbabilities(conf)
+	// Paths disabled via the API are shared so online training skips them.
+	disabledPaths := filters.NewDisabledPaths()
+	probabilityStore := initProbabilityStore(conf)
+	if probabilityStore != nil {
+		restorePathProbabilities(pathProbabilities, probabilityStore, initPaths(conf))
+	}
+
+	cookieAttributes := initCookieAttributes(conf)
 
 	onlineTrainingService, err := onlinetraining.NewOnlineTraining(
 		logger,
 		initPaths(conf),
 		pathProbabilities,
 		1,
+		onlinetraining.Options{
+			Seed:                           conf.Dimming.OnlineTraining.Seed,
+			PinEpsilon:                     *conf.Dimming.OnlineTraining.PinEpsilon,
+			PinnedPathHandling:             *conf.Dimming.OnlineTraining.PinnedPathHandling,
+			ShouldLogRounds:                *conf.Dimming.OnlineTraining.LogRounds,
+			MaxLoggedResponseTimesPerGroup: *conf.Dimming.OnlineTraining.MaxLoggedResponseTimesPerGroup,
+			MinCandidateResponseTimes:      *conf.Dimming.OnlineTraining.MinCandidateResponseTimes,
+			ShouldCompareErrorRates:        *conf.Dimming.OnlineTraining.CompareErrorRates,
+			ErrorRateTolerance:             *conf.Dimming.OnlineTraining.ErrorRateTolerance,
+			MinimumImprovementRatio:        *conf.Dimming.OnlineTraining.MinimumImprovementRatio,
+			CookieName:                     *conf.Dimming.OnlineTraining.CookieName,
+			CookieAttributes:               cookieAttributes,
+			CandidateProbability:           *conf.Dimming.OnlineTraining.CandidateProbability,
+			MinCandidateProbability:        *conf.Dimming.OnlineTraining.MinCandidateProbability,
+			MaxCandidateProbability:        *conf.Dimming.OnlineTraining.MaxCandidateProbability,
+			EventSink:                      eventSink,
+			TestDuration:                   time.Duration(*conf.Dimming.OnlineTraining.TestDurationSeconds * float64(time.Second)),
+			AdjustmentDuration:             time.Duration(*conf.Dimming.OnlineTraining.AdjustmentDurationSeconds * float64(time.Second)),
+			SamplingVariance:               *conf.Dimming.OnlineTraining.SamplingVariance,
+			CandidateSampler:               initCandidateSampler(conf),
+			SignificancePercentile:         *conf.Dimming.OnlineTraining.SignificancePercentile,
+			ProbabilityStore:               probabilityStore,
+			CandidateGroups:                *conf.Dimming.OnlineTraining.CandidateGroups,
+			DisabledPaths:                  disabledPaths,
+			ImprovementRatioScaling: onlinetraining.ImprovementRatioScaling{
+				IsEnabled:              *conf.Dimming.OnlineTraining.ImprovementRatioScaling.Enabled,
+				ReferenceResponseTimes: *conf.Dimming.OnlineTraining.ImprovementRatioScaling.ReferenceResponseTimes,
+				Exponent:               *conf.Dimming.OnlineTraining.ImprovementRatioScaling.Exponent,
+				MaxMultiplier:          *conf.Dimming.OnlineTraining.ImprovementRatioScaling.MaxMultiplier,
+			},
+		},
 	)
 	if err != nil {
 		log.Fatalf("expected onlineTrainingService to return nil err; got err = %v", err)
 	}
 
 	var profiler *profiling.Profiler
+	// aggregatorStore is nil unless aggregator counts are persisted, in which
+	// case they are saved on shutdown.
+	var aggregatorStore profiling.AggregatorStore
 	if *conf.Dimming.Profiler.Enabled {
-		priorityFetcher, err := profiling.NewRedisPriorityFetcher(
-			*conf.Dimming.Profiler.Redis.Addr,
-			*conf.Dimming.Profiler.Redis.Password,
-			*conf.Dimming.Profiler.Redis.PrioritiesDB,
-			*conf.Dimming.Profiler.Redis.QueueDB,
+		tiers := initProfilerTiers(conf)
+		priorityFetcher := initPriorityFetcher(conf, tiers)
+
+		aggregator, err := profiling.NewProfiledRequestAggregator(
+			time.Duration(*conf.Dimming.Profiler.AggregatorHalfLifeSeconds * float64(time.Second)),
 		)
 		if err != nil {
-			panic(fmt.Errorf("could not create RedisPriorityFetcher: %w", err))
+			log.Fatalf("expected profiling.NewProfiledRequestAggregator() returns nil err; got err = %v", err)
+		}
+		if *conf.Dimming.Profiler.PersistAggregator {
+			redisPriorityFetcher, ok := priorityFetcher.(*profiling.RedisPriorityFetcher)
+			if !ok {
+				log.Fatalf("expected dimming.profiler.driver to be redis when dimming.profiler.persistAggregator is true; got %s", *conf.Dimming.Profiler.Driver)
+			}
+			aggregatorStore = redisPriorityFetcher.NewAggregatorStore(*conf.Dimming.Profiler.AggregatorRedisKey)
+			restoreAggregator(aggregator, aggregatorStore)
 		}
 
 		profiler = &profiling.Profiler{
@@ -66,30 +151,70 @@ func main() {
 				*conf.Dimming.Profiler.InfluxDB.Token,
 				*conf.Dimming.Profiler.InfluxDB.Org,
 				*conf.Dimming.Profiler.InfluxDB.Bucket,
+				*conf.Dimming.Profiler.InfluxDB.MeasurementPrefix,
 			),
-			Aggregator:                               profiling.NewProfiledRequestAggregator(),
-			LowPriorityDimmingProbability:            *conf.Dimming.Profiler.Probabilities.Low,
-			LowPriorityDimmingProbabilityMultiplier:  *conf.Dimming.Profiler.Probabilities.LowMultiplier,
-			HighPriorityDimmingProbability:           *conf.Dimming.Profiler.Probabilities.High,
-			HighPriorityDimmingProbabilityMultiplier: *conf.Dimming.Profiler.Probabilities.HighMultiplier,
+			Aggregator:                  aggregator,
+			Tiers:                       tiers,
+			PriorityCookieName:          *conf.Dimming.Profiler.PriorityCookieName,
+			DimmingDecisionCookieName:   *conf.Dimming.Profiler.DimmingDecisionCookieName,
+			CookieAttributes:            cookieAttributes,
+			UnknownPriorityCookieExpiry: time.Duration(*conf.Dimming.Profiler.UnknownPriorityCookieExpirySeconds * float64(time.Second)),
+			PriorityCookieExpiry:        time.Duration(*conf.Dimming.Profiler.PriorityCookieExpirySeconds * float64(time.Second)),
+			DimmingDecisionCookieExpiry: time.Duration(*conf.Dimming.Profiler.DimmingDecisionCookieExpirySeconds * float64(time.Second)),
 		}
 	}
 
+	decisionSink := initDecisionSink(conf)
+
 	// Serve the reverse proxy with dimming control loop.
 	server := NewServer(&ServerOptions{
-		FrontendAddr:           fmt.Sprintf(":%d", *conf.Connection.FrontendPort),
-		BackendAddr:            fmt.Sprintf("%s:%d", *conf.Connection.BackendHost, *conf.Connection.BackendPort),
-		MaxConns:               2048,
-		ControlLoop:            controlLoop,
-		RequestFilter:          requestFilter,
-		PathProbabilities:      pathProbabilities,
-		Logger:                 logger,
-		IsDimmingEnabled:       *conf.Dimming.Enabled,
-		OnlineTrainingService:  onlineTrainingService,
-		OfflineTrainingService: offlinetraining.NewOfflineTraining(),
-		IsProfilingEnabled:     *conf.Dimming.Profiler.Enabled,
-		ProfilingService:       profiler,
-		ProfilingSessionCookie: *conf.Dimming.Profiler.SessionCookie,
+		FrontendAddr:                   frontendAddr(conf),
+		BackendAddr:                    backendAddr(conf),
+		MaxConns:                       2048,
+		ControlLoop:                    controlLoop,
+		RequestFilter:                  requestFilter,
+		PathProbabilities:              pathProbabilities,
+		DisabledPaths:                  disabledPaths,
+		Logger:                         logger,
+		IsDimmingEnabled:               *conf.Dimming.Enabled,
+		OnlineTrainingService:          onlineTrainingService,
+		OfflineTrainingService:         offlinetraining.NewOfflineTraining(),
+		IsProfilingEnabled:             *conf.Dimming.Profiler.Enabled,
+		ProfilingService:               profiler,
+		ProfilingSessionCookie:         *conf.Dimming.Profiler.SessionCookie,
+		IsContentTypeDimmingEnabled:    *conf.Dimming.ContentTypeDimming.Enabled,
+		ContentTypeFilter:              filters.NewContentTypeFilter(conf.Dimming.ContentTypeDimming.ContentTypes),
+		IsDimmingBudgetEnabled:         *conf.Dimming.Budget.Enabled,
+		DimmingBudget:                  initDimmingBudget(conf),
+		DimmedRateCaps:                 initDimmedRateCaps(conf),
+		OverloadProtector:              initOverloadProtector(conf),
+		PathValidator:                  initPathValidator(conf),
+		ControlSignalFilter:            controlSignalFilter,
+		ExcludedStatusCodes:            conf.Dimming.Controller.ExcludedStatusCodes,
+		IsPerIPConcurrencyLimitEnabled: *conf.Connection.PerIPConcurrencyLimit.Enabled,
+		PerIPConcurrencyLimiter:        initPerIPConcurrencyLimiter(conf),
+		IsRequestDecompressionEnabled:  *conf.Connection.DecompressGzipRequests,
+		MaxRequestBodySize:             *conf.Connection.MaxRequestBodySize,
+		IsHTTP10KeepAliveEnabled:       *conf.Connection.PreserveHTTP10KeepAlive,
+		RequestTimeout:                 time.Duration(*conf.Connection.RequestTimeoutSeconds * float64(time.Second)),
+		ClientIPResolver:               initClientIPResolver(conf),
+		FilterMatchCounter:             filterMatchCounter,
+		MethodMultipliers:              initMethodMultipliers(conf),
+		DecisionSink:                   decisionSink,
+		EventSink:                      eventSink,
+		DimmedResponses:                initDimmedResponses(conf),
+		ResponseTransformers:           initResponseTransformers(conf),
+		DimResponseStatusCode:          *conf.Dimming.DimResponseStatusCode,
+		DimResponseBody:                *conf.Dimming.DimResponseBody,
+		DimResponseTemplatePath:        *conf.Dimming.DimResponseTemplatePath,
+		DimRedirectURL:                 *conf.Dimming.DimRedirectURL,
+		NavigationRedirectURL:          initNavigationRedirectURL(conf),
+		NavigationRedirectStatusCode:   *conf.Dimming.NavigationRedirect.StatusCode,
+		NavigationRedirectPathParam:    *conf.Dimming.NavigationRedirect.PathQueryParameter,
+		VaryHeaders:                    initVaryHeaders(conf),
+		DimRetryAfterBaseSeconds:       *conf.Dimming.DimRetryAfterBaseSeconds,
+		IsControlStateHeadersEnabled:   *conf.Dimming.ExposeControlStateHeaders,
+		TLSConfig:                      initTLSConfig(conf),
 	})
 
 	// Start the server in a goroutine so we can separately block the main
@@ -100,9 +225,68 @@ func main() {
 		}
 	}()
 
-	api := APIServer{Server: server}
-	if err := api.ListenAndServe(fmt.Sprintf(":%d", *conf.Connection.AdminPort)); err != nil {
-		panic(fmt.Errorf("expected api.ListenAndServe() returns nil err; got err = %w", err))
+	api := APIServer{
+		Server:            server,
+		ProbabilityFloors: initProbabilityFloors(conf),
+		Events:            eventStream,
+	}
+	// Loggers which expose metrics to be scraped are served by the API server.
+	if metrics, ok := logger.(logging.MetricsWriter); ok {
+		api.Metrics = metrics
+	}
+	go func() {
+		if err := api.ListenAndServe(fmt.Sprintf(":%d", *conf.Connection.AdminPort)); err != nil {
+			panic(fmt.Errorf("expected api.ListenAndServe() returns nil err; got err = %w", err))
+		}
+	}()
+
+	// Block until SIGINT or SIGTERM, then shut down in order: stop serving so
+	// no further state changes are made, save the aggregator counts, then
+	// flush buffered events and points so they are not lost on shutdown.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+
+	if err := server.Shutdown(); err != nil {
+		log.Printf("expected server.Shutdown() returns nil err; got err = %v", err)
+	}
+	if aggregatorStore != nil {
+		if err := aggregatorStore.Save(profiler.Aggregator.Counts()); err != nil {
+			log.Printf("expected AggregatorStore.Save() returns nil err; got err = %v", err)
+		}
+	}
+	if kafkaSink != nil {
+		kafkaSink.Close()
+	}
+	var writers []interface{}
+	writers = append(writers, logger, decisionSink)
+	if profiler != nil {
+		writers = append(writers, profiler.Requests)
+	}
+	for _, writer := range writers {
+		if closer, ok := writer.(bufferedWriter); ok {
+			closer.Close()
+		}
+	}
+}
+
+// bufferedWriter is implemented by writers which buffer writes, such as the
+// InfluxDB writers, which must be closed on shutdown to flush buffered writes.
+type bufferedWriter interface {
+	Close()
+}
+
+// restoreAggregator restores the aggregator's counts from store, so profiling
+// is not cold after rolling restarts. The counts are saved to store on
+// shutdown. Failing to restore or save is logged rather than fatal, as the
+// counts rebuild over time.
+func restoreAggregator(aggregator *profiling.ProfiledRequestAggregator, store profiling.AggregatorStore) {
+	counts, isFound, err := store.Load()
+	if err != nil {
+		log.Printf("expected AggregatorStore.Load() returns nil err; got err = %v", err)
+	} else if isFound {
+		aggregator.Restore(counts)
+		log.Printf("restored profiling aggregator counts saved at %v", counts.SavedAt)
 	}
 }
 
@@ -112,30 +296,157 @@ func initLogger(conf *config.Config) logging.Logger {
 		logger = logging.NewNoopLogger()
 	} else if *conf.Logging.Driver == "stdout" {
 		logger = logging.NewStdoutLogger()
+	} else if *conf.Logging.Driver == "prometheus" {
+		logger = logging.NewPrometheusLogger()
 	} else if *conf.Logging.Driver == "influxdb" {
 		logger = logging.NewInfluxDBLogger(
 			*conf.Logging.InfluxDB.Addr,
 			*conf.Logging.InfluxDB.Token,
 			*conf.Logging.InfluxDB.Org,
 			*conf.Logging.InfluxDB.Bucket,
+			*conf.Logging.InfluxDB.MeasurementPrefix,
 		)
 	} else {
-		log.Fatalf("expected env var LOGGER_DRIVER one of {noop, stdout, influxdb}; got %s", *conf.Logging.Driver)
+		log.Fatalf("expected env var LOGGER_DRIVER one of {noop, stdout, prometheus, influxdb}; got %s", *conf.Logging.Driver)
 	}
 	return logger
 }
 
+// frontendAddr returns the configured frontend Unix domain socket if set, and
+// the frontend TCP port otherwise.
+func frontendAddr(conf *config.Config) string {
+	if conf.Connection.FrontendSocketPath != "" {
+		return unixSocketAddrPrefix + conf.Connection.FrontendSocketPath
+	}
+	return fmt.Sprintf(":%d", *conf.Connection.FrontendPort)
+}
+
+// backendAddr returns the configured backend Unix domain socket if set, and
+// the backend TCP address otherwise.
+func backendAddr(conf *config.Config) string {
+	if conf.Connection.BackendSocketPath != "" {
+		return unixSocketAddrPrefix + conf.Connection.BackendSocketPath
+	}
+	return fmt.Sprintf("%s:%d", *conf.Connection.BackendHost, *conf.Connection.BackendPort)
+}
+
+// initProbabilityStore returns nil if probabilities adopted by online training
+// should not be persisted.
+func initProbabilityStore(conf *config.Config) onlinetraining.ProbabilityStore {
+	switch *conf.Dimming.OnlineTraining.ProbabilityStore.Driver {
+	case "file":
+		return onlinetraining.NewFileProbabilityStore(*conf.Dimming.OnlineTraining.ProbabilityStore.FilePath)
+	default:
+		return nil
+	}
+}
+
+// restorePathProbabilities sets the probabilities saved to store for paths,
+// so probabilities learned by online training survive restarts. Saved paths
+// which are no longer dimmable are ignored. Failing to restore is logged
+// rather than fatal, as the configured probabilities remain usable.
+func restorePathProbabilities(probabilities *filters.PathProbabilities, store onlinetraining.ProbabilityStore, paths []string) {
+	rules, isFound, err := store.Load()
+	if err != nil {
+		log.Printf("expected ProbabilityStore.Load() returns nil err; got err = %v", err)
+		return
+	} else if !isFound {
+		return
+	}
+
+	isPath := map[string]bool{}
+	for _, path := range paths {
+		isPath[path] = true
+	}
+	var restored []filters.PathProbabilityRule
+	for _, rule := range rules {
+		if isPath[rule.Path] {
+			restored = append(restored, rule)
+		}
+	}
+	if err := probabilities.SetAll(restored); err != nil {
+		log.Printf("expected PathProbabilities.SetAll() returns nil err for restored probabilities; got err = %v", err)
+		return
+	}
+	log.Printf("restored %d path probabilities learned by online training", len(restored))
+}
+
+func initCookieAttributes(conf *config.Config) cookies.Attributes {
+	var sameSite fasthttp.CookieSameSite
+	switch *conf.Dimming.Cookies.SameSite {
+	case "disabled":
+		sameSite = fasthttp.CookieSameSiteDisabled
+	case "default":
+		sameSite = fasthttp.CookieSameSiteDefaultMode
+	case "lax":
+		sameSite = fasthttp.CookieSameSiteLaxMode
+	case "strict":
+		sameSite = fasthttp.CookieSameSiteStrictMode
+	case "none":
+		sameSite = fasthttp.CookieSameSiteNoneMode
+	default:
+		log.Fatalf("expected dimming.cookies.sameSite one of {disabled, default, lax, strict, none}; got %s", *conf.Dimming.Cookies.SameSite)
+	}
+
+	return cookies.Attributes{
+		SameSite:   sameSite,
+		IsSecure:   *conf.Dimming.Cookies.Secure,
+		IsHTTPOnly: *conf.Dimming.Cookies.HTTPOnly,
+		Path:       *conf.Dimming.Cookies.Path,
+		Domain:     *conf.Dimming.Cookies.Domain,
+	}
+}
+
+// initPaths returns the paths of dimmable components, excluding observe-only
+// components.
 func initPaths(conf *config.Config) []string {
 	var paths []string
 	for _, component := range conf.Dimming.DimmableComponents {
+		if isObserveOnly(component) {
+			continue
+		}
 		paths = append(paths, *component.Path)
 	}
 	return paths
 }
 
+// isObserveOnly returns true if the component's response times are measured
+// but the component is never dimmed.
+func isObserveOnly(component config.DimmableComponent) bool {
+	return component.ObserveOnly != nil && *component.ObserveOnly
+}
+
 func initRequestFilter(conf *config.Config) *filters.RequestFilter {
-	filter := filters.NewRequestFilter()
+	var mode filters.FilterMode
+	if *conf.Dimming.FilterMode == "allowlist" {
+		mode = filters.FilterModeAllowlist
+	} else if *conf.Dimming.FilterMode == "denylist" {
+		mode = filters.FilterModeDenylist
+	} else {
+		log.Fatalf("expected dimming.filterMode one of {allowlist, denylist}; got %s", *conf.Dimming.FilterMode)
+	}
+
+	filter := filters.NewRequestFilter(mode, *conf.Dimming.MaxRefererExclusionsPerRule)
 	for _, component := range conf.Dimming.DimmableComponents {
+		// Observe-only components are never dimmed, so they are left out of an
+		// allowlist. They are still added to a denylist, which otherwise
+		// matches all paths.
+		if isObserveOnly(component) && mode == filters.FilterModeAllowlist {
+			continue
+		}
+
+		// A component with probability 0 is never dimmed, yet still incurs the
+		// filter overhead. This is usually a misconfiguration where dimming
+		// was meant to be disabled by removing the component instead. In
+		// denylist mode, components are never dimmed so this does not apply.
+		if mode == filters.FilterModeAllowlist && component.Probability != nil && *component.Probability == 0 {
+			if *conf.Dimming.PruneZeroProbabilityComponents {
+				log.Printf("warning: dimmable component with path %s has probability 0 and has been removed from the filter", *component.Path)
+				continue
+			}
+			log.Printf("warning: dimmable component with path %s has probability 0 and will never be dimmed; set dimming.pruneZeroProbabilityComponents to remove it from the filter", *component.Path)
+		}
+
 		if component.Method.ShouldMatchAll != nil && *component.Method.ShouldMatchAll {
 			filter.AddPathForAllMethods(*component.Path)
 		} else {
@@ -143,10 +454,21 @@ func initRequestFilter(conf *config.Config) *filters.RequestFilter {
 		}
 
 		for _, exclusion := range component.Exclusions {
+			if exclusion.Header != nil {
+				if err := filter.AddHeaderExclusion(*component.Path, *exclusion.Method, *exclusion.Header, *exclusion.Substring); err != nil {
+					log.Fatalf("expected filter.AddHeaderExclusion(path=%s, method=%s, header=%s, substring=%s) returns nil err; got err = %v", *component.Path, *exclusion.Method, *exclusion.Header, *exclusion.Substring, err)
+				}
+				continue
+			}
 			if err := filter.AddRefererExclusion(*component.Path, *exclusion.Method, *exclusion.Substring); err != nil {
 				log.Fatalf("expected filter.AddRefererExclusion(path=%s, method=%s, substring=%s) returns nil err; got err = %v", *component.Path, *exclusion.Method, *exclusion.Substring, err)
 			}
 		}
+		for _, inclusion := range component.Inclusions {
+			if err := filter.AddRefererInclusion(*component.Path, *inclusion.Method, *inclusion.Substring); err != nil {
+				log.Fatalf("expected filter.AddRefererInclusion(path=%s, method=%s, substring=%s) returns nil err; got err = %v", *component.Path, *inclusion.Method, *inclusion.Substring, err)
+			}
+		}
 	}
 	return filter
 }
@@ -175,10 +497,434 @@ func initPathProbabilities(conf *config.Config) *filters.PathProbabilities {
 	return p
 }
 
+func initDimmedResponses(conf *config.Config) *filters.DimmedResponses {
+	responses := map[string]filters.DimmedResponse{}
+	for _, component := range conf.Dimming.DimmableComponents {
+		if component.DimmedResponse == nil {
+			continue
+		}
+
+		if component.DimmedResponse.StatusCode == nil {
+			log.Fatalf("expected dimmedResponse.statusCode to be set for dimmable component with path %s", *component.Path)
+		}
+		response := filters.DimmedResponse{StatusCode: *component.DimmedResponse.StatusCode}
+		if component.DimmedResponse.Body != nil {
+			response.Body = *component.DimmedResponse.Body
+		}
+		if component.DimmedResponse.ContentType != nil {
+			response.ContentType = *component.DimmedResponse.ContentType
+		}
+		responses[*component.Path] = response
+	}
+
+	defaultResponse := filters.DimmedResponse{
+		StatusCode: *conf.Dimming.DimResponseStatusCode,
+		Body:       *conf.Dimming.DimResponseBody,
+	}
+	dimmedResponses, err := filters.NewDimmedResponses(defaultResponse, responses)
+	if err != nil {
+		log.Fatalf("expected filters.NewDimmedResponses() returns nil err; got err = %v", err)
+	}
+	return dimmedResponses
+}
+
+// initProfilerTiers returns the configured tiers, or the low and high tiers if
+// none are configured.
+func initProfilerTiers(conf *config.Config) []profiling.Tier {
+	if len(conf.Dimming.Profiler.Tiers) == 0 {
+		return []profiling.Tier{
+			{
+				Priority:                     profiling.Low,
+				DimmingProbability:           *conf.Dimming.Profiler.Probabilities.Low,
+				DimmingProbabilityMultiplier: *conf.Dimming.Profiler.Probabilities.LowMultiplier,
+			},
+			{
+				Priority:                     profiling.High,
+				DimmingProbability:           *conf.Dimming.Profiler.Probabilities.High,
+				DimmingProbabilityMultiplier: *conf.Dimming.Profiler.Probabilities.HighMultiplier,
+			},
+		}
+	}
+
+	var tiers []profiling.Tier
+	for _, tier := range conf.Dimming.Profiler.Tiers {
+		tiers = append(tiers, profiling.Tier{
+			Priority:                     profiling.Priority(*tier.Name),
+			DimmingProbability:           *tier.Probability,
+			DimmingProbabilityMultiplier: *tier.Multiplier,
+		})
+	}
+	return tiers
+}
+
+// initPriorityFetcher returns the configured fetcher. Fetchers backed by an
+// external profiler reject priorities which are not one of tiers.
+func initPriorityFetcher(conf *config.Config, tiers []profiling.Tier) profiling.PriorityFetcher {
+	tierNames := make([]profiling.Priority, len(tiers))
+	for i, tier := range tiers {
+		tierNames[i] = tier.Priority
+	}
+
+	switch *conf.Dimming.Profiler.Driver {
+	case "redis":
+		priorityFetcher, err := profiling.NewRedisPriorityFetcher(
+			*conf.Dimming.Profiler.Redis.Addr,
+			*conf.Dimming.Profiler.Redis.Password,
+			*conf.Dimming.Profiler.Redis.PrioritiesDB,
+			*conf.Dimming.Profiler.Redis.QueueDB,
+			tierNames,
+		)
+		if err != nil {
+			panic(fmt.Errorf("could not create RedisPriorityFetcher: %w", err))
+		}
+		return priorityFetcher
+	case "memory":
+		rule, err := profiling.NewHashProfilingRule(*conf.Dimming.Profiler.Memory.LowPriorityFraction)
+		if err != nil {
+			log.Fatalf("expected profiling.NewHashProfilingRule() returns nil err; got err = %v", err)
+		}
+		priorityFetcher, err := profiling.NewInMemoryPriorityFetcher(rule)
+		if err != nil {
+			log.Fatalf("expected profiling.NewInMemoryPriorityFetcher() returns nil err; got err = %v", err)
+		}
+		return priorityFetcher
+	case "http":
+		var timeout time.Duration
+		if conf.Dimming.Profiler.HTTP.TimeoutSeconds != nil {
+			timeout = time.Duration(*conf.Dimming.Profiler.HTTP.TimeoutSeconds * float64(time.Second))
+		}
+		priorityFetcher, err := profiling.NewHTTPPriorityFetcher(*conf.Dimming.Profiler.HTTP.BaseURL, timeout, tierNames)
+		if err != nil {
+			log.Fatalf("expected profiling.NewHTTPPriorityFetcher() returns nil err; got err = %v", err)
+		}
+		return priorityFetcher
+	default:
+		log.Fatalf("expected dimming.profiler.driver to be valid; got %s", *conf.Dimming.Profiler.Driver)
+		return nil
+	}
+}
+
+// initCandidateSampler returns nil if the random sampler is configured, so
+// online training seeds its default sampler.
+func initCandidateSampler(conf *config.Config) onlinetraining.CandidateSampler {
+	if *conf.Dimming.OnlineTraining.Sampler != "gradient" {
+		return nil
+	}
+
+	sampler, err := onlinetraining.NewGradientCandidateSampler(onlinetraining.GradientCandidateSamplerOptions{
+		StepSize: *conf.Dimming.OnlineTraining.GradientStepSize,
+	})
+	if err != nil {
+		log.Fatalf("expected onlinetraining.NewGradientCandidateSampler() returns nil err; got err = %v", err)
+	}
+	return sampler
+}
+
+func initResponseTransformers(conf *config.Config) *filters.ResponseTransformers {
+	transformers := map[string]filters.ResponseTransformer{}
+	for _, component := range conf.Dimming.DimmableComponents {
+		if component.Transformer == nil {
+			continue
+		}
+
+		switch *component.Transformer.Type {
+		case "jsonArrayTruncation":
+			transformer, err := filters.NewJSONArrayTruncator(*component.Transformer.MaxItems)
+			if err != nil {
+				log.Fatalf("expected filters.NewJSONArrayTruncator() returns nil err; got err = %v", err)
+			}
+			transformers[*component.Path] = transformer
+		default:
+			log.Fatalf("expected transformer.type to be valid for dimmable component with path %s; got %s", *component.Path, *component.Transformer.Type)
+		}
+	}
+
+	if len(transformers) == 0 {
+		return nil
+	}
+	responseTransformers, err := filters.NewResponseTransformers(transformers)
+	if err != nil {
+		log.Fatalf("expected filters.NewResponseTransformers() returns nil err; got err = %v", err)
+	}
+	return responseTransformers
+}
+
+func initDecisionSink(conf *config.Config) logging.DecisionSink {
+	if !*conf.Dimming.DecisionSink.Enabled {
+		return nil
+	}
+
+	return logging.NewInfluxDBDecisionSink(
+		*conf.Dimming.DecisionSink.InfluxDB.Addr,
+		*conf.Dimming.DecisionSink.InfluxDB.Token,
+		*conf.Dimming.DecisionSink.InfluxDB.Org,
+		*conf.Dimming.DecisionSink.InfluxDB.Bucket,
+		*conf.Dimming.DecisionSink.InfluxDB.MeasurementPrefix,
+	)
+}
+
+// initEventSink returns nil if events are not published to Kafka.
+func initEventSink(conf *config.Config) *logging.KafkaRESTEventSink {
+	if !*conf.Dimming.Events.Enabled {
+		return nil
+	}
+
+	sink, err := logging.NewKafkaRESTEventSink(
+		*conf.Dimming.Events.Kafka.RESTProxyURL,
+		*conf.Dimming.Events.Kafka.Topic,
+		time.Duration(*conf.Dimming.Events.Kafka.FlushIntervalSeconds*float64(time.Second)),
+	)
+	if err != nil {
+		log.Fatalf("expected logging.NewKafkaRESTEventSink() returns nil err; got err = %v", err)
+	}
+	return sink
+}
+
+// initTLSConfig returns nil if TLS is disabled. Otherwise, the certificate is
+// reloaded on SIGHUP.
+func initTLSConfig(conf *config.Config) *tls.Config {
+	if !*conf.Connection.TLS.Enabled {
+		return nil
+	}
+
+	reloader, err := newCertificateReloader(*conf.Connection.TLS.CertFile, *conf.Connection.TLS.KeyFile)
+	if err != nil {
+		log.Fatalf("expected newCertificateReloader() returns nil err; got err = %v", err)
+	}
+	reloader.ReloadOnSIGHUP()
+	return reloader.TLSConfig()
+}
+
+func initMethodMultipliers(conf *config.Config) *filters.MethodMultipliers {
+	multipliers, err := filters.NewMethodMultipliers(conf.Dimming.MethodMultipliers)
+	if err != nil {
+		log.Fatalf("expected filters.NewMethodMultipliers() returns nil err; got err = %v", err)
+	}
+	return multipliers
+}
+
+func initOverloadProtector(conf *config.Config) *filters.OverloadProtector {
+	if !*conf.Dimming.OverloadProtection.Enabled {
+		return nil
+	}
+
+	p, err := filters.NewOverloadProtector(filters.OverloadProtectorOptions{
+		Window:              time.Duration(*conf.Dimming.OverloadProtection.WindowSeconds * float64(time.Second)),
+		MinRequests:         *conf.Dimming.OverloadProtection.MinRequests,
+		OpenErrorRate:       *conf.Dimming.OverloadProtection.OpenErrorRate,
+		CloseErrorRate:      *conf.Dimming.OverloadProtection.CloseErrorRate,
+		RampStep:            *conf.Dimming.OverloadProtection.RampStep,
+		MaxShedFraction:     *conf.Dimming.OverloadProtection.MaxShedFraction,
+		OverloadStatusCodes: conf.Dimming.OverloadProtection.OverloadStatusCodes,
+	})
+	if err != nil {
+		log.Fatalf("expected filters.NewOverloadProtector() returns nil err; got err = %v", err)
+	}
+	return p
+}
+
+func initSurgeDetector(conf *config.Config) *filters.SurgeDetector {
+	if !*conf.Dimming.SurgeDetection.Enabled {
+		return nil
+	}
+
+	d, err := filters.NewSurgeDetector(filters.SurgeDetectorOptions{
+		Window:               time.Duration(*conf.Dimming.SurgeDetection.WindowSeconds * float64(time.Second)),
+		MinRequestsPerSecond: *conf.Dimming.SurgeDetection.MinRequestsPerSecond,
+		Hysteresis:           *conf.Dimming.SurgeDetection.HysteresisRequestsPerSecond,
+	})
+	if err != nil {
+		log.Fatalf("expected filters.NewSurgeDetector() returns nil err; got err = %v", err)
+	}
+	return d
+}
+
+func initDimmingBudget(conf *config.Config) *filters.DimmingBudget {
+	b, err := filters.NewDimmingBudget(
+		*conf.Dimming.Budget.MaxCategories,
+		time.Duration(*conf.Dimming.Budget.WindowSeconds*float64(time.Second)),
+	)
+	if err != nil {
+		log.Fatalf("expected filters.NewDimmingBudget() returns nil err; got err = %v", err)
+	}
+
+	for _, component := range conf.Dimming.DimmableComponents {
+		if component.Category != nil {
+			b.SetCategory(*component.Path, *component.Category)
+		}
+	}
+
+	return b
+}
+
+// initNavigationRedirectURL returns nil if dimmed navigations should not be
+// redirected.
+func initNavigationRedirectURL(conf *config.Config) *url.URL {
+	if !*conf.Dimming.NavigationRedirect.Enabled {
+		return nil
+	}
+
+	u, err := url.Parse(*conf.Dimming.NavigationRedirect.URL)
+	if err != nil {
+		log.Fatalf("expected dimming.navigationRedirect.url to be a valid URL; got err = %v", err)
+	}
+	return u
+}
+
+// initVaryHeaders returns the request headers which influence dimming
+// decisions, or nil if the Vary header should not be set.
+func initVaryHeaders(conf *config.Config) []string {
+	if !*conf.Dimming.Vary.Enabled {
+		return nil
+	}
+
+	// Cookie is always included, as online training and profiling can be
+	// enabled at runtime by changing the dimming mode.
+	candidates := []string{"Cookie"}
+	if *conf.Dimming.NavigationRedirect.Enabled {
+		candidates = append(candidates, "Accept", "Sec-Fetch-Mode")
+	}
+	for _, component := range conf.Dimming.DimmableComponents {
+		for _, exclusion := range component.Exclusions {
+			if exclusion.Header != nil {
+				candidates = append(candidates, *exclusion.Header)
+			} else {
+				candidates = append(candidates, "Referer")
+			}
+		}
+		if len(component.Inclusions) != 0 {
+			candidates = append(candidates, "Referer")
+		}
+	}
+	candidates = append(candidates, conf.Dimming.Vary.Headers...)
+
+	var headers []string
+	seen := map[string]bool{}
+	for _, header := range candidates {
+		header = http.CanonicalHeaderKey(header)
+		if !seen[header] {
+			seen[header] = true
+			headers = append(headers, header)
+		}
+	}
+	return headers
+}
+
+// initDimmedRateCaps returns nil if no component has a maxDimmedRate.
+func initDimmedRateCaps(conf *config.Config) *filters.DimmedRateCaps {
+	var c *filters.DimmedRateCaps
+	for _, component := range conf.Dimming.DimmableComponents {
+		if component.MaxDimmedRate == nil {
+			continue
+		}
+
+		if c == nil {
+			var err error
+			c, err = filters.NewDimmedRateCaps(time.Duration(*conf.Dimming.DimmedRateCapWindowSeconds * float64(time.Second)))
+			if err != nil {
+				log.Fatalf("expected filters.NewDimmedRateCaps() returns nil err; got err = %v", err)
+			}
+		}
+		if err := c.SetCap(*component.Path, *component.MaxDimmedRate); err != nil {
+			log.Fatalf("expected DimmedRateCaps.SetCap(path=%s, maxRate=%v) returns nil err; got err = %v", *component.Path, *component.MaxDimmedRate, err)
+		}
+	}
+	return c
+}
+
+func initProbabilityFloors(conf *config.Config) *filters.ProbabilityFloors {
+	if !*conf.Dimming.ProbabilityFloors.Enabled {
+		return nil
+	}
+
+	f, err := filters.NewProbabilityFloors(*conf.Dimming.ProbabilityFloors.DefaultFloor)
+	if err != nil {
+		log.Fatalf("expected filters.NewProbabilityFloors() returns nil err; got err = %v", err)
+	}
+
+	for _, component := range conf.Dimming.DimmableComponents {
+		if component.Category != nil {
+			f.SetCategory(*component.Path, *component.Category)
+		}
+	}
+	for category, floor := range conf.Dimming.ProbabilityFloors.Floors {
+		if err := f.SetFloor(category, floor); err != nil {
+			log.Fatalf("expected ProbabilityFloors.SetFloor() returns nil err; got err = %v", err)
+		}
+	}
+
+	return f
+}
+
+func initPathValidator(conf *config.Config) *filters.PathValidator {
+	if !*conf.Connection.PathValidation.Enabled {
+		return nil
+	}
+
+	v, err := filters.NewPathValidator(
+		*conf.Connection.PathValidation.MaxLength,
+		*conf.Connection.PathValidation.AllowedCharacters,
+	)
+	if err != nil {
+		log.Fatalf("expected filters.NewPathValidator() returns nil err; got err = %v", err)
+	}
+	return v
+}
+
+func initPerIPConcurrencyLimiter(conf *config.Config) *filters.ConcurrencyLimiter {
+	l, err := filters.NewConcurrencyLimiter(*conf.Connection.PerIPConcurrencyLimit.MaxConcurrent)
+	if err != nil {
+		log.Fatalf("expected filters.NewConcurrencyLimiter() returns nil err; got err = %v", err)
+	}
+	return l
+}
+
+func initClientIPResolver(conf *config.Config) *filters.ClientIPResolver {
+	r, err := filters.NewClientIPResolver(conf.Connection.TrustedProxies)
+	if err != nil {
+		log.Fatalf("expected filters.NewClientIPResolver() returns nil err; got err = %v", err)
+	}
+	return r
+}
+
+// initControlSignalFilter returns nil if all response times should drive the
+// control loop. Observe-only components are added to the filter so their
+// response times are measured.
+func initControlSignalFilter(conf *config.Config) *filters.RequestFilter {
+	if len(conf.Dimming.Controller.ControlSignalPaths) == 0 {
+		return nil
+	}
+
+	filter := filters.NewRequestFilter(filters.FilterModeAllowlist, 0)
+	for _, path := range conf.Dimming.Controller.ControlSignalPaths {
+		filter.AddPathForAllMethods(path)
+	}
+	for _, component := range conf.Dimming.DimmableComponents {
+		if isObserveOnly(component) {
+			filter.AddPathForAllMethods(*component.Path)
+		}
+	}
+	return filter
+}
+
+// initPIDController initialises the primary PID controller. Its input is a
+// ratio if any component sets a target latency, so the ratio setpoint is used
+// in place of the response time setpoint.
 func initPIDController(conf *config.Config) *pid.PIDController {
+	for _, component := range conf.Dimming.DimmableComponents {
+		if component.TargetLatency != nil {
+			return initPIDControllerWithSetpoint(conf, *conf.Dimming.Controller.RatioSetpoint)
+		}
+	}
+	return initPIDControllerWithSetpoint(conf, *conf.Dimming.Controller.Setpoint)
+}
+
+// initPIDControllerWithSetpoint initialises a PID controller using the
+// configured gains with the given setpoint, as used by controller tiers.
+func initPIDControllerWithSetpoint(conf *config.Config, setpoint float64) *pid.PIDController {
 	c, err := pid.NewPIDController(
 		pid.NewRealtimeClock(),
-		*conf.Dimming.Controller.Setpoint,
+		setpoint,
 		*conf.Dimming.Controller.Kp,
 		*conf.Dimming.Controller.Ki,
 		*conf.Dimming.Controller.Kd,
@@ -193,6 +939,7 @@ func initPIDController(conf *config.Config) *pid.PIDController {
 		// components.
 		99,
 		*conf.Dimming.Controller.SamplePeriod,
+		*conf.Dimming.Controller.DerivativeOn == "measurement",
 	)
 	if err != nil {
 		log.Fatalf("expected controller.NewPIDController() returns nil err; got err = %v", err)
@@ -201,18 +948,129 @@ func initPIDController(conf *config.Config) *pid.PIDController {
 	return c
 }
 
+// initResponseTimeCollector initialises the collector whose response times
+// drive the control loop.
+func initResponseTimeCollector(conf *config.Config) responsetimecollector.Collector {
+	collector := initWindowResponseTimeCollector(conf)
+	if *conf.Dimming.Controller.RecencyWeight == 0 {
+		return collector
+	}
+
+	recencyWeighted, err := responsetimecollector.NewRecencyWeightedCollector(collector, *conf.Dimming.Controller.RecentSamples, *conf.Dimming.Controller.RecencyWeight)
+	if err != nil {
+		log.Fatalf("expected responsetimecollector.NewRecencyWeightedCollector() returns nil err; got err = %v", err)
+	}
+	return recencyWeighted
+}
+
+// initWindowResponseTimeCollector initialises the collector whose window of
+// response times the control loop's percentiles are calculated over.
+func initWindowResponseTimeCollector(conf *config.Config) responsetimecollector.Collector {
+	switch *conf.Dimming.Controller.Collector {
+	case "tachymeter":
+		return responsetimecollector.NewTachymeterCollector(ResponseTimeCollectorRequestsWindow)
+	case "timeWindowed":
+		collector, err := responsetimecollector.NewTimeWindowedCollector(time.Duration(*conf.Dimming.Controller.WindowDuration * float64(time.Second)))
+		if err != nil {
+			log.Fatalf("expected responsetimecollector.NewTimeWindowedCollector() returns nil err; got err = %v", err)
+		}
+		return collector
+	case "ewma":
+		collector, err := responsetimecollector.NewEWMACollector(ResponseTimeCollectorRequestsWindow, *conf.Dimming.Controller.EWMAAlpha)
+		if err != nil {
+			log.Fatalf("expected responsetimecollector.NewEWMACollector() returns nil err; got err = %v", err)
+		}
+		return collector
+	default:
+		log.Fatalf("expected dimming.controller.collector one of {tachymeter, timeWindowed, ewma}; got %s", *conf.Dimming.Controller.Collector)
+		return nil
+	}
+}
+
 func initControlLoop(
 	conf *config.Config,
 	pid *pid.PIDController,
 	responseTimeCollector responsetimecollector.Collector,
 	logger logging.Logger,
+	filterMatchCounter *filters.MatchCounter,
+	eventSink logging.EventSink,
+	tickEventSink logging.EventSink,
 ) *ServerControlLoop {
-	percentile := *conf.Dimming.Controller.Percentile
-	if percentile != "p50" && percentile != "p75" && percentile != "p95" {
-		log.Fatalf("expected environment variable CONTROLLER_PERCENTILE to be one of {p50|p75|p95}; got %s", percentile)
+	// percentileWeights takes precedence over a single percentile, which is
+	// equivalent to a weight of 1 on that percentile.
+	weights := conf.Dimming.Controller.PercentileWeights
+	if len(weights) == 0 {
+		percentile := *conf.Dimming.Controller.Percentile
+		if _, err := stats.ParsePercentileRank(percentile); err != nil {
+			log.Fatalf("expected environment variable CONTROLLER_PERCENTILE to be a percentile such as p95 or p99.9; got %s", percentile)
+		}
+		weights = map[string]float64{percentile: 1}
+	}
+
+	var tickAlignment time.Duration
+	switch *conf.Dimming.Controller.TickAlignment {
+	case "none":
+		tickAlignment = 0
+	case "second":
+		tickAlignment = time.Second
+	case "minute":
+		tickAlignment = time.Minute
+	default:
+		log.Fatalf("expected dimming.controller.tickAlignment one of {none, second, minute}; got %s", *conf.Dimming.Controller.TickAlignment)
 	}
 
-	c, err := NewServerControlLoop(pid, responseTimeCollector, percentile, logger)
+	// Response times are only observed separately if a subset of them drives
+	// the control loop.
+	var observabilityResponseTimeCollector responsetimecollector.Collector
+	if len(conf.Dimming.Controller.ControlSignalPaths) != 0 {
+		observabilityResponseTimeCollector = responsetimecollector.NewTachymeterCollector(ResponseTimeCollectorRequestsWindow)
+	}
+
+	// Components with a target latency are normalised individually.
+	pathResponseTimeTargets := map[string]*PathResponseTimeTarget{}
+	for _, component := range conf.Dimming.DimmableComponents {
+		if component.TargetLatency != nil {
+			pathResponseTimeTargets[*component.Path] = &PathResponseTimeTarget{
+				Target:    time.Duration(*component.TargetLatency * float64(time.Second)),
+				Collector: responsetimecollector.NewTachymeterCollector(ResponseTimeCollectorRequestsWindow),
+			}
+		}
+	}
+
+	// A nil maxSampleSeconds disables clamping of response times.
+	var maxResponseTime time.Duration
+	if conf.Dimming.Controller.MaxSampleSeconds != nil {
+		maxResponseTime = time.Duration(*conf.Dimming.Controller.MaxSampleSeconds * float64(time.Second))
+	}
+
+	var tiers []ControlTier
+	for _, tier := range conf.Dimming.Controller.Tiers {
+		tiers = append(tiers, ControlTier{
+			Percentile:   *tier.Percentile,
+			PID:          initPIDControllerWithSetpoint(conf, *tier.Setpoint),
+			Contribution: *tier.Contribution,
+		})
+	}
+
+	c, err := NewServerControlLoop(&ServerControlLoopOptions{
+		Logger:                             logger,
+		PID:                                pid,
+		ResponseTimeCollector:              responseTimeCollector,
+		ResponseTimePercentileWeights:      weights,
+		MaxResponseTime:                    maxResponseTime,
+		ShouldInterpolateDimmingPercentage: *conf.Dimming.Controller.InterpolateOutput,
+		ObservabilityResponseTimeCollector: observabilityResponseTimeCollector,
+		WarmupPeriod:                       time.Duration(*conf.Dimming.Controller.WarmupSeconds * float64(time.Second)),
+		PathResponseTimeTargets:            pathResponseTimeTargets,
+		FilterMatchCounter:                 filterMatchCounter,
+		TickAlignment:                      tickAlignment,
+		Tiers:                              tiers,
+		EventSink:                          eventSink,
+		EventThreshold:                     *conf.Dimming.Events.DimmingThreshold,
+		TickEventSink:                      tickEventSink,
+		BackendUnavailableThreshold:        *conf.Dimming.Controller.BackendUnavailableThreshold,
+		SurgeDetector:                      initSurgeDetector(conf),
+	})
 	if err != nil {
 		log.Fatalf("expected NewServerControlLoop() returns nil err; got err = %v", err)
 	}
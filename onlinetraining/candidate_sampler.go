@@ -0,0 +1,129 @@
+package onlinetraining
+
+import (
+	"errors"
+	"fmt"
+	"github.com/kcz17/dimmer/stats"
+	exprand "golang.org/x/exp/rand"
+	"math"
+)
+
+// DefaultGradientStepSize is the distance GradientCandidateSampler moves a
+// path's probability each round if GradientCandidateSamplerOptions.StepSize
+// is not set.
+const DefaultGradientStepSize = 0.1
+
+// CandidateSampler samples the candidate probability of the path changed in
+// each training round, and observes the outcome of each round so samplers can
+// learn from previous rounds. Samplers are only called from the training
+// loop, so need not be safe for concurrent use.
+type CandidateSampler interface {
+	// Sample returns a candidate probability in [0, 1] for path around mean,
+	// which is the path's control probability unless exploration has been
+	// re-centred as the path is pinned at a probability bound.
+	Sample(path string, mean float64) float64
+	// Observe reports the P95 response times in seconds measured for a
+	// candidate probability of path against its control probability.
+	Observe(path string, controlProbability, candidateProbability, controlP95, candidateP95 float64)
+}
+
+// RandomCandidateSampler samples candidate probabilities using random
+// optimisation, sampling from a truncated normal distribution around the mean.
+// It explores widely, but is slow to converge on smooth response time
+// surfaces as it ignores the outcome of previous rounds.
+type RandomCandidateSampler struct {
+	// src drives sampling. It is seeded once so that a fixed seed yields a
+	// reproducible sequence of candidates.
+	src exprand.Source
+	// variance is the variance of the truncated normal distribution.
+	// sampleTruncatedNormal allows sampling to be controlled in tests.
+	variance              float64
+	sampleTruncatedNormal func(src exprand.Source, lo, hi, mean, variance float64) float64
+}
+
+func NewRandomCandidateSampler(seed uint64, variance float64) (*RandomCandidateSampler, error) {
+	if !(variance > 0) || math.IsInf(variance, 1) {
+		return nil, errors.New(fmt.Sprintf("NewRandomCandidateSampler() expected positive variance; got %v", variance))
+	}
+
+	return &RandomCandidateSampler{
+		src:                   exprand.NewSource(seed),
+		variance:              variance,
+		sampleTruncatedNormal: stats.SampleTruncatedNormalDistribution,
+	}, nil
+}
+
+func (s *RandomCandidateSampler) Sample(_ string, mean float64) float64 {
+	return s.sampleTruncatedNormal(s.src, 0, 1, mean, s.variance)
+}
+
+// Observe is a no-op, as random optimisation does not learn from previous
+// rounds.
+func (s *RandomCandidateSampler) Observe(string, float64, float64, float64, float64) {}
+
+// GradientCandidateSamplerOptions configures a GradientCandidateSampler.
+type GradientCandidateSamplerOptions struct {
+	// StepSize is the distance a path's probability is moved from the mean
+	// each round. If 0, DefaultGradientStepSize is used.
+	StepSize float64
+}
+
+// GradientCandidateSampler samples candidate probabilities by estimating the
+// gradient of the P95 response time with respect to each path's probability
+// from the last round which changed the path, and stepping the path's
+// probability against the gradient's sign, i.e. in the direction which
+// reduced the P95. It converges faster than RandomCandidateSampler on smooth
+// response time surfaces, but may settle in a local minimum.
+//
+// Paths without an estimate, or whose last round did not change the P95, are
+// probed with a lower probability, as lower probabilities are preferred while
+// the application remains stable. As candidates are deterministic, every
+// candidate group samples the same probability.
+type GradientCandidateSampler struct {
+	stepSize float64
+	// gradients maps paths to the last estimated gradient of the P95 in
+	// seconds per unit of probability.
+	gradients map[string]float64
+}
+
+func NewGradientCandidateSampler(options GradientCandidateSamplerOptions) (*GradientCandidateSampler, error) {
+	stepSize := options.StepSize
+	if stepSize == 0 {
+		stepSize = DefaultGradientStepSize
+	}
+	if !(stepSize > 0 && stepSize <= 1) {
+		return nil, errors.New(fmt.Sprintf("NewGradientCandidateSampler() expected StepSize in (0, 1]; got StepSize = %v", options.StepSize))
+	}
+
+	return &GradientCandidateSampler{
+		stepSize:  stepSize,
+		gradients: map[string]float64{},
+	}, nil
+}
+
+func (s *GradientCandidateSampler) Sample(path string, mean float64) float64 {
+	// A positive gradient means the P95 increases with probability, so the
+	// probability is stepped down.
+	direction := -1.0
+	if s.gradients[path] < 0 {
+		direction = 1
+	}
+
+	probability := math.Max(0, math.Min(1, mean+direction*s.stepSize))
+	// A candidate equal to the mean would be tested against itself, so the
+	// step is reversed at the bounds.
+	if probability == mean {
+		probability = math.Max(0, math.Min(1, mean-direction*s.stepSize))
+	}
+	return probability
+}
+
+// Observe estimates the gradient for path by finite difference. Observations
+// which did not change the probability are ignored, as no gradient can be
+// estimated.
+func (s *GradientCandidateSampler) Observe(path string, controlProbability, candidateProbability, controlP95, candidateP95 float64) {
+	if candidateProbability == controlProbability {
+		return
+	}
+	s.gradients[path] = (candidateP95 - controlP95) / (candidateProbability - controlProbability)
+}
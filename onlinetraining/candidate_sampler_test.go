@@ -0,0 +1,76 @@
+package onlinetraining
+
+import (
+	"math"
+	"testing"
+
+	"github.com/kcz17/dimmer/filters"
+	"github.com/kcz17/dimmer/logging"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGradientCandidateSampler_ConvergesOnSyntheticObjective(t *testing.T) {
+	sampler, err := NewGradientCandidateSampler(GradientCandidateSamplerOptions{})
+	assert.Nil(t, err)
+
+	// The P95 in seconds is smooth in the probability, and lowest at 0.7.
+	p95 := func(probability float64) float64 {
+		return 1 + math.Pow(probability-0.7, 2)
+	}
+
+	// Each round, the candidate is adopted if it has a lower P95, as online
+	// training would.
+	control := 0.2
+	for round := 0; round < 20; round++ {
+		candidate := sampler.Sample("/path", control)
+		sampler.Observe("/path", control, candidate, p95(control), p95(candidate))
+		if p95(candidate) < p95(control) {
+			control = candidate
+		}
+	}
+	assert.InDelta(t, 0.7, control, 1e-9)
+}
+
+func TestGradientCandidateSampler_Sample(t *testing.T) {
+	sampler, err := NewGradientCandidateSampler(GradientCandidateSamplerOptions{StepSize: 0.2})
+	assert.Nil(t, err)
+
+	// Paths without an estimate are probed with a lower probability, unless
+	// already at 0.
+	assert.InDelta(t, 0.3, sampler.Sample("/path", 0.5), 1e-9)
+	assert.InDelta(t, 0.2, sampler.Sample("/path", 0), 1e-9)
+
+	// Raising the probability reduced the P95, so it is raised again.
+	sampler.Observe("/path", 0.5, 0.7, 2, 1)
+	assert.InDelta(t, 0.9, sampler.Sample("/path", 0.7), 1e-9)
+	assert.InDelta(t, 0.8, sampler.Sample("/path", 1), 1e-9)
+
+	// Estimates are kept per path.
+	assert.InDelta(t, 0.5, sampler.Sample("/other", 0.7), 1e-9)
+
+	// Observations which did not change the probability are ignored.
+	sampler.Observe("/path", 0.7, 0.7, 1, 2)
+	assert.InDelta(t, 0.9, sampler.Sample("/path", 0.7), 1e-9)
+}
+
+func TestNewGradientCandidateSampler_InvalidStepSize(t *testing.T) {
+	for _, stepSize := range []float64{-0.1, 1.5, math.NaN()} {
+		_, err := NewGradientCandidateSampler(GradientCandidateSamplerOptions{StepSize: stepSize})
+		assert.NotNilf(t, err, "expected err for StepSize = %v", stepSize)
+	}
+}
+
+func TestOnlineTraining_sampleCandidateGroupProbabilities_UsesCandidateSampler(t *testing.T) {
+	probabilities, err := filters.NewPathProbabilities(1)
+	assert.Nilf(t, err, "expected NewPathProbabilities(...) has no err; got %v", err)
+	assert.Nil(t, probabilities.Set(filters.PathProbabilityRule{Path: "/path", Probability: 0.5}))
+	sampler, err := NewGradientCandidateSampler(GradientCandidateSamplerOptions{})
+	assert.Nil(t, err)
+
+	o, err := NewOnlineTraining(logging.NewNoopLogger(), []string{"/path"}, probabilities, 1, Options{CandidateSampler: sampler})
+	assert.Nilf(t, err, "expected NewOnlineTraining(...) has no err; got %v", err)
+
+	rules := o.sampleCandidateGroupProbabilities(0, false)
+	assert.Len(t, rules, 1)
+	assert.InDelta(t, 0.4, rules[0].Probability, 1e-9)
+}
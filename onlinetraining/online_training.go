@@ -3,35 +3,385 @@ package onlinetraining
 import (
 	"errors"
 	"fmt"
+	"github.com/kcz17/dimmer/cookies"
 	"github.com/kcz17/dimmer/filters"
 	"github.com/kcz17/dimmer/logging"
 	"github.com/kcz17/dimmer/responsetimecollector"
 	"github.com/kcz17/dimmer/stats"
 	"github.com/valyala/fasthttp"
 	"log"
+	"math"
 	"math/rand"
-	"strings"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-const onlineTrainingCookieKey = "ONLINE_TRAINING"
+// DefaultCookieName is the name of the online training cookie if
+// Options.CookieName is not set.
+const DefaultCookieName = "ONLINE_TRAINING"
 const onlineTrainingCookieControl = "CONTROL"
 const onlineTrainingCookieCandidate = "CANDIDATE"
-const onlineTrainingCookieCandidateProbability = 0.05
+
+// DefaultCandidateProbability is the probability of a session being assigned
+// to the candidate group if Options.CandidateProbability is not set.
+// DefaultMinCandidateProbability and DefaultMaxCandidateProbability bound the
+// candidate probability if Options.MaxCandidateProbability is not set.
+const (
+	DefaultCandidateProbability    = 0.05
+	DefaultMinCandidateProbability = 0.01
+	DefaultMaxCandidateProbability = 0.2
+)
+
+// DefaultCandidateGroups is the number of candidate groups tested against the
+// control group each round if Options.CandidateGroups is not set.
+const DefaultCandidateGroups = 1
+
+// DefaultSamplingVariance is the variance of the truncated normal distribution
+// candidate probabilities are sampled from if Options.SamplingVariance is not
+// set, based on empirical observations.
+const DefaultSamplingVariance = 0.8
+
+// DefaultSignificancePercentile is the percentile of the K-S test comparing
+// the response times of candidates which increase probability if
+// Options.SignificancePercentile is not set. It has been chosen based on
+// empirical tests where the 99.5th percentile is overly sensitive.
+const DefaultSignificancePercentile = "p99"
+
+// DefaultTestDuration is the duration response times are collected for in
+// each round if Options.TestDuration is not set. DefaultAdjustmentDuration is
+// the duration the controller is given to adjust before a round if
+// Options.AdjustmentDuration is not set.
+const (
+	DefaultTestDuration       = 3 * time.Minute
+	DefaultAdjustmentDuration = 2 * time.Minute
+)
+
+// PinnedPathHandling determines how training treats paths whose control
+// probability is pinned at a bound of 0 or 1, where sampling has little room
+// to move.
+type PinnedPathHandling = string
+
+const (
+	// PinnedPathHandlingNone samples pinned paths like any other path.
+	PinnedPathHandlingNone PinnedPathHandling = "none"
+	// PinnedPathHandlingSkip skips pinned paths in the round-robin. If all
+	// paths are pinned, exploration is re-centred instead.
+	PinnedPathHandlingSkip PinnedPathHandling = "skip"
+	// PinnedPathHandlingRecenter samples pinned paths around a probability of
+	// 0.5 instead of their pinned probability.
+	PinnedPathHandlingRecenter PinnedPathHandling = "recenter"
+)
+
+// Phase is the current phase of the training loop, exposed so operators can
+// alert on training being stuck in a phase.
+type Phase int32
+
+const (
+	// PhaseIdle is the phase while the training loop is not running.
+	PhaseIdle Phase = iota
+	// PhaseAdjusting is the phase while the controller is given time to
+	// respond to newly accepted probabilities.
+	PhaseAdjusting
+	// PhaseMeasuring is the phase while response times of the control and
+	// candidate groups are collected.
+	PhaseMeasuring
+)
+
+func (p Phase) String() string {
+	switch p {
+	case PhaseIdle:
+		return "idle"
+	case PhaseAdjusting:
+		return "adjusting"
+	case PhaseMeasuring:
+		return "measuring"
+	default:
+		return fmt.Sprintf("Phase(%d)", int32(p))
+	}
+}
+
+// Status is a snapshot of online training, allowing operators to observe
+// whether a candidate is being measured and the outcome of the last round.
+type Status struct {
+	Phase Phase
+	// IsIterationActive is true while a candidate is being measured.
+	IsIterationActive bool
+	// ControlProbabilities and each of CandidateProbabilities are maps from
+	// each trained path to its probability in the control group and each
+	// candidate group.
+	ControlProbabilities   map[string]float64
+	CandidateProbabilities []map[string]float64
+	// LastComparison is the comparison of the last round, or nil if no round
+	// has completed.
+	LastComparison *Comparison
+}
+
+// Comparison is the outcome of comparing the control and candidate groups at
+// the end of a round.
+type Comparison struct {
+	// ControlP95 and CandidateP95s are the P95 response times of the control
+	// group and each candidate group in seconds.
+	ControlP95    float64
+	CandidateP95s []float64
+	// IsSignificant is true if a candidate was found to be an improvement
+	// and its probabilities adopted, in which case AdoptedCandidateGroup is
+	// the index of its group. Otherwise, AdoptedCandidateGroup is -1.
+	IsSignificant         bool
+	AdoptedCandidateGroup int
+	CompletedAt           time.Time
+}
+
+// recenteredMean is the mean sampled around when re-centring exploration.
+const recenteredMean = 0.5
+
+// Options configures OnlineTraining.
+type Options struct {
+	// Seed is optional: if nil, candidate sampling is seeded from the current
+	// time; otherwise the given seed is used so training runs can be
+	// reproduced.
+	Seed *uint64
+	// PinEpsilon is the distance from 0 or 1 within which a path's control
+	// probability is considered pinned at a bound.
+	PinEpsilon         float64
+	PinnedPathHandling PinnedPathHandling
+	// ShouldLogRounds logs the response times and verdict of each training
+	// round, downsampled to at most MaxLoggedResponseTimesPerGroup per group.
+	ShouldLogRounds                bool
+	MaxLoggedResponseTimesPerGroup int
+	// MinCandidateResponseTimes is the floor on candidate response times
+	// collected in a round, below which the round is rejected as
+	// inconclusive.
+	MinCandidateResponseTimes int
+	// ShouldCompareErrorRates rejects candidates whose error rate exceeds the
+	// control error rate by more than ErrorRateTolerance.
+	ShouldCompareErrorRates bool
+	ErrorRateTolerance      float64
+	// MinimumImprovementRatio is the proportion by which the candidate P95
+	// must be lower than the control P95 for a candidate which increases
+	// probability to be accepted, e.g. 0.05 for 5%.
+	MinimumImprovementRatio float64
+	// CookieName is the name of the cookie assigning requests to the control
+	// or candidate group. If empty, DefaultCookieName is used.
+	CookieName string
+	// CookieAttributes are applied to the online training cookie.
+	CookieAttributes cookies.Attributes
+	// ImprovementRatioScaling optionally scales MinimumImprovementRatio up
+	// when few candidate response times are collected.
+	ImprovementRatioScaling ImprovementRatioScaling
+	// CandidateProbability is the initial probability of a session being
+	// assigned to the candidate group. If 0, DefaultCandidateProbability is
+	// used.
+	CandidateProbability float64
+	// MinCandidateProbability and MaxCandidateProbability bound the candidate
+	// probability, which cannot be set outside the range at runtime, so an
+	// operator cannot accidentally expose all sessions to the experiment. If
+	// MaxCandidateProbability is 0, DefaultMinCandidateProbability and
+	// DefaultMaxCandidateProbability are used.
+	MinCandidateProbability float64
+	MaxCandidateProbability float64
+	// EventSink is optional. If set, an event is published each time
+	// candidate probabilities are adopted.
+	EventSink logging.EventSink
+	// TestDuration is the duration response times are collected for in each
+	// round before the candidate is compared against the control. Shorter
+	// durations suit high-traffic sites, while low-traffic sites need longer
+	// durations to collect enough response times. If 0, DefaultTestDuration
+	// is used.
+	TestDuration time.Duration
+	// AdjustmentDuration is the duration the controller is given to respond
+	// to the training loop starting or candidate probabilities being adopted
+	// before the next round. If 0, DefaultAdjustmentDuration is used.
+	AdjustmentDuration time.Duration
+	// SamplingVariance is the variance of the truncated normal distribution
+	// around the control probability which candidate probabilities are
+	// sampled from. Larger variances explore more widely. If 0,
+	// DefaultSamplingVariance is used. SamplingVariance is ignored if
+	// CandidateSampler is set.
+	SamplingVariance float64
+	// CandidateSampler is optional. If nil, candidate probabilities are
+	// sampled by a RandomCandidateSampler seeded with Seed and sampling with
+	// SamplingVariance.
+	CandidateSampler CandidateSampler
+	// SignificancePercentile is the percentile of the K-S test which a
+	// candidate increasing probability must pass to be accepted, one of
+	// {p90|p95|p97.5|p99|p99.5|p99.9}. Lower percentiles accept candidates on
+	// weaker evidence. If empty, DefaultSignificancePercentile is used.
+	SignificancePercentile string
+	// ProbabilityStore is optional. If set, control probabilities are saved
+	// to it each time candidate probabilities are adopted.
+	ProbabilityStore ProbabilityStore
+	// CandidateGroups is the number of candidate groups tested against the
+	// control group each round, each with its own candidate probabilities.
+	// Sessions assigned to a candidate group are split evenly between them.
+	// Testing several candidates per round converges faster, but each
+	// candidate collects fewer response times. If 0, DefaultCandidateGroups
+	// is used.
+	CandidateGroups int
+	// DisabledPaths is optional. If set, paths whose dimming is disabled are
+	// skipped when choosing the path to change each round, as they are never
+	// dimmed.
+	DisabledPaths *filters.DisabledPaths
+}
+
+// ImprovementRatioScaling scales the minimum improvement ratio by the number
+// of candidate response times n collected in a round, so that candidates
+// tested with little evidence must show a larger improvement. When n is below
+// ReferenceResponseTimes, the ratio is multiplied by
+// (ReferenceResponseTimes / n) ^ Exponent, capped at MaxMultiplier. An
+// Exponent of 0.5 scales the ratio with the standard error of the P95.
+type ImprovementRatioScaling struct {
+	IsEnabled              bool
+	ReferenceResponseTimes int
+	Exponent               float64
+	MaxMultiplier          float64
+}
+
+// multiplier returns the factor the minimum improvement ratio is scaled by
+// when n candidate response times have been collected.
+func (s ImprovementRatioScaling) multiplier(n int) float64 {
+	if !s.IsEnabled || n >= s.ReferenceResponseTimes {
+		return 1
+	}
+	if n <= 0 {
+		return s.MaxMultiplier
+	}
+	return math.Min(s.MaxMultiplier, math.Pow(float64(s.ReferenceResponseTimes)/float64(n), s.Exponent))
+}
+
+// errorRateCounter counts the responses of a group and the responses which
+// are errors. Fields are accessed atomically.
+type errorRateCounter struct {
+	responses uint64
+	errors    uint64
+}
+
+func (c *errorRateCounter) add(statusCode int) {
+	atomic.AddUint64(&c.responses, 1)
+	if statusCode < 200 || statusCode > 299 {
+		atomic.AddUint64(&c.errors, 1)
+	}
+}
+
+func (c *errorRateCounter) reset() {
+	atomic.StoreUint64(&c.responses, 0)
+	atomic.StoreUint64(&c.errors, 0)
+}
+
+// errorRate returns the proportion of responses which are errors, or 0 if
+// there are no responses.
+func (c *errorRateCounter) errorRate() float64 {
+	responses := atomic.LoadUint64(&c.responses)
+	if responses == 0 {
+		return 0
+	}
+	return float64(atomic.LoadUint64(&c.errors)) / float64(responses)
+}
+
+// candidateGroup is a group of sessions whose requests are dimmed using
+// candidate probabilities, which are compared against the control group at
+// the end of each round.
+type candidateGroup struct {
+	pathProbabilities *filters.PathProbabilities
+	// responseTimes is wrapped by NewSortedCollector, so All() returns
+	// response times in ascending order which can be passed to the K-S test
+	// without sorting.
+	responseTimes responsetimecollector.Collector
+	errors        *errorRateCounter
+}
 
 type OnlineTraining struct {
-	logger                      logging.Logger
-	controlGroupResponseTimes   responsetimecollector.Collector
-	candidateGroupResponseTimes responsetimecollector.Collector
-	candidatePathProbabilities  *filters.PathProbabilities
-	paths                       []string
+	// candidateProbabilityBits holds the float64 bits of the probability of a
+	// session being assigned to the candidate group. It must be accessed
+	// atomically, and is first in the struct for 64-bit alignment on 32-bit
+	// platforms.
+	candidateProbabilityBits uint64
+	// minCandidateProbability and maxCandidateProbability bound the candidate
+	// probability.
+	minCandidateProbability float64
+	maxCandidateProbability float64
+	logger                  logging.Logger
+	// eventSink publishes adopted candidate probabilities. If nil, adoptions
+	// are not published.
+	eventSink logging.EventSink
+	// probabilityStore persists adopted candidate probabilities. If nil,
+	// adoptions are not persisted.
+	probabilityStore ProbabilityStore
+	// controlGroupResponseTimes is wrapped by NewSortedCollector, so All()
+	// returns response times in ascending order which can be passed to the
+	// K-S test without sorting.
+	controlGroupResponseTimes responsetimecollector.Collector
+	// candidateGroups are the groups whose candidate probabilities are
+	// tested against the control group each round. There is always at least
+	// one candidate group.
+	candidateGroups []*candidateGroup
+	paths           []string
 	// controlPathProbabilities is a pointer to the main ("control") group
 	// of path probabilities applied to the majority of requests under Server.
 	controlPathProbabilities *filters.PathProbabilities
+	// candidateSampler samples the candidate probability of the path
+	// changed each round. It is guarded by mux as samplers are not safe for
+	// concurrent use.
+	candidateSampler CandidateSampler
+	// pinEpsilon and pinnedPathHandling determine how paths pinned at a
+	// probability bound are treated. See Options.
+	pinEpsilon         float64
+	pinnedPathHandling PinnedPathHandling
+	// disabledPaths are skipped when choosing the path to change. If nil, no
+	// paths are skipped.
+	disabledPaths *filters.DisabledPaths
+	// If shouldLogRounds is true, the response times of each round are logged
+	// for post-hoc analysis of why a candidate was accepted or rejected. As
+	// this can be high-volume, response times are downsampled to at most
+	// maxLoggedResponseTimesPerGroup per group.
+	shouldLogRounds                bool
+	maxLoggedResponseTimesPerGroup int
+	// minCandidateResponseTimes rejects rounds with too few candidate
+	// response times to be compared.
+	minCandidateResponseTimes int
+	// A candidate which is faster as a result of returning more errors is
+	// worse, so if shouldCompareErrorRates is true, candidates with an error
+	// rate materially higher than the control are rejected. Error rates are
+	// counted over the same measurement window as response times.
+	shouldCompareErrorRates bool
+	errorRateTolerance      float64
+	controlGroupErrors      *errorRateCounter
+	// minimumImprovementRatio is the required reduction in P95 for a
+	// candidate to be accepted, scaled by improvementRatioScaling according
+	// to how many candidate response times were collected.
+	minimumImprovementRatio float64
+	improvementRatioScaling ImprovementRatioScaling
+	// significancePercentile is the percentile of the K-S test a candidate
+	// which increases probability must pass.
+	significancePercentile stats.Percentile
+	// cookieName is the name of the cookie assigning requests to groups.
+	cookieName       string
+	cookieAttributes cookies.Attributes
+	// testDuration and adjustmentDuration are the durations of each round's
+	// measurement window and the adjustment period. See Options.
+	testDuration       time.Duration
+	adjustmentDuration time.Duration
+	// windowStartedAt is the start of the current round's measurement window.
+	// Response times of requests which started before the window are
+	// discarded, as they may have been dimmed using the previous round's
+	// candidate probabilities. windowMux is held for writing while the window
+	// is started, so response times cannot be added between the collectors
+	// being reset.
+	windowStartedAt time.Time
+	windowMux       *sync.RWMutex
+	// now allows time to be controlled in tests.
+	now func() time.Time
+	// lastComparison is the comparison of the last round, or nil if no round
+	// has completed. It is guarded by mux.
+	lastComparison *Comparison
 	// mux protects fields from race conditions.
 	mux *sync.Mutex
 
+	// phase is the current Phase of the training loop. It must be accessed
+	// atomically.
+	phase int32
+
 	// loopStarted is used so the control loop can be started and stopped.
 	loopStarted bool
 	// As trainingLoop runs in a goroutine, loopWaiter and loopStop allow the
@@ -40,29 +390,176 @@ type OnlineTraining struct {
 	loopStop   chan bool
 }
 
-func NewOnlineTraining(logger logging.Logger, paths []string, controlPathProbabilities *filters.PathProbabilities, defaultPathProbability float64) (*OnlineTraining, error) {
-	candidatePathProbabilities, err := filters.NewPathProbabilities(defaultPathProbability)
+// NewOnlineTraining initialises online training.
+func NewOnlineTraining(logger logging.Logger, paths []string, controlPathProbabilities *filters.PathProbabilities, defaultPathProbability float64, options Options) (*OnlineTraining, error) {
+	if !(options.PinEpsilon >= 0 && options.PinEpsilon < 0.5) {
+		return nil, errors.New(fmt.Sprintf("NewOnlineTraining() expected PinEpsilon in [0, 0.5); got %v", options.PinEpsilon))
+	}
+
+	pinnedPathHandling := options.PinnedPathHandling
+	if pinnedPathHandling == "" {
+		pinnedPathHandling = PinnedPathHandlingNone
+	}
+	if pinnedPathHandling != PinnedPathHandlingNone &&
+		pinnedPathHandling != PinnedPathHandlingSkip &&
+		pinnedPathHandling != PinnedPathHandlingRecenter {
+		return nil, errors.New(fmt.Sprintf("NewOnlineTraining() expected PinnedPathHandling to be one of {none|skip|recenter}; got %s", pinnedPathHandling))
+	}
+
+	if options.MinCandidateResponseTimes < 0 {
+		return nil, errors.New(fmt.Sprintf("NewOnlineTraining() expected non-negative MinCandidateResponseTimes; got %d", options.MinCandidateResponseTimes))
+	}
+
+	if !(options.ErrorRateTolerance >= 0 && options.ErrorRateTolerance <= 1) {
+		return nil, errors.New(fmt.Sprintf("NewOnlineTraining() expected ErrorRateTolerance in [0, 1]; got %v", options.ErrorRateTolerance))
+	}
+
+	if !(options.MinimumImprovementRatio >= 0 && options.MinimumImprovementRatio < 1) {
+		return nil, errors.New(fmt.Sprintf("NewOnlineTraining() expected MinimumImprovementRatio in [0, 1); got %v", options.MinimumImprovementRatio))
+	}
+
+	candidateProbability := options.CandidateProbability
+	if candidateProbability == 0 {
+		candidateProbability = DefaultCandidateProbability
+	}
+	minCandidateProbability, maxCandidateProbability := options.MinCandidateProbability, options.MaxCandidateProbability
+	if maxCandidateProbability == 0 {
+		minCandidateProbability, maxCandidateProbability = DefaultMinCandidateProbability, DefaultMaxCandidateProbability
+	}
+	if !(minCandidateProbability >= 0 && minCandidateProbability <= maxCandidateProbability && maxCandidateProbability <= 1) {
+		return nil, errors.New(fmt.Sprintf("NewOnlineTraining() expected 0 <= MinCandidateProbability <= MaxCandidateProbability <= 1; got [%v, %v]", minCandidateProbability, maxCandidateProbability))
+	}
+	if !(candidateProbability >= minCandidateProbability && candidateProbability <= maxCandidateProbability) {
+		return nil, errors.New(fmt.Sprintf("NewOnlineTraining() expected CandidateProbability in [%v, %v]; got %v", minCandidateProbability, maxCandidateProbability, candidateProbability))
+	}
+
+	if scaling := options.ImprovementRatioScaling; scaling.IsEnabled {
+		if scaling.ReferenceResponseTimes <= 0 {
+			return nil, errors.New(fmt.Sprintf("NewOnlineTraining() expected positive ImprovementRatioScaling.ReferenceResponseTimes; got %d", scaling.ReferenceResponseTimes))
+		}
+		if scaling.Exponent < 0 {
+			return nil, errors.New(fmt.Sprintf("NewOnlineTraining() expected non-negative ImprovementRatioScaling.Exponent; got %v", scaling.Exponent))
+		}
+		if scaling.MaxMultiplier < 1 {
+			return nil, errors.New(fmt.Sprintf("NewOnlineTraining() expected ImprovementRatioScaling.MaxMultiplier >= 1; got %v", scaling.MaxMultiplier))
+		}
+	}
+
+	testDuration := options.TestDuration
+	if testDuration == 0 {
+		testDuration = DefaultTestDuration
+	}
+	if testDuration < 0 {
+		return nil, errors.New(fmt.Sprintf("NewOnlineTraining() expected non-negative TestDuration; got %v", options.TestDuration))
+	}
+	adjustmentDuration := options.AdjustmentDuration
+	if adjustmentDuration == 0 {
+		adjustmentDuration = DefaultAdjustmentDuration
+	}
+	if adjustmentDuration < 0 {
+		return nil, errors.New(fmt.Sprintf("NewOnlineTraining() expected non-negative AdjustmentDuration; got %v", options.AdjustmentDuration))
+	}
+
+	significancePercentileName := options.SignificancePercentile
+	if significancePercentileName == "" {
+		significancePercentileName = DefaultSignificancePercentile
+	}
+	significancePercentile, err := stats.ParsePercentile(significancePercentileName)
 	if err != nil {
-		return nil, fmt.Errorf("expected filters.NewPathProbabilities() returns nil err; got err = %w", err)
+		return nil, fmt.Errorf("NewOnlineTraining() expected valid SignificancePercentile; got err = %w", err)
 	}
 
-	for _, path := range paths {
-		if err := candidatePathProbabilities.Set(filters.PathProbabilityRule{
-			Path:        path,
-			Probability: controlPathProbabilities.Get(path),
-		}); err != nil {
-			return nil, fmt.Errorf("expected initial candidate probabilities setting returns nil err; got err = %w", err)
+	samplingVariance := options.SamplingVariance
+	if samplingVariance == 0 {
+		samplingVariance = DefaultSamplingVariance
+	}
+	if !(samplingVariance > 0) || math.IsInf(samplingVariance, 1) {
+		return nil, errors.New(fmt.Sprintf("NewOnlineTraining() expected positive SamplingVariance; got %v", options.SamplingVariance))
+	}
+
+	if options.ShouldLogRounds && options.MaxLoggedResponseTimesPerGroup <= 0 {
+		return nil, errors.New(fmt.Sprintf("NewOnlineTraining() expected positive MaxLoggedResponseTimesPerGroup when ShouldLogRounds is true; got %d", options.MaxLoggedResponseTimesPerGroup))
+	}
+
+	candidateGroupCount := options.CandidateGroups
+	if candidateGroupCount == 0 {
+		candidateGroupCount = DefaultCandidateGroups
+	}
+	if candidateGroupCount < 0 {
+		return nil, errors.New(fmt.Sprintf("NewOnlineTraining() expected non-negative CandidateGroups; got %d", options.CandidateGroups))
+	}
+
+	candidateGroups := make([]*candidateGroup, candidateGroupCount)
+	for i := range candidateGroups {
+		candidatePathProbabilities, err := filters.NewPathProbabilities(defaultPathProbability)
+		if err != nil {
+			return nil, fmt.Errorf("expected filters.NewPathProbabilities() returns nil err; got err = %w", err)
+		}
+
+		for _, path := range paths {
+			if err := candidatePathProbabilities.Set(filters.PathProbabilityRule{
+				Path:        path,
+				Probability: controlPathProbabilities.Get(path),
+			}); err != nil {
+				return nil, fmt.Errorf("expected initial candidate probabilities setting returns nil err; got err = %w", err)
+			}
+		}
+
+		candidateGroups[i] = &candidateGroup{
+			pathProbabilities: candidatePathProbabilities,
+			responseTimes:     responsetimecollector.NewSortedCollector(responsetimecollector.NewArrayCollector()),
+			errors:            &errorRateCounter{},
+		}
+	}
+
+	cookieName := options.CookieName
+	if cookieName == "" {
+		cookieName = DefaultCookieName
+	}
+
+	candidateSampler := options.CandidateSampler
+	if candidateSampler == nil {
+		randSeed := uint64(time.Now().UTC().UnixNano())
+		if options.Seed != nil {
+			randSeed = *options.Seed
+		}
+		candidateSampler, err = NewRandomCandidateSampler(randSeed, samplingVariance)
+		if err != nil {
+			return nil, fmt.Errorf("expected NewRandomCandidateSampler() returns nil err; got err = %w", err)
 		}
 	}
 
 	return &OnlineTraining{
-		logger:                      logger,
-		controlGroupResponseTimes:   responsetimecollector.NewTachymeterCollector(1500),
-		candidateGroupResponseTimes: responsetimecollector.NewArrayCollector(),
-		candidatePathProbabilities:  candidatePathProbabilities,
-		paths:                       paths,
-		controlPathProbabilities:    controlPathProbabilities,
-		mux:                         &sync.Mutex{},
+		candidateProbabilityBits:       math.Float64bits(candidateProbability),
+		minCandidateProbability:        minCandidateProbability,
+		maxCandidateProbability:        maxCandidateProbability,
+		logger:                         logger,
+		eventSink:                      options.EventSink,
+		probabilityStore:               options.ProbabilityStore,
+		controlGroupResponseTimes:      responsetimecollector.NewSortedCollector(responsetimecollector.NewTachymeterCollector(1500)),
+		candidateGroups:                candidateGroups,
+		paths:                          paths,
+		controlPathProbabilities:       controlPathProbabilities,
+		candidateSampler:               candidateSampler,
+		pinEpsilon:                     options.PinEpsilon,
+		pinnedPathHandling:             pinnedPathHandling,
+		disabledPaths:                  options.DisabledPaths,
+		shouldLogRounds:                options.ShouldLogRounds,
+		maxLoggedResponseTimesPerGroup: options.MaxLoggedResponseTimesPerGroup,
+		minCandidateResponseTimes:      options.MinCandidateResponseTimes,
+		shouldCompareErrorRates:        options.ShouldCompareErrorRates,
+		errorRateTolerance:             options.ErrorRateTolerance,
+		controlGroupErrors:             &errorRateCounter{},
+		minimumImprovementRatio:        options.MinimumImprovementRatio,
+		improvementRatioScaling:        options.ImprovementRatioScaling,
+		significancePercentile:         significancePercentile,
+		cookieName:                     cookieName,
+		cookieAttributes:               options.CookieAttributes,
+		testDuration:                   testDuration,
+		adjustmentDuration:             adjustmentDuration,
+		windowMux:                      &sync.RWMutex{},
+		now:                            time.Now,
+		mux:                            &sync.Mutex{},
 	}, nil
 }
 
@@ -89,15 +586,29 @@ func (t *OnlineTraining) StopLoop() error {
 	// in this order to ensure stale data is not written between each reset.
 	close(t.loopStop)
 	t.loopWaiter.Wait()
-	t.candidateGroupResponseTimes.Reset()
+	for _, group := range t.candidateGroups {
+		group.responseTimes.Reset()
+	}
 	t.controlGroupResponseTimes.Reset()
 
 	t.loopStarted = false
 	return nil
 }
 
+// Phase returns the current phase of the training loop.
+func (t *OnlineTraining) Phase() Phase {
+	return Phase(atomic.LoadInt32(&t.phase))
+}
+
+// setPhase records a phase transition, logging the new phase.
+func (t *OnlineTraining) setPhase(phase Phase) {
+	atomic.StoreInt32(&t.phase, int32(phase))
+	t.logger.LogOnlineTrainingPhase(int(phase))
+}
+
 func (t *OnlineTraining) trainingLoop() {
 	defer t.loopWaiter.Done()
+	defer t.setPhase(PhaseIdle)
 
 	// Used to ensure the controller responds to changes in PID values before
 	// continuing with another training loop. Initially set to true to allow
@@ -114,101 +625,333 @@ func (t *OnlineTraining) trainingLoop() {
 			return
 		default:
 			if isInAdjustmentPeriod {
+				t.setPhase(PhaseAdjusting)
 				// Wait for enough data to be collected while continuing to listen for
 				// Stop() in a non-blocking manner.
 				select {
 				case <-t.loopStop:
 					return
-				case <-time.After(2 * time.Minute):
+				case <-time.After(t.adjustmentDuration):
 					isInAdjustmentPeriod = false
 				}
 			}
 
-			// Sample new rules.
-			newCandidateRules := t.sampleCandidateGroupProbabilities(pathIdxToChange)
-			t.candidatePathProbabilities.Clear()
-			if err := t.candidatePathProbabilities.SetAll(newCandidateRules); err != nil {
-				panic(fmt.Errorf("expected t.candidatePathProbabilities.SetAll(rules = %+v) returns nil err; got err = %w", newCandidateRules, err))
+			// Sample new rules for each candidate group, each changing the
+			// probability of the same path.
+			var shouldRecenter bool
+			pathIdxToChange, shouldRecenter = t.selectPathToChange(pathIdxToChange)
+			changedPath := t.paths[pathIdxToChange]
+			controlProbability := t.controlPathProbabilities.Get(changedPath)
+			newCandidateRules := make([][]filters.PathProbabilityRule, len(t.candidateGroups))
+			hasProbabilityDecreased := make([]bool, len(t.candidateGroups))
+			for i, group := range t.candidateGroups {
+				newCandidateRules[i] = t.sampleCandidateGroupProbabilities(pathIdxToChange, shouldRecenter)
+				group.pathProbabilities.Clear()
+				if err := group.pathProbabilities.SetAll(newCandidateRules[i]); err != nil {
+					panic(fmt.Errorf("expected candidate group %d SetAll(rules = %+v) returns nil err; got err = %w", i, newCandidateRules[i], err))
+				}
+				hasProbabilityDecreased[i] = controlProbability > group.pathProbabilities.Get(changedPath)
 			}
-			hasProbabilityDecreased := t.controlPathProbabilities.Get(t.paths[pathIdxToChange]) >
-				t.candidatePathProbabilities.Get(t.paths[pathIdxToChange])
 			pathIdxToChange = (pathIdxToChange + 1) % len(t.paths)
 
 			log.Printf("[Online Testing] starting test with candidate rules: %+v\n\tprobability decreased: %v\n", newCandidateRules, hasProbabilityDecreased)
-			t.logger.LogOnlineTrainingProbabilities(
-				t.controlPathProbabilities.ListForPaths(t.paths),
-				t.candidatePathProbabilities.ListForPaths(t.paths),
-			)
+			for _, group := range t.candidateGroups {
+				t.logger.LogOnlineTrainingProbabilities(
+					t.controlPathProbabilities.ListForPaths(t.paths),
+					group.pathProbabilities.ListForPaths(t.paths),
+				)
+			}
 
-			t.candidateGroupResponseTimes.Reset()
-			t.controlGroupResponseTimes.Reset()
+			// The collectors are only reset here, once the candidate
+			// probabilities have been applied, so the measurement window
+			// starts from a clean state.
+			if err := t.startMeasurementWindow(); err != nil {
+				panic(fmt.Errorf("expected t.startMeasurementWindow() returns nil err; got err = %w", err))
+			}
+			t.setPhase(PhaseMeasuring)
 
 			// Wait for enough data to be collected while continuing to listen for
 			// Stop() in a non-blocking manner.
 			select {
 			case <-t.loopStop:
 				return
-			case <-time.After(3 * time.Minute):
+			case <-time.After(t.testDuration):
 				break
 			}
 
-			// Test whether the rules collected are significant, overriding the
-			// main path probabilities if so.
-			comparison := t.checkCandidateCausesImprovement(hasProbabilityDecreased)
-			log.Printf(
-				"[Online Testing] finished test with %d candidate response times collected for candidate rules: %+v\n",
-				t.candidateGroupResponseTimes.Len(),
-				newCandidateRules,
-			)
-			log.Printf("[Online Testing] significant improvement? %t\n", comparison)
-			if comparison {
-				log.Printf("[Online Testing] updating control with candidate rules\n")
-				if err := t.controlPathProbabilities.SetAll(newCandidateRules); err != nil {
-					panic(fmt.Errorf("expected t.controlPathProbabilities.SetAll(rules = %+v) returns nil err; got err = %w", newCandidateRules, err))
+			// Test whether the rules collected by each candidate group are
+			// significant, overriding the main path probabilities with the
+			// best significant candidate if any.
+			var acceptedGroups []int
+			for i, group := range t.candidateGroups {
+				comparison := t.checkCandidateCausesImprovement(i, hasProbabilityDecreased[i])
+				log.Printf(
+					"[Online Testing] finished test with %d candidate response times collected for candidate rules: %+v\n",
+					group.responseTimes.Len(),
+					newCandidateRules[i],
+				)
+				log.Printf("[Online Testing] significant improvement? %t\n", comparison)
+				if t.shouldLogRounds {
+					t.logger.LogOnlineTrainingRound(
+						stats.Downsample(t.controlGroupResponseTimes.All(), t.maxLoggedResponseTimesPerGroup),
+						stats.Downsample(group.responseTimes.All(), t.maxLoggedResponseTimesPerGroup),
+						hasProbabilityDecreased[i],
+						comparison,
+					)
 				}
+				if comparison {
+					acceptedGroups = append(acceptedGroups, i)
+				}
+				t.observeCandidateGroup(i, changedPath, controlProbability)
+			}
+
+			adoptedGroup := -1
+			if len(acceptedGroups) != 0 {
+				adoptedGroup = t.selectBestCandidateGroup(acceptedGroups, changedPath)
+			}
+			t.recordComparison(adoptedGroup)
+			if adoptedGroup >= 0 {
+				rules := newCandidateRules[adoptedGroup]
+				log.Printf("[Online Testing] updating control with candidate rules of group %d\n", adoptedGroup)
+				if err := t.controlPathProbabilities.SetAll(rules); err != nil {
+					panic(fmt.Errorf("expected t.controlPathProbabilities.SetAll(rules = %+v) returns nil err; got err = %w", rules, err))
+				}
+				t.publishAdoption()
+				t.saveAdoption(rules)
 				isInAdjustmentPeriod = true
 			}
 		}
 	}
 }
 
+// observeCandidateGroup reports the outcome of the round which has just
+// completed for a candidate group to the candidate sampler. Rounds where
+// either group collected too few response times are not reported, as their
+// P95s are unreliable.
+func (t *OnlineTraining) observeCandidateGroup(group int, changedPath string, controlProbability float64) {
+	candidate := t.candidateGroups[group]
+	if candidate.responseTimes.Len() == 0 || candidate.responseTimes.Len() < t.minCandidateResponseTimes ||
+		t.controlGroupResponseTimes.Len() == 0 {
+		return
+	}
+
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.candidateSampler.Observe(
+		changedPath,
+		controlProbability,
+		candidate.pathProbabilities.Get(changedPath),
+		t.controlGroupResponseTimes.Aggregate().P95.Seconds(),
+		candidate.responseTimes.Aggregate().P95.Seconds(),
+	)
+}
+
+// recordComparison records the outcome of the round which has just completed
+// for Status, where adoptedGroup is the index of the adopted candidate group,
+// or -1 if no candidate was adopted.
+func (t *OnlineTraining) recordComparison(adoptedGroup int) {
+	comparison := &Comparison{
+		ControlP95:            t.controlGroupResponseTimes.Aggregate().P95.Seconds(),
+		CandidateP95s:         make([]float64, len(t.candidateGroups)),
+		IsSignificant:         adoptedGroup >= 0,
+		AdoptedCandidateGroup: adoptedGroup,
+		CompletedAt:           t.now(),
+	}
+	for i, group := range t.candidateGroups {
+		comparison.CandidateP95s[i] = group.responseTimes.Aggregate().P95.Seconds()
+	}
+
+	t.mux.Lock()
+	t.lastComparison = comparison
+	t.mux.Unlock()
+}
+
+// Status returns a snapshot of online training.
+func (t *OnlineTraining) Status() Status {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	phase := t.Phase()
+	status := Status{
+		Phase:                phase,
+		IsIterationActive:    phase == PhaseMeasuring,
+		ControlProbabilities: t.controlPathProbabilities.ListForPaths(t.paths),
+	}
+	for _, group := range t.candidateGroups {
+		status.CandidateProbabilities = append(status.CandidateProbabilities, group.pathProbabilities.ListForPaths(t.paths))
+	}
+	if t.lastComparison != nil {
+		comparison := *t.lastComparison
+		comparison.CandidateP95s = append([]float64(nil), t.lastComparison.CandidateP95s...)
+		status.LastComparison = &comparison
+	}
+	return status
+}
+
+// publishAdoption publishes the control probabilities once candidate
+// probabilities are adopted.
+func (t *OnlineTraining) publishAdoption() {
+	if t.eventSink == nil {
+		return
+	}
+
+	t.eventSink.Publish(logging.Event{
+		Timestamp: t.now(),
+		Type:      logging.EventOnlineTrainingRulesAdopted,
+		Attributes: map[string]interface{}{
+			"probabilities": t.controlPathProbabilities.ListForPaths(t.paths),
+		},
+	})
+}
+
+// saveAdoption saves the adopted candidate probabilities to the probability
+// store. Failing to save is logged rather than fatal, as training continues
+// regardless.
+func (t *OnlineTraining) saveAdoption(rules []filters.PathProbabilityRule) {
+	if t.probabilityStore == nil {
+		return
+	}
+
+	if err := t.probabilityStore.Save(rules); err != nil {
+		log.Printf("expected ProbabilityStore.Save() returns nil err; got err = %v", err)
+	}
+}
+
 func (t *OnlineTraining) SetPaths(paths []string) {
 	t.mux.Lock()
 	t.paths = paths
 	t.mux.Unlock()
 }
 
-func (t *OnlineTraining) SampleCandidateGroupShouldDim(path string) bool {
-	return t.candidatePathProbabilities.SampleShouldDim(path)
+// SampleCandidateGroupShouldDim samples whether to dim using the probability
+// of the candidate group for path multiplied by multiplier.
+func (t *OnlineTraining) SampleCandidateGroupShouldDim(group int, path string, multiplier float64) bool {
+	return t.candidateGroups[group].pathProbabilities.SampleShouldDimWithMultiplier(path, multiplier)
+}
+
+// AddCandidateResponse adds the response time and status code of a request in
+// the candidate group which has just completed. It is discarded if the request
+// started before the measurement window.
+func (t *OnlineTraining) AddCandidateResponse(group int, duration time.Duration, statusCode int) {
+	t.windowMux.RLock()
+	defer t.windowMux.RUnlock()
+
+	if t.isWithinMeasurementWindow(duration) {
+		t.candidateGroups[group].responseTimes.Add(duration)
+		t.candidateGroups[group].errors.add(statusCode)
+	}
 }
 
-func (t *OnlineTraining) AddCandidateResponseTime(duration time.Duration) {
-	t.candidateGroupResponseTimes.Add(duration)
+// AddControlResponse adds the response time and status code of a request
+// which has just completed. It is discarded if the request started before the
+// measurement window.
+func (t *OnlineTraining) AddControlResponse(duration time.Duration, statusCode int) {
+	t.windowMux.RLock()
+	defer t.windowMux.RUnlock()
+
+	if t.isWithinMeasurementWindow(duration) {
+		t.controlGroupResponseTimes.Add(duration)
+		t.controlGroupErrors.add(statusCode)
+	}
 }
 
-func (t *OnlineTraining) AddControlResponseTime(duration time.Duration) {
-	t.controlGroupResponseTimes.Add(duration)
+// isWithinMeasurementWindow returns true if a request which has just completed
+// with the given duration started within the measurement window. windowMux
+// must be held.
+func (t *OnlineTraining) isWithinMeasurementWindow(duration time.Duration) bool {
+	return !t.now().Add(-duration).Before(t.windowStartedAt)
 }
 
-func (t *OnlineTraining) sampleCandidateGroupProbabilities(pathIdxToChange int) []filters.PathProbabilityRule {
+// startMeasurementWindow resets all collectors and starts a new measurement
+// window, returning an error if any collector is not empty once reset.
+func (t *OnlineTraining) startMeasurementWindow() error {
+	t.windowMux.Lock()
+	defer t.windowMux.Unlock()
+
+	for _, group := range t.candidateGroups {
+		group.responseTimes.Reset()
+		group.errors.reset()
+	}
+	t.controlGroupResponseTimes.Reset()
+	t.controlGroupErrors.reset()
+	for i, group := range t.candidateGroups {
+		if n := group.responseTimes.Len(); n != 0 {
+			return errors.New(fmt.Sprintf("startMeasurementWindow() expected empty candidate group %d collector after reset; got %d response times", i, n))
+		}
+	}
+	if n := t.controlGroupResponseTimes.Len(); n != 0 {
+		return errors.New(fmt.Sprintf("startMeasurementWindow() expected empty control collector after reset; got %d response times", n))
+	}
+
+	t.windowStartedAt = t.now()
+	return nil
+}
+
+// selectPathToChange returns the index of the next path to change, starting
+// from start, and whether exploration for that path should be re-centred as
+// its probability is pinned at a bound. Disabled paths are skipped unless all
+// paths are disabled.
+func (t *OnlineTraining) selectPathToChange(start int) (int, bool) {
 	t.mux.Lock()
 	defer t.mux.Unlock()
 
-	// Sample a set of probabilities for rules using random optimisation with
-	// a normal distribution, setting the mean to be the current path
-	// probability. The variance is set to 0.5 based on empirical observations.
-	variance := 0.8
+	start = start % len(t.paths)
+	for i := 0; i < len(t.paths); i++ {
+		idx := (start + i) % len(t.paths)
+		if !t.isDisabled(t.paths[idx]) {
+			start = idx
+			break
+		}
+	}
+
+	switch t.pinnedPathHandling {
+	case PinnedPathHandlingSkip:
+		for i := 0; i < len(t.paths); i++ {
+			idx := (start + i) % len(t.paths)
+			if !t.isPinned(t.paths[idx]) && !t.isDisabled(t.paths[idx]) {
+				return idx, false
+			}
+		}
+
+		// Skipping would otherwise waste every round once all paths are
+		// pinned.
+		log.Printf("[Online Testing] all paths pinned at probability bounds; re-centring exploration\n")
+		return start, true
+	case PinnedPathHandlingRecenter:
+		return start, t.isPinned(t.paths[start])
+	default:
+		return start, false
+	}
+}
+
+// isDisabled returns true if dimming is disabled for path.
+func (t *OnlineTraining) isDisabled(path string) bool {
+	return t.disabledPaths != nil && t.disabledPaths.Contains(path)
+}
+
+// isPinned returns true if the control probability for path is within
+// pinEpsilon of 0 or 1.
+func (t *OnlineTraining) isPinned(path string) bool {
+	probability := t.controlPathProbabilities.Get(path)
+	return probability <= t.pinEpsilon || probability >= 1-t.pinEpsilon
+}
+
+func (t *OnlineTraining) sampleCandidateGroupProbabilities(pathIdxToChange int, shouldRecenter bool) []filters.PathProbabilityRule {
+	t.mux.Lock()
+	defer t.mux.Unlock()
 
+	// Sample a set of probabilities for rules using the candidate sampler,
+	// setting the mean to be the current path probability.
 	var rules []filters.PathProbabilityRule
 	for i, path := range t.paths {
 		var probability float64
 		if i == pathIdxToChange {
-			probability = stats.SampleTruncatedNormalDistribution(
-				0,
-				1,
-				t.controlPathProbabilities.Get(path),
-				variance,
-			)
+			mean := t.controlPathProbabilities.Get(path)
+			if shouldRecenter {
+				mean = recenteredMean
+			}
+
+			probability = t.candidateSampler.Sample(path, mean)
 		} else {
 			probability = t.controlPathProbabilities.Get(path)
 		}
@@ -222,9 +965,27 @@ func (t *OnlineTraining) sampleCandidateGroupProbabilities(pathIdxToChange int)
 	return rules
 }
 
-func (t *OnlineTraining) checkCandidateCausesImprovement(hasProbabilityDecreased bool) bool {
+// checkCandidateCausesImprovement returns true if the candidate group's
+// response times are an improvement over the control group's.
+func (t *OnlineTraining) checkCandidateCausesImprovement(group int, hasProbabilityDecreased bool) bool {
+	candidate := t.candidateGroups[group]
+	if n := candidate.responseTimes.Len(); n < t.minCandidateResponseTimes {
+		log.Printf("[Online Testing] candidate collected %d response times; expected at least %d\n", n, t.minCandidateResponseTimes)
+		return false
+	}
+
+	if t.shouldCompareErrorRates {
+		controlErrorRate := t.controlGroupErrors.errorRate()
+		candidateErrorRate := candidate.errors.errorRate()
+		log.Printf("[Online Testing] control error rate: %.4f, candidate error rate: %.4f\n", controlErrorRate, candidateErrorRate)
+		if candidateErrorRate > controlErrorRate+t.errorRateTolerance {
+			log.Printf("[Online Testing] candidate error rate exceeds control error rate by more than %.4f\n", t.errorRateTolerance)
+			return false
+		}
+	}
+
 	controlAggregate := t.controlGroupResponseTimes.Aggregate()
-	candidateAggregate := t.candidateGroupResponseTimes.Aggregate()
+	candidateAggregate := candidate.responseTimes.Aggregate()
 
 	controlP95 := float64(controlAggregate.P95) / float64(time.Second)
 	candidateP95 := float64(candidateAggregate.P95) / float64(time.Second)
@@ -238,8 +999,9 @@ func (t *OnlineTraining) checkCandidateCausesImprovement(hasProbabilityDecreased
 		return false
 	}
 
+	// The collectors are sorted, so the K-S test need not sort them again.
 	controlAll := t.controlGroupResponseTimes.All()
-	candidateAll := t.candidateGroupResponseTimes.All()
+	candidateAll := candidate.responseTimes.All()
 
 	// If the probability decreases and the application remains stable, we
 	// prefer the probability to be lowered to improve business objectives.
@@ -247,49 +1009,134 @@ func (t *OnlineTraining) checkCandidateCausesImprovement(hasProbabilityDecreased
 		// The K-S test will return false if there is an insignificant
 		// difference in response times.
 		return 0.97*controlP95 < candidateP95 && candidateP95 < 1.03*controlP95 &&
-			!stats.KolmogorovSmirnovTestRejection(controlAll, candidateAll, stats.P95)
+			!stats.KolmogorovSmirnovTestRejectionSorted(controlAll, candidateAll, stats.P95)
 	}
 
-	// The candidate P95 must be  lower than the control P95 for
-	// there to be a potential improvement in response times.
-	if !(candidateP95 < controlP95) {
+	// The candidate P95 must be lower than the control P95 by the minimum
+	// improvement ratio for there to be a potential improvement in response
+	// times. The ratio is larger when fewer candidate response times were
+	// collected, as the candidate P95 is less certain.
+	requiredRatio := t.requiredImprovementRatio(candidate.responseTimes.Len())
+	if !(candidateP95 < (1-requiredRatio)*controlP95) {
+		if requiredRatio > 0 {
+			log.Printf("[Online Testing] candidate p95 not lower than control p95 by required ratio %.4f\n", requiredRatio)
+		}
 		return false
 	}
 
 	// Test whether there is a significant change in response time distributions
-	// by performing a Kolmogorov-Smirnov test at the 99th percentile. The 99th
-	// percentile has been chosen based on empirical tests where the 99.5th
-	// percentile is overly sensitive.
-	return stats.KolmogorovSmirnovTestRejection(controlAll, candidateAll, stats.P99)
+	// by performing a Kolmogorov-Smirnov test at the significance percentile.
+	return stats.KolmogorovSmirnovTestRejectionSorted(controlAll, candidateAll, t.significancePercentile)
+}
+
+// selectBestCandidateGroup returns the best of the accepted candidate groups
+// by comparing them pairwise. A candidate replaces the best so far if a K-S
+// test at the significance percentile finds their response times differ and
+// its P95 is lower. If their response times do not differ, the candidate with
+// the lower probability for the changed path is preferred, as lower
+// probabilities improve business objectives while the application remains
+// stable.
+func (t *OnlineTraining) selectBestCandidateGroup(acceptedGroups []int, changedPath string) int {
+	best := acceptedGroups[0]
+	for _, challenger := range acceptedGroups[1:] {
+		bestResponseTimes := t.candidateGroups[best].responseTimes
+		challengerResponseTimes := t.candidateGroups[challenger].responseTimes
+
+		if stats.KolmogorovSmirnovTestRejectionSorted(bestResponseTimes.All(), challengerResponseTimes.All(), t.significancePercentile) {
+			if challengerResponseTimes.Aggregate().P95 < bestResponseTimes.Aggregate().P95 {
+				best = challenger
+			}
+		} else if t.candidateGroups[challenger].pathProbabilities.Get(changedPath) < t.candidateGroups[best].pathProbabilities.Get(changedPath) {
+			best = challenger
+		}
+	}
+	return best
+}
+
+// requiredImprovementRatio returns the minimum improvement ratio scaled for n
+// candidate response times, capped below 1 so an improvement remains
+// possible.
+func (t *OnlineTraining) requiredImprovementRatio(n int) float64 {
+	return math.Min(0.99, t.minimumImprovementRatio*t.improvementRatioScaling.multiplier(n))
+}
+
+// RequestHasCookie returns true if the request has a cookie assigning it to
+// the control group or an existing candidate group. Cookies assigning it to a
+// candidate group which no longer exists, e.g. after the number of candidate
+// groups is reduced, are ignored so the session is assigned again.
+func (t *OnlineTraining) RequestHasCookie(request *fasthttp.Request) bool {
+	if string(request.Header.Cookie(t.cookieName)) == onlineTrainingCookieControl {
+		return true
+	}
+	_, isCandidate := t.CandidateGroup(request)
+	return isCandidate
+}
+
+// CandidateGroup returns the index of the candidate group the request's cookie
+// assigns it to, and false if it is not assigned to a candidate group.
+func (t *OnlineTraining) CandidateGroup(request *fasthttp.Request) (int, bool) {
+	value := string(request.Header.Cookie(t.cookieName))
+	for i := range t.candidateGroups {
+		if value == candidateCookieValue(i) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// CandidateProbability returns the probability of a session being assigned to
+// a candidate group, which is split evenly between candidate groups.
+func (t *OnlineTraining) CandidateProbability() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&t.candidateProbabilityBits))
 }
 
-func RequestHasCookie(request *fasthttp.Request) bool {
-	return len(request.Header.Cookie(onlineTrainingCookieKey)) != 0
+// CandidateProbabilityRange returns the range the candidate probability can
+// be set within.
+func (t *OnlineTraining) CandidateProbabilityRange() (min float64, max float64) {
+	return t.minCandidateProbability, t.maxCandidateProbability
 }
 
-func RequestHasCandidateCookie(request *fasthttp.Request) bool {
-	return strings.Compare(onlineTrainingCookieCandidate,
-		string(request.Header.Cookie(onlineTrainingCookieKey))) == 0
+// SetCandidateProbability changes the probability of new sessions being
+// assigned to the candidate group, rejecting probabilities outside the
+// configured range.
+func (t *OnlineTraining) SetCandidateProbability(probability float64) error {
+	if !(probability >= t.minCandidateProbability && probability <= t.maxCandidateProbability) {
+		return errors.New(fmt.Sprintf("SetCandidateProbability() expected probability in [%v, %v]; got probability = %v", t.minCandidateProbability, t.maxCandidateProbability, probability))
+	}
+	atomic.StoreUint64(&t.candidateProbabilityBits, math.Float64bits(probability))
+	return nil
 }
 
-func SampleCookie() *fasthttp.Cookie {
-	if rand.Float64() < onlineTrainingCookieCandidateProbability {
-		return candidateCookie()
+func (t *OnlineTraining) SampleCookie() *fasthttp.Cookie {
+	if rand.Float64() < t.CandidateProbability() {
+		return t.candidateCookie(rand.Intn(len(t.candidateGroups)))
 	} else {
-		return controlCookie()
+		return t.controlCookie()
 	}
 }
 
-func controlCookie() *fasthttp.Cookie {
+func (t *OnlineTraining) controlCookie() *fasthttp.Cookie {
 	cookie := &fasthttp.Cookie{}
-	cookie.SetKey(onlineTrainingCookieKey)
+	cookie.SetKey(t.cookieName)
 	cookie.SetValue(onlineTrainingCookieControl)
+	t.cookieAttributes.Apply(cookie)
 	return cookie
 }
 
-func candidateCookie() *fasthttp.Cookie {
+func (t *OnlineTraining) candidateCookie(group int) *fasthttp.Cookie {
 	cookie := &fasthttp.Cookie{}
-	cookie.SetKey(onlineTrainingCookieKey)
-	cookie.SetValue(onlineTrainingCookieCandidate)
+	cookie.SetKey(t.cookieName)
+	cookie.SetValue(candidateCookieValue(group))
+	t.cookieAttributes.Apply(cookie)
 	return cookie
 }
+
+// candidateCookieValue returns the cookie value assigning sessions to the
+// candidate group. The first group's value is the same as when there was only
+// one candidate group, so existing sessions keep their assignment.
+func candidateCookieValue(group int) string {
+	if group == 0 {
+		return onlineTrainingCookieCandidate
+	}
+	return onlineTrainingCookieCandidate + "_" + strconv.Itoa(group+1)
+}
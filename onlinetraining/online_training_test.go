@@ -0,0 +1,577 @@
+package onlinetraining
+
+import (
+	"math"
+	"net/http"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kcz17/dimmer/filters"
+	"github.com/kcz17/dimmer/logging"
+	"github.com/kcz17/dimmer/stats"
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+	exprand "golang.org/x/exp/rand"
+)
+
+func newTestOnlineTraining(t *testing.T) *OnlineTraining {
+	probabilities, err := filters.NewPathProbabilities(1)
+	assert.Nilf(t, err, "expected NewPathProbabilities(...) has no err; got %v", err)
+
+	o, err := NewOnlineTraining(logging.NewNoopLogger(), []string{"/path"}, probabilities, 1, Options{})
+	assert.Nilf(t, err, "expected NewOnlineTraining(...) has no err; got %v", err)
+	return o
+}
+
+func TestOnlineTraining_startMeasurementWindow_DiscardsPreWindowResponseTimes(t *testing.T) {
+	o := newTestOnlineTraining(t)
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	o.now = func() time.Time { return now }
+
+	o.AddCandidateResponse(0, time.Second, http.StatusOK)
+	o.AddControlResponse(time.Second, http.StatusOK)
+
+	assert.Nil(t, o.startMeasurementWindow())
+	assert.Equal(t, 0, o.candidateGroups[0].responseTimes.Len())
+	assert.Equal(t, 0, o.controlGroupResponseTimes.Len())
+
+	// Requests which started before the window but complete within it were
+	// dimmed using the previous round's probabilities.
+	now = now.Add(500 * time.Millisecond)
+	o.AddCandidateResponse(0, time.Second, http.StatusOK)
+	o.AddControlResponse(time.Second, http.StatusOK)
+	assert.Equal(t, 0, o.candidateGroups[0].responseTimes.Len())
+	assert.Equal(t, 0, o.controlGroupResponseTimes.Len())
+
+	o.AddCandidateResponse(0, 500*time.Millisecond, http.StatusOK)
+	o.AddControlResponse(100*time.Millisecond, http.StatusOK)
+	assert.Equal(t, []float64{0.5}, o.candidateGroups[0].responseTimes.All())
+	assert.Equal(t, 1, o.controlGroupResponseTimes.Len())
+}
+
+func TestOnlineTraining_checkCandidateCausesImprovement_RejectsBelowMinimumResponseTimes(t *testing.T) {
+	o := newTestOnlineTraining(t)
+	o.minCandidateResponseTimes = 10
+
+	for i := 0; i < 9; i++ {
+		o.candidateGroups[0].responseTimes.Add(100 * time.Millisecond)
+		o.controlGroupResponseTimes.Add(time.Second)
+	}
+
+	assert.False(t, o.checkCandidateCausesImprovement(0, false))
+}
+
+func TestOnlineTraining_checkCandidateCausesImprovement_RejectsHigherErrorRate(t *testing.T) {
+	o := newTestOnlineTraining(t)
+	o.shouldCompareErrorRates = true
+	o.errorRateTolerance = 0.05
+
+	// The candidate is faster as it returns errors.
+	for i := 0; i < 100; i++ {
+		o.AddControlResponse(time.Second, http.StatusOK)
+		statusCode := http.StatusOK
+		if i%10 == 0 {
+			statusCode = http.StatusInternalServerError
+		}
+		o.AddCandidateResponse(0, 100*time.Millisecond, statusCode)
+	}
+
+	assert.InDelta(t, 0.1, o.candidateGroups[0].errors.errorRate(), 1e-9)
+	assert.False(t, o.checkCandidateCausesImprovement(0, false))
+
+	o.errorRateTolerance = 0.2
+	assert.True(t, o.checkCandidateCausesImprovement(0, false))
+}
+
+func TestOnlineTraining_checkCandidateCausesImprovement_UsesSignificancePercentile(t *testing.T) {
+	tests := []struct {
+		percentile string
+		want       bool
+	}{
+		{percentile: "p90", want: true},
+		{percentile: "p95", want: true},
+		{percentile: "p97.5", want: false},
+		{percentile: "", want: false},
+	}
+	for _, tt := range tests {
+		t.Run("Percentile "+tt.percentile, func(t *testing.T) {
+			probabilities, err := filters.NewPathProbabilities(1)
+			assert.Nilf(t, err, "expected NewPathProbabilities(...) has no err; got %v", err)
+			o, err := NewOnlineTraining(logging.NewNoopLogger(), []string{"/path"}, probabilities, 1, Options{SignificancePercentile: tt.percentile})
+			assert.Nilf(t, err, "expected NewOnlineTraining(...) has no err; got %v", err)
+
+			// The candidate response times are 20% lower, giving a K-S test
+			// statistic of 0.2, which is only significant up to the 95th
+			// percentile for 100 response times per group.
+			for i := 1; i <= 100; i++ {
+				o.AddControlResponse(time.Duration(i)*10*time.Millisecond, http.StatusOK)
+				o.AddCandidateResponse(0, time.Duration(i)*8*time.Millisecond, http.StatusOK)
+			}
+			assert.Equal(t, tt.want, o.checkCandidateCausesImprovement(0, false))
+		})
+	}
+}
+
+func TestNewOnlineTraining_InvalidSignificancePercentile(t *testing.T) {
+	probabilities, err := filters.NewPathProbabilities(1)
+	assert.Nilf(t, err, "expected NewPathProbabilities(...) has no err; got %v", err)
+
+	_, err = NewOnlineTraining(logging.NewNoopLogger(), []string{"/path"}, probabilities, 1, Options{SignificancePercentile: "p50"})
+	assert.NotNil(t, err)
+}
+
+func TestImprovementRatioScaling_multiplier(t *testing.T) {
+	scaling := ImprovementRatioScaling{
+		IsEnabled:              true,
+		ReferenceResponseTimes: 1000,
+		Exponent:               0.5,
+		MaxMultiplier:          4,
+	}
+
+	assert.InDelta(t, 1, scaling.multiplier(1000), 1e-9)
+	assert.InDelta(t, 1, scaling.multiplier(5000), 1e-9)
+	assert.InDelta(t, 2, scaling.multiplier(250), 1e-9)
+	assert.InDelta(t, 4, scaling.multiplier(10), 1e-9)
+	assert.InDelta(t, 4, scaling.multiplier(0), 1e-9)
+
+	scaling.IsEnabled = false
+	assert.InDelta(t, 1, scaling.multiplier(10), 1e-9)
+}
+
+func TestOnlineTraining_checkCandidateCausesImprovement_ScalesImprovementRatioBySamples(t *testing.T) {
+	o := newTestOnlineTraining(t)
+	o.minimumImprovementRatio = 0.1
+	o.improvementRatioScaling = ImprovementRatioScaling{
+		IsEnabled:              true,
+		ReferenceResponseTimes: 400,
+		Exponent:               0.5,
+		MaxMultiplier:          4,
+	}
+
+	// The candidate P95 is 20% lower than the control P95, which satisfies
+	// the minimum improvement ratio of 10% but not the ratio of 20% required
+	// with a quarter of the reference response times.
+	for i := 0; i < 100; i++ {
+		o.AddControlResponse(time.Second, http.StatusOK)
+		o.AddCandidateResponse(0, 800*time.Millisecond, http.StatusOK)
+	}
+	assert.InDelta(t, 0.2, o.requiredImprovementRatio(o.candidateGroups[0].responseTimes.Len()), 1e-9)
+	assert.False(t, o.checkCandidateCausesImprovement(0, false))
+
+	for i := 0; i < 300; i++ {
+		o.AddControlResponse(time.Second, http.StatusOK)
+		o.AddCandidateResponse(0, 800*time.Millisecond, http.StatusOK)
+	}
+	assert.InDelta(t, 0.1, o.requiredImprovementRatio(o.candidateGroups[0].responseTimes.Len()), 1e-9)
+	assert.True(t, o.checkCandidateCausesImprovement(0, false))
+}
+
+func TestOnlineTraining_Phase_TracksTrainingLoop(t *testing.T) {
+	o := newTestOnlineTraining(t)
+	assert.Equal(t, PhaseIdle, o.Phase())
+
+	assert.Nil(t, o.StartLoop())
+	assert.Eventually(t, func() bool { return o.Phase() == PhaseAdjusting }, time.Second, time.Millisecond)
+
+	assert.Nil(t, o.StopLoop())
+	assert.Equal(t, PhaseIdle, o.Phase())
+	assert.Equal(t, "idle", o.Phase().String())
+}
+
+func TestOnlineTraining_StartStopLoop_DoesNotLeakGoroutines(t *testing.T) {
+	o := newTestOnlineTraining(t)
+
+	baseline := runtime.NumGoroutine()
+	for i := 0; i < 50; i++ {
+		assert.Nil(t, o.StartLoop())
+		assert.Nil(t, o.StopLoop())
+	}
+	assert.NotNil(t, o.StopLoop(), "expected err stopping a stopped training loop")
+
+	// Goroutines may take a moment to exit after signalling the wait group.
+	// assert.Eventually is not used as it checks its condition in a new
+	// goroutine.
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > baseline && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	assert.LessOrEqualf(t, runtime.NumGoroutine(), baseline, "expected goroutine count to return to baseline %d", baseline)
+}
+
+// roundCountingLogger counts the training rounds logged.
+type roundCountingLogger struct {
+	logging.Logger
+	rounds int32
+}
+
+func (l *roundCountingLogger) LogOnlineTrainingRound(control []float64, candidate []float64, hasProbabilityDecreased bool, isAccepted bool) {
+	atomic.AddInt32(&l.rounds, 1)
+}
+
+func TestOnlineTraining_TrainingLoop_CompletesRoundsWithinTestDuration(t *testing.T) {
+	probabilities, err := filters.NewPathProbabilities(1)
+	assert.Nilf(t, err, "expected NewPathProbabilities(...) has no err; got %v", err)
+
+	logger := &roundCountingLogger{Logger: logging.NewNoopLogger()}
+	o, err := NewOnlineTraining(logger, []string{"/path"}, probabilities, 1, Options{
+		ShouldLogRounds:                true,
+		MaxLoggedResponseTimesPerGroup: 10,
+		TestDuration:                   5 * time.Millisecond,
+		AdjustmentDuration:             5 * time.Millisecond,
+	})
+	assert.Nilf(t, err, "expected NewOnlineTraining(...) has no err; got %v", err)
+
+	assert.Nil(t, o.StartLoop())
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&logger.rounds) >= 3 }, time.Second, time.Millisecond)
+	assert.Nil(t, o.StopLoop())
+}
+
+func TestNewOnlineTraining_NegativeDurations(t *testing.T) {
+	probabilities, err := filters.NewPathProbabilities(1)
+	assert.Nilf(t, err, "expected NewPathProbabilities(...) has no err; got %v", err)
+
+	for _, options := range []Options{{TestDuration: -time.Second}, {AdjustmentDuration: -time.Second}} {
+		_, err = NewOnlineTraining(logging.NewNoopLogger(), []string{"/path"}, probabilities, 1, options)
+		assert.NotNilf(t, err, "expected err for options = %+v", options)
+	}
+}
+
+func TestOnlineTraining_sampleCandidateGroupProbabilities_UsesSamplingVariance(t *testing.T) {
+	probabilities, err := filters.NewPathProbabilities(1)
+	assert.Nilf(t, err, "expected NewPathProbabilities(...) has no err; got %v", err)
+	assert.Nil(t, probabilities.Set(filters.PathProbabilityRule{Path: "/path", Probability: 0.3}))
+
+	o, err := NewOnlineTraining(logging.NewNoopLogger(), []string{"/path"}, probabilities, 1, Options{SamplingVariance: 0.2})
+	assert.Nilf(t, err, "expected NewOnlineTraining(...) has no err; got %v", err)
+
+	var gotMean, gotVariance float64
+	o.candidateSampler.(*RandomCandidateSampler).sampleTruncatedNormal = func(src exprand.Source, lo, hi, mean, variance float64) float64 {
+		gotMean, gotVariance = mean, variance
+		return 0.4
+	}
+
+	rules := o.sampleCandidateGroupProbabilities(0, false)
+	assert.Equal(t, 0.3, gotMean)
+	assert.Equal(t, 0.2, gotVariance)
+	assert.Equal(t, []filters.PathProbabilityRule{{Path: "/path", Probability: 0.4}}, rules)
+}
+
+func TestNewOnlineTraining_NonPositiveSamplingVariance(t *testing.T) {
+	probabilities, err := filters.NewPathProbabilities(1)
+	assert.Nilf(t, err, "expected NewPathProbabilities(...) has no err; got %v", err)
+
+	for _, variance := range []float64{-0.1, math.NaN(), math.Inf(1)} {
+		_, err = NewOnlineTraining(logging.NewNoopLogger(), []string{"/path"}, probabilities, 1, Options{SamplingVariance: variance})
+		assert.NotNilf(t, err, "expected err for variance = %v", variance)
+	}
+}
+
+func TestOnlineTraining_SetCandidateProbability(t *testing.T) {
+	o := newTestOnlineTraining(t)
+	assert.Equal(t, DefaultCandidateProbability, o.CandidateProbability())
+	min, max := o.CandidateProbabilityRange()
+	assert.Equal(t, DefaultMinCandidateProbability, min)
+	assert.Equal(t, DefaultMaxCandidateProbability, max)
+
+	assert.Nil(t, o.SetCandidateProbability(0.1))
+	assert.Equal(t, 0.1, o.CandidateProbability())
+
+	for _, probability := range []float64{0.005, 0.5, 1, math.NaN()} {
+		assert.NotNilf(t, o.SetCandidateProbability(probability), "expected err for probability = %v", probability)
+		assert.Equal(t, 0.1, o.CandidateProbability())
+	}
+}
+
+func TestNewOnlineTraining_CandidateProbabilityOutsideRange(t *testing.T) {
+	probabilities, err := filters.NewPathProbabilities(1)
+	assert.Nilf(t, err, "expected NewPathProbabilities(...) has no err; got %v", err)
+
+	_, err = NewOnlineTraining(logging.NewNoopLogger(), []string{"/path"}, probabilities, 1, Options{
+		CandidateProbability:    0.5,
+		MinCandidateProbability: 0.01,
+		MaxCandidateProbability: 0.2,
+	})
+	assert.NotNil(t, err)
+}
+
+func TestOnlineTraining_Status(t *testing.T) {
+	o := newTestOnlineTraining(t)
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	o.now = func() time.Time { return now }
+
+	status := o.Status()
+	assert.Equal(t, PhaseIdle, status.Phase)
+	assert.False(t, status.IsIterationActive)
+	assert.Equal(t, map[string]float64{"/path": 1}, status.ControlProbabilities)
+	assert.Nil(t, status.LastComparison)
+
+	assert.Nil(t, o.candidateGroups[0].pathProbabilities.SetAll([]filters.PathProbabilityRule{{Path: "/path", Probability: 0.4}}))
+	o.setPhase(PhaseMeasuring)
+	o.AddControlResponse(time.Second, http.StatusOK)
+	o.AddCandidateResponse(0, 500*time.Millisecond, http.StatusOK)
+	o.recordComparison(0)
+
+	status = o.Status()
+	assert.Equal(t, PhaseMeasuring, status.Phase)
+	assert.True(t, status.IsIterationActive)
+	assert.Equal(t, map[string]float64{"/path": 1}, status.ControlProbabilities)
+	assert.Equal(t, []map[string]float64{{"/path": 0.4}}, status.CandidateProbabilities)
+	assert.Equal(t, &Comparison{
+		ControlP95:            1,
+		CandidateP95s:         []float64{0.5},
+		IsSignificant:         true,
+		AdoptedCandidateGroup: 0,
+		CompletedAt:           now,
+	}, status.LastComparison)
+
+	// The snapshot is a copy, so modifying it does not modify the status.
+	status.LastComparison.IsSignificant = false
+	assert.True(t, o.Status().LastComparison.IsSignificant)
+}
+
+func newTestOnlineTrainingWithCandidateGroups(t *testing.T, candidateGroups int) *OnlineTraining {
+	probabilities, err := filters.NewPathProbabilities(1)
+	assert.Nilf(t, err, "expected NewPathProbabilities(...) has no err; got %v", err)
+
+	o, err := NewOnlineTraining(logging.NewNoopLogger(), []string{"/path"}, probabilities, 1, Options{CandidateGroups: candidateGroups})
+	assert.Nilf(t, err, "expected NewOnlineTraining(...) has no err; got %v", err)
+	return o
+}
+
+func TestOnlineTraining_CandidateGroup(t *testing.T) {
+	o := newTestOnlineTrainingWithCandidateGroups(t, 2)
+
+	tests := []struct {
+		cookie          string
+		wantGroup       int
+		wantIsCandidate bool
+		wantHasCookie   bool
+	}{
+		{cookie: "CONTROL", wantIsCandidate: false, wantHasCookie: true},
+		{cookie: "CANDIDATE", wantGroup: 0, wantIsCandidate: true, wantHasCookie: true},
+		{cookie: "CANDIDATE_2", wantGroup: 1, wantIsCandidate: true, wantHasCookie: true},
+		// Cookies for groups which no longer exist are resampled.
+		{cookie: "CANDIDATE_3", wantIsCandidate: false, wantHasCookie: false},
+		{cookie: "", wantIsCandidate: false, wantHasCookie: false},
+	}
+	for _, tt := range tests {
+		t.Run("Cookie "+tt.cookie, func(t *testing.T) {
+			request := &fasthttp.Request{}
+			if tt.cookie != "" {
+				request.Header.SetCookie(DefaultCookieName, tt.cookie)
+			}
+
+			group, isCandidate := o.CandidateGroup(request)
+			assert.Equal(t, tt.wantIsCandidate, isCandidate)
+			if tt.wantIsCandidate {
+				assert.Equal(t, tt.wantGroup, group)
+			}
+			assert.Equal(t, tt.wantHasCookie, o.RequestHasCookie(request))
+		})
+	}
+}
+
+func TestOnlineTraining_SampleCookie_AssignsAllCandidateGroups(t *testing.T) {
+	o := newTestOnlineTrainingWithCandidateGroups(t, 2)
+	assert.Nil(t, o.SetCandidateProbability(DefaultMaxCandidateProbability))
+
+	values := map[string]bool{}
+	for i := 0; i < 1000; i++ {
+		values[string(o.SampleCookie().Value())] = true
+	}
+	assert.Equal(t, map[string]bool{"CONTROL": true, "CANDIDATE": true, "CANDIDATE_2": true}, values)
+}
+
+func TestOnlineTraining_selectBestCandidateGroup_PromotesFasterCandidate(t *testing.T) {
+	o := newTestOnlineTrainingWithCandidateGroups(t, 2)
+	o.significancePercentile = stats.P95
+
+	// Both candidates are faster than the control, and the second candidate
+	// is significantly faster than the first.
+	for i := 1; i <= 100; i++ {
+		o.AddControlResponse(time.Duration(i)*20*time.Millisecond, http.StatusOK)
+		o.AddCandidateResponse(0, time.Duration(i)*10*time.Millisecond, http.StatusOK)
+		o.AddCandidateResponse(1, time.Duration(i)*5*time.Millisecond, http.StatusOK)
+	}
+	assert.True(t, o.checkCandidateCausesImprovement(0, false))
+	assert.True(t, o.checkCandidateCausesImprovement(1, false))
+
+	assert.Equal(t, 1, o.selectBestCandidateGroup([]int{0, 1}, "/path"))
+	assert.Equal(t, 1, o.selectBestCandidateGroup([]int{1, 0}, "/path"))
+}
+
+func TestOnlineTraining_selectBestCandidateGroup_PrefersLowerProbabilityWhenIndistinguishable(t *testing.T) {
+	o := newTestOnlineTrainingWithCandidateGroups(t, 2)
+	assert.Nil(t, o.candidateGroups[0].pathProbabilities.Set(filters.PathProbabilityRule{Path: "/path", Probability: 0.6}))
+	assert.Nil(t, o.candidateGroups[1].pathProbabilities.Set(filters.PathProbabilityRule{Path: "/path", Probability: 0.4}))
+
+	for i := 1; i <= 100; i++ {
+		o.AddCandidateResponse(0, time.Duration(i)*10*time.Millisecond, http.StatusOK)
+		o.AddCandidateResponse(1, time.Duration(i)*10*time.Millisecond, http.StatusOK)
+	}
+
+	assert.Equal(t, 1, o.selectBestCandidateGroup([]int{0, 1}, "/path"))
+}
+
+func TestOnlineTraining_TrainingLoop_PromotesBetterCandidateGroup(t *testing.T) {
+	probabilities, err := filters.NewPathProbabilities(1)
+	assert.Nilf(t, err, "expected NewPathProbabilities(...) has no err; got %v", err)
+	assert.Nil(t, probabilities.Set(filters.PathProbabilityRule{Path: "/path", Probability: 0.5}))
+
+	o, err := NewOnlineTraining(logging.NewNoopLogger(), []string{"/path"}, probabilities, 1, Options{
+		CandidateGroups:        2,
+		SignificancePercentile: "p95",
+		TestDuration:           50 * time.Millisecond,
+		AdjustmentDuration:     time.Millisecond,
+	})
+	assert.Nilf(t, err, "expected NewOnlineTraining(...) has no err; got %v", err)
+
+	// Each candidate group samples a higher probability in turn.
+	var samples int32
+	o.candidateSampler.(*RandomCandidateSampler).sampleTruncatedNormal = func(src exprand.Source, lo, hi, mean, variance float64) float64 {
+		if atomic.AddInt32(&samples, 1)%2 == 1 {
+			return 0.6
+		}
+		return 0.7
+	}
+
+	// Time is advanced once measuring, so the response times added are
+	// within the measurement window.
+	var offset int64
+	o.now = func() time.Time { return time.Now().Add(time.Duration(atomic.LoadInt64(&offset))) }
+
+	assert.Nil(t, o.StartLoop())
+	assert.Eventually(t, func() bool { return o.Phase() == PhaseMeasuring }, time.Second, time.Millisecond)
+	atomic.StoreInt64(&offset, int64(time.Minute))
+	// The second candidate group is significantly faster than the first,
+	// which is faster than the control.
+	for i := 1; i <= 100; i++ {
+		o.AddControlResponse(time.Duration(i)*20*time.Millisecond, http.StatusOK)
+		o.AddCandidateResponse(0, time.Duration(i)*10*time.Millisecond, http.StatusOK)
+		o.AddCandidateResponse(1, time.Duration(i)*5*time.Millisecond, http.StatusOK)
+	}
+	// Later rounds collect no response times, so the comparison is captured
+	// as soon as a candidate is adopted.
+	var comparison *Comparison
+	assert.Eventually(t, func() bool {
+		comparison = o.Status().LastComparison
+		return comparison != nil && comparison.IsSignificant
+	}, time.Second, time.Millisecond)
+	assert.Nil(t, o.StopLoop())
+
+	if assert.NotNil(t, comparison) {
+		assert.Equal(t, 1, comparison.AdoptedCandidateGroup)
+	}
+	assert.Equal(t, 0.7, probabilities.Get("/path"))
+}
+
+func TestOnlineTraining_selectPathToChange_SkipsDisabledPaths(t *testing.T) {
+	probabilities, err := filters.NewPathProbabilities(0.5)
+	assert.Nilf(t, err, "expected NewPathProbabilities(...) has no err; got %v", err)
+	assert.Nil(t, probabilities.Set(filters.PathProbabilityRule{Path: "/c", Probability: 0}))
+	disabledPaths := filters.NewDisabledPaths()
+	assert.Nil(t, disabledPaths.Disable("/a"))
+
+	o, err := NewOnlineTraining(logging.NewNoopLogger(), []string{"/a", "/b", "/c"}, probabilities, 1, Options{
+		PinnedPathHandling: PinnedPathHandlingSkip,
+		DisabledPaths:      disabledPaths,
+	})
+	assert.Nilf(t, err, "expected NewOnlineTraining(...) has no err; got %v", err)
+
+	idx, _ := o.selectPathToChange(0)
+	assert.Equal(t, 1, idx, "expected disabled path /a to be skipped")
+
+	// /b is disabled and /c is pinned, so /a is the only candidate once
+	// enabled.
+	assert.Nil(t, disabledPaths.Disable("/b"))
+	assert.Nil(t, disabledPaths.Enable("/a"))
+	idx, _ = o.selectPathToChange(1)
+	assert.Equal(t, 0, idx)
+}
+
+func TestOnlineTraining_isPinned(t *testing.T) {
+	tests := []struct {
+		name        string
+		epsilon     float64
+		probability float64
+		want        bool
+	}{
+		{name: "Zero is pinned without epsilon", epsilon: 0, probability: 0, want: true},
+		{name: "One is pinned without epsilon", epsilon: 0, probability: 1, want: true},
+		{name: "Near zero is not pinned without epsilon", epsilon: 0, probability: 0.125, want: false},
+		{name: "Lower bound is pinned", epsilon: 0.125, probability: 0.125, want: true},
+		{name: "Above lower bound is not pinned", epsilon: 0.125, probability: 0.25, want: false},
+		{name: "Upper bound is pinned", epsilon: 0.125, probability: 0.875, want: true},
+		{name: "Below upper bound is not pinned", epsilon: 0.125, probability: 0.75, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			probabilities, err := filters.NewPathProbabilities(1)
+			assert.Nilf(t, err, "expected NewPathProbabilities(...) has no err; got %v", err)
+			assert.Nil(t, probabilities.Set(filters.PathProbabilityRule{Path: "/path", Probability: tt.probability}))
+
+			o, err := NewOnlineTraining(logging.NewNoopLogger(), []string{"/path"}, probabilities, 1, Options{PinEpsilon: tt.epsilon})
+			assert.Nilf(t, err, "expected NewOnlineTraining(...) has no err; got %v", err)
+			assert.Equal(t, tt.want, o.isPinned("/path"))
+		})
+	}
+}
+
+func TestOnlineTraining_selectPathToChange_PinnedPathHandling(t *testing.T) {
+	tests := []struct {
+		name               string
+		handling           PinnedPathHandling
+		bProbability       float64
+		start              int
+		wantIdx            int
+		wantShouldRecenter bool
+	}{
+		{name: "None samples pinned paths", handling: PinnedPathHandlingNone, bProbability: 0.5, start: 0, wantIdx: 0},
+		{name: "Skip skips pinned paths", handling: PinnedPathHandlingSkip, bProbability: 0.5, start: 0, wantIdx: 1},
+		{name: "Skip keeps unpinned paths", handling: PinnedPathHandlingSkip, bProbability: 0.5, start: 1, wantIdx: 1},
+		{name: "Recenter re-centres pinned paths", handling: PinnedPathHandlingRecenter, bProbability: 0.5, start: 0, wantIdx: 0, wantShouldRecenter: true},
+		{name: "Recenter keeps unpinned paths", handling: PinnedPathHandlingRecenter, bProbability: 0.5, start: 1, wantIdx: 1},
+		{name: "Skip re-centres if all paths are pinned", handling: PinnedPathHandlingSkip, bProbability: 1, start: 1, wantIdx: 1, wantShouldRecenter: true},
+		{name: "Recenter re-centres if all paths are pinned", handling: PinnedPathHandlingRecenter, bProbability: 1, start: 1, wantIdx: 1, wantShouldRecenter: true},
+		{name: "None samples if all paths are pinned", handling: PinnedPathHandlingNone, bProbability: 1, start: 1, wantIdx: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			probabilities, err := filters.NewPathProbabilities(1)
+			assert.Nilf(t, err, "expected NewPathProbabilities(...) has no err; got %v", err)
+			assert.Nil(t, probabilities.Set(filters.PathProbabilityRule{Path: "/a", Probability: 0.0625}))
+			assert.Nil(t, probabilities.Set(filters.PathProbabilityRule{Path: "/b", Probability: tt.bProbability}))
+
+			o, err := NewOnlineTraining(logging.NewNoopLogger(), []string{"/a", "/b"}, probabilities, 1, Options{
+				PinEpsilon:         0.125,
+				PinnedPathHandling: tt.handling,
+			})
+			assert.Nilf(t, err, "expected NewOnlineTraining(...) has no err; got %v", err)
+
+			idx, shouldRecenter := o.selectPathToChange(tt.start)
+			assert.Equal(t, tt.wantIdx, idx)
+			assert.Equal(t, tt.wantShouldRecenter, shouldRecenter)
+		})
+	}
+}
+
+func TestOnlineTraining_sampleCandidateGroupProbabilities_RecentersPinnedPaths(t *testing.T) {
+	probabilities, err := filters.NewPathProbabilities(1)
+	assert.Nilf(t, err, "expected NewPathProbabilities(...) has no err; got %v", err)
+
+	o, err := NewOnlineTraining(logging.NewNoopLogger(), []string{"/path"}, probabilities, 1, Options{PinnedPathHandling: PinnedPathHandlingRecenter})
+	assert.Nilf(t, err, "expected NewOnlineTraining(...) has no err; got %v", err)
+
+	var gotMean float64
+	o.candidateSampler.(*RandomCandidateSampler).sampleTruncatedNormal = func(src exprand.Source, lo, hi, mean, variance float64) float64 {
+		gotMean = mean
+		return 0.4
+	}
+
+	o.sampleCandidateGroupProbabilities(0, false)
+	assert.Equal(t, 1.0, gotMean)
+	o.sampleCandidateGroupProbabilities(0, true)
+	assert.Equal(t, recenteredMean, gotMean)
+}
@@ -0,0 +1,69 @@
+package onlinetraining
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/kcz17/dimmer/filters"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// ProbabilityStore persists the control probabilities adopted by online
+// training, so learned probabilities survive restarts rather than reverting to
+// their configured values.
+type ProbabilityStore interface {
+	Save(rules []filters.PathProbabilityRule) error
+	// Load returns false if no probabilities have been saved.
+	Load() ([]filters.PathProbabilityRule, bool, error)
+}
+
+// FileProbabilityStore persists probabilities as a JSON file.
+type FileProbabilityStore struct {
+	path string
+}
+
+func NewFileProbabilityStore(path string) *FileProbabilityStore {
+	return &FileProbabilityStore{path: path}
+}
+
+// Save writes the rules to a temporary file which then replaces the store's
+// file, so a crash while saving cannot leave a partially written file.
+func (s *FileProbabilityStore) Save(rules []filters.PathProbabilityRule) error {
+	data, err := json.Marshal(rules)
+	if err != nil {
+		return fmt.Errorf("expected json.Marshal(rules) returns nil err; got err = %w", err)
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("expected ioutil.TempFile() returns nil err; got err = %w", err)
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return fmt.Errorf("expected writing %s returns nil err; got err = %w", file.Name(), err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("expected closing %s returns nil err; got err = %w", file.Name(), err)
+	}
+	if err := os.Rename(file.Name(), s.path); err != nil {
+		return fmt.Errorf("expected renaming %s to %s returns nil err; got err = %w", file.Name(), s.path, err)
+	}
+	return nil
+}
+
+func (s *FileProbabilityStore) Load() ([]filters.PathProbabilityRule, bool, error) {
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, fmt.Errorf("expected reading %s returns nil err; got err = %w", s.path, err)
+	}
+
+	var rules []filters.PathProbabilityRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, false, fmt.Errorf("expected %s to contain JSON path probability rules; got err = %w", s.path, err)
+	}
+	return rules, true, nil
+}
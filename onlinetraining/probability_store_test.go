@@ -0,0 +1,47 @@
+package onlinetraining
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/kcz17/dimmer/filters"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileProbabilityStore_RoundTripsRules(t *testing.T) {
+	store := NewFileProbabilityStore(filepath.Join(t.TempDir(), "probabilities.json"))
+	rules := []filters.PathProbabilityRule{
+		{Path: "/news", Probability: 0.25},
+		{Path: "recommendations", Probability: 1},
+	}
+
+	assert.Nil(t, store.Save(rules))
+	got, isFound, err := store.Load()
+	assert.Nil(t, err)
+	assert.True(t, isFound)
+	assert.Equal(t, rules, got)
+
+	// Saving again replaces the previous rules.
+	assert.Nil(t, store.Save(rules[:1]))
+	got, _, err = store.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, rules[:1], got)
+}
+
+func TestFileProbabilityStore_LoadMissingFile(t *testing.T) {
+	store := NewFileProbabilityStore(filepath.Join(t.TempDir(), "probabilities.json"))
+
+	got, isFound, err := store.Load()
+	assert.Nil(t, err)
+	assert.False(t, isFound)
+	assert.Empty(t, got)
+}
+
+func TestFileProbabilityStore_LoadMalformedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "probabilities.json")
+	assert.Nil(t, ioutil.WriteFile(path, []byte("garbage"), 0644))
+
+	_, _, err := NewFileProbabilityStore(path).Load()
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,28 @@
+package pid
+
+// Controller calculates a control output, such as a dimming percentage, from
+// an input, such as a response time. PIDController is the default
+// implementation, and alternatives such as fuzzy or model predictive
+// controllers can be supplied in its place.
+type Controller interface {
+	Output(input float64) float64
+	Reset()
+}
+
+// TunableController is a Controller whose setpoint and gain constants can be
+// changed at runtime. Gains returns the effective gain constants, which are
+// negative if the controller is reversed, as for PIDController.
+type TunableController interface {
+	Controller
+	Setpoint() float64
+	SetSetpoint(setpoint float64)
+	Gains() (kp float64, ki float64, kd float64)
+	SetGains(kp float64, ki float64, kd float64) error
+}
+
+// PausableController is a Controller which can discard the time elapsed while
+// it was paused. See PIDController.DiscardElapsed.
+type PausableController interface {
+	Controller
+	DiscardElapsed()
+}
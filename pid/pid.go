@@ -2,6 +2,7 @@ package pid
 
 import (
 	"errors"
+	"sync"
 	"time"
 )
 
@@ -11,21 +12,35 @@ type PIDController struct {
 	kp            float64   // Proportional gain constant.
 	ki            float64   // Integral gain constant.
 	kd            float64   // Differential gain constant.
+	isReversed    bool      // If true, the gain constants are negated.
 	minOutput     float64   // Output will never go below lower bound.
 	maxOutput     float64   // Output will never go above upper bound.
 	minSampleTime float64   // Output will not change before minSampleTime is elapsed.
 	lastOutput    float64   // If minSampleTime has not yet elapsed, this will be the output.
 	lastTick      time.Time // Used to scale differential and integral terms and to enforce minSampleTime.
-	lastInput     float64   // Used to calculate the differential term.
+	lastInput     float64   // Used to calculate the differential term on measurement.
+	lastError     float64   // Used to calculate the differential term on error.
 	integral      float64   // Running integral term for PID calculation.
 	lowPassPole   float64   // TODO(kz)
-	DebugP        float64   // P value calculated during loop, accessible for debug purposes.
-	DebugI        float64   // I value calculated during loop, accessible for debug purposes.
-	DebugD        float64   // D value calculated during loop, accessible for debug purposes.
-	DebugErr      float64   // Error term calculated during loop, accessible for debug purposes.
+	// derivativeOnMeasurement calculates the differential term from the rate
+	// of change of the input rather than of the error. The error is the
+	// setpoint minus the input, so the two are numerically identical while
+	// the setpoint is constant. When the setpoint changes, however, the error
+	// steps by the change, and derivative-on-error outputs a spike of
+	// kd * change / elapsed for a single loop (a "derivative kick"), whereas
+	// derivative-on-measurement is unaffected.
+	derivativeOnMeasurement bool
+	// mux guards the controller state, as the setpoint can be changed while
+	// the control loop is running.
+	mux *sync.Mutex
+
+	DebugP   float64 // P value calculated during loop, accessible for debug purposes.
+	DebugI   float64 // I value calculated during loop, accessible for debug purposes.
+	DebugD   float64 // D value calculated during loop, accessible for debug purposes.
+	DebugErr float64 // Error term calculated during loop, accessible for debug purposes.
 }
 
-func NewPIDController(clock Clock, setpoint float64, kp float64, ki float64, kd float64, isReversed bool, minOutput float64, maxOutput float64, minSampleTime float64) (*PIDController, error) {
+func NewPIDController(clock Clock, setpoint float64, kp float64, ki float64, kd float64, isReversed bool, minOutput float64, maxOutput float64, minSampleTime float64, derivativeOnMeasurement bool) (*PIDController, error) {
 	if kp < 0 || ki < 0 || kd < 0 {
 		return nil, errors.New("expected positive controller parameters; got negative (toggle isReversed instead)")
 	}
@@ -44,14 +59,21 @@ func NewPIDController(clock Clock, setpoint float64, kp float64, ki float64, kd
 		kp:            kp,
 		ki:            ki,
 		kd:            kd,
+		isReversed:    isReversed,
 		lowPassPole:   0.9,
 		minOutput:     minOutput,
 		maxOutput:     maxOutput,
 		minSampleTime: minSampleTime,
+
+		derivativeOnMeasurement: derivativeOnMeasurement,
+		mux:                     &sync.Mutex{},
 	}, nil
 }
 
 func (c *PIDController) Output(input float64) float64 {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
 	now := c.clock.Now()
 
 	// The elapsed time > 0 only once a control loop has been made.
@@ -79,8 +101,10 @@ func (c *PIDController) Output(input float64) float64 {
 
 	// Prevent division by zero if control loop not yet made.
 	var d float64
-	if elapsed != 0 {
+	if elapsed != 0 && c.derivativeOnMeasurement {
 		d = c.kd * -((input - c.lastInput) / elapsed)
+	} else if elapsed != 0 {
+		d = c.kd * ((errorTerm - c.lastError) / elapsed)
 	} else {
 		d = 0
 	}
@@ -99,15 +123,94 @@ func (c *PIDController) Output(input float64) float64 {
 	// Save calculations for the next loop.
 	c.lastTick = now
 	c.lastInput = input
+	c.lastError = errorTerm
 	c.lastOutput = output
 
 	return output
 }
 
+// Setpoint returns the setpoint the controller aims to achieve.
+func (c *PIDController) Setpoint() float64 {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.setpoint
+}
+
+// SetSetpoint changes the setpoint the controller aims to achieve. The change
+// is bumpless: the integral is offset by the change in the proportional term,
+// so the output does not jump at the next loop but moves gradually towards
+// the new setpoint as the integral accumulates. The differential term is only
+// unaffected if calculated on measurement.
+func (c *PIDController) SetSetpoint(setpoint float64) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	// The integral is only offset once a loop has been made, as the first
+	// loop has no previous output to transfer from.
+	if !c.lastTick.IsZero() {
+		c.integral -= c.kp * (setpoint - c.setpoint)
+	}
+	c.setpoint = setpoint
+}
+
+// Gains returns the effective gain constants, which are negative if the
+// controller is reversed.
+func (c *PIDController) Gains() (kp float64, ki float64, kd float64) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.kp, c.ki, c.kd
+}
+
+// SetGains changes the gain constants, which are negated if the controller is
+// reversed as in NewPIDController. The change is bumpless: the integral is
+// stored already scaled by ki, so changing ki only affects its accumulation
+// from the next loop, and the integral is offset by the change in the
+// proportional term so changing kp does not step the output.
+func (c *PIDController) SetGains(kp float64, ki float64, kd float64) error {
+	if kp < 0 || ki < 0 || kd < 0 {
+		return errors.New("expected positive controller parameters; got negative (toggle isReversed instead)")
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.isReversed {
+		kp = -kp
+		ki = -ki
+		kd = -kd
+	}
+	// The integral is only offset once a loop has been made, as the first
+	// loop has no previous output to transfer from.
+	if !c.lastTick.IsZero() {
+		c.integral -= (kp - c.kp) * c.lastError
+	}
+	c.kp = kp
+	c.ki = ki
+	c.kd = kd
+	return nil
+}
+
+// DiscardElapsed restarts the elapsed time from now, so the next loop neither
+// integrates nor differentiates over a period in which the controller was
+// paused, e.g. while its input was unreliable. Other state is retained.
+func (c *PIDController) DiscardElapsed() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	// The elapsed time is only tracked once a loop has been made.
+	if !c.lastTick.IsZero() {
+		c.lastTick = c.clock.Now()
+	}
+}
+
 func (c *PIDController) Reset() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
 	c.lastOutput = 0
 	c.lastTick = time.Time{}
 	c.lastInput = 0
+	c.lastError = 0
 	c.integral = 0
 	c.DebugP = 0
 	c.DebugI = 0
@@ -62,6 +62,7 @@ func TestPidController_WaterBoilerSimulation(t *testing.T) {
 		0,
 		100,
 		0.5,
+		true,
 	)
 	assert.Nilf(t, err, "expected NewPIDController(...) has no err; got %v", err)
 
@@ -124,7 +125,7 @@ func TestPidController_Output_MinSampleTimeIsExclusive(t *testing.T) {
 	setpoint := float64(50)
 
 	clock := newSimulatedClock()
-	controller, err := NewPIDController(clock, setpoint, 1, 0, 0, false, 0, 100, minSampleTime)
+	controller, err := NewPIDController(clock, setpoint, 1, 0, 0, false, 0, 100, minSampleTime, true)
 	assert.Nilf(t, err, "expected NewPIDController(...) has no err; got %v", err)
 
 	// Perform an initial loop so that the minSampleTime check will take place.
@@ -142,7 +143,7 @@ func TestPidController_Output_ReturnsLastOutputIfMinSampleTimeNotElapsed(t *test
 	setpoint := float64(50)
 
 	clock := newSimulatedClock()
-	controller, err := NewPIDController(clock, setpoint, 1, 0, 0, false, 0, 100, minSampleTime)
+	controller, err := NewPIDController(clock, setpoint, 1, 0, 0, false, 0, 100, minSampleTime, true)
 	assert.Nilf(t, err, "expected NewPIDController(...) has no err; got %v", err)
 
 	// Perform an initial loop so that the minSampleTime check will take place.
@@ -160,7 +161,7 @@ func TestPidController_Output_withReversedInput(t *testing.T) {
 	setpoint := 1000.0
 
 	clock := newSimulatedClock()
-	controller, err := NewPIDController(clock, setpoint, kp, ki, kd, isReversed, math.Inf(-1), math.Inf(1), 1)
+	controller, err := NewPIDController(clock, setpoint, kp, ki, kd, isReversed, math.Inf(-1), math.Inf(1), 1, true)
 	assert.Nilf(t, err, "expected NewPIDController(...) has no err; got %v", err)
 
 	initialOutput := controller.Output(1500)
@@ -170,3 +171,144 @@ func TestPidController_Output_withReversedInput(t *testing.T) {
 	nextOutput := controller.Output(950)
 	assert.Equalf(t, true, initialOutput > nextOutput, "expected initial output > next output; got initial %.3f and next %.3f", initialOutput, nextOutput)
 }
+
+func TestPidController_Output_SetpointChangeCausesNoDerivativeKickOnMeasurement(t *testing.T) {
+	tests := []struct {
+		name                    string
+		derivativeOnMeasurement bool
+		wantKick                bool
+	}{
+		{name: "Derivative on measurement", derivativeOnMeasurement: true, wantKick: false},
+		{name: "Derivative on error", derivativeOnMeasurement: false, wantKick: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := newSimulatedClock()
+			controller, err := NewPIDController(clock, 50, 1, 0, 1, false, math.Inf(-1), math.Inf(1), 1, tt.derivativeOnMeasurement)
+			assert.Nilf(t, err, "expected NewPIDController(...) has no err; got %v", err)
+
+			// Run until the low-pass filtered input settles at a constant input.
+			for i := 0; i < 300; i++ {
+				clock.advance(1)
+				controller.Output(50)
+			}
+			assert.InDelta(t, 0, controller.DebugD, 1e-6)
+
+			controller.SetSetpoint(80)
+			clock.advance(1)
+			controller.Output(50)
+
+			if tt.wantKick {
+				assert.InDelta(t, 30, controller.DebugD, 1e-6)
+			} else {
+				assert.InDelta(t, 0, controller.DebugD, 1e-6)
+			}
+		})
+	}
+}
+
+func TestPidController_SetSetpoint_IsBumpless(t *testing.T) {
+	tests := []struct {
+		name       string
+		isReversed bool
+	}{
+		{name: "Direct", isReversed: false},
+		{name: "Reversed", isReversed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := newSimulatedClock()
+			controller, err := NewPIDController(clock, 50, 2, 0.1, 0, tt.isReversed, math.Inf(-1), math.Inf(1), 1, true)
+			assert.Nilf(t, err, "expected NewPIDController(...) has no err; got %v", err)
+
+			// Run until the low-pass filtered input settles, after which the
+			// output changes only by the integral of the error each loop.
+			var output float64
+			for i := 0; i < 300; i++ {
+				clock.advance(1)
+				output = controller.Output(40)
+			}
+
+			controller.SetSetpoint(60)
+			assert.Equal(t, 60.0, controller.Setpoint())
+			clock.advance(1)
+			nextOutput := controller.Output(40)
+
+			// Without bumpless transfer, the proportional term would step the
+			// output by kp * 10 = 20.
+			_, ki, _ := controller.Gains()
+			assert.InDelta(t, ki*20, nextOutput-output, 1e-6)
+		})
+	}
+}
+
+func TestPidController_SetGains_IsBumpless(t *testing.T) {
+	tests := []struct {
+		name       string
+		isReversed bool
+	}{
+		{name: "Direct", isReversed: false},
+		{name: "Reversed", isReversed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := newSimulatedClock()
+			controller, err := NewPIDController(clock, 50, 2, 0.1, 0, tt.isReversed, math.Inf(-1), math.Inf(1), 1, true)
+			assert.Nilf(t, err, "expected NewPIDController(...) has no err; got %v", err)
+
+			// Run until the low-pass filtered input settles, after which the
+			// output changes only by the integral of the error each loop.
+			var output float64
+			for i := 0; i < 300; i++ {
+				clock.advance(1)
+				output = controller.Output(40)
+			}
+
+			assert.Nil(t, controller.SetGains(4, 0.3, 1))
+			kp, ki, kd := controller.Gains()
+			if tt.isReversed {
+				assert.Equal(t, []float64{-4, -0.3, -1}, []float64{kp, ki, kd})
+			} else {
+				assert.Equal(t, []float64{4, 0.3, 1}, []float64{kp, ki, kd})
+			}
+			clock.advance(1)
+			nextOutput := controller.Output(40)
+
+			// Without bumpless transfer, the proportional term would step the
+			// output by (4 - 2) * 10 = 20.
+			assert.InDelta(t, ki*10, nextOutput-output, 1e-6)
+		})
+	}
+}
+
+func TestPidController_SetGains_RejectsNegativeGains(t *testing.T) {
+	controller, err := NewPIDController(newSimulatedClock(), 50, 2, 0.1, 0, false, 0, 100, 1, true)
+	assert.Nilf(t, err, "expected NewPIDController(...) has no err; got %v", err)
+
+	assert.NotNil(t, controller.SetGains(-1, 0, 0))
+	kp, ki, kd := controller.Gains()
+	assert.Equal(t, []float64{2, 0.1, 0}, []float64{kp, ki, kd})
+}
+
+func TestPidController_DiscardElapsed(t *testing.T) {
+	clock := newSimulatedClock()
+	controller, err := NewPIDController(clock, 50, 2, 0.1, 0, false, math.Inf(-1), math.Inf(1), 1, true)
+	assert.Nilf(t, err, "expected NewPIDController(...) has no err; got %v", err)
+
+	// Run until the low-pass filtered input settles, after which the output
+	// changes only by the integral of the error each loop.
+	var output float64
+	for i := 0; i < 300; i++ {
+		clock.advance(1)
+		output = controller.Output(40)
+	}
+
+	// The controller is paused for 100 seconds, which would otherwise be
+	// integrated over at the next loop.
+	clock.advance(100)
+	controller.DiscardElapsed()
+	clock.advance(1)
+	nextOutput := controller.Output(40)
+
+	assert.InDelta(t, 0.1*10, nextOutput-output, 1e-6)
+}
@@ -0,0 +1,108 @@
+package profiling
+
+import (
+	"fmt"
+	"github.com/go-redis/redis/v7"
+	"strconv"
+	"time"
+)
+
+// DefaultAggregatorStoreKey is the Redis key aggregator counts are persisted
+// to if no key is configured.
+const DefaultAggregatorStoreKey = "dimmer:profiling:aggregator"
+
+// AggregatorCounts are the decayed counts of a ProfiledRequestAggregator at
+// SavedAt, which are persisted so the counts survive restarts.
+type AggregatorCounts struct {
+	// Counts maps priority tiers to their visit counts.
+	Counts  map[Priority]float64
+	SavedAt time.Time
+}
+
+// aggregatorSavedAtField is the hash field SavedAt is stored in. Counts are
+// stored in fields named after their tiers, which are lowercase, so cannot
+// collide with it. Counts saved before tiers were configurable were stored in
+// the low and high fields, so are restored into the default tiers.
+const aggregatorSavedAtField = "savedAt"
+
+// AggregatorStore persists AggregatorCounts across restarts.
+type AggregatorStore interface {
+	Save(counts AggregatorCounts) error
+	// Load returns false if no counts have been saved.
+	Load() (AggregatorCounts, bool, error)
+}
+
+// redisHashClient is the subset of *redis.Client used by RedisAggregatorStore,
+// so the store can be tested without a Redis server.
+type redisHashClient interface {
+	HSet(key string, values ...interface{}) *redis.IntCmd
+	HGetAll(key string) *redis.StringStringMapCmd
+}
+
+// RedisAggregatorStore persists AggregatorCounts as a Redis hash.
+type RedisAggregatorStore struct {
+	client redisHashClient
+	key    string
+}
+
+// NewAggregatorStore returns a store persisting counts to key using the
+// fetcher's priorities client, so no further Redis connection is needed.
+func (f *RedisPriorityFetcher) NewAggregatorStore(key string) *RedisAggregatorStore {
+	return &RedisAggregatorStore{
+		client: f.prioritiesClient,
+		key:    key,
+	}
+}
+
+func (s *RedisAggregatorStore) Save(counts AggregatorCounts) error {
+	if err := s.client.HSet(s.key, aggregatorCountsToHash(counts)).Err(); err != nil {
+		return fmt.Errorf("expected HSet(%s) returns nil err; got err = %w", s.key, err)
+	}
+	return nil
+}
+
+func (s *RedisAggregatorStore) Load() (AggregatorCounts, bool, error) {
+	hash, err := s.client.HGetAll(s.key).Result()
+	if err != nil {
+		return AggregatorCounts{}, false, fmt.Errorf("expected HGetAll(%s) returns nil err; got err = %w", s.key, err)
+	}
+	if len(hash) == 0 {
+		return AggregatorCounts{}, false, nil
+	}
+
+	counts, err := aggregatorCountsFromHash(hash)
+	if err != nil {
+		return AggregatorCounts{}, false, fmt.Errorf("expected aggregatorCountsFromHash() returns nil err; got err = %w", err)
+	}
+	return counts, true, nil
+}
+
+func aggregatorCountsToHash(counts AggregatorCounts) map[string]interface{} {
+	hash := map[string]interface{}{
+		aggregatorSavedAtField: strconv.FormatInt(counts.SavedAt.UnixNano(), 10),
+	}
+	for priority, count := range counts.Counts {
+		hash[string(priority)] = strconv.FormatFloat(count, 'g', -1, 64)
+	}
+	return hash
+}
+
+func aggregatorCountsFromHash(hash map[string]string) (AggregatorCounts, error) {
+	savedAt, err := strconv.ParseInt(hash[aggregatorSavedAtField], 10, 64)
+	if err != nil {
+		return AggregatorCounts{}, fmt.Errorf("expected savedAt to be an integer; got err = %w", err)
+	}
+
+	counts := AggregatorCounts{Counts: map[Priority]float64{}, SavedAt: time.Unix(0, savedAt)}
+	for field, value := range hash {
+		if field == aggregatorSavedAtField {
+			continue
+		}
+		count, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return AggregatorCounts{}, fmt.Errorf("expected %s count to be a float; got err = %w", field, err)
+		}
+		counts.Counts[Priority(field)] = count
+	}
+	return counts, nil
+}
@@ -0,0 +1,144 @@
+package profiling
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+)
+
+func TestProfiledRequestAggregator_CountsRoundTripThroughStoreEncoding(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	newAggregator := func() *ProfiledRequestAggregator {
+		a, err := NewProfiledRequestAggregator(time.Minute)
+		if err != nil {
+			t.Fatalf("expected NewProfiledRequestAggregator() returns nil err; got err = %v", err)
+		}
+		a.now = func() time.Time { return now }
+		a.lastDecay = now
+		return a
+	}
+
+	before := newAggregator()
+	for i := 0; i < 8; i++ {
+		before.MarkVisit(Low)
+	}
+	for i := 0; i < 2; i++ {
+		before.MarkVisit(High)
+	}
+
+	restored, err := aggregatorCountsFromHash(stringifyHash(aggregatorCountsToHash(before.Counts())))
+	if err != nil {
+		t.Fatalf("expected aggregatorCountsFromHash() returns nil err; got err = %v", err)
+	}
+	after := newAggregator()
+	after.Restore(restored)
+
+	if got := after.Visits(Low); got != 8 {
+		t.Errorf("expected restored low visits = 8; got %v", got)
+	}
+	if got := after.Visits(High); got != 2 {
+		t.Errorf("expected restored high visits = 2; got %v", got)
+	}
+
+	// Counts decay over the downtime between saving and restoring.
+	now = now.Add(time.Minute)
+	if got := after.Visits(Low); math.Abs(got-4) > 1e-9 {
+		t.Errorf("expected low visits to halve after one half-life; got %v", got)
+	}
+}
+
+func TestAggregatorCountsFromHash_InvalidHash(t *testing.T) {
+	if _, err := aggregatorCountsFromHash(map[string]string{"low": "1", "high": "x", "savedAt": "0"}); err == nil {
+		t.Errorf("expected err for non-float high count; got nil")
+	}
+}
+
+// fakeRedisHashClient stores hashes in memory, returning err from each command
+// if set.
+type fakeRedisHashClient struct {
+	hashes map[string]map[string]string
+	err    error
+}
+
+func (c *fakeRedisHashClient) HSet(key string, values ...interface{}) *redis.IntCmd {
+	if c.err != nil {
+		return redis.NewIntResult(0, c.err)
+	}
+	if c.hashes[key] == nil {
+		c.hashes[key] = map[string]string{}
+	}
+	var added int64
+	for field, value := range stringifyHash(values[0].(map[string]interface{})) {
+		if _, exists := c.hashes[key][field]; !exists {
+			added++
+		}
+		c.hashes[key][field] = value
+	}
+	return redis.NewIntResult(added, nil)
+}
+
+func (c *fakeRedisHashClient) HGetAll(key string) *redis.StringStringMapCmd {
+	if c.err != nil {
+		return redis.NewStringStringMapResult(nil, c.err)
+	}
+	hash := map[string]string{}
+	for field, value := range c.hashes[key] {
+		hash[field] = value
+	}
+	return redis.NewStringStringMapResult(hash, nil)
+}
+
+func TestRedisAggregatorStore_SaveAndLoad(t *testing.T) {
+	client := &fakeRedisHashClient{hashes: map[string]map[string]string{}}
+	store := &RedisAggregatorStore{client: client, key: DefaultAggregatorStoreKey}
+
+	if _, isFound, err := store.Load(); err != nil || isFound {
+		t.Fatalf("expected Load() returns not found and nil err before Save(); got isFound = %v, err = %v", isFound, err)
+	}
+
+	savedAt := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	if err := store.Save(AggregatorCounts{Counts: map[Priority]float64{Low: 8, High: 2.5}, SavedAt: savedAt}); err != nil {
+		t.Fatalf("expected Save() returns nil err; got err = %v", err)
+	}
+	if _, exists := client.hashes[DefaultAggregatorStoreKey]; !exists {
+		t.Fatalf("expected Save() writes the hash to key %s; got keys %v", DefaultAggregatorStoreKey, client.hashes)
+	}
+
+	counts, isFound, err := store.Load()
+	if err != nil || !isFound {
+		t.Fatalf("expected Load() returns found and nil err after Save(); got isFound = %v, err = %v", isFound, err)
+	}
+	if counts.Counts[Low] != 8 || counts.Counts[High] != 2.5 {
+		t.Errorf("expected loaded counts {low: 8, high: 2.5}; got %v", counts.Counts)
+	}
+	if !counts.SavedAt.Equal(savedAt) {
+		t.Errorf("expected loaded SavedAt = %v; got %v", savedAt, counts.SavedAt)
+	}
+}
+
+func TestRedisAggregatorStore_ReturnsClientErrors(t *testing.T) {
+	store := &RedisAggregatorStore{
+		client: &fakeRedisHashClient{err: errors.New("connection refused")},
+		key:    DefaultAggregatorStoreKey,
+	}
+
+	if err := store.Save(AggregatorCounts{Counts: map[Priority]float64{Low: 1}}); err == nil {
+		t.Errorf("expected Save() returns err when the client errs; got nil")
+	}
+	if _, _, err := store.Load(); err == nil {
+		t.Errorf("expected Load() returns err when the client errs; got nil")
+	}
+}
+
+// stringifyHash converts a hash to be written to Redis into the form it is
+// read back from Redis.
+func stringifyHash(hash map[string]interface{}) map[string]string {
+	s := make(map[string]string, len(hash))
+	for key, value := range hash {
+		s[key] = value.(string)
+	}
+	return s
+}
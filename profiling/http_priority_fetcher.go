@@ -0,0 +1,113 @@
+package profiling
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DefaultHTTPPriorityFetcherTimeout bounds each request to the profiler
+// service if no timeout is given.
+const DefaultHTTPPriorityFetcherTimeout = time.Second
+
+// HTTPPriorityFetcher fetches priorities from a profiler service over HTTP,
+// for profiling models run as a separate microservice rather than behind
+// Redis. Priorities are fetched from GET {baseURL}/priorities/{sessionID},
+// which responds with a JSON priorityResponse, or 404 if the session has not
+// been profiled. Sessions are enqueued for profiling by POSTing a JSON
+// profileRequest to {baseURL}/sessions.
+type HTTPPriorityFetcher struct {
+	baseURL string
+	client  *http.Client
+	// tiers are the configured tier names, so priorities naming other tiers
+	// are rejected.
+	tiers map[Priority]bool
+}
+
+type priorityResponse struct {
+	// Priority is the name of a configured tier, or unknown.
+	Priority string `json:"priority"`
+}
+
+type profileRequest struct {
+	SessionID string `json:"sessionID"`
+}
+
+func NewHTTPPriorityFetcher(baseURL string, timeout time.Duration, tiers []Priority) (*HTTPPriorityFetcher, error) {
+	if _, err := url.ParseRequestURI(baseURL); err != nil {
+		return nil, fmt.Errorf("NewHTTPPriorityFetcher() expected valid baseURL; got err = %w", err)
+	}
+	if timeout == 0 {
+		timeout = DefaultHTTPPriorityFetcherTimeout
+	}
+	if timeout < 0 {
+		return nil, errors.New(fmt.Sprintf("NewHTTPPriorityFetcher() expected non-negative timeout; got timeout = %v", timeout))
+	}
+	tierSet, err := newTierSet(tiers)
+	if err != nil {
+		return nil, fmt.Errorf("NewHTTPPriorityFetcher() expected valid tiers; got err = %w", err)
+	}
+
+	return &HTTPPriorityFetcher{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		client:  &http.Client{Timeout: timeout},
+		tiers:   tierSet,
+	}, nil
+}
+
+// Profile enqueues the session for profiling. Errors are logged, as the
+// session is profiled again on its next request while its priority is
+// unknown.
+func (f *HTTPPriorityFetcher) Profile(sessionID string) {
+	body, err := json.Marshal(profileRequest{SessionID: sessionID})
+	if err != nil {
+		log.Printf("could not marshal session ID: %s", err)
+		return
+	}
+
+	profileURL := f.baseURL + "/sessions"
+	resp, err := f.client.Post(profileURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("could not enqueue session ID for profiling: expected POST %s returns nil err; got err = %v", profileURL, err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		log.Printf("could not enqueue session ID for profiling: expected POST %s returns status 2xx; got status %d", profileURL, resp.StatusCode)
+	}
+}
+
+// Fetch returns Unknown with a nil err for sessions which have not been
+// profiled, and Unknown with a non-nil err if the profiler service times out
+// or responds unexpectedly, including with a priority which is not one of the
+// configured tiers.
+func (f *HTTPPriorityFetcher) Fetch(sessionID string) (Priority, error) {
+	priorityURL := f.baseURL + "/priorities/" + url.PathEscape(sessionID)
+	resp, err := f.client.Get(priorityURL)
+	if err != nil {
+		return Unknown, fmt.Errorf("expected GET %s returns nil err; got err = %w", priorityURL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return Unknown, nil
+	} else if resp.StatusCode != http.StatusOK {
+		return Unknown, errors.New(fmt.Sprintf("expected GET %s returns status 200; got status %d", priorityURL, resp.StatusCode))
+	}
+
+	var body priorityResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return Unknown, fmt.Errorf("expected GET %s returns a JSON priority; got err = %w", priorityURL, err)
+	}
+	priority, err := strToPriority(body.Priority, f.tiers)
+	if err != nil {
+		return Unknown, fmt.Errorf("expected GET %s returns a valid priority; got err = %w", priorityURL, err)
+	}
+	return priority, nil
+}
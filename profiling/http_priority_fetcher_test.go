@@ -0,0 +1,127 @@
+package profiling
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHTTPPriorityFetcher_Fetch(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			t.Errorf("expected GET request; got %s", r.Method)
+		}
+		switch r.URL.Path {
+		case "/priorities/low-session":
+			_, _ = w.Write([]byte(`{"priority": "low"}`))
+		case "/priorities/high-session":
+			_, _ = w.Write([]byte(`{"priority": "high"}`))
+		case "/priorities/gold-session":
+			_, _ = w.Write([]byte(`{"priority": "gold"}`))
+		case "/priorities/platinum-session":
+			_, _ = w.Write([]byte(`{"priority": "platinum"}`))
+		case "/priorities/unknown-session":
+			_, _ = w.Write([]byte(`{"priority": "unknown"}`))
+		case "/priorities/invalid-session":
+			_, _ = w.Write([]byte(`{"priority": ""}`))
+		case "/priorities/failing-session":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	f, err := NewHTTPPriorityFetcher(server.URL+"/", 0, []Priority{Low, High, "gold"})
+	if err != nil {
+		t.Fatalf("expected NewHTTPPriorityFetcher() returns nil err; got err = %v", err)
+	}
+
+	tests := []struct {
+		sessionID    string
+		wantPriority Priority
+		wantErr      bool
+	}{
+		{sessionID: "low-session", wantPriority: Low},
+		{sessionID: "high-session", wantPriority: High},
+		{sessionID: "gold-session", wantPriority: "gold"},
+		{sessionID: "platinum-session", wantPriority: Unknown, wantErr: true},
+		{sessionID: "unknown-session", wantPriority: Unknown},
+		{sessionID: "unseen-session", wantPriority: Unknown},
+		{sessionID: "invalid-session", wantPriority: Unknown, wantErr: true},
+		{sessionID: "failing-session", wantPriority: Unknown, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sessionID, func(t *testing.T) {
+			priority, err := f.Fetch(tt.sessionID)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("expected Fetch() returns err = %v; got err = %v", tt.wantErr, err)
+			}
+			if priority != tt.wantPriority {
+				t.Errorf("expected Fetch() = %v; got %v", tt.wantPriority, priority)
+			}
+		})
+	}
+}
+
+func TestHTTPPriorityFetcher_FetchTimeout(t *testing.T) {
+	unblock := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+	}))
+	defer server.Close()
+	defer close(unblock)
+
+	f, err := NewHTTPPriorityFetcher(server.URL, 10*time.Millisecond, []Priority{Low, High})
+	if err != nil {
+		t.Fatalf("expected NewHTTPPriorityFetcher() returns nil err; got err = %v", err)
+	}
+
+	priority, err := f.Fetch("session")
+	if err == nil {
+		t.Errorf("expected Fetch() returns non-nil err on timeout")
+	}
+	if priority != Unknown {
+		t.Errorf("expected Fetch() = %v on timeout; got %v", Unknown, priority)
+	}
+}
+
+func TestHTTPPriorityFetcher_Profile(t *testing.T) {
+	sessionIDs := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/sessions" {
+			t.Errorf("expected POST /sessions; got %s %s", r.Method, r.URL.Path)
+		}
+		var body profileRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("expected JSON body; got err = %v", err)
+		}
+		sessionIDs <- body.SessionID
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	f, err := NewHTTPPriorityFetcher(server.URL, 0, []Priority{Low, High})
+	if err != nil {
+		t.Fatalf("expected NewHTTPPriorityFetcher() returns nil err; got err = %v", err)
+	}
+
+	f.Profile("session")
+	if got := <-sessionIDs; got != "session" {
+		t.Errorf("expected session ID %q enqueued; got %q", "session", got)
+	}
+}
+
+func TestNewHTTPPriorityFetcher_InvalidArguments(t *testing.T) {
+	if _, err := NewHTTPPriorityFetcher("not a url", 0, []Priority{Low, High}); err == nil {
+		t.Errorf("expected NewHTTPPriorityFetcher() with an invalid baseURL returns non-nil err")
+	}
+	if _, err := NewHTTPPriorityFetcher("http://profiler", -time.Second, []Priority{Low, High}); err == nil {
+		t.Errorf("expected NewHTTPPriorityFetcher() with a negative timeout returns non-nil err")
+	}
+	if _, err := NewHTTPPriorityFetcher("http://profiler", 0, nil); err == nil {
+		t.Errorf("expected NewHTTPPriorityFetcher() with no tiers returns non-nil err")
+	}
+}
@@ -1,27 +1,49 @@
 package profiling
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+)
 
-type Priority int
+// Priority is the name of the priority tier a session is profiled into, or
+// Unknown if the session has not been profiled. Tiers are configured on the
+// Profiler, e.g. bronze, silver, gold and platinum.
+type Priority string
 
 const (
-	Unknown Priority = 0
-	Low              = 1
-	High             = 2
+	Unknown Priority = "unknown"
+	// Low and High are the tiers of the default two-tier configuration.
+	Low  Priority = "low"
+	High Priority = "high"
 )
 
-func strToPriority(str string) (Priority, error) {
-	if str == "unknown" {
-		return Unknown, nil
-	} else if str == "low" {
-		return Low, nil
-	} else if str == "high" {
-		return High, nil
-	} else {
-		return Unknown, fmt.Errorf("unknown priority string %s", str)
+// newTierSet returns the set of tier names fetched priorities are checked
+// against, returning an error if no tiers are given.
+func newTierSet(tiers []Priority) (map[Priority]bool, error) {
+	if len(tiers) == 0 {
+		return nil, errors.New("expected at least one tier; got no tiers")
+	}
+
+	set := make(map[Priority]bool, len(tiers))
+	for _, tier := range tiers {
+		set[tier] = true
+	}
+	return set, nil
+}
+
+// strToPriority parses str as the name of one of tiers or Unknown, returning
+// an error for any other name, e.g. if the profiler service assigns tiers
+// which are not configured, as sessions in those tiers would never be dimmed.
+func strToPriority(str string, tiers map[Priority]bool) (Priority, error) {
+	if str == "" {
+		return Unknown, errors.New("expected non-empty priority string; got empty string")
+	}
+	if priority := Priority(str); priority == Unknown || tiers[priority] {
+		return priority, nil
 	}
+	return Unknown, errors.New(fmt.Sprintf("expected priority to be unknown or a configured tier; got %s", str))
 }
 
 func (p Priority) String() string {
-	return [...]string{"unknown", "low", "high"}[p]
+	return string(p)
 }
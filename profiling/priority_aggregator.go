@@ -1,63 +1,110 @@
 package profiling
 
 import (
+	"errors"
+	"fmt"
+	"math"
 	"sync"
-	"sync/atomic"
 	"time"
 )
 
-const decayPeriod = 30 * time.Second
-const decayFactor = 2
-
 // ProfiledRequestAggregator captures data used to ensure high priority
 // requests are dimmed when low priority requests are exhausted and vice-versa.
-// The aggregator is implemented using atomic integers such that overhead added
-// to requests is reduced. The counters decay over time to approximate a
-// sliding window of requests without having to store the timestamps of
-// requests.
+// Visits are counted per priority tier. The counters decay exponentially over
+// time to approximate a sliding window of requests without having to store the
+// timestamps of requests.
+//
+// Decay is continuous and applied lazily based on the time elapsed since the
+// counters were last updated, rather than periodically halving the counters.
+// Periodic halving causes a sawtooth where counts, and hence the dimming
+// decision probabilities derived from them, jump immediately after each decay.
 type ProfiledRequestAggregator struct {
-	lowCount  *int32
-	highCount *int32
-	// decayMux exists despite use of atomic counters due to the need to
-	// synchronise decay at the same time.
-	decayMux *sync.RWMutex
+	// counts maps priority tiers to their decayed visit counts. Tiers which
+	// have not been visited are absent.
+	counts map[Priority]float64
+	// decayRate is the rate of exponential decay per second, derived from the
+	// half-life such that counts halve every half-life.
+	decayRate float64
+	// lastDecay is the time the counters were last decayed.
+	lastDecay time.Time
+	// mux guards the counters and lastDecay as the counters must be decayed
+	// at the same time.
+	mux *sync.Mutex
+	// now allows time to be controlled in tests.
+	now func() time.Time
 }
 
-func NewProfiledRequestAggregator() *ProfiledRequestAggregator {
-	a := &ProfiledRequestAggregator{
-		lowCount:  new(int32),
-		highCount: new(int32),
-		decayMux:  &sync.RWMutex{},
+func NewProfiledRequestAggregator(halfLife time.Duration) (*ProfiledRequestAggregator, error) {
+	if halfLife <= 0 {
+		return nil, errors.New(fmt.Sprintf("NewProfiledRequestAggregator() expected positive halfLife; got halfLife = %v", halfLife))
 	}
 
-	go func() {
-		for range time.Tick(decayPeriod) {
-			a.decayMux.Lock()
-			atomic.StoreInt32(a.lowCount, atomic.LoadInt32(a.lowCount)/decayFactor)
-			atomic.StoreInt32(a.highCount, atomic.LoadInt32(a.highCount)/decayFactor)
-			a.decayMux.Unlock()
-		}
-	}()
+	return &ProfiledRequestAggregator{
+		counts:    map[Priority]float64{},
+		decayRate: math.Ln2 / halfLife.Seconds(),
+		lastDecay: time.Now(),
+		mux:       &sync.Mutex{},
+		now:       time.Now,
+	}, nil
+}
+
+// decay decays the counters to the current time. mux must be held.
+func (a *ProfiledRequestAggregator) decay() {
+	now := a.now()
+	elapsed := now.Sub(a.lastDecay).Seconds()
+	if elapsed <= 0 {
+		return
+	}
 
-	return a
+	multiplier := math.Exp(-a.decayRate * elapsed)
+	for priority := range a.counts {
+		a.counts[priority] *= multiplier
+	}
+	a.lastDecay = now
 }
 
-func (a *ProfiledRequestAggregator) MarkLowPriorityVisit() {
-	atomic.AddInt32(a.lowCount, 1)
+// MarkVisit counts a visit by a session of the given priority tier.
+func (a *ProfiledRequestAggregator) MarkVisit(priority Priority) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	a.decay()
+	a.counts[priority]++
 }
 
-func (a *ProfiledRequestAggregator) MarkHighPriorityVisit() {
-	atomic.AddInt32(a.highCount, 1)
+// Visits returns the decayed visit count of the given priority tier.
+func (a *ProfiledRequestAggregator) Visits(priority Priority) float64 {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	a.decay()
+	return a.counts[priority]
 }
 
-func (a *ProfiledRequestAggregator) GetLowPriorityVisits() int32 {
-	a.decayMux.RLock()
-	defer a.decayMux.RUnlock()
-	return atomic.LoadInt32(a.lowCount)
+// Counts returns the counts decayed to the current time, e.g. to be persisted
+// to an AggregatorStore.
+func (a *ProfiledRequestAggregator) Counts() AggregatorCounts {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	a.decay()
+	counts := make(map[Priority]float64, len(a.counts))
+	for priority, count := range a.counts {
+		counts[priority] = count
+	}
+	return AggregatorCounts{Counts: counts, SavedAt: a.lastDecay}
 }
 
-func (a *ProfiledRequestAggregator) GetHighPriorityVisits() int32 {
-	a.decayMux.RLock()
-	defer a.decayMux.RUnlock()
-	return atomic.LoadInt32(a.highCount)
+// Restore replaces the counts with persisted counts, which are decayed by the
+// time elapsed since they were saved, e.g. the downtime during a restart.
+func (a *ProfiledRequestAggregator) Restore(counts AggregatorCounts) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	a.counts = make(map[Priority]float64, len(counts.Counts))
+	for priority, count := range counts.Counts {
+		a.counts[priority] = count
+	}
+	a.lastDecay = counts.SavedAt
+	// Counts saved in the future, e.g. due to clock skew between instances,
+	// are treated as saved now so they are not inflated.
+	if now := a.now(); a.lastDecay.After(now) {
+		a.lastDecay = now
+	}
 }
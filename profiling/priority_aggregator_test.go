@@ -0,0 +1,106 @@
+package profiling
+
+import (
+	"math"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// halvingAggregator simulates the previous approach of halving integer counts
+// at the end of each decay period.
+type halvingAggregator struct {
+	count int32
+}
+
+func (a *halvingAggregator) decay() {
+	a.count /= 2
+}
+
+// maxRelativeStep returns the largest change between consecutive counts
+// relative to the mean count.
+func maxRelativeStep(counts []float64) float64 {
+	var sum float64
+	for _, count := range counts {
+		sum += count
+	}
+	mean := sum / float64(len(counts))
+
+	var maxStep float64
+	for i := 1; i < len(counts); i++ {
+		maxStep = math.Max(maxStep, math.Abs(counts[i]-counts[i-1]))
+	}
+	return maxStep / mean
+}
+
+func TestProfiledRequestAggregator_DecayIsSmootherThanHalving(t *testing.T) {
+	const halfLife = 30 * time.Second
+	a, err := NewProfiledRequestAggregator(halfLife)
+	assert.Nilf(t, err, "expected NewProfiledRequestAggregator() returns nil err; got err = %v", err)
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	a.now = func() time.Time { return now }
+	a.lastDecay = now
+	halving := &halvingAggregator{}
+
+	// Simulate a constant 10 visits per second for 10 minutes, reading the
+	// counts each second once they reach a steady state.
+	var exponentialCounts, halvingCounts []float64
+	for second := 1; second <= 600; second++ {
+		for i := 0; i < 10; i++ {
+			now = now.Add(100 * time.Millisecond)
+			a.MarkVisit(Low)
+			halving.count++
+		}
+		if second%int(halfLife/time.Second) == 0 {
+			halving.decay()
+		}
+
+		if second > 300 {
+			exponentialCounts = append(exponentialCounts, a.Visits(Low))
+			halvingCounts = append(halvingCounts, float64(halving.count))
+		}
+	}
+
+	exponentialStep := maxRelativeStep(exponentialCounts)
+	halvingStep := maxRelativeStep(halvingCounts)
+	assert.Less(t, exponentialStep, 0.01, "expected exponential decay to have a steady state under constant load")
+	assert.Less(t, exponentialStep, halvingStep/10, "expected exponential decay to be smoother than halving")
+}
+
+func TestProfiledRequestAggregator_HalvesEveryHalfLife(t *testing.T) {
+	a, err := NewProfiledRequestAggregator(30 * time.Second)
+	assert.Nilf(t, err, "expected NewProfiledRequestAggregator() returns nil err; got err = %v", err)
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	a.now = func() time.Time { return now }
+	a.lastDecay = now
+
+	for i := 0; i < 100; i++ {
+		a.MarkVisit(High)
+	}
+	now = now.Add(30 * time.Second)
+
+	assert.InDelta(t, 50, a.Visits(High), 1e-9)
+	assert.Equal(t, float64(0), a.Visits(Low))
+}
+
+func TestNewProfiledRequestAggregator_InvalidHalfLife(t *testing.T) {
+	_, err := NewProfiledRequestAggregator(0)
+	assert.NotNil(t, err, "expected err for halfLife = 0")
+}
+
+// Aggregators may be recreated, e.g. on mode changes, so an aggregator must
+// not leave a decay goroutine running for the process lifetime. Decay is
+// applied lazily, so no goroutine is needed and none need be stopped.
+func TestProfiledRequestAggregator_DoesNotLeakGoroutines(t *testing.T) {
+	baseline := runtime.NumGoroutine()
+	for i := 0; i < 50; i++ {
+		a, err := NewProfiledRequestAggregator(time.Minute)
+		assert.Nilf(t, err, "expected NewProfiledRequestAggregator() returns nil err; got err = %v", err)
+		a.MarkVisit(Low)
+		a.MarkVisit(High)
+	}
+
+	assert.LessOrEqual(t, runtime.NumGoroutine(), baseline, "expected goroutine count at most baseline")
+}
@@ -1,10 +1,14 @@
 package profiling
 
 import (
+	"errors"
 	"fmt"
 	"github.com/adjust/rmq/v3"
 	"github.com/go-redis/redis/v7"
+	"hash/fnv"
 	"log"
+	"math"
+	"sync"
 )
 
 type PriorityFetcher interface {
@@ -17,12 +21,20 @@ type PriorityFetcher interface {
 type RedisPriorityFetcher struct {
 	prioritiesClient *redis.Client
 	queue            rmq.Queue
+	// tiers are the configured tier names, so priorities naming other tiers
+	// are rejected.
+	tiers map[Priority]bool
 }
 
 const RedisQueueTag = "profiler service"
 const RedisQueueName = "sessions"
 
-func NewRedisPriorityFetcher(addr string, password string, prioritiesDB int, queueDB int) (*RedisPriorityFetcher, error) {
+func NewRedisPriorityFetcher(addr string, password string, prioritiesDB int, queueDB int, tiers []Priority) (*RedisPriorityFetcher, error) {
+	tierSet, err := newTierSet(tiers)
+	if err != nil {
+		return nil, fmt.Errorf("NewRedisPriorityFetcher() expected valid tiers; got err = %w", err)
+	}
+
 	queueConn, err := rmq.OpenConnectionWithRedisClient(RedisQueueTag, redis.NewClient(&redis.Options{
 		Addr:     addr,
 		Password: password,
@@ -44,6 +56,7 @@ func NewRedisPriorityFetcher(addr string, password string, prioritiesDB int, que
 			DB:       prioritiesDB,
 		}),
 		queue: queue,
+		tiers: tierSet,
 	}, nil
 }
 
@@ -61,10 +74,74 @@ func (f *RedisPriorityFetcher) Fetch(sessionID string) (Priority, error) {
 		return Unknown, fmt.Errorf("expected rdb.Get(%s) returns nil err; got err = %w", sessionID, err)
 	}
 
-	priority, err := strToPriority(val)
+	priority, err := strToPriority(val, f.tiers)
 	if err != nil {
-		return Unknown, fmt.Errorf("expected strconv.Atoi(%s) returns nil err; got err = %w", val, err)
+		return Unknown, fmt.Errorf("expected strToPriority(%s) returns nil err; got err = %w", val, err)
 	}
 
 	return priority, nil
 }
+
+// ProfilingRule assigns a priority to a session.
+type ProfilingRule func(sessionID string) Priority
+
+// NewHashProfilingRule returns a ProfilingRule which deterministically assigns
+// lowPriorityFraction of sessions low priority and the rest high priority by
+// hashing their session IDs, so a session keeps its priority across restarts
+// and instances.
+func NewHashProfilingRule(lowPriorityFraction float64) (ProfilingRule, error) {
+	if !(lowPriorityFraction >= 0 && lowPriorityFraction <= 1) {
+		return nil, errors.New(fmt.Sprintf("NewHashProfilingRule() expected lowPriorityFraction in [0, 1]; got lowPriorityFraction = %v", lowPriorityFraction))
+	}
+
+	return func(sessionID string) Priority {
+		hash := fnv.New32a()
+		_, _ = hash.Write([]byte(sessionID))
+		if float64(hash.Sum32())/(math.MaxUint32+1) < lowPriorityFraction {
+			return Low
+		}
+		return High
+	}, nil
+}
+
+// InMemoryPriorityFetcher profiles sessions in-process using a ProfilingRule,
+// for local testing and small deployments without Redis. Priorities are
+// never evicted, so memory grows with the number of sessions profiled.
+type InMemoryPriorityFetcher struct {
+	rule       ProfilingRule
+	priorities map[string]Priority
+	// mux guards priorities.
+	mux *sync.RWMutex
+}
+
+func NewInMemoryPriorityFetcher(rule ProfilingRule) (*InMemoryPriorityFetcher, error) {
+	if rule == nil {
+		return nil, errors.New("NewInMemoryPriorityFetcher() expected non-nil rule")
+	}
+
+	return &InMemoryPriorityFetcher{
+		rule:       rule,
+		priorities: map[string]Priority{},
+		mux:        &sync.RWMutex{},
+	}, nil
+}
+
+func (f *InMemoryPriorityFetcher) Profile(sessionID string) {
+	priority := f.rule(sessionID)
+
+	f.mux.Lock()
+	f.priorities[sessionID] = priority
+	f.mux.Unlock()
+}
+
+// Fetch returns Unknown for sessions which have not been profiled.
+func (f *InMemoryPriorityFetcher) Fetch(sessionID string) (Priority, error) {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	priority, exists := f.priorities[sessionID]
+	if !exists {
+		return Unknown, nil
+	}
+	return priority, nil
+}
@@ -0,0 +1,75 @@
+package profiling
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestInMemoryPriorityFetcher_FetchUnseenSessionIsUnknown(t *testing.T) {
+	f, err := NewInMemoryPriorityFetcher(func(string) Priority { return High })
+	if err != nil {
+		t.Fatalf("expected NewInMemoryPriorityFetcher() returns nil err; got err = %v", err)
+	}
+
+	priority, err := f.Fetch("unseen")
+	if err != nil {
+		t.Fatalf("expected Fetch() returns nil err; got err = %v", err)
+	}
+	if priority != Unknown {
+		t.Errorf("expected Fetch() = %v for an unseen session; got %v", Unknown, priority)
+	}
+
+	f.Profile("seen")
+	if priority, _ := f.Fetch("seen"); priority != High {
+		t.Errorf("expected Fetch() = %v after Profile(); got %v", Priority(High), priority)
+	}
+}
+
+func TestInMemoryPriorityFetcher_HashProfilingRuleIsDeterministic(t *testing.T) {
+	rule, err := NewHashProfilingRule(0.5)
+	if err != nil {
+		t.Fatalf("expected NewHashProfilingRule() returns nil err; got err = %v", err)
+	}
+	a, _ := NewInMemoryPriorityFetcher(rule)
+	b, _ := NewInMemoryPriorityFetcher(rule)
+
+	var lowCount int
+	for i := 0; i < 1000; i++ {
+		sessionID := "session-" + strconv.Itoa(i)
+		a.Profile(sessionID)
+		b.Profile(sessionID)
+		priorityA, _ := a.Fetch(sessionID)
+		priorityB, _ := b.Fetch(sessionID)
+		if priorityA != priorityB {
+			t.Fatalf("expected session %s profiled identically; got %v and %v", sessionID, priorityA, priorityB)
+		}
+		if priorityA == Low {
+			lowCount++
+		}
+	}
+
+	// Roughly half of sessions are low priority.
+	if lowCount < 400 || lowCount > 600 {
+		t.Errorf("expected roughly 500 of 1000 sessions to be low priority; got %d", lowCount)
+	}
+}
+
+func TestNewHashProfilingRule_FractionBounds(t *testing.T) {
+	for _, fraction := range []float64{0, 1} {
+		rule, err := NewHashProfilingRule(fraction)
+		if err != nil {
+			t.Fatalf("expected NewHashProfilingRule(%v) returns nil err; got err = %v", fraction, err)
+		}
+		want := Priority(High)
+		if fraction == 1 {
+			want = Low
+		}
+		if got := rule("session"); got != want {
+			t.Errorf("expected rule() = %v with lowPriorityFraction = %v; got %v", want, fraction, got)
+		}
+	}
+
+	if _, err := NewHashProfilingRule(1.5); err == nil {
+		t.Errorf("expected NewHashProfilingRule(1.5) returns non-nil err")
+	}
+}
@@ -1,110 +1,196 @@
 package profiling
 
 import (
+	"github.com/kcz17/dimmer/cookies"
 	"github.com/valyala/fasthttp"
 	"log"
 	"time"
 )
 
-const priorityKey = "PRIORITY"
-const priorityUnknownValue = "unknown"
-const priorityLowValue = "low"
-const priorityHighValue = "high"
-const cookieUnknownDefaultExpiry = 2 * time.Minute
-const cookiePriorityDefaultExpiry = 2 * time.Hour
+// DefaultPriorityCookieName is the name of the priority cookie if
+// Profiler.PriorityCookieName is not set.
+const DefaultPriorityCookieName = "PRIORITY"
+
+// DefaultUnknownPriorityCookieExpiry and DefaultPriorityCookieExpiry are the
+// expiries of priority cookies for sessions of unknown and known priority if
+// Profiler.UnknownPriorityCookieExpiry and Profiler.PriorityCookieExpiry are
+// not set.
+const (
+	DefaultUnknownPriorityCookieExpiry = 2 * time.Minute
+	DefaultPriorityCookieExpiry        = 2 * time.Hour
+)
 
-const dimmingDecisionKey = "DIMMING_DECISION"
+// DefaultDimmingDecisionCookieName is the name of the dimming decision cookie
+// if Profiler.DimmingDecisionCookieName is not set.
+const DefaultDimmingDecisionCookieName = "DIMMING_DECISION"
 const dimmingDecisionTrueValue = "true"
 const dimmingDecisionFalseValue = "false"
-const cookieDimmingDefaultExpiry = 1 * time.Minute
+
+// DefaultDimmingDecisionCookieExpiry is the expiry of the dimming decision
+// cookie if Profiler.DimmingDecisionCookieExpiry is not set.
+const DefaultDimmingDecisionCookieExpiry = 1 * time.Minute
+
+// Tier is a priority tier which sessions are profiled into, with its own
+// dimming probability.
+type Tier struct {
+	Priority                     Priority
+	DimmingProbability           float64
+	DimmingProbabilityMultiplier float64
+}
 
 type Profiler struct {
-	Priorities                               PriorityFetcher
-	Requests                                 RequestWriter
-	Aggregator                               *ProfiledRequestAggregator
-	LowPriorityDimmingProbability            float64
-	LowPriorityDimmingProbabilityMultiplier  float64
-	HighPriorityDimmingProbability           float64
-	HighPriorityDimmingProbabilityMultiplier float64
+	Priorities PriorityFetcher
+	Requests   RequestWriter
+	Aggregator *ProfiledRequestAggregator
+	// Tiers are the priority tiers sessions are profiled into, ordered from
+	// lowest to highest priority, e.g. Low then High.
+	Tiers []Tier
+	// PriorityCookieName and DimmingDecisionCookieName are the names of the
+	// cookies the profiler reads and writes, allowing collisions with the
+	// application's own cookies to be avoided. If empty, the defaults are
+	// used.
+	PriorityCookieName        string
+	DimmingDecisionCookieName string
+	// CookieAttributes are applied to all cookies the profiler sets.
+	CookieAttributes cookies.Attributes
+	// UnknownPriorityCookieExpiry, PriorityCookieExpiry and
+	// DimmingDecisionCookieExpiry are the durations the priority cookie of
+	// sessions of unknown and known priority and the dimming decision cookie
+	// last for, allowing them to match the site's session lengths, e.g.
+	// longer for long-lived dashboards. If 0, the defaults are used.
+	UnknownPriorityCookieExpiry time.Duration
+	PriorityCookieExpiry        time.Duration
+	DimmingDecisionCookieExpiry time.Duration
 }
 
-func RequestHasPriorityCookie(request *fasthttp.Request) bool {
-	return len(string(request.Header.Cookie(priorityKey))) != 0
+func (p *Profiler) priorityCookieName() string {
+	if p.PriorityCookieName == "" {
+		return DefaultPriorityCookieName
+	}
+	return p.PriorityCookieName
 }
 
-func RequestHasPriorityLowOrHighCookie(request *fasthttp.Request) bool {
-	return string(request.Header.Cookie(priorityKey)) == priorityLowValue ||
-		string(request.Header.Cookie(priorityKey)) == priorityHighValue
+func (p *Profiler) dimmingDecisionCookieName() string {
+	if p.DimmingDecisionCookieName == "" {
+		return DefaultDimmingDecisionCookieName
+	}
+	return p.DimmingDecisionCookieName
 }
 
-func (p *Profiler) MarkProfiledRequestByPriorityCookie(request *fasthttp.Request) {
-	if string(request.Header.Cookie(priorityKey)) == priorityLowValue {
-		p.Aggregator.MarkLowPriorityVisit()
-	} else {
-		p.Aggregator.MarkHighPriorityVisit()
+func (p *Profiler) unknownPriorityCookieExpiry() time.Duration {
+	if p.UnknownPriorityCookieExpiry == 0 {
+		return DefaultUnknownPriorityCookieExpiry
 	}
+	return p.UnknownPriorityCookieExpiry
 }
 
-func CookieForPriority(priority Priority) *fasthttp.Cookie {
-	cookie := &fasthttp.Cookie{}
-	cookie.SetKey(priorityKey)
-	if priority == Low {
-		cookie.SetValue(priorityLowValue)
-	} else if priority == High {
-		cookie.SetValue(priorityHighValue)
-	} else if priority == Unknown {
-		cookie.SetValue(priorityUnknownValue)
-	} else {
-		log.Printf("unexpected priority cookie value during CookieForPriority(); priority = %d", priority)
-		cookie.SetValue(priorityUnknownValue)
+func (p *Profiler) priorityCookieExpiry() time.Duration {
+	if p.PriorityCookieExpiry == 0 {
+		return DefaultPriorityCookieExpiry
+	}
+	return p.PriorityCookieExpiry
+}
+
+func (p *Profiler) dimmingDecisionCookieExpiry() time.Duration {
+	if p.DimmingDecisionCookieExpiry == 0 {
+		return DefaultDimmingDecisionCookieExpiry
+	}
+	return p.DimmingDecisionCookieExpiry
+}
+
+// tier returns the configured tier of priority, or false if priority is not
+// a configured tier, e.g. Unknown.
+func (p *Profiler) tier(priority Priority) (Tier, bool) {
+	for _, tier := range p.Tiers {
+		if tier.Priority == priority {
+			return tier, true
+		}
+	}
+	return Tier{}, false
+}
+
+// requestTier returns the configured tier of the request's priority cookie,
+// or false if the cookie is absent or not a configured tier.
+func (p *Profiler) requestTier(request *fasthttp.Request) (Tier, bool) {
+	return p.tier(Priority(request.Header.Cookie(p.priorityCookieName())))
+}
+
+func (p *Profiler) RequestHasPriorityCookie(request *fasthttp.Request) bool {
+	return len(string(request.Header.Cookie(p.priorityCookieName()))) != 0
+}
+
+// RequestHasTierPriorityCookie returns true if the request's priority cookie
+// is a configured tier, i.e. the session has been profiled.
+func (p *Profiler) RequestHasTierPriorityCookie(request *fasthttp.Request) bool {
+	_, exists := p.requestTier(request)
+	return exists
+}
+
+func (p *Profiler) MarkProfiledRequestByPriorityCookie(request *fasthttp.Request) {
+	if tier, exists := p.requestTier(request); exists {
+		p.Aggregator.MarkVisit(tier.Priority)
 	}
+}
 
-	if priority == Low || priority == High {
-		cookie.SetExpire(time.Now().Add(cookiePriorityDefaultExpiry))
+func (p *Profiler) CookieForPriority(priority Priority) *fasthttp.Cookie {
+	cookie := &fasthttp.Cookie{}
+	cookie.SetKey(p.priorityCookieName())
+	if _, exists := p.tier(priority); exists {
+		cookie.SetValue(string(priority))
+		cookie.SetExpire(time.Now().Add(p.priorityCookieExpiry()))
 	} else {
-		cookie.SetExpire(time.Now().Add(cookieUnknownDefaultExpiry))
+		if priority != Unknown {
+			log.Printf("unexpected priority cookie value during CookieForPriority(); priority = %s", priority)
+		}
+		cookie.SetValue(string(Unknown))
+		cookie.SetExpire(time.Now().Add(p.unknownPriorityCookieExpiry()))
 	}
+	p.CookieAttributes.Apply(cookie)
 
 	return cookie
 }
 
 func (p *Profiler) DimmingDecisionProbabilityForPriorityCookie(request *fasthttp.Request) float64 {
-	// Instead of directly returning [low/high]PriorityDimmingProbability, the
-	// proportion of low to high priority request must be taken into account, so
+	requestTier, exists := p.requestTier(request)
+	if !exists {
+		log.Printf("unexpected priority cookie value during SampleDimmingForPriorityCookie: %s", string(request.Header.Cookie(p.priorityCookieName())))
+		return 0
+	}
+
+	// Instead of directly returning the tier's dimming probability, the
+	// proportion of requests in each tier must be taken into account, so
 	// that, for example, the dimming decision probability of high priority
 	// requests goes to 1 if there are no low priority requests to dim.
-	numLow := float64(p.Aggregator.GetLowPriorityVisits())
-	numHigh := float64(p.Aggregator.GetHighPriorityVisits())
-
 	// Occurrences are incremented by one to prevent divide-by-zero errors later.
-	expectation := p.LowPriorityDimmingProbability*(numLow+1) + p.HighPriorityDimmingProbability*(numHigh+1)
-	if string(request.Header.Cookie(priorityKey)) == priorityLowValue {
-		return p.LowPriorityDimmingProbabilityMultiplier * p.LowPriorityDimmingProbability * (numLow / expectation)
-	} else if string(request.Header.Cookie(priorityKey)) == priorityHighValue {
-		return p.HighPriorityDimmingProbabilityMultiplier * p.HighPriorityDimmingProbability * (numHigh / expectation)
-	} else {
-		log.Printf("unexpected priority cookie value during SampleDimmingForPriorityCookie: %s", string(request.Header.Cookie(priorityKey)))
-		return 0
+	var expectation, visits float64
+	for _, tier := range p.Tiers {
+		tierVisits := p.Aggregator.Visits(tier.Priority)
+		expectation += tier.DimmingProbability * (tierVisits + 1)
+		if tier.Priority == requestTier.Priority {
+			visits = tierVisits
+		}
 	}
+	return requestTier.DimmingProbabilityMultiplier * requestTier.DimmingProbability * (visits / expectation)
 }
 
-func HasDimmingDecisionCookie(request *fasthttp.Request) bool {
-	return len(request.Header.Cookie(dimmingDecisionKey)) != 0
+func (p *Profiler) HasDimmingDecisionCookie(request *fasthttp.Request) bool {
+	return len(request.Header.Cookie(p.dimmingDecisionCookieName())) != 0
 }
 
-func ReadDimmingDecisionCookie(request *fasthttp.Request) bool {
-	return string(request.Header.Cookie(dimmingDecisionKey)) == dimmingDecisionTrueValue
+func (p *Profiler) ReadDimmingDecisionCookie(request *fasthttp.Request) bool {
+	return string(request.Header.Cookie(p.dimmingDecisionCookieName())) == dimmingDecisionTrueValue
 }
 
-func CookieForDimmingDecision(decision bool) *fasthttp.Cookie {
+func (p *Profiler) CookieForDimmingDecision(decision bool) *fasthttp.Cookie {
 	cookie := &fasthttp.Cookie{}
-	cookie.SetKey(dimmingDecisionKey)
+	cookie.SetKey(p.dimmingDecisionCookieName())
 	if decision {
 		cookie.SetValue(dimmingDecisionTrueValue)
 	} else {
 		cookie.SetValue(dimmingDecisionFalseValue)
 	}
-	cookie.SetExpire(time.Now().Add(cookieDimmingDefaultExpiry))
+	cookie.SetExpire(time.Now().Add(p.dimmingDecisionCookieExpiry()))
+	p.CookieAttributes.Apply(cookie)
 
 	return cookie
 }
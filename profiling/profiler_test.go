@@ -0,0 +1,132 @@
+package profiling
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestProfiler_CookieNames(t *testing.T) {
+	p := &Profiler{PriorityCookieName: "APP_PRIORITY", Tiers: []Tier{{Priority: Low}, {Priority: High}}}
+
+	if got := string(p.CookieForPriority(Low).Key()); got != "APP_PRIORITY" {
+		t.Errorf("CookieForPriority().Key() = %s, want APP_PRIORITY", got)
+	}
+	if got := string(p.CookieForDimmingDecision(true).Key()); got != DefaultDimmingDecisionCookieName {
+		t.Errorf("CookieForDimmingDecision().Key() = %s, want %s", got, DefaultDimmingDecisionCookieName)
+	}
+
+	req := &fasthttp.Request{}
+	req.Header.SetCookie(DefaultPriorityCookieName, string(Low))
+	if p.RequestHasPriorityCookie(req) {
+		t.Errorf("expected RequestHasPriorityCookie() to ignore the default cookie name")
+	}
+	req.Header.SetCookie("APP_PRIORITY", string(Low))
+	if !p.RequestHasTierPriorityCookie(req) {
+		t.Errorf("expected RequestHasTierPriorityCookie() to read the configured cookie name")
+	}
+}
+
+func TestProfiler_CookieForPriority_UnconfiguredTierIsUnknown(t *testing.T) {
+	p := &Profiler{Tiers: []Tier{{Priority: "bronze"}, {Priority: "gold"}}}
+
+	if got := string(p.CookieForPriority("gold").Value()); got != "gold" {
+		t.Errorf("CookieForPriority(gold).Value() = %s, want gold", got)
+	}
+	if got := string(p.CookieForPriority(High).Value()); got != string(Unknown) {
+		t.Errorf("CookieForPriority(high).Value() = %s, want %s", got, Unknown)
+	}
+}
+
+func TestProfiler_DimmingDecisionProbabilityForPriorityCookie_ThreeTiers(t *testing.T) {
+	aggregator, err := NewProfiledRequestAggregator(time.Hour)
+	if err != nil {
+		t.Fatalf("expected NewProfiledRequestAggregator() returns nil err; got err = %v", err)
+	}
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	aggregator.now = func() time.Time { return now }
+	aggregator.lastDecay = now
+
+	p := &Profiler{
+		Aggregator: aggregator,
+		Tiers: []Tier{
+			{Priority: "bronze", DimmingProbability: 0.6, DimmingProbabilityMultiplier: 1},
+			{Priority: "silver", DimmingProbability: 0.3, DimmingProbabilityMultiplier: 2},
+			{Priority: "gold", DimmingProbability: 0.1, DimmingProbabilityMultiplier: 1},
+		},
+	}
+	visits := map[Priority]int{"bronze": 9, "silver": 4, "gold": 19}
+	for priority, n := range visits {
+		for i := 0; i < n; i++ {
+			aggregator.MarkVisit(priority)
+		}
+	}
+
+	// Each tier's probability is normalised by the expected proportion of
+	// dimmed requests across tiers, with visits incremented by one:
+	// 0.6 * 10 + 0.3 * 5 + 0.1 * 20 = 9.5.
+	tests := []struct {
+		priority Priority
+		want     float64
+	}{
+		{priority: "bronze", want: 0.6 * 9 / 9.5},
+		{priority: "silver", want: 2 * 0.3 * 4 / 9.5},
+		{priority: "gold", want: 0.1 * 19 / 9.5},
+		{priority: Unknown, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.priority), func(t *testing.T) {
+			req := &fasthttp.Request{}
+			req.Header.SetCookie(DefaultPriorityCookieName, string(tt.priority))
+			if got := p.DimmingDecisionProbabilityForPriorityCookie(req); math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("DimmingDecisionProbabilityForPriorityCookie() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// Visits are only marked for configured tiers.
+	req := &fasthttp.Request{}
+	req.Header.SetCookie(DefaultPriorityCookieName, "platinum")
+	p.MarkProfiledRequestByPriorityCookie(req)
+	req.Header.SetCookie(DefaultPriorityCookieName, "gold")
+	p.MarkProfiledRequestByPriorityCookie(req)
+	if got := aggregator.Visits("platinum"); got != 0 {
+		t.Errorf("expected no visits for unconfigured tier platinum; got %v", got)
+	}
+	if got := aggregator.Visits("gold"); got != 20 {
+		t.Errorf("expected 20 visits for gold; got %v", got)
+	}
+}
+
+func TestProfiler_CookieExpiries(t *testing.T) {
+	p := &Profiler{
+		Tiers:                       []Tier{{Priority: Low}, {Priority: High}},
+		UnknownPriorityCookieExpiry: 5 * time.Minute,
+		PriorityCookieExpiry:        24 * time.Hour,
+		DimmingDecisionCookieExpiry: 10 * time.Minute,
+	}
+
+	tests := []struct {
+		name   string
+		cookie func() *fasthttp.Cookie
+		want   time.Duration
+	}{
+		{name: "Unknown priority", cookie: func() *fasthttp.Cookie { return p.CookieForPriority(Unknown) }, want: 5 * time.Minute},
+		{name: "Low priority", cookie: func() *fasthttp.Cookie { return p.CookieForPriority(Low) }, want: 24 * time.Hour},
+		{name: "High priority", cookie: func() *fasthttp.Cookie { return p.CookieForPriority(High) }, want: 24 * time.Hour},
+		{name: "Dimming decision", cookie: func() *fasthttp.Cookie { return p.CookieForDimmingDecision(true) }, want: 10 * time.Minute},
+		{name: "Default dimming decision", cookie: func() *fasthttp.Cookie { return (&Profiler{}).CookieForDimmingDecision(true) }, want: DefaultDimmingDecisionCookieExpiry},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := time.Now()
+			expire := tt.cookie().Expire()
+			after := time.Now()
+			if expire.Before(before.Add(tt.want)) || expire.After(after.Add(tt.want)) {
+				t.Errorf("expected Expire() = now + %v; got %v from now", tt.want, expire.Sub(before))
+			}
+		})
+	}
+}
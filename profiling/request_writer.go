@@ -16,9 +16,12 @@ type RequestWriter interface {
 type InfluxDBRequestWriter struct {
 	client      influxdb2.Client
 	asyncWriter api.WriteAPI
+	// measurementPrefix is prepended to the request measurement name, which
+	// the profiler service must be configured to read.
+	measurementPrefix string
 }
 
-func NewInfluxDBRequestWriter(addr, authToken, org, bucket string) *InfluxDBRequestWriter {
+func NewInfluxDBRequestWriter(addr, authToken, org, bucket, measurementPrefix string) *InfluxDBRequestWriter {
 	options := influxdb2.DefaultOptions()
 	options.WriteOptions().SetBatchSize(500)
 	options.WriteOptions().SetFlushInterval(1000)
@@ -35,13 +38,20 @@ func NewInfluxDBRequestWriter(addr, authToken, org, bucket string) *InfluxDBRequ
 	}()
 
 	return &InfluxDBRequestWriter{
-		client:      client,
-		asyncWriter: writeAPI,
+		client:            client,
+		asyncWriter:       writeAPI,
+		measurementPrefix: measurementPrefix,
 	}
 }
 
+// Close flushes buffered requests and closes the client, so requests are not
+// lost on shutdown.
+func (w *InfluxDBRequestWriter) Close() {
+	w.client.Close()
+}
+
 func (w *InfluxDBRequestWriter) Write(sessionID string, method string, path string) {
-	p := influxdb2.NewPointWithMeasurement("request").
+	p := influxdb2.NewPointWithMeasurement(w.measurementPrefix+"request").
 		AddTag("session_id", sessionID).
 		AddField("method", method).
 		AddField("path", path).
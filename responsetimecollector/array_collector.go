@@ -11,7 +11,13 @@ import (
 // computation are both O(n), this has been designed for ephemeral usage in
 // training mode.
 type arrayCollector struct {
-	responseTimesSeconds    []float64
+	responseTimesSeconds []float64
+	// firstAddedAt and lastAddedAt are the times the oldest and newest
+	// response times were added.
+	firstAddedAt time.Time
+	lastAddedAt  time.Time
+	// responseTimesSecondsMux guards responseTimesSeconds, firstAddedAt and
+	// lastAddedAt.
 	responseTimesSecondsMux *sync.Mutex
 }
 
@@ -37,7 +43,12 @@ func (c *arrayCollector) Len() int {
 }
 
 func (c *arrayCollector) Add(t time.Duration) {
+	now := time.Now()
 	c.responseTimesSecondsMux.Lock()
+	if len(c.responseTimesSeconds) == 0 {
+		c.firstAddedAt = now
+	}
+	c.lastAddedAt = now
 	c.responseTimesSeconds = append(c.responseTimesSeconds, float64(t)/float64(time.Second))
 	c.responseTimesSecondsMux.Unlock()
 }
@@ -54,6 +65,7 @@ func (c *arrayCollector) Aggregate() *Aggregation {
 			P50: 0,
 			P75: 0,
 			P95: 0,
+			P99: 0,
 		}
 	}
 
@@ -69,12 +81,35 @@ func (c *arrayCollector) Aggregate() *Aggregation {
 	if err != nil {
 		panic(fmt.Errorf("unexpected err in ArrayCollector.Aggregate() while calculating p95: %w", err))
 	}
+	p99, err := stats.Percentile(c.responseTimesSeconds, 99)
+	if err != nil {
+		panic(fmt.Errorf("unexpected err in ArrayCollector.Aggregate() while calculating p99: %w", err))
+	}
 
 	return &Aggregation{
 		P50: time.Duration(p50 * float64(time.Second)),
 		P75: time.Duration(p75 * float64(time.Second)),
 		P95: time.Duration(p95 * float64(time.Second)),
+		P99: time.Duration(p99 * float64(time.Second)),
+	}
+}
+
+func (c *arrayCollector) Percentile(p float64) time.Duration {
+	return percentileOf(c.All(), p)
+}
+
+// Utilization always returns 1 as the collector is unbounded.
+func (c *arrayCollector) Utilization() float64 {
+	return 1
+}
+
+func (c *arrayCollector) TimeSpan() time.Duration {
+	c.responseTimesSecondsMux.Lock()
+	defer c.responseTimesSecondsMux.Unlock()
+	if len(c.responseTimesSeconds) == 0 {
+		return 0
 	}
+	return c.lastAddedAt.Sub(c.firstAddedAt)
 }
 
 func (c *arrayCollector) Reset() {
@@ -82,3 +117,13 @@ func (c *arrayCollector) Reset() {
 	c.responseTimesSeconds = []float64{}
 	c.responseTimesSecondsMux.Unlock()
 }
+
+func (c *arrayCollector) SnapshotAndReset() []float64 {
+	// No copy is needed as the underlying slice is replaced rather than
+	// cleared.
+	c.responseTimesSecondsMux.Lock()
+	times := c.responseTimesSeconds
+	c.responseTimesSeconds = []float64{}
+	c.responseTimesSecondsMux.Unlock()
+	return times
+}
@@ -0,0 +1,138 @@
+package responsetimecollector
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestArrayCollector_Aggregate_P99(t *testing.T) {
+	c := NewArrayCollector()
+	// Response times of 1ms to 100ms are added out of order, as the collector
+	// must not rely on insertion order.
+	for _, i := range rand.New(rand.NewSource(1)).Perm(100) {
+		c.Add(time.Duration(i+1) * time.Millisecond)
+	}
+
+	aggregation := c.Aggregate()
+	if aggregation.P99 != 99*time.Millisecond {
+		t.Errorf("expected P99 = 99ms; got P99 = %v", aggregation.P99)
+	}
+	if aggregation.P95 != 95*time.Millisecond {
+		t.Errorf("expected P95 = 95ms; got P95 = %v", aggregation.P95)
+	}
+}
+
+func TestArrayCollector_Aggregate_P99_TracksTailOutliers(t *testing.T) {
+	tests := []struct {
+		name     string
+		outliers int
+		wantP99  time.Duration
+	}{
+		{name: "Single outlier beyond P99", outliers: 1, wantP99: 10 * time.Millisecond},
+		{name: "Outliers reaching P99", outliers: 2, wantP99: time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewArrayCollector()
+			for i := 0; i < 100-tt.outliers; i++ {
+				c.Add(10 * time.Millisecond)
+			}
+			for i := 0; i < tt.outliers; i++ {
+				c.Add(time.Second)
+			}
+
+			aggregation := c.Aggregate()
+			if aggregation.P99 != tt.wantP99 {
+				t.Errorf("expected P99 = %v; got P99 = %v", tt.wantP99, aggregation.P99)
+			}
+			// The outliers are too rare to affect the P95.
+			if aggregation.P95 != 10*time.Millisecond {
+				t.Errorf("expected P95 = 10ms; got P95 = %v", aggregation.P95)
+			}
+		})
+	}
+}
+
+func TestArrayCollector_Aggregate_P99_Empty(t *testing.T) {
+	c := NewArrayCollector()
+	if aggregation := c.Aggregate(); aggregation.P99 != 0 {
+		t.Errorf("expected P99 = 0 for empty collector; got P99 = %v", aggregation.P99)
+	}
+
+	c.Add(time.Second)
+	c.Reset()
+	if aggregation := c.Aggregate(); aggregation.P99 != 0 {
+		t.Errorf("expected P99 = 0 after Reset(); got P99 = %v", aggregation.P99)
+	}
+}
+
+func TestArrayCollector_Percentile(t *testing.T) {
+	c := NewArrayCollector()
+	if got := c.Percentile(99.9); got != 0 {
+		t.Errorf("expected Percentile(99.9) = 0 for empty collector; got %v", got)
+	}
+
+	for _, i := range rand.New(rand.NewSource(1)).Perm(1000) {
+		c.Add(time.Duration(i+1) * time.Millisecond)
+	}
+
+	tests := []struct {
+		p    float64
+		want time.Duration
+	}{
+		{p: 0.01, want: time.Millisecond},
+		{p: 90, want: 900 * time.Millisecond},
+		{p: 99, want: c.Aggregate().P99},
+		{p: 99.9, want: 999 * time.Millisecond},
+		{p: 99.99, want: time.Second},
+	}
+	for _, tt := range tests {
+		// Durations are converted via seconds, so allow rounding error.
+		if got := c.Percentile(tt.p); (got - tt.want).Round(time.Microsecond) != 0 {
+			t.Errorf("expected Percentile(%v) = %v; got %v", tt.p, tt.want, got)
+		}
+	}
+}
+
+func TestArrayCollector_SnapshotAndReset(t *testing.T) {
+	c := NewArrayCollector()
+	c.Add(time.Second)
+	c.Add(2 * time.Second)
+
+	assertFloatsEqual(t, []float64{1, 2}, c.SnapshotAndReset())
+	if c.Len() != 0 {
+		t.Errorf("expected Len() = 0 after SnapshotAndReset(); got %d", c.Len())
+	}
+	assertFloatsEqual(t, []float64{}, c.SnapshotAndReset())
+
+	c.Add(3 * time.Second)
+	assertFloatsEqual(t, []float64{3}, c.All())
+}
+
+func TestArrayCollector_SnapshotAndReset_ConcurrentAddsAreNotLost(t *testing.T) {
+	c := NewArrayCollector()
+	const adds = 10000
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < adds; i++ {
+			c.Add(time.Millisecond)
+		}
+	}()
+
+	var snapshotted int
+	for {
+		select {
+		case <-done:
+			snapshotted += len(c.SnapshotAndReset())
+			if snapshotted != adds {
+				t.Errorf("expected %d response times across snapshots; got %d", adds, snapshotted)
+			}
+			return
+		default:
+			snapshotted += len(c.SnapshotAndReset())
+		}
+	}
+}
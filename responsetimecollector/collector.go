@@ -1,17 +1,77 @@
 package responsetimecollector
 
-import "time"
+import (
+	"math"
+	"sort"
+	"time"
+)
 
 type Aggregation struct {
 	P50 time.Duration // P50 is the 50th percentile response time.
 	P75 time.Duration // P75 is the 75th percentile response time.
 	P95 time.Duration // P95 is the 95th percentile response time.
+	P99 time.Duration // P99 is the 99th percentile response time.
 }
 
 type Collector interface {
-	All() []float64          // All gets all the response times collected.
+	// All gets all the response times collected in seconds. The order is
+	// unspecified unless the collector is wrapped by NewSortedCollector, in
+	// which case response times are in ascending order.
+	All() []float64
 	Len() int                // Len gets the number of response times collected.
 	Add(t time.Duration)     // Add sends a new response time to the collector.
 	Aggregate() *Aggregation // Aggregate calculates aggregate metrics over a defined time period.
 	Reset()                  // Reset resets the state of the collector for reuse.
+	// Percentile calculates the pth percentile response time, where
+	// 0 < p < 100, e.g. 99.9, for percentiles not included in Aggregate().
+	// Collectors with no response times return 0.
+	Percentile(p float64) time.Duration
+	// Utilization gets Len() as a proportion of the window size, indicating
+	// how much data percentiles are calculated from. Unbounded collectors
+	// return 1.
+	Utilization() float64
+	// TimeSpan gets the time between adding the oldest and newest response
+	// times collected.
+	TimeSpan() time.Duration
+	// SnapshotAndReset atomically retrieves All() response times collected
+	// and resets the collector, so data can be archived without racing Add.
+	SnapshotAndReset() []float64
+}
+
+// WindowResizer is implemented by collectors whose window holds a fixed number
+// of response times, so the window can be tuned to the traffic rate at
+// runtime. Collectors without a sample-count window, such as the EWMA and
+// time-windowed collectors, do not implement it.
+type WindowResizer interface {
+	// ResizeWindow returns a collector of the same kind with a window of size
+	// response times, holding up to size of the most recent response times
+	// collected so percentiles do not reset. The receiver must not be added
+	// to concurrently.
+	ResizeWindow(size int) (Collector, error)
+}
+
+// percentileOfSorted returns the pth percentile of response times in seconds
+// sorted in ascending order using the nearest-rank method, matching the
+// percentiles calculated by Aggregate() where the rank is a whole number.
+func percentileOfSorted(sortedSeconds []float64, p float64) time.Duration {
+	if len(sortedSeconds) == 0 {
+		return 0
+	}
+
+	// A tolerance is subtracted so floating point error such as
+	// 99.9 / 100 * 1000 = 999.0000000000001 does not round up the rank.
+	rank := int(math.Ceil(p/100*float64(len(sortedSeconds)) - 1e-9))
+	if rank < 1 {
+		rank = 1
+	} else if rank > len(sortedSeconds) {
+		rank = len(sortedSeconds)
+	}
+	return time.Duration(sortedSeconds[rank-1] * float64(time.Second))
+}
+
+// percentileOf returns the pth percentile of unsorted response times in
+// seconds. responseTimesSeconds is sorted in place.
+func percentileOf(responseTimesSeconds []float64, p float64) time.Duration {
+	sort.Float64s(responseTimesSeconds)
+	return percentileOfSorted(responseTimesSeconds, p)
 }
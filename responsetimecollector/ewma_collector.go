@@ -0,0 +1,180 @@
+package responsetimecollector
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// ewmaCollector maintains an exponentially weighted moving average (EWMA) and
+// exponentially weighted variance of response times, so aggregate metrics
+// react to sudden latency spikes within a few samples rather than once the
+// spike dominates a fixed window.
+//
+// Percentiles are estimated by assuming response times are normally
+// distributed about the EWMA with the exponentially weighted standard
+// deviation. As response times are typically right-skewed, estimates are
+// approximate, but track changes in latency quickly.
+//
+// All() returns the most recent response times retained in a ring buffer of
+// the window size, oldest first, rather than the data the EWMA is derived
+// from, which is all response times since the last reset.
+type ewmaCollector struct {
+	// alpha is the weight of each new response time, in (0, 1].
+	alpha    float64
+	mean     float64
+	variance float64
+	// ring is a ring buffer of the most recent response times in seconds,
+	// with addedAt holding the times they were added. next is the index the
+	// next response time is written to, and added is the number of response
+	// times added since the last reset.
+	ring    []float64
+	addedAt []time.Time
+	next    int
+	added   int
+	// mux guards all fields other than alpha.
+	mux *sync.Mutex
+}
+
+func NewEWMACollector(window int, alpha float64) (*ewmaCollector, error) {
+	if window <= 0 {
+		return nil, errors.New(fmt.Sprintf("NewEWMACollector() expected positive window; got window = %d", window))
+	}
+	if !(alpha > 0 && alpha <= 1) {
+		return nil, errors.New(fmt.Sprintf("NewEWMACollector() expected alpha in (0, 1]; got alpha = %v", alpha))
+	}
+
+	return &ewmaCollector{
+		alpha:   alpha,
+		ring:    make([]float64, window),
+		addedAt: make([]time.Time, window),
+		mux:     &sync.Mutex{},
+	}, nil
+}
+
+func (c *ewmaCollector) All() []float64 {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.allLocked()
+}
+
+// allLocked returns the response times in the ring buffer, oldest first. mux
+// must be held.
+func (c *ewmaCollector) allLocked() []float64 {
+	retained := c.retainedLocked()
+	times := make([]float64, retained)
+	for i := 0; i < retained; i++ {
+		times[i] = c.ring[(c.next-retained+i+len(c.ring))%len(c.ring)]
+	}
+	return times
+}
+
+// retainedLocked returns the number of response times in the ring buffer. mux
+// must be held.
+func (c *ewmaCollector) retainedLocked() int {
+	if c.added < len(c.ring) {
+		return c.added
+	}
+	return len(c.ring)
+}
+
+// Len returns the number of response times retained, which is at most the
+// window size.
+func (c *ewmaCollector) Len() int {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.retainedLocked()
+}
+
+// Add updates the EWMA and variance using the incremental formulae from
+// Finch, "Incremental calculation of weighted mean and variance" (2009).
+func (c *ewmaCollector) Add(t time.Duration) {
+	seconds := t.Seconds()
+	now := time.Now()
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.added == 0 {
+		c.mean = seconds
+		c.variance = 0
+	} else {
+		diff := seconds - c.mean
+		increment := c.alpha * diff
+		c.mean += increment
+		c.variance = (1 - c.alpha) * (c.variance + diff*increment)
+	}
+
+	c.ring[c.next] = seconds
+	c.addedAt[c.next] = now
+	c.next = (c.next + 1) % len(c.ring)
+	c.added++
+}
+
+func (c *ewmaCollector) Aggregate() *Aggregation {
+	return &Aggregation{
+		P50: c.Percentile(50),
+		P75: c.Percentile(75),
+		P95: c.Percentile(95),
+		P99: c.Percentile(99),
+	}
+}
+
+// Percentile estimates the percentile from the normal distribution with the
+// EWMA and exponentially weighted standard deviation. Estimates are clamped
+// to 0 as response times cannot be negative.
+func (c *ewmaCollector) Percentile(p float64) time.Duration {
+	c.mux.Lock()
+	mean, variance, added := c.mean, c.variance, c.added
+	c.mux.Unlock()
+
+	if added == 0 {
+		return 0
+	}
+
+	// z is the standard normal quantile of p.
+	z := math.Sqrt2 * math.Erfinv(2*p/100-1)
+	seconds := math.Max(0, mean+z*math.Sqrt(variance))
+	return time.Duration(seconds * float64(time.Second))
+}
+
+func (c *ewmaCollector) Reset() {
+	c.mux.Lock()
+	c.resetLocked()
+	c.mux.Unlock()
+}
+
+// resetLocked resets the collector. mux must be held.
+func (c *ewmaCollector) resetLocked() {
+	c.mean = 0
+	c.variance = 0
+	c.next = 0
+	c.added = 0
+}
+
+func (c *ewmaCollector) Utilization() float64 {
+	return float64(c.Len()) / float64(len(c.ring))
+}
+
+func (c *ewmaCollector) TimeSpan() time.Duration {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	retained := c.retainedLocked()
+	if retained == 0 {
+		return 0
+	}
+	newest := c.addedAt[(c.next-1+len(c.ring))%len(c.ring)]
+	oldest := c.addedAt[(c.next-retained+len(c.ring))%len(c.ring)]
+	return newest.Sub(oldest)
+}
+
+func (c *ewmaCollector) SnapshotAndReset() []float64 {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	times := c.allLocked()
+	c.resetLocked()
+	return times
+}
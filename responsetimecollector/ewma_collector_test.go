@@ -0,0 +1,122 @@
+package responsetimecollector
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestNewEWMACollector_InvalidArguments(t *testing.T) {
+	if _, err := NewEWMACollector(0, 0.1); err == nil {
+		t.Errorf("expected err for window = 0; got nil")
+	}
+	for _, alpha := range []float64{0, -0.1, 1.1, math.NaN()} {
+		if _, err := NewEWMACollector(10, alpha); err == nil {
+			t.Errorf("expected err for alpha = %v; got nil", alpha)
+		}
+	}
+}
+
+func TestEWMACollector_Aggregate(t *testing.T) {
+	c, err := NewEWMACollector(10, 0.1)
+	if err != nil {
+		t.Fatalf("expected NewEWMACollector() returns nil err; got err = %v", err)
+	}
+	if aggregation := c.Aggregate(); aggregation.P50 != 0 || aggregation.P99 != 0 {
+		t.Errorf("expected zero aggregation for empty collector; got %+v", aggregation)
+	}
+
+	// Constant response times have no variance, so all percentiles equal the
+	// response time.
+	for i := 0; i < 20; i++ {
+		c.Add(100 * time.Millisecond)
+	}
+	aggregation := c.Aggregate()
+	for _, got := range []time.Duration{aggregation.P50, aggregation.P75, aggregation.P95, aggregation.P99} {
+		if (got - 100*time.Millisecond).Round(time.Microsecond) != 0 {
+			t.Errorf("expected percentiles = 100ms for constant response times; got %+v", aggregation)
+		}
+	}
+
+	// Varying response times spread the percentiles in ascending order.
+	for i := 0; i < 20; i++ {
+		c.Add(time.Duration(i%2) * 200 * time.Millisecond)
+	}
+	aggregation = c.Aggregate()
+	if !(aggregation.P50 < aggregation.P75 && aggregation.P75 < aggregation.P95 && aggregation.P95 < aggregation.P99) {
+		t.Errorf("expected ascending percentiles for varying response times; got %+v", aggregation)
+	}
+}
+
+func TestEWMACollector_All_RetainsWindow(t *testing.T) {
+	c, err := NewEWMACollector(3, 0.1)
+	if err != nil {
+		t.Fatalf("expected NewEWMACollector() returns nil err; got err = %v", err)
+	}
+	for _, seconds := range []float64{1, 2, 3, 4, 5} {
+		c.Add(time.Duration(seconds * float64(time.Second)))
+	}
+
+	assertFloatsEqual(t, []float64{3, 4, 5}, c.All())
+	if c.Len() != 3 {
+		t.Errorf("expected Len() = 3; got %d", c.Len())
+	}
+	if c.Utilization() != 1 {
+		t.Errorf("expected Utilization() = 1; got %v", c.Utilization())
+	}
+
+	assertFloatsEqual(t, []float64{3, 4, 5}, c.SnapshotAndReset())
+	assertFloatsEqual(t, []float64{}, c.All())
+	if aggregation := c.Aggregate(); aggregation.P50 != 0 {
+		t.Errorf("expected P50 = 0 after SnapshotAndReset(); got %v", aggregation.P50)
+	}
+}
+
+// samplesUntilExceeds adds response times of the step value to the collector
+// until percentile of the collector exceeds threshold, returning the number
+// of response times added, or -1 if the percentile does not exceed threshold
+// after limit response times.
+func samplesUntilExceeds(c Collector, step time.Duration, percentile func(*Aggregation) time.Duration, threshold time.Duration, limit int) int {
+	for i := 1; i <= limit; i++ {
+		c.Add(step)
+		if percentile(c.Aggregate()) > threshold {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestEWMACollector_ReactsFasterThanTachymeterToStep(t *testing.T) {
+	const window = 100
+	tests := []struct {
+		name       string
+		percentile func(*Aggregation) time.Duration
+	}{
+		{name: "P50", percentile: func(a *Aggregation) time.Duration { return a.P50 }},
+		{name: "P95", percentile: func(a *Aggregation) time.Duration { return a.P95 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ewma, err := NewEWMACollector(window, 0.1)
+			if err != nil {
+				t.Fatalf("expected NewEWMACollector() returns nil err; got err = %v", err)
+			}
+			tachymeter := NewTachymeterCollector(window)
+
+			// Both collectors settle at 100ms before latency steps up to 1s.
+			for i := 0; i < window; i++ {
+				ewma.Add(100 * time.Millisecond)
+				tachymeter.Add(100 * time.Millisecond)
+			}
+
+			ewmaSamples := samplesUntilExceeds(ewma, time.Second, tt.percentile, 550*time.Millisecond, window)
+			tachymeterSamples := samplesUntilExceeds(tachymeter, time.Second, tt.percentile, 550*time.Millisecond, window)
+			if ewmaSamples == -1 {
+				t.Fatalf("expected ewma %s to exceed 550ms after step; did not after %d samples", tt.name, window)
+			}
+			if tachymeterSamples != -1 && ewmaSamples >= tachymeterSamples {
+				t.Errorf("expected ewma %s to react faster than tachymeter; got ewma samples = %d, tachymeter samples = %d", tt.name, ewmaSamples, tachymeterSamples)
+			}
+		})
+	}
+}
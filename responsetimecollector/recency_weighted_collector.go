@@ -0,0 +1,151 @@
+package responsetimecollector
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// recencyWeightedCollector wraps a Collector so percentiles blend the
+// percentile over the wrapped collector's whole window with the percentile
+// over only the most recent response times. At a traffic transition, the
+// percentile over the whole window lags until the window fills with response
+// times under the new conditions, whereas blending in the most recent response
+// times lets the control loop react faster without shrinking the window.
+//
+// All(), Len(), Utilization() and TimeSpan() describe the wrapped collector's
+// whole window.
+type recencyWeightedCollector struct {
+	Collector
+	// recentWeight is the weight of the recent percentile, in [0, 1]. The
+	// percentile over the whole window has weight 1 - recentWeight.
+	recentWeight float64
+	// recent is a ring buffer of the most recent response times in seconds.
+	// next is the index the next response time is written to, and added is
+	// the number of response times added since the last reset.
+	recent []float64
+	next   int
+	added  int
+	// recentMux guards recent, next and added.
+	recentMux *sync.Mutex
+}
+
+func NewRecencyWeightedCollector(collector Collector, recentSize int, recentWeight float64) (*recencyWeightedCollector, error) {
+	if recentSize <= 0 {
+		return nil, errors.New(fmt.Sprintf("NewRecencyWeightedCollector() expected positive recentSize; got recentSize = %d", recentSize))
+	}
+	if !(recentWeight >= 0 && recentWeight <= 1) {
+		return nil, errors.New(fmt.Sprintf("NewRecencyWeightedCollector() expected recentWeight in [0, 1]; got recentWeight = %v", recentWeight))
+	}
+
+	return &recencyWeightedCollector{
+		Collector:    collector,
+		recentWeight: recentWeight,
+		recent:       make([]float64, recentSize),
+		recentMux:    &sync.Mutex{},
+	}, nil
+}
+
+func (c *recencyWeightedCollector) Add(t time.Duration) {
+	c.Collector.Add(t)
+
+	c.recentMux.Lock()
+	c.recent[c.next] = t.Seconds()
+	c.next = (c.next + 1) % len(c.recent)
+	c.added++
+	c.recentMux.Unlock()
+}
+
+// Aggregate blends each percentile of the wrapped collector's aggregation with
+// the same percentile of the most recent response times.
+func (c *recencyWeightedCollector) Aggregate() *Aggregation {
+	full := c.Collector.Aggregate()
+	recent := c.recentSnapshot()
+	if len(recent) == 0 {
+		return full
+	}
+
+	return &Aggregation{
+		P50: c.blend(full.P50, percentileOf(recent, 50)),
+		P75: c.blend(full.P75, percentileOf(recent, 75)),
+		P95: c.blend(full.P95, percentileOf(recent, 95)),
+		P99: c.blend(full.P99, percentileOf(recent, 99)),
+	}
+}
+
+// Percentile blends the wrapped collector's pth percentile with the pth
+// percentile of the most recent response times.
+func (c *recencyWeightedCollector) Percentile(p float64) time.Duration {
+	full := c.Collector.Percentile(p)
+	recent := c.recentSnapshot()
+	if len(recent) == 0 {
+		return full
+	}
+	return c.blend(full, percentileOf(recent, p))
+}
+
+func (c *recencyWeightedCollector) Reset() {
+	c.Collector.Reset()
+	c.resetRecent()
+}
+
+func (c *recencyWeightedCollector) SnapshotAndReset() []float64 {
+	times := c.Collector.SnapshotAndReset()
+	c.resetRecent()
+	return times
+}
+
+// ResizeWindow resizes the wrapped collector's window, retaining the weighting
+// and the most recent response times. It returns an error if the wrapped
+// collector has no sample-count window.
+func (c *recencyWeightedCollector) ResizeWindow(size int) (Collector, error) {
+	resizer, ok := c.Collector.(WindowResizer)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("recencyWeightedCollector.ResizeWindow() expected wrapped collector with a sample-count window; got %T", c.Collector))
+	}
+	collector, err := resizer.ResizeWindow(size)
+	if err != nil {
+		return nil, err
+	}
+
+	c.recentMux.Lock()
+	defer c.recentMux.Unlock()
+
+	recent := make([]float64, len(c.recent))
+	copy(recent, c.recent)
+	return &recencyWeightedCollector{
+		Collector:    collector,
+		recentWeight: c.recentWeight,
+		recent:       recent,
+		next:         c.next,
+		added:        c.added,
+		recentMux:    &sync.Mutex{},
+	}, nil
+}
+
+func (c *recencyWeightedCollector) blend(full time.Duration, recent time.Duration) time.Duration {
+	return time.Duration((1-c.recentWeight)*float64(full) + c.recentWeight*float64(recent))
+}
+
+// recentSnapshot returns a copy of the most recent response times in seconds,
+// in unspecified order.
+func (c *recencyWeightedCollector) recentSnapshot() []float64 {
+	c.recentMux.Lock()
+	defer c.recentMux.Unlock()
+
+	n := c.added
+	if n > len(c.recent) {
+		n = len(c.recent)
+	}
+	times := make([]float64, n)
+	copy(times, c.recent[:n])
+	return times
+}
+
+func (c *recencyWeightedCollector) resetRecent() {
+	c.recentMux.Lock()
+	c.next = 0
+	c.added = 0
+	c.recentMux.Unlock()
+}
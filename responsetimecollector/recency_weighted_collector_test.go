@@ -0,0 +1,61 @@
+package responsetimecollector
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRecencyWeightedCollector_Percentile(t *testing.T) {
+	c, err := NewRecencyWeightedCollector(NewTachymeterCollector(10), 2, 0.5)
+	if err != nil {
+		t.Fatalf("expected NewRecencyWeightedCollector() returns nil err; got err = %v", err)
+	}
+
+	if got := c.Percentile(50); got != 0 {
+		t.Errorf("expected Percentile(50) = 0 with no response times; got %v", got)
+	}
+
+	// The whole window has median 2s and the two most recent response times
+	// have median 4s, so the blended median is halfway between.
+	for _, seconds := range []float64{1, 1, 2, 2, 4, 4} {
+		c.Add(time.Duration(seconds * float64(time.Second)))
+	}
+	if got := c.Percentile(50); got != 3*time.Second {
+		t.Errorf("expected Percentile(50) = 3s; got %v", got)
+	}
+	if got := c.Aggregate().P50; got != 3*time.Second {
+		t.Errorf("expected Aggregate().P50 = 3s; got %v", got)
+	}
+	if got := c.Len(); got != 6 {
+		t.Errorf("expected Len() = 6 for the whole window; got %d", got)
+	}
+
+	c.Reset()
+	c.Add(time.Second)
+	if got := c.Percentile(50); got != time.Second {
+		t.Errorf("expected Percentile(50) = 1s after Reset(); got %v", got)
+	}
+}
+
+func TestRecencyWeightedCollector_ZeroWeightMatchesWrappedCollector(t *testing.T) {
+	c, err := NewRecencyWeightedCollector(NewTachymeterCollector(10), 2, 0)
+	if err != nil {
+		t.Fatalf("expected NewRecencyWeightedCollector() returns nil err; got err = %v", err)
+	}
+
+	for _, seconds := range []float64{1, 2, 3, 9, 9} {
+		c.Add(time.Duration(seconds * float64(time.Second)))
+	}
+	if got := c.Percentile(50); got != 3*time.Second {
+		t.Errorf("expected Percentile(50) = 3s; got %v", got)
+	}
+}
+
+func TestNewRecencyWeightedCollector_InvalidArguments(t *testing.T) {
+	if _, err := NewRecencyWeightedCollector(NewTachymeterCollector(10), 0, 0.5); err == nil {
+		t.Errorf("expected NewRecencyWeightedCollector() with recentSize = 0 returns non-nil err")
+	}
+	if _, err := NewRecencyWeightedCollector(NewTachymeterCollector(10), 2, 1.5); err == nil {
+		t.Errorf("expected NewRecencyWeightedCollector() with recentWeight = 1.5 returns non-nil err")
+	}
+}
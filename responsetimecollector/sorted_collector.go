@@ -0,0 +1,83 @@
+package responsetimecollector
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// sortedCollector wraps a Collector so All() and SnapshotAndReset() return
+// response times in ascending order, as required by the Kolmogorov-Smirnov
+// test. The sorted snapshot returned by All() is cached until a response time
+// is added or the collector is reset, so repeated comparisons over a large
+// window do not repeatedly sort the same data.
+type sortedCollector struct {
+	// version is incremented after each change to the wrapped collector. It
+	// must be accessed atomically, and is first in the struct for 64-bit
+	// alignment on 32-bit platforms.
+	version uint64
+	Collector
+	// sorted is the cached sorted snapshot of All(), valid while
+	// sortedVersion equals version.
+	sorted        []float64
+	sortedVersion uint64
+	hasSorted     bool
+	// sortedMux guards sorted, sortedVersion and hasSorted.
+	sortedMux *sync.Mutex
+}
+
+// NewSortedCollector wraps collector so All() and SnapshotAndReset() return
+// response times in ascending order.
+func NewSortedCollector(collector Collector) Collector {
+	return &sortedCollector{
+		Collector: collector,
+		sortedMux: &sync.Mutex{},
+	}
+}
+
+// All returns all response times collected in ascending order.
+func (c *sortedCollector) All() []float64 {
+	c.sortedMux.Lock()
+	defer c.sortedMux.Unlock()
+
+	// The version is loaded before retrieving response times, so a response
+	// time added concurrently invalidates the cache even if it is included.
+	version := atomic.LoadUint64(&c.version)
+	if !c.hasSorted || c.sortedVersion != version {
+		c.sorted = c.Collector.All()
+		sort.Float64s(c.sorted)
+		c.sortedVersion = version
+		c.hasSorted = true
+	}
+
+	// Copy the cache so callers cannot modify it.
+	times := make([]float64, len(c.sorted))
+	copy(times, c.sorted)
+	return times
+}
+
+// Percentile calculates the percentile from the cached sorted snapshot, so
+// calculating several percentiles does not sort the same data repeatedly.
+func (c *sortedCollector) Percentile(p float64) time.Duration {
+	return percentileOfSorted(c.All(), p)
+}
+
+func (c *sortedCollector) Add(t time.Duration) {
+	c.Collector.Add(t)
+	atomic.AddUint64(&c.version, 1)
+}
+
+func (c *sortedCollector) Reset() {
+	c.Collector.Reset()
+	atomic.AddUint64(&c.version, 1)
+}
+
+// SnapshotAndReset returns all response times collected in ascending order
+// and resets the collector.
+func (c *sortedCollector) SnapshotAndReset() []float64 {
+	times := c.Collector.SnapshotAndReset()
+	atomic.AddUint64(&c.version, 1)
+	sort.Float64s(times)
+	return times
+}
@@ -0,0 +1,96 @@
+package responsetimecollector
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestSortedCollector_All(t *testing.T) {
+	c := NewSortedCollector(NewArrayCollector())
+	for _, seconds := range []float64{3, 1, 2} {
+		c.Add(time.Duration(seconds * float64(time.Second)))
+	}
+	assertFloatsEqual(t, []float64{1, 2, 3}, c.All())
+
+	// Adding a response time invalidates the cached snapshot.
+	c.Add(0)
+	all := c.All()
+	assertFloatsEqual(t, []float64{0, 1, 2, 3}, all)
+
+	// Modifying the returned slice does not modify the cached snapshot.
+	all[0] = 10
+	assertFloatsEqual(t, []float64{0, 1, 2, 3}, c.All())
+
+	c.Reset()
+	assertFloatsEqual(t, []float64{}, c.All())
+}
+
+func TestSortedCollector_Percentile(t *testing.T) {
+	c := NewSortedCollector(NewTachymeterCollector(10))
+	for _, seconds := range []float64{5, 1, 4, 2, 3} {
+		c.Add(time.Duration(seconds * float64(time.Second)))
+	}
+
+	if got := c.Percentile(50); got != 3*time.Second {
+		t.Errorf("expected Percentile(50) = 3s; got %v", got)
+	}
+	if got := c.Percentile(99.9); got != 5*time.Second {
+		t.Errorf("expected Percentile(99.9) = 5s; got %v", got)
+	}
+
+	// Adding a response time invalidates the cached snapshot.
+	c.Add(10 * time.Second)
+	if got := c.Percentile(99.9); got != 10*time.Second {
+		t.Errorf("expected Percentile(99.9) = 10s after Add(); got %v", got)
+	}
+}
+
+func TestSortedCollector_SnapshotAndReset(t *testing.T) {
+	c := NewSortedCollector(NewTachymeterCollector(10))
+	for _, seconds := range []float64{2, 3, 1} {
+		c.Add(time.Duration(seconds * float64(time.Second)))
+	}
+	assertFloatsEqual(t, []float64{1, 2, 3}, c.SnapshotAndReset())
+	assertFloatsEqual(t, []float64{}, c.All())
+}
+
+func assertFloatsEqual(t *testing.T, want []float64, got []float64) {
+	t.Helper()
+	if len(want) != len(got) {
+		t.Fatalf("expected %v; got %v", want, got)
+	}
+	for i := range want {
+		if want[i] != got[i] {
+			t.Fatalf("expected %v; got %v", want, got)
+		}
+	}
+}
+
+const benchmarkWindow = 100000
+
+func newBenchmarkCollector(c Collector) Collector {
+	for i := 0; i < benchmarkWindow; i++ {
+		c.Add(time.Duration(rand.ExpFloat64() * float64(time.Second)))
+	}
+	return c
+}
+
+// BenchmarkArrayCollector_AllSorted sorts on every retrieval, as the online
+// training K-S test did before collectors were sorted.
+func BenchmarkArrayCollector_AllSorted(b *testing.B) {
+	c := newBenchmarkCollector(NewArrayCollector())
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sort.Float64s(c.All())
+	}
+}
+
+func BenchmarkSortedCollector_All(b *testing.B) {
+	c := newBenchmarkCollector(NewSortedCollector(NewArrayCollector()))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.All()
+	}
+}
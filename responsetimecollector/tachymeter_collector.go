@@ -1,6 +1,8 @@
 package responsetimecollector
 
 import (
+	"errors"
+	"fmt"
 	"github.com/jamiealquiza/tachymeter"
 	"math"
 	"sync/atomic"
@@ -11,8 +13,17 @@ import (
 // calculate timings locally. This collector should be used where the overhead
 // of local instrumentation does not affect the use case.
 type tachymeterCollector struct {
+	// added is the number of response times added since the last reset. It
+	// must be accessed atomically, and is first in the struct for 64-bit
+	// alignment on 32-bit platforms.
+	added  uint64
 	window int
 	tach   *tachymeter.Tachymeter
+	// addedAt is a ring buffer of the Unix nanosecond times response times
+	// were added, indexed by the number added modulo the window, used to
+	// report the time span of the window. Elements must be accessed
+	// atomically.
+	addedAt []int64
 }
 
 func NewTachymeterCollector(window int) *tachymeterCollector {
@@ -21,13 +32,19 @@ func NewTachymeterCollector(window int) *tachymeterCollector {
 		tach: tachymeter.New(&tachymeter.Config{
 			Size: window,
 		}),
+		addedAt: make([]int64, window),
 	}
 }
 
 func (c *tachymeterCollector) All() []float64 {
 	c.tach.Lock()
 	defer c.tach.Unlock()
+	return c.allLocked()
+}
 
+// allLocked retrieves all response times collected. The caller must hold the
+// tachymeter lock.
+func (c *tachymeterCollector) allLocked() []float64 {
 	if atomic.LoadUint64(&c.tach.Count) == 0 {
 		return []float64{}
 	}
@@ -44,12 +61,16 @@ func (c *tachymeterCollector) All() []float64 {
 	return durationsSeconds
 }
 
+// Len returns the number of response times collected, which is at most the
+// window size as the tachymeter overwrites the oldest response times.
 func (c *tachymeterCollector) Len() int {
-	return c.window
+	return int(math.Min(float64(atomic.LoadUint64(&c.tach.Count)), float64(c.window)))
 }
 
 func (c *tachymeterCollector) Add(t time.Duration) {
 	c.tach.AddTime(t)
+	n := atomic.AddUint64(&c.added, 1) - 1
+	atomic.StoreInt64(&c.addedAt[n%uint64(c.window)], time.Now().UnixNano())
 }
 
 func (c *tachymeterCollector) Aggregate() *Aggregation {
@@ -58,9 +79,68 @@ func (c *tachymeterCollector) Aggregate() *Aggregation {
 		P50: aggregation.Time.P50,
 		P75: aggregation.Time.P75,
 		P95: aggregation.Time.P95,
+		P99: aggregation.Time.P99,
+	}
+}
+
+// Percentile calculates the percentile from the response times in the window,
+// as tachymeter only calculates a fixed set of percentiles.
+func (c *tachymeterCollector) Percentile(p float64) time.Duration {
+	return percentileOf(c.All(), p)
+}
+
+func (c *tachymeterCollector) Utilization() float64 {
+	return float64(c.Len()) / float64(c.window)
+}
+
+// TimeSpan returns the time span covered by the window, which is approximate
+// as response times may be added concurrently.
+func (c *tachymeterCollector) TimeSpan() time.Duration {
+	added := atomic.LoadUint64(&c.added)
+	if added == 0 {
+		return 0
+	}
+	retained := uint64(math.Min(float64(added), float64(c.window)))
+	newest := atomic.LoadInt64(&c.addedAt[(added-1)%uint64(c.window)])
+	oldest := atomic.LoadInt64(&c.addedAt[(added-retained)%uint64(c.window)])
+	if newest < oldest {
+		// The newest time has not yet been stored by a concurrent Add.
+		return 0
+	}
+	return time.Duration(newest - oldest)
+}
+
+// ResizeWindow returns a tachymeter collector of the given window size holding
+// up to size of the response times collected. As All() is unordered, the
+// response times retained are not guaranteed to be the most recent.
+func (c *tachymeterCollector) ResizeWindow(size int) (Collector, error) {
+	if size <= 0 {
+		return nil, errors.New(fmt.Sprintf("tachymeterCollector.ResizeWindow() expected positive size; got size = %d", size))
+	}
+
+	resized := NewTachymeterCollector(size)
+	samples := c.All()
+	if len(samples) > size {
+		samples = samples[len(samples)-size:]
+	}
+	for _, sample := range samples {
+		resized.Add(time.Duration(sample * float64(time.Second)))
 	}
+	return resized, nil
 }
 
 func (c *tachymeterCollector) Reset() {
 	c.tach.Reset()
+	atomic.StoreUint64(&c.added, 0)
+}
+
+func (c *tachymeterCollector) SnapshotAndReset() []float64 {
+	// Resetting is inlined rather than calling tach.Reset(), which acquires
+	// the same lock, so the snapshot and reset occur under a single lock.
+	c.tach.Lock()
+	defer c.tach.Unlock()
+	durationsSeconds := c.allLocked()
+	atomic.StoreUint64(&c.tach.Count, 0)
+	atomic.StoreUint64(&c.added, 0)
+	return durationsSeconds
 }
@@ -0,0 +1,29 @@
+package responsetimecollector
+
+import (
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestTachymeterCollector_SnapshotAndReset(t *testing.T) {
+	c := NewTachymeterCollector(3)
+	for i := 1; i <= 4; i++ {
+		c.Add(time.Duration(i) * time.Second)
+	}
+
+	// The window holds the 3 most recent response times.
+	snapshot := c.SnapshotAndReset()
+	sort.Float64s(snapshot)
+	assertFloatsEqual(t, []float64{2, 3, 4}, snapshot)
+	if c.Len() != 0 {
+		t.Errorf("expected Len() = 0 after SnapshotAndReset(); got %d", c.Len())
+	}
+	if c.TimeSpan() != 0 {
+		t.Errorf("expected TimeSpan() = 0 after SnapshotAndReset(); got %v", c.TimeSpan())
+	}
+	assertFloatsEqual(t, []float64{}, c.SnapshotAndReset())
+
+	c.Add(5 * time.Second)
+	assertFloatsEqual(t, []float64{5}, c.All())
+}
@@ -0,0 +1,133 @@
+package responsetimecollector
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// timeWindowedCollector retains only response times added within the last
+// window duration, so during low traffic stale response times do not continue
+// to influence the control loop as they would in a window of the last N
+// requests. Response times are pruned as they are added and before they are
+// read.
+type timeWindowedCollector struct {
+	window time.Duration
+	// entries are the response times retained, in the order they were added.
+	entries []timedResponseTime
+	// mux guards entries.
+	mux *sync.Mutex
+	// now allows time to be controlled in tests.
+	now func() time.Time
+}
+
+// timedResponseTime is a response time in seconds and the time it was added.
+type timedResponseTime struct {
+	addedAt time.Time
+	seconds float64
+}
+
+func NewTimeWindowedCollector(window time.Duration) (*timeWindowedCollector, error) {
+	if window <= 0 {
+		return nil, errors.New(fmt.Sprintf("NewTimeWindowedCollector() expected positive window; got window = %v", window))
+	}
+
+	return &timeWindowedCollector{
+		window: window,
+		mux:    &sync.Mutex{},
+		now:    time.Now,
+	}, nil
+}
+
+// pruneLocked discards response times added before the window. mux must be
+// held.
+func (c *timeWindowedCollector) pruneLocked() {
+	cutoff := c.now().Add(-c.window)
+	// Entries are in the order they were added, so the first entry within the
+	// window can be found with a binary search.
+	i := sort.Search(len(c.entries), func(i int) bool {
+		return c.entries[i].addedAt.After(cutoff)
+	})
+	// Reslicing rather than copying keeps pruning O(log n). The discarded
+	// entries are released once append next reallocates.
+	c.entries = c.entries[i:]
+}
+
+// allLocked returns the response times retained, in the order they were
+// added. mux must be held.
+func (c *timeWindowedCollector) allLocked() []float64 {
+	c.pruneLocked()
+	times := make([]float64, len(c.entries))
+	for i, entry := range c.entries {
+		times[i] = entry.seconds
+	}
+	return times
+}
+
+func (c *timeWindowedCollector) All() []float64 {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.allLocked()
+}
+
+func (c *timeWindowedCollector) Len() int {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.pruneLocked()
+	return len(c.entries)
+}
+
+func (c *timeWindowedCollector) Add(t time.Duration) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	// The time is read while holding mux so entries remain in order.
+	c.entries = append(c.entries, timedResponseTime{addedAt: c.now(), seconds: t.Seconds()})
+	c.pruneLocked()
+}
+
+func (c *timeWindowedCollector) Aggregate() *Aggregation {
+	times := c.All()
+	sort.Float64s(times)
+	return &Aggregation{
+		P50: percentileOfSorted(times, 50),
+		P75: percentileOfSorted(times, 75),
+		P95: percentileOfSorted(times, 95),
+		P99: percentileOfSorted(times, 99),
+	}
+}
+
+func (c *timeWindowedCollector) Percentile(p float64) time.Duration {
+	return percentileOf(c.All(), p)
+}
+
+func (c *timeWindowedCollector) Reset() {
+	c.mux.Lock()
+	c.entries = nil
+	c.mux.Unlock()
+}
+
+// Utilization always returns 1 as the number of response times retained is
+// unbounded.
+func (c *timeWindowedCollector) Utilization() float64 {
+	return 1
+}
+
+func (c *timeWindowedCollector) TimeSpan() time.Duration {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.pruneLocked()
+	if len(c.entries) == 0 {
+		return 0
+	}
+	return c.entries[len(c.entries)-1].addedAt.Sub(c.entries[0].addedAt)
+}
+
+func (c *timeWindowedCollector) SnapshotAndReset() []float64 {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	times := c.allLocked()
+	c.entries = nil
+	return times
+}
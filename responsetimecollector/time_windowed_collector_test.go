@@ -0,0 +1,65 @@
+package responsetimecollector
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewTimeWindowedCollector_InvalidWindow(t *testing.T) {
+	if _, err := NewTimeWindowedCollector(0); err == nil {
+		t.Errorf("expected err for window = 0; got nil")
+	}
+}
+
+func TestTimeWindowedCollector_DropsOldResponseTimes(t *testing.T) {
+	c, err := NewTimeWindowedCollector(10 * time.Second)
+	if err != nil {
+		t.Fatalf("expected NewTimeWindowedCollector() returns nil err; got err = %v", err)
+	}
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	c.now = func() time.Time { return now }
+
+	c.Add(5 * time.Second)
+	now = now.Add(6 * time.Second)
+	c.Add(100 * time.Millisecond)
+	c.Add(200 * time.Millisecond)
+	assertFloatsEqual(t, []float64{5, 0.1, 0.2}, c.All())
+	if got := c.TimeSpan(); got != 6*time.Second {
+		t.Errorf("expected TimeSpan() = 6s; got %v", got)
+	}
+
+	// Once the first response time is older than the window, it no longer
+	// influences the aggregation.
+	now = now.Add(5 * time.Second)
+	if got := c.Aggregate().P99; got != 200*time.Millisecond {
+		t.Errorf("expected P99 = 200ms once the outlier leaves the window; got %v", got)
+	}
+	if c.Len() != 2 {
+		t.Errorf("expected Len() = 2; got %d", c.Len())
+	}
+
+	// Response times are also pruned on insert.
+	now = now.Add(10 * time.Second)
+	c.Add(time.Second)
+	assertFloatsEqual(t, []float64{1}, c.All())
+
+	now = now.Add(10 * time.Second)
+	if c.Len() != 0 {
+		t.Errorf("expected Len() = 0 once all response times leave the window; got %d", c.Len())
+	}
+	if got := c.Aggregate().P50; got != 0 {
+		t.Errorf("expected P50 = 0 for empty window; got %v", got)
+	}
+}
+
+func TestTimeWindowedCollector_SnapshotAndReset(t *testing.T) {
+	c, err := NewTimeWindowedCollector(10 * time.Second)
+	if err != nil {
+		t.Fatalf("expected NewTimeWindowedCollector() returns nil err; got err = %v", err)
+	}
+	c.Add(time.Second)
+	c.Add(2 * time.Second)
+
+	assertFloatsEqual(t, []float64{1, 2}, c.SnapshotAndReset())
+	assertFloatsEqual(t, []float64{}, c.All())
+}
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"github.com/kcz17/dimmer/filters"
@@ -9,11 +12,18 @@ import (
 	"github.com/kcz17/dimmer/onlinetraining"
 	"github.com/kcz17/dimmer/profiling"
 	"github.com/valyala/fasthttp"
+	"io"
+	"io/ioutil"
 	"log"
-	"math/rand"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -25,22 +35,183 @@ const (
 	Dimming
 	DimmingWithProfiling
 	DimmingWithOnlineTraining
+	// ShadowDimming makes dimming decisions as in Dimming without actuating
+	// them, instead reporting each decision in response headers.
+	ShadowDimming
 )
 
+// String returns the name of the mode as accepted by the API server.
+func (m DimmingMode) String() string {
+	switch m {
+	case Disabled:
+		return "Disabled"
+	case OfflineTraining:
+		return "OfflineTraining"
+	case Dimming:
+		return "Dimming"
+	case DimmingWithProfiling:
+		return "DimmingWithProfiling"
+	case DimmingWithOnlineTraining:
+		return "DimmingWithOnlineTraining"
+	case ShadowDimming:
+		return "ShadowDimming"
+	default:
+		return fmt.Sprintf("DimmingMode(%d)", int(m))
+	}
+}
+
+// Reasons reported by the X-Would-Dim-Reason header in ShadowDimming mode.
+const (
+	wouldDimReasonDimmed          = "dimmed"
+	wouldDimReasonNotDimmable     = "not-dimmable"
+	wouldDimReasonController      = "controller"
+	wouldDimReasonPathProbability = "path-probability"
+	wouldDimReasonBudget          = "budget"
+	wouldDimReasonOverload        = "overload"
+	wouldDimReasonRateCap         = "rate-cap"
+)
+
+// defaultDimmedResponse is returned in place of dimmed components without a
+// dimmed response of their own if no dim response status code is set.
+var defaultDimmedResponse = filters.DimmedResponse{
+	StatusCode: http.StatusTooManyRequests,
+	Body:       "Dimming!",
+}
+
+// retryAfterMaxMultiplier scales the dim response Retry-After base delay at
+// 100% dimming. The delay rises linearly from the base delay at 0% dimming.
+const retryAfterMaxMultiplier = 10
+
+// unixSocketAddrPrefix prefixes frontend and backend addresses which are Unix
+// domain socket paths rather than TCP addresses, e.g. unix:/run/dimmer.sock.
+const unixSocketAddrPrefix = "unix:"
+
+// frontendUnixSocketMode is the file mode of the frontend Unix domain socket.
+const frontendUnixSocketMode = 0666
+
 type ServerOptions struct {
-	Logger                 logging.Logger
-	FrontendAddr           string
-	BackendAddr            string
-	MaxConns               int
-	ControlLoop            *ServerControlLoop
-	RequestFilter          *filters.RequestFilter
-	PathProbabilities      *filters.PathProbabilities
+	Logger logging.Logger
+	// FrontendAddr and BackendAddr are TCP addresses, or Unix domain socket
+	// paths prefixed by unix: for sidecar deployments sharing a pod.
+	FrontendAddr      string
+	BackendAddr       string
+	MaxConns          int
+	ControlLoop       *ServerControlLoop
+	RequestFilter     *filters.RequestFilter
+	PathProbabilities *filters.PathProbabilities
+	// DisabledPaths is optional. If set, it should be shared with
+	// OnlineTrainingService so training skips disabled paths. If nil, an
+	// empty set is used.
+	DisabledPaths          *filters.DisabledPaths
 	OnlineTrainingService  *onlinetraining.OnlineTraining
 	OfflineTrainingService *offlinetraining.OfflineTraining
 	IsProfilingEnabled     bool
 	ProfilingService       *profiling.Profiler
 	ProfilingSessionCookie string
 	IsDimmingEnabled       bool
+	// IsContentTypeDimmingEnabled enables dimming of proxied responses whose
+	// Content-Type matches ContentTypeFilter.
+	IsContentTypeDimmingEnabled bool
+	ContentTypeFilter           *filters.ContentTypeFilter
+	// IsDimmingBudgetEnabled caps the component categories dimmed per session
+	// using DimmingBudget. Sessions are identified by ProfilingSessionCookie.
+	IsDimmingBudgetEnabled bool
+	DimmingBudget          *filters.DimmingBudget
+	// DimmedRateCaps is optional. If set, requests are not dimmed if doing so
+	// would exceed the dimmed rate cap of their path.
+	DimmedRateCaps *filters.DimmedRateCaps
+	// ControlSignalFilter matches the requests whose response times drive the
+	// control loop. Other response times are only observed. If nil, all
+	// response times drive the control loop.
+	ControlSignalFilter *filters.RequestFilter
+	// ExcludedStatusCodes is optional. Response times of responses
+	// with one of the status codes are only observed, rather than driving the
+	// control loop.
+	ExcludedStatusCodes []int
+	// IsPerIPConcurrencyLimitEnabled rejects requests from client IPs with
+	// too many requests in flight. Client IPs are resolved by ClientIPResolver.
+	IsPerIPConcurrencyLimitEnabled bool
+	PerIPConcurrencyLimiter        *filters.ConcurrencyLimiter
+	ClientIPResolver               *filters.ClientIPResolver
+	// IsRequestDecompressionEnabled decompresses gzip-encoded request bodies
+	// before proxying, for backends which cannot decompress them.
+	IsRequestDecompressionEnabled bool
+	// MaxRequestBodySize is the maximum size in bytes of request bodies, both
+	// as received and once decompressed. If 0,
+	// fasthttp.DefaultMaxRequestBodySize is used.
+	MaxRequestBodySize int
+	// IsHTTP10KeepAliveEnabled forwards an explicit Connection: keep-alive
+	// from HTTP/1.0 clients to the backend rather than stripping it.
+	IsHTTP10KeepAliveEnabled bool
+	// RequestTimeout bounds the total time a request spends in the dimmer,
+	// including waiting for the backend. If 0, requests are not timed out.
+	RequestTimeout time.Duration
+	// DimDecider is optional. If nil, the default decider is used, which dims
+	// according to the PID output and profiling.
+	DimDecider DimDecider
+	// FilterMatchCounter is optional. If nil, a counter is created.
+	FilterMatchCounter *filters.MatchCounter
+	// MethodMultipliers is optional. If nil, path probabilities apply to all
+	// methods unscaled.
+	MethodMultipliers *filters.MethodMultipliers
+	// DecisionSink is optional. If set, the dimming decision for each
+	// dimmable request is recorded to it.
+	DecisionSink logging.DecisionSink
+	// EventSink is optional. If set, dimming mode changes are published to it.
+	EventSink logging.EventSink
+	// DimmedResponses is optional. If nil, all dimmed components return the
+	// dim response.
+	DimmedResponses *filters.DimmedResponses
+	// ResponseTransformers is optional. If set, dimmed components with a
+	// transformer are proxied and their response bodies transformed instead
+	// of returning a dimmed response.
+	ResponseTransformers *filters.ResponseTransformers
+	// DimResponseStatusCode and DimResponseBody are the response returned in
+	// place of dimmed components without a dimmed response of their own, e.g.
+	// 503 for CDNs which retry 429s. If DimResponseStatusCode is 0,
+	// defaultDimmedResponse is returned.
+	DimResponseStatusCode int
+	DimResponseBody       string
+	// DimResponseTemplatePath is optional. If set, the HTML file at the path
+	// is read once and returned as text/html in place of DimResponseBody, so
+	// dimmed pages render a styled error page. If the file cannot be read,
+	// DimResponseBody is returned and a warning is logged.
+	DimResponseTemplatePath string
+	// DimRedirectURL is optional. If set, dimmed components without a dimmed
+	// response of their own are redirected to it with a 302 instead.
+	DimRedirectURL string
+	// NavigationRedirectURL is optional. If set, dimmed top-level navigations
+	// without a dimmed response of their own are redirected to it with
+	// NavigationRedirectStatusCode, e.g. to a lite version of the page, with
+	// the original path as the NavigationRedirectPathParam query parameter.
+	NavigationRedirectURL        *url.URL
+	NavigationRedirectStatusCode int
+	NavigationRedirectPathParam  string
+	// VaryHeaders is optional. If set, the request headers are added to the
+	// Vary header of dimmed responses and proxied responses which could have
+	// been dimmed, so caches do not serve dimmed responses to users who
+	// would not be dimmed, or vice versa.
+	VaryHeaders []string
+	// IsControlStateHeadersEnabled annotates dimmed responses with the
+	// control loop's setpoint, input and output, so clients can adapt their
+	// request rate. This leaks internal state, so should only be enabled for
+	// trusted clients.
+	IsControlStateHeadersEnabled bool
+	// DimRetryAfterBaseSeconds is the Retry-After delay suggested by 429 and
+	// 503 dim responses at 0% dimming, rising with the dimming percentage so
+	// clients back off for longer under heavier load. If 0, Retry-After is
+	// not set.
+	DimRetryAfterBaseSeconds float64
+	// OverloadProtector is optional. If set, a fraction of dimmable requests
+	// driven by the backend error rate is shed independently of the control
+	// loop. Responses with one of its overload status codes count as errors.
+	OverloadProtector *filters.OverloadProtector
+	// PathValidator is optional. If set, requests with malformed paths are
+	// rejected with 400 Bad Request before any other processing.
+	PathValidator *filters.PathValidator
+	// TLSConfig is optional. If set, TLS is terminated on FrontendAddr,
+	// whether it is a TCP address or a Unix domain socket.
+	TLSConfig *tls.Config
 }
 
 // Server is a dimming-enhanced server. Dimming is actuated using a control
@@ -53,12 +224,20 @@ type Server struct {
 		FrontendAddr string
 		BackendAddr  string
 		MaxConns     int
+		// TLSConfig terminates TLS on FrontendAddr. If nil, the frontend
+		// serves plaintext HTTP.
+		TLSConfig *tls.Config
 		// server and proxy implement our reverse proxy, allowing requests
 		// to be forwarded to the backend host.
 		server *fasthttp.Server
 		proxy  *fasthttp.HostClient
 	}
+	// dimmingModeMux is held for reading by request handlers while they read
+	// the mode and its associated state, and for writing while SetDimmingMode
+	// transitions between modes, so requests see either the old mode and its
+	// state or the new mode and its state, never a partial transition.
 	dimmingMode        DimmingMode
+	dimmingModeMux     *sync.RWMutex
 	defaultDimmingMode DimmingMode
 	dimming            struct {
 		// ControlLoop reads the response time of the server and adjusts the
@@ -67,6 +246,118 @@ type Server struct {
 		RequestFilter     *filters.RequestFilter
 		PathProbabilities *filters.PathProbabilities
 	}
+	// isContentTypeDimmingEnabled enables a post-hoc dimming model, where
+	// requests are proxied and responses with a Content-Type matching
+	// contentTypeFilter have their body replaced if dimming is actuated. The
+	// backend still serves the request, so this saves bandwidth rather than
+	// backend load. Requests matched by the RequestFilter are decided before
+	// proxying only.
+	isContentTypeDimmingEnabled bool
+	contentTypeFilter           *filters.ContentTypeFilter
+	// dimmingBudget coordinates dimming decisions within a session so that
+	// too many component categories are not dimmed at once.
+	isDimmingBudgetEnabled bool
+	dimmingBudget          *filters.DimmingBudget
+	// dimmedRateCaps is a guardrail which stops dimming paths whose dimmed
+	// rate within a rolling window reaches their cap, regardless of the
+	// dimming percentage. If nil, dimmed rates are uncapped.
+	dimmedRateCaps *filters.DimmedRateCaps
+	// controlSignalFilter restricts the response times which drive the control
+	// loop, e.g. to critical paths. If nil, all response times drive it.
+	controlSignalFilter *filters.RequestFilter
+	// excludedStatusCodes is a set of status codes, such as 304
+	// and other redirects, whose near-instant response times do not reflect
+	// content-serving work and would bias the control loop towards
+	// under-dimming. Their response times are only observed.
+	excludedStatusCodes map[int]bool
+	// dimDecider decides whether requests matching RequestFilter are dimmed.
+	dimDecider DimDecider
+	// filterMatchCounter counts all requests and those matching
+	// RequestFilter, indicating how much traffic is eligible for dimming.
+	filterMatchCounter *filters.MatchCounter
+	// methodMultipliers scale path probabilities by request method, a lighter
+	// alternative to per-method path probabilities for read-write asymmetry.
+	// If nil, all methods have a multiplier of 1.
+	methodMultipliers *filters.MethodMultipliers
+	// decisionSink exports decisions for dimmable requests for A/B analysis
+	// against business metrics. If nil, decisions are not exported.
+	decisionSink logging.DecisionSink
+	// eventSink publishes dimming mode changes for downstream consumers. If
+	// nil, changes are not published.
+	eventSink logging.EventSink
+	// dimmedResponses are the responses returned in place of dimmed
+	// components, allowing components to degrade silently, e.g. with a 200
+	// and an empty JSON list. If nil, dimResponse is returned.
+	dimmedResponses *filters.DimmedResponses
+	// responseTransformers allow components to degrade to a reduced payload
+	// rather than being dimmed wholesale: dimmed components with a
+	// transformer are proxied as usual and the body of a successful response
+	// is transformed, e.g. truncating a JSON array. If nil, no components are
+	// transformed.
+	responseTransformers *filters.ResponseTransformers
+	// dimResponse is returned in place of dimmed components without a dimmed
+	// response of their own.
+	dimResponse filters.DimmedResponse
+	// dimRedirectURL is the Location dimmed components without a dimmed
+	// response of their own are redirected to. If empty, dimResponse is
+	// returned instead.
+	dimRedirectURL string
+	// navigationRedirectURL is the Location dimmed top-level navigations are
+	// redirected to with navigationRedirectStatusCode in place of
+	// dimRedirectURL or dimResponse, with the original path set as the
+	// navigationRedirectPathParam query parameter. If nil, navigations are
+	// dimmed as other requests.
+	navigationRedirectURL        *url.URL
+	navigationRedirectStatusCode int
+	navigationRedirectPathParam  string
+	// varyHeaders are the request headers which influence dimming decisions,
+	// e.g. Cookie, which are merged into the Vary header of responses which
+	// were or could have been dimmed. If empty, Vary is left unchanged.
+	varyHeaders []string
+	// dimRetryAfterBaseSeconds is the Retry-After delay of dim responses at
+	// 0% dimming. If 0, Retry-After is not set.
+	dimRetryAfterBaseSeconds float64
+	// isControlStateHeadersEnabled sets X-Dimmer-Setpoint, X-Dimmer-Input and
+	// X-Dimmer-Output on dimmed responses, allowing smarter client
+	// back-pressure than Retry-After alone.
+	isControlStateHeadersEnabled bool
+	// overloadProtector sheds requests while the backend is failing. If nil,
+	// requests are never shed.
+	overloadProtector *filters.OverloadProtector
+	// pathValidator rejects malformed paths, e.g. from scanners, so they do
+	// not bloat or confuse path-keyed structures. If nil, all paths are
+	// accepted.
+	pathValidator *filters.PathValidator
+	// perIPConcurrencyLimiter is a basic abuse protection layer which caps the
+	// concurrent requests proxied for each client IP, so a single client
+	// cannot open thousands of connections through the proxy.
+	isPerIPConcurrencyLimitEnabled bool
+	perIPConcurrencyLimiter        *filters.ConcurrencyLimiter
+	clientIPResolver               *filters.ClientIPResolver
+	// isRequestDecompressionEnabled decompresses request bodies with a
+	// Content-Encoding of gzip before proxying. Malformed bodies are rejected
+	// with a 400, and bodies which decompress to more than maxRequestBodySize
+	// bytes with a 413. Dimmed requests are not decompressed.
+	isRequestDecompressionEnabled bool
+	maxRequestBodySize            int
+	// isHTTP10KeepAliveEnabled preserves keep-alive for HTTP/1.0 clients which
+	// explicitly request it. Unlike HTTP/1.1, HTTP/1.0 connections are not
+	// persistent by default, so stripping the Connection header causes the
+	// backend to treat the request as non-persistent.
+	isHTTP10KeepAliveEnabled bool
+	// requestTimeout bounds the worst-case latency the dimmer adds. The
+	// backend request is abandoned once requestTimeout has elapsed since the
+	// handler started, and a 504 is returned. The response time recorded is
+	// then the time waited before abandoning the backend request. If 0,
+	// requests are not timed out.
+	requestTimeout time.Duration
+	// isMaintenanceEnabled returns a maintenance response for all requests
+	// without proxying, independently of the dimming mode. It is 1 if enabled
+	// and is accessed atomically as it is read on every request, as is
+	// maintenanceRetryAfterSeconds, which sets Retry-After if positive. Both
+	// are int32 so atomic access does not depend on 64-bit alignment.
+	isMaintenanceEnabled         int32
+	maintenanceRetryAfterSeconds int32
 	// onlineTraining improves PathProbabilities by randomising the
 	// PathProbabilities for a candidate group selected from users being dimmed.
 	onlineTraining *onlinetraining.OnlineTraining
@@ -79,6 +370,10 @@ type Server struct {
 	// experience the website with dimming consistent to their profiled priority.
 	profiling              *profiling.Profiler
 	profilingSessionCookie string
+	// disabledPaths are never dimmed, whatever their probability. Their
+	// probabilities are not changed via the API while disabled, so enabling
+	// a path restores its probability from before it was disabled.
+	disabledPaths *filters.DisabledPaths
 	// isStarted is checked to ensure each Server is only ever started once.
 	isStarted bool
 	// externalOperationsLock guards external operations which interact with the server.
@@ -91,22 +386,67 @@ func NewServer(options *ServerOptions) *Server {
 		defaultMode = Dimming
 	}
 
+	dimDecider := options.DimDecider
+	if dimDecider == nil {
+		dimDecider = NewDefaultDimDecider(options.IsProfilingEnabled, options.ProfilingService, options.ProfilingSessionCookie)
+	}
+
+	filterMatchCounter := options.FilterMatchCounter
+	if filterMatchCounter == nil {
+		filterMatchCounter = filters.NewMatchCounter()
+	}
+
+	disabledPaths := options.DisabledPaths
+	if disabledPaths == nil {
+		disabledPaths = filters.NewDisabledPaths()
+	}
+
+	maxRequestBodySize := options.MaxRequestBodySize
+	if maxRequestBodySize == 0 {
+		maxRequestBodySize = fasthttp.DefaultMaxRequestBodySize
+	}
+
+	excludedStatusCodes := map[int]bool{}
+	for _, statusCode := range options.ExcludedStatusCodes {
+		excludedStatusCodes[statusCode] = true
+	}
+
+	dimResponse := defaultDimmedResponse
+	if options.DimResponseStatusCode != 0 {
+		dimResponse = filters.DimmedResponse{
+			StatusCode: options.DimResponseStatusCode,
+			Body:       options.DimResponseBody,
+		}
+	}
+	if options.DimResponseTemplatePath != "" {
+		template, err := ioutil.ReadFile(options.DimResponseTemplatePath)
+		if err != nil {
+			log.Printf("warning: could not read dim response template, falling back to plain text: err = %v", err)
+		} else {
+			dimResponse.Body = string(template)
+			dimResponse.ContentType = "text/html; charset=utf-8"
+		}
+	}
+
 	return &Server{
 		logger: options.Logger,
 		proxying: struct {
 			FrontendAddr string
 			BackendAddr  string
 			MaxConns     int
+			TLSConfig    *tls.Config
 			server       *fasthttp.Server
 			proxy        *fasthttp.HostClient
 		}{
 			FrontendAddr: options.FrontendAddr,
 			BackendAddr:  options.BackendAddr,
 			MaxConns:     options.MaxConns,
+			TLSConfig:    options.TLSConfig,
 			server:       nil,
 			proxy:        nil,
 		},
 		dimmingMode:        defaultMode,
+		dimmingModeMux:     &sync.RWMutex{},
 		defaultDimmingMode: defaultMode,
 		dimming: struct {
 			ControlLoop       *ServerControlLoop
@@ -117,16 +457,69 @@ func NewServer(options *ServerOptions) *Server {
 			RequestFilter:     options.RequestFilter,
 			PathProbabilities: options.PathProbabilities,
 		},
-		onlineTraining:         options.OnlineTrainingService,
-		offlineTraining:        options.OfflineTrainingService,
-		profiling:              options.ProfilingService,
-		profilingSessionCookie: options.ProfilingSessionCookie,
-		isProfilingEnabled:     options.IsProfilingEnabled,
-		isStarted:              false,
-		externalOperationsLock: &sync.Mutex{},
+		onlineTraining:                 options.OnlineTrainingService,
+		offlineTraining:                options.OfflineTrainingService,
+		profiling:                      options.ProfilingService,
+		profilingSessionCookie:         options.ProfilingSessionCookie,
+		isProfilingEnabled:             options.IsProfilingEnabled,
+		isContentTypeDimmingEnabled:    options.IsContentTypeDimmingEnabled,
+		contentTypeFilter:              options.ContentTypeFilter,
+		isDimmingBudgetEnabled:         options.IsDimmingBudgetEnabled,
+		dimmingBudget:                  options.DimmingBudget,
+		dimmedRateCaps:                 options.DimmedRateCaps,
+		controlSignalFilter:            options.ControlSignalFilter,
+		excludedStatusCodes:            excludedStatusCodes,
+		dimDecider:                     dimDecider,
+		filterMatchCounter:             filterMatchCounter,
+		methodMultipliers:              options.MethodMultipliers,
+		decisionSink:                   options.DecisionSink,
+		eventSink:                      options.EventSink,
+		dimmedResponses:                options.DimmedResponses,
+		responseTransformers:           options.ResponseTransformers,
+		dimResponse:                    dimResponse,
+		dimRedirectURL:                 options.DimRedirectURL,
+		navigationRedirectURL:          options.NavigationRedirectURL,
+		navigationRedirectStatusCode:   options.NavigationRedirectStatusCode,
+		navigationRedirectPathParam:    options.NavigationRedirectPathParam,
+		varyHeaders:                    options.VaryHeaders,
+		dimRetryAfterBaseSeconds:       options.DimRetryAfterBaseSeconds,
+		isControlStateHeadersEnabled:   options.IsControlStateHeadersEnabled,
+		overloadProtector:              options.OverloadProtector,
+		pathValidator:                  options.PathValidator,
+		isPerIPConcurrencyLimitEnabled: options.IsPerIPConcurrencyLimitEnabled,
+		isRequestDecompressionEnabled:  options.IsRequestDecompressionEnabled,
+		maxRequestBodySize:             maxRequestBodySize,
+		isHTTP10KeepAliveEnabled:       options.IsHTTP10KeepAliveEnabled,
+		requestTimeout:                 options.RequestTimeout,
+		perIPConcurrencyLimiter:        options.PerIPConcurrencyLimiter,
+		clientIPResolver:               options.ClientIPResolver,
+		disabledPaths:                  disabledPaths,
+		isStarted:                      false,
+		externalOperationsLock:         &sync.Mutex{},
 	}
 }
 
+// Shutdown stops accepting requests, waiting for open connections to close,
+// then stops the control loop, so no further state changes are made while
+// the dimmer shuts down.
+func (s *Server) Shutdown() error {
+	s.externalOperationsLock.Lock()
+	defer s.externalOperationsLock.Unlock()
+
+	if !s.isStarted {
+		return errors.New("Server.Shutdown() failed: server not started")
+	}
+
+	if err := s.proxying.server.Shutdown(); err != nil {
+		return fmt.Errorf("Server.Shutdown() got fasthttp server error: %w", err)
+	}
+	if err := s.dimming.ControlLoop.Stop(); err != nil {
+		return fmt.Errorf("Server.Shutdown() got err when calling ControlLoop.Stop(): %w", err)
+	}
+	s.isStarted = false
+	return nil
+}
+
 func (s *Server) ListenAndServe() error {
 	s.externalOperationsLock.Lock()
 
@@ -134,10 +527,11 @@ func (s *Server) ListenAndServe() error {
 		return errors.New("server already started")
 	}
 
-	s.proxying.proxy = &fasthttp.HostClient{Addr: s.proxying.BackendAddr, MaxConns: s.proxying.MaxConns}
+	s.proxying.proxy = newBackendClient(s.proxying.BackendAddr, s.proxying.MaxConns)
 	s.proxying.server = &fasthttp.Server{
-		Handler:         s.requestHandler(),
-		CloseOnShutdown: true,
+		Handler:            s.requestHandler(),
+		CloseOnShutdown:    true,
+		MaxRequestBodySize: s.maxRequestBodySize,
 	}
 	s.isStarted = true
 
@@ -147,6 +541,22 @@ func (s *Server) ListenAndServe() error {
 
 	s.externalOperationsLock.Unlock()
 
+	if socketPath, isUnixSocket := unixSocketPath(s.proxying.FrontendAddr); isUnixSocket {
+		ln, err := listenUnixSocket(socketPath, frontendUnixSocketMode)
+		if err != nil {
+			return fmt.Errorf("Server.ListenAndServe() got err when listening on %s: %w", s.proxying.FrontendAddr, err)
+		}
+		return s.serveFrontend(ln)
+	}
+
+	if s.proxying.TLSConfig != nil {
+		ln, err := net.Listen("tcp", s.proxying.FrontendAddr)
+		if err != nil {
+			return fmt.Errorf("Server.ListenAndServe() got err when listening on %s: %w", s.proxying.FrontendAddr, err)
+		}
+		return s.serveFrontend(ln)
+	}
+
 	if err := s.proxying.server.ListenAndServe(s.proxying.FrontendAddr); err != nil {
 		return fmt.Errorf("Server.ListenAndServe() got fasthttp server error: %w", err)
 	}
@@ -154,11 +564,99 @@ func (s *Server) ListenAndServe() error {
 	return nil
 }
 
+// serveFrontend serves requests from ln, terminating TLS if configured.
+func (s *Server) serveFrontend(ln net.Listener) error {
+	if s.proxying.TLSConfig != nil {
+		ln = tls.NewListener(ln, s.proxying.TLSConfig)
+	}
+	if err := s.proxying.server.Serve(ln); err != nil {
+		return fmt.Errorf("Server.ListenAndServe() got fasthttp server error: %w", err)
+	}
+	return nil
+}
+
+// listenUnixSocket listens on the Unix domain socket at path with the given
+// file mode, removing a stale socket left by a previous run as fasthttp's
+// ListenAndServeUNIX does.
+func listenUnixSocket(path string, mode os.FileMode) (net.Listener, error) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("expected stale socket %s is removed; got err = %w", path, err)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		_ = ln.Close()
+		return nil, fmt.Errorf("expected socket %s mode is set to %#o; got err = %w", path, mode, err)
+	}
+	return ln, nil
+}
+
+// unixSocketPath returns the socket path of an address prefixed by unix:, and
+// false if the address is a TCP address.
+func unixSocketPath(addr string) (string, bool) {
+	if !strings.HasPrefix(addr, unixSocketAddrPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(addr, unixSocketAddrPrefix), true
+}
+
+// backendProbeTimeout bounds the connection attempt made to check whether the
+// backend is reachable.
+const backendProbeTimeout = time.Second
+
+// isBackendReachable returns true if a connection to the backend can be
+// opened. It probes the backend directly rather than relying on proxied
+// responses, so readiness can be reported before any traffic is received.
+func (s *Server) isBackendReachable() bool {
+	network, addr := "tcp", s.proxying.BackendAddr
+	if socketPath, isUnixSocket := unixSocketPath(addr); isUnixSocket {
+		network, addr = "unix", socketPath
+	}
+
+	conn, err := net.DialTimeout(network, addr, backendProbeTimeout)
+	if err != nil {
+		return false
+	}
+	_ = conn.Close()
+	return true
+}
+
+// newBackendClient returns a client proxying to addr, dialling a Unix domain
+// socket if addr is prefixed by unix:.
+func newBackendClient(addr string, maxConns int) *fasthttp.HostClient {
+	socketPath, isUnixSocket := unixSocketPath(addr)
+	if !isUnixSocket {
+		return &fasthttp.HostClient{Addr: addr, MaxConns: maxConns}
+	}
+
+	return &fasthttp.HostClient{
+		Addr:     socketPath,
+		MaxConns: maxConns,
+		Dial: func(string) (net.Conn, error) {
+			return net.Dial("unix", socketPath)
+		},
+	}
+}
+
 func (s *Server) UpdatePathProbabilities(rules []filters.PathProbabilityRule) error {
+	// The probabilities of disabled paths are skipped, so enabling a path
+	// restores its probability from before it was disabled. Disabled paths
+	// remain in online training, which skips them while they are disabled.
+	var enabledRules []filters.PathProbabilityRule
+	for _, rule := range rules {
+		if s.disabledPaths.Contains(rule.Path) {
+			log.Printf("skipping probability for disabled path %s", rule.Path)
+			continue
+		}
+		enabledRules = append(enabledRules, rule)
+	}
+
 	// Path probabilities affect both dimming and online training, hence both
 	// must be accurately set.
-	if err := s.dimming.PathProbabilities.SetAll(rules); err != nil {
-		return fmt.Errorf("expected PathProbabilities.SetAll(probabilities = %+v) to return err != nil; got err = %w", rules, err)
+	if err := s.dimming.PathProbabilities.SetAll(enabledRules); err != nil {
+		return fmt.Errorf("expected PathProbabilities.SetAll(probabilities = %+v) to return err != nil; got err = %w", enabledRules, err)
 	}
 
 	var paths []string
@@ -170,14 +668,58 @@ func (s *Server) UpdatePathProbabilities(rules []filters.PathProbabilityRule) er
 	return nil
 }
 
+// DisablePathDimming stops path from being dimmed until EnablePathDimming is
+// called. The path's probability is left unchanged.
+func (s *Server) DisablePathDimming(path string) error {
+	if err := s.disabledPaths.Disable(path); err != nil {
+		return fmt.Errorf("expected DisabledPaths.Disable() returns nil err; got err = %w", err)
+	}
+	return nil
+}
+
+// EnablePathDimming allows a path disabled by DisablePathDimming to be dimmed
+// again.
+func (s *Server) EnablePathDimming(path string) error {
+	if err := s.disabledPaths.Enable(path); err != nil {
+		return fmt.Errorf("expected DisabledPaths.Enable() returns nil err; got err = %w", err)
+	}
+	return nil
+}
+
+// SetMaintenance enables or disables maintenance mode. retryAfter is rounded
+// down to the second and not sent if zero.
+func (s *Server) SetMaintenance(isEnabled bool, retryAfter time.Duration) error {
+	if retryAfter < 0 {
+		return errors.New(fmt.Sprintf("SetMaintenance() expected non-negative retryAfter; got %v", retryAfter))
+	}
+
+	// retryAfter is stored before enabling so an enabled maintenance mode
+	// never uses a stale value.
+	atomic.StoreInt32(&s.maintenanceRetryAfterSeconds, int32(retryAfter/time.Second))
+	var isEnabledFlag int32
+	if isEnabled {
+		isEnabledFlag = 1
+	}
+	atomic.StoreInt32(&s.isMaintenanceEnabled, isEnabledFlag)
+	return nil
+}
+
 func (s *Server) SetDimmingMode(newMode DimmingMode) error {
 	s.externalOperationsLock.Lock()
 	defer s.externalOperationsLock.Unlock()
+	return s.setDimmingModeLocked(newMode)
+}
 
+// setDimmingModeLocked implements SetDimmingMode. externalOperationsLock must
+// be held.
+func (s *Server) setDimmingModeLocked(newMode DimmingMode) error {
 	if !s.isStarted {
 		return errors.New("SetDimmingMode() expected server running; server is not running")
 	}
 
+	s.dimmingModeMux.Lock()
+	defer s.dimmingModeMux.Unlock()
+
 	if s.dimmingMode == DimmingWithOnlineTraining {
 		if err := s.onlineTraining.StopLoop(); err != nil {
 			return fmt.Errorf("expected onlineTraining.StopLoop() returns nil err; got err = %w", err)
@@ -195,114 +737,358 @@ func (s *Server) SetDimmingMode(newMode DimmingMode) error {
 		}
 	}
 
+	if s.eventSink != nil {
+		s.eventSink.Publish(logging.Event{
+			Timestamp: time.Now(),
+			Type:      logging.EventDimmingModeChanged,
+			Attributes: map[string]interface{}{
+				"from": s.dimmingMode.String(),
+				"to":   newMode.String(),
+			},
+		})
+	}
+
 	s.dimmingMode = newMode
 	return nil
 }
 
+// ConfigChange is a set of changes applied together by ApplyConfig. Nil
+// fields are left unchanged.
+type ConfigChange struct {
+	Mode *DimmingMode
+	// Probabilities are set as by UpdatePathProbabilities, so paths without
+	// a rule keep their probability.
+	Probabilities []filters.PathProbabilityRule
+	Setpoint      *float64
+	// Gains are the kp, ki and kd gain constants, which must be set together.
+	Gains *ControllerGains
+}
+
+type ControllerGains struct {
+	Kp float64
+	Ki float64
+	Kd float64
+}
+
+// EffectiveConfig is the configuration in effect after ApplyConfig.
+type EffectiveConfig struct {
+	Mode          string
+	Probabilities map[string]float64
+	Setpoint      float64
+	Gains         ControllerGains
+}
+
+// validate checks every change can be applied, so ApplyConfig fails before
+// applying any change where possible.
+func (c ConfigChange) validate() error {
+	for _, rule := range c.Probabilities {
+		if rule.Path == "" {
+			return errors.New("ConfigChange expected probabilities with non-empty paths; got empty path")
+		}
+		if !(rule.Probability >= 0 && rule.Probability <= 1) {
+			return errors.New(fmt.Sprintf("ConfigChange expected probabilities between 0 and 1; got probability = %v for path %s", rule.Probability, rule.Path))
+		}
+	}
+	if c.Setpoint != nil && (!(*c.Setpoint > 0) || math.IsInf(*c.Setpoint, 1)) {
+		return errors.New(fmt.Sprintf("ConfigChange expected positive finite setpoint; got setpoint = %v", *c.Setpoint))
+	}
+	if c.Gains != nil && !(c.Gains.Kp >= 0 && c.Gains.Ki >= 0 && c.Gains.Kd >= 0) {
+		return errors.New(fmt.Sprintf("ConfigChange expected non-negative gains; got gains = %+v", *c.Gains))
+	}
+	return nil
+}
+
+// ApplyConfig validates all changes, then applies them while holding
+// externalOperationsLock, so deploy tooling can change the mode, path
+// probabilities and controller together without other external operations
+// observing a partially applied configuration. If applying a change fails,
+// changes already applied are rolled back.
+//
+// The mode is changed first as it is the only change which can fail once
+// validated, e.g. if online training cannot be started.
+func (s *Server) ApplyConfig(change ConfigChange) (*EffectiveConfig, error) {
+	if err := change.validate(); err != nil {
+		return nil, err
+	}
+
+	s.externalOperationsLock.Lock()
+	defer s.externalOperationsLock.Unlock()
+
+	previousMode := s.dimmingMode
+	previousProbabilities := s.dimming.PathProbabilities.List()
+	previousSetpoint := s.dimming.ControlLoop.Setpoint()
+	previousKp, previousKi, previousKd := s.dimming.ControlLoop.Gains()
+
+	// rollback restores the configuration from before ApplyConfig in the
+	// reverse order to which changes are applied. Failures are logged as
+	// the original error is returned.
+	rollback := func() {
+		s.dimming.PathProbabilities.Restore(previousProbabilities)
+		if change.Gains != nil {
+			if err := s.dimming.ControlLoop.SetGains(previousKp, previousKi, previousKd); err != nil {
+				log.Printf("expected ControlLoop.SetGains() returns nil err when rolling back; got err = %v", err)
+			}
+		}
+		if change.Setpoint != nil {
+			if err := s.dimming.ControlLoop.SetSetpoint(previousSetpoint); err != nil {
+				log.Printf("expected ControlLoop.SetSetpoint() returns nil err when rolling back; got err = %v", err)
+			}
+		}
+		if s.dimmingMode != previousMode {
+			if err := s.setDimmingModeLocked(previousMode); err != nil {
+				log.Printf("expected setDimmingModeLocked() returns nil err when rolling back; got err = %v", err)
+			}
+		}
+	}
+
+	if change.Mode != nil && *change.Mode != s.dimmingMode {
+		if err := s.setDimmingModeLocked(*change.Mode); err != nil {
+			rollback()
+			return nil, fmt.Errorf("expected SetDimmingMode() returns nil err; got err = %w", err)
+		}
+	}
+	if change.Setpoint != nil {
+		if err := s.dimming.ControlLoop.SetSetpoint(*change.Setpoint); err != nil {
+			rollback()
+			return nil, fmt.Errorf("expected ControlLoop.SetSetpoint() returns nil err; got err = %w", err)
+		}
+	}
+	if change.Gains != nil {
+		if err := s.dimming.ControlLoop.SetGains(change.Gains.Kp, change.Gains.Ki, change.Gains.Kd); err != nil {
+			rollback()
+			return nil, fmt.Errorf("expected ControlLoop.SetGains() returns nil err; got err = %w", err)
+		}
+	}
+	if len(change.Probabilities) != 0 {
+		if err := s.UpdatePathProbabilities(change.Probabilities); err != nil {
+			rollback()
+			return nil, err
+		}
+	}
+
+	kp, ki, kd := s.dimming.ControlLoop.Gains()
+	return &EffectiveConfig{
+		Mode:          s.dimmingMode.String(),
+		Probabilities: s.dimming.PathProbabilities.List(),
+		Setpoint:      s.dimming.ControlLoop.Setpoint(),
+		Gains:         ControllerGains{Kp: kp, Ki: ki, Kd: kd},
+	}, nil
+}
+
 func (s *Server) requestHandler() fasthttp.RequestHandler {
 	return func(ctx *fasthttp.RequestCtx) {
 		req := &ctx.Request
 		resp := &ctx.Response
 
-		// Remove connection header per RFC2616.
-		req.Header.Del("Connection")
+		// The deadline covers the whole request, not only the backend
+		// request, so time spent in the dimmer is also bounded.
+		var deadline time.Time
+		if s.requestTimeout > 0 {
+			deadline = time.Now().Add(s.requestTimeout)
+		}
+
+		// Remove connection header per RFC2616. The client's keep-alive
+		// semantics are read by the fasthttp server before the handler runs,
+		// so stripping the header only affects the request to the backend.
+		stripRequestConnectionHeader(req, s.isHTTP10KeepAliveEnabled)
 		resp.Header.Del("Connection")
 
+		if s.pathValidator != nil {
+			if err := s.pathValidator.Validate(string(ctx.Path())); err != nil {
+				ctx.Logger().Printf("rejecting request with malformed path %q: %v", ctx.Path(), err)
+				writePlaceholderResponse(ctx, http.StatusBadRequest, "Malformed path!")
+				return
+			}
+		}
+
+		// Maintenance mode bypasses dimming and proxying entirely.
+		if atomic.LoadInt32(&s.isMaintenanceEnabled) == 1 {
+			writeMaintenanceResponse(ctx, atomic.LoadInt32(&s.maintenanceRetryAfterSeconds))
+			return
+		}
+
+		if s.isPerIPConcurrencyLimitEnabled {
+			clientIP := s.clientIPResolver.Resolve(ctx.RemoteIP(), string(req.Header.Peek("X-Forwarded-For")))
+			if !s.perIPConcurrencyLimiter.Acquire(clientIP) {
+				writePlaceholderResponse(ctx, http.StatusTooManyRequests, "Too many concurrent requests!")
+				return
+			}
+			defer s.perIPConcurrencyLimiter.Release(clientIP)
+		}
+
+		isDimmableRequest := s.dimming.RequestFilter.Matches(string(ctx.Path()), string(ctx.Method()), string(req.Header.Referer()), req.Header.Peek)
+
+		// The mode and the dimming percentage, which mode transitions reset,
+		// are read once under dimmingModeMux, so the request is decided with
+		// either the old mode and its state or the new mode and its state.
+		// The lock is released before the request is decided, as DimDeciders
+		// may call external services such as profilers, and a pending mode
+		// transition would otherwise block every new request until they
+		// return. The dimming percentage is only read if the request can be
+		// dimmed, eliminating its mutex overhead otherwise.
+		s.dimmingModeMux.RLock()
+		dimmingMode := s.dimmingMode
+		var dimmingPercentage float64
+		if isDimmableRequest || s.isContentTypeDimmingEnabled {
+			dimmingPercentage = s.dimming.ControlLoop.readDimmingPercentage()
+		}
+		s.dimmingModeMux.RUnlock()
+
 		// preResponseHook guarantees that modifications to the response within
 		// the hook will not be reset prior to the response returning. This is
 		// used as header modifications (e.g., setting dimming decision cookies)
 		// made before proxying will be reset during proxying.
 		var preResponseHook func()
+		setResponseCookie := func(cookie *fasthttp.Cookie) {
+			previousHook := preResponseHook
+			preResponseHook = func() {
+				if previousHook != nil {
+					previousHook()
+				}
+				resp.Header.SetCookie(cookie)
+			}
+		}
+
+		// responseTransformer is set if the request is dimmed but its
+		// component degrades by transforming the proxied response instead.
+		var responseTransformer filters.ResponseTransformer
 
 		// To actuate the PID output correctly during dimming, the proportion
 		// between low priority and high priority requests should be captured.
 		// This will ensure, for example, that high priority requests are dimmed
 		// when there are no low priority requests to dim.
-		if s.isProfilingEnabled && s.dimmingMode == DimmingWithProfiling &&
-			profiling.RequestHasPriorityLowOrHighCookie(req) &&
+		if s.isProfilingEnabled && dimmingMode == DimmingWithProfiling &&
+			s.profiling.RequestHasTierPriorityCookie(req) &&
 			strings.Contains(string(ctx.Path()), ".html") {
 			s.profiling.MarkProfiledRequestByPriorityCookie(req)
 		}
 
 		// If dimming or training mode is enabled, enforce dimming on dimmable
 		// components by returning a HTTP error page if a probability is met.
-		isDimmingEnabled := s.dimmingMode != Disabled
-		isDimmableRequest := s.dimming.RequestFilter.Matches(string(ctx.Path()), string(ctx.Method()), string(req.Header.Referer()))
-		if isDimmingEnabled && isDimmableRequest {
-			// If offline training is enabled, we always dim. shouldDim is
-			// nested inside an if statement instead of being top-level to
-			// eliminate the mutex overhead of reading the dimming percentage if
-			// the request is not dimmable.
-			shouldDim := s.dimmingMode == OfflineTraining ||
-				rand.Float64()*100 < s.dimming.ControlLoop.readDimmingPercentage()
-
-			// Profiled sessions which are dimmed as a result of their priority
-			// will have all optional components uniformly dimmed irrespective
-			// of path probabilities.
-			skipPathProbabilities := false
-
-			// Profiling should only occur when the session cookie is set.
-			if s.isProfilingEnabled && s.dimmingMode == DimmingWithProfiling &&
-				len(req.Header.Cookie(s.profilingSessionCookie)) != 0 {
-				if profiling.HasDimmingDecisionCookie(req) {
-					// If the session is dimmed as a result of its priority, we
-					// override the dimmer to always dim optional components.
-					skipPathProbabilities = true
-					shouldDim = profiling.ReadDimmingDecisionCookie(req)
-				} else if profiling.RequestHasPriorityLowOrHighCookie(req) {
-					// Sample a long-term dimming decision as the session has a
-					// priority profiled but its dimming decision has not been
-					// made. We use the current PID output to achieve
-					// responsiveness to changes in PID output, even if not
-					// instant due to the cookie expiry time.
-					dimmingDecision := rand.Float64()*100 < s.dimming.ControlLoop.readDimmingPercentage()*
-						s.profiling.DimmingDecisionProbabilityForPriorityCookie(req)
-
-					// Persist the dimming decision. We do not actuate dimming
-					// for the current request even if the dimming decision is
-					// true, as the response headers would otherwise be reset by
-					// the ctx.Error call below.
-					preResponseHook = func() {
-						resp.Header.SetCookie(profiling.CookieForDimmingDecision(dimmingDecision))
-					}
+		// Paths disabled at runtime are checked before any probability is
+		// looked up, so they are never dimmed whatever their probability.
+		isDimmingEnabled := dimmingMode != Disabled && !s.disabledPaths.Contains(string(ctx.Path()))
+		s.filterMatchCounter.Add(isDimmableRequest)
+		s.dimming.ControlLoop.recordRequest()
+		if isDimmingEnabled && s.dimmedRateCaps != nil {
+			s.dimmedRateCaps.AddRequest(string(ctx.Path()))
+		}
 
-					// Actuate the dimming decision for the current request.
-					skipPathProbabilities = dimmingDecision
-					shouldDim = shouldDim || dimmingDecision
-				}
-			}
+		// In shadow mode, the request is proxied regardless of the decision,
+		// which is reported along with the reason it was made so clients such
+		// as synthetic monitors can correlate decisions with user metrics.
+		isShadowMode := dimmingMode == ShadowDimming
+		wouldDim := false
+		wouldDimReason := wouldDimReasonNotDimmable
 
-			if !skipPathProbabilities {
-				// Ensure dimming is weighted according to path probabilities. Path
-				// probabilities are chosen according to whether the request is an
-				// online training candidate or not.
-				shouldUseOnlineTrainingCandidateGroupProbabilities :=
-					s.dimmingMode == DimmingWithOnlineTraining &&
-						onlinetraining.RequestHasCandidateCookie(req)
+		// Overload shedding takes precedence over the control loop, as
+		// latency-driven dimming cannot react to a failing backend whose
+		// requests fail fast.
+		isShed := isDimmingEnabled && isDimmableRequest &&
+			s.overloadProtector != nil && s.overloadProtector.SampleShouldShed()
+		if isShed && isShadowMode {
+			wouldDim = true
+			wouldDimReason = wouldDimReasonOverload
+		} else if isShed {
+			s.writeDimmedResponse(ctx)
+			return
+		}
 
-				if shouldUseOnlineTrainingCandidateGroupProbabilities {
-					shouldDim = shouldDim && s.onlineTraining.SampleCandidateGroupShouldDim(string(ctx.Path()))
-				} else {
-					shouldDim = shouldDim && s.dimming.PathProbabilities.SampleShouldDim(string(ctx.Path()))
-				}
-			}
+		if isDimmingEnabled && isDimmableRequest && !isShed {
+			shouldDim, reason := s.sampleShouldDim(ctx, dimmingMode, dimmingPercentage, setResponseCookie)
+			wouldDimReason = reason
+			s.recordDecision(ctx, shouldDim && !isShadowMode)
 
-			if shouldDim {
+			if shouldDim && isShadowMode {
+				wouldDim = true
+			} else if transformer, exists := s.lookupResponseTransformer(string(ctx.Path())); shouldDim && exists {
+				responseTransformer = transformer
+				// The body can only be transformed if it is not compressed.
+				req.Header.Del("Accept-Encoding")
+			} else if shouldDim {
 				if preResponseHook != nil {
 					preResponseHook()
 				}
-				ctx.SetStatusCode(http.StatusTooManyRequests)
-				ctx.SetBodyString("Dimming!")
+				s.writeDimmedResponse(ctx)
+				return
+			}
+		}
+
+		if s.isRequestDecompressionEnabled && isGzipEncoded(req) {
+			if err := decompressGzipRequestBody(req, s.maxRequestBodySize); errors.Is(err, errRequestBodyTooLarge) {
+				ctx.Logger().Printf("rejecting request with oversized gzip body: %v", err)
+				writePlaceholderResponse(ctx, http.StatusRequestEntityTooLarge, "Request body too large!")
+				return
+			} else if err != nil {
+				ctx.Logger().Printf("rejecting request with malformed gzip body: %v", err)
+				writePlaceholderResponse(ctx, http.StatusBadRequest, "Malformed gzip body!")
 				return
 			}
 		}
 
 		// Proxy the request, capturing the request time.
 		startTime := time.Now()
-		if err := s.proxying.proxy.Do(req, resp); err != nil {
+		// statusCode is captured before Content-Type dimming can replace the
+		// response, so online training compares backend errors only.
+		var statusCode int
+		if err := s.doBackendRequest(req, resp, deadline); errors.Is(err, fasthttp.ErrTimeout) {
+			ctx.Logger().Printf("backend request exceeded request timeout of %v", s.requestTimeout)
+			resp.Reset()
+			writePlaceholderResponse(ctx, http.StatusGatewayTimeout, "Gateway timeout!")
+			statusCode = http.StatusGatewayTimeout
+		} else if err != nil {
 			ctx.Logger().Printf("fasthttp: error when proxying the request: %v", err)
+			statusCode = http.StatusBadGateway
+			s.dimming.ControlLoop.recordBackendAvailability(false)
+		} else {
+			statusCode = resp.StatusCode()
+			s.dimming.ControlLoop.recordBackendAvailability(true)
 		}
+		// The backend's Connection header describes the connection between
+		// the dimmer and the backend, so it is not forwarded to the client.
+		// The fasthttp server then sets the client's Connection header
+		// according to the client's HTTP version and request.
+		resp.Header.Del("Connection")
 		duration := time.Now().Sub(startTime)
+		if s.overloadProtector != nil {
+			s.overloadProtector.Add(isBackendUnavailableStatusCode(statusCode) || s.overloadProtector.IsOverloadStatusCode(statusCode))
+		}
+
+		if responseTransformer != nil && statusCode >= 200 && statusCode < 300 {
+			s.transformResponse(ctx, responseTransformer)
+		}
+
+		// Content-Type dimming can only be decided once the response is known.
+		// Requests which were already decided before proxying are not decided
+		// again, as they would otherwise be dimmed with a compounded
+		// probability. The response is reset so backend headers such as
+		// Content-Encoding do not apply to the dimmed body.
+		if s.isContentTypeDimmingEnabled && isDimmingEnabled &&
+			!isDimmableRequest && responseTransformer == nil &&
+			s.contentTypeFilter.Matches(string(resp.Header.ContentType())) {
+			shouldDim, reason := s.sampleShouldDim(ctx, dimmingMode, dimmingPercentage, setResponseCookie)
+			wouldDimReason = reason
+			s.recordDecision(ctx, shouldDim && !isShadowMode)
+
+			if shouldDim && isShadowMode {
+				wouldDim = true
+			} else if shouldDim {
+				resp.Reset()
+				s.writeDimmedResponse(ctx)
+			}
+		}
+
+		// Proxied responses which could have been dimmed vary on the same
+		// headers as dimmed responses, so neither is served from a cache in
+		// place of the other.
+		if isDimmableRequest || s.isContentTypeDimmingEnabled {
+			s.addVaryHeaders(&resp.Header)
+		}
+
+		if isShadowMode {
+			resp.Header.Set("X-Would-Dim", strconv.FormatBool(wouldDim))
+			resp.Header.Set("X-Would-Dim-Reason", wouldDimReason)
+		}
 
 		if preResponseHook != nil {
 			preResponseHook()
@@ -313,37 +1099,44 @@ func (s *Server) requestHandler() fasthttp.RequestHandler {
 		// what the dimmer would do if enabled. Static .html files are excluded
 		// from the control loop as these cache-able files cause bias.
 		if !strings.Contains(string(ctx.Path()), ".html") {
-			s.dimming.ControlLoop.addResponseTime(duration)
+			if !s.excludedStatusCodes[statusCode] &&
+				(s.controlSignalFilter == nil ||
+					s.controlSignalFilter.Matches(string(ctx.Path()), string(ctx.Method()), string(req.Header.Referer()), req.Header.Peek)) {
+				s.dimming.ControlLoop.addResponseTime(duration)
+				s.dimming.ControlLoop.addPathResponseTime(string(ctx.Path()), duration)
+			} else {
+				s.dimming.ControlLoop.addObservedResponseTime(duration)
+			}
 
-			if s.dimmingMode == OfflineTraining {
+			if dimmingMode == OfflineTraining {
 				s.offlineTraining.AddResponseTime(duration)
 			}
 
-			if s.dimmingMode == DimmingWithOnlineTraining &&
-				onlinetraining.RequestHasCookie(req) {
-				if onlinetraining.RequestHasCandidateCookie(req) {
-					s.onlineTraining.AddCandidateResponseTime(duration)
+			if dimmingMode == DimmingWithOnlineTraining &&
+				s.onlineTraining.RequestHasCookie(req) {
+				if candidateGroup, isCandidate := s.onlineTraining.CandidateGroup(req); isCandidate {
+					s.onlineTraining.AddCandidateResponse(candidateGroup, duration, statusCode)
 				} else {
-					s.onlineTraining.AddControlResponseTime(duration)
+					s.onlineTraining.AddControlResponse(duration, statusCode)
 				}
 			}
 		}
 
 		// If profiling is enabled, save the request for further profiling and
 		// set appropriate profiling cookies if none exist.
-		if s.isProfilingEnabled && s.dimmingMode == DimmingWithProfiling &&
+		if s.isProfilingEnabled && dimmingMode == DimmingWithProfiling &&
 			len(req.Header.Cookie(s.profilingSessionCookie)) != 0 {
 			s.profiling.Requests.Write(string(req.Header.Cookie(s.profilingSessionCookie)), string(ctx.Method()), string(ctx.Path()))
 
 			// Fetch the session's priority if it does not have a priority set.
-			if !profiling.RequestHasPriorityCookie(req) &&
+			if !s.profiling.RequestHasPriorityCookie(req) &&
 				strings.Contains(string(ctx.Path()), ".html") {
 				sessionID := string(req.Header.Cookie(s.profilingSessionCookie))
 				priority, err := s.profiling.Priorities.Fetch(sessionID)
 				if err != nil {
 					log.Printf("could not fetch priority for sessionID = %s due to err %s", sessionID, err)
 				} else {
-					resp.Header.SetCookie(profiling.CookieForPriority(priority))
+					resp.Header.SetCookie(s.profiling.CookieForPriority(priority))
 
 					// Profiler implementations may require a push to an external
 					// service profile unknown sessions.
@@ -358,10 +1151,340 @@ func (s *Server) requestHandler() fasthttp.RequestHandler {
 		// restriction did not exist, a cookie could be sampled several
 		// times for each of the API requests associated with a single
 		// page, despite the user only visiting one page.
-		if s.dimmingMode == DimmingWithOnlineTraining &&
+		if dimmingMode == DimmingWithOnlineTraining &&
 			strings.Contains(string(ctx.Path()), ".html") &&
-			!onlinetraining.RequestHasCookie(req) {
-			resp.Header.SetCookie(onlinetraining.SampleCookie())
+			!s.onlineTraining.RequestHasCookie(req) {
+			resp.Header.SetCookie(s.onlineTraining.SampleCookie())
+		}
+	}
+}
+
+// doBackendRequest proxies the request to the backend, abandoning it with
+// fasthttp.ErrTimeout once deadline passes. A zero deadline disables the
+// timeout.
+func (s *Server) doBackendRequest(req *fasthttp.Request, resp *fasthttp.Response, deadline time.Time) error {
+	// Requests received over TLS have the https scheme, which the plaintext
+	// backend client rejects.
+	req.URI().SetScheme("http")
+	if deadline.IsZero() {
+		return s.proxying.proxy.Do(req, resp)
+	}
+	return s.proxying.proxy.DoDeadline(req, resp, deadline)
+}
+
+// methodMultiplier returns the multiplier applied to path probabilities for
+// requests with the given method.
+func (s *Server) methodMultiplier(method string) float64 {
+	if s.methodMultipliers == nil {
+		return 1
+	}
+	return s.methodMultipliers.Get(method)
+}
+
+// isBackendUnavailableStatusCode returns true if the status code indicates the
+// backend is unreachable or overloaded rather than an application error.
+func isBackendUnavailableStatusCode(statusCode int) bool {
+	return statusCode == http.StatusBadGateway ||
+		statusCode == http.StatusServiceUnavailable ||
+		statusCode == http.StatusGatewayTimeout
+}
+
+// sampleShouldDim decides whether to dim the request using the DimDecider,
+// path probabilities, rate caps and dimming budgets, returning the reason for
+// the decision. Path probabilities are chosen according to whether the request
+// is in an online training candidate group or not. dimmingMode and
+// dimmingPercentage must have been read together under dimmingModeMux, which
+// must not be held as the DimDecider may block.
+func (s *Server) sampleShouldDim(ctx *fasthttp.RequestCtx, dimmingMode DimmingMode, dimmingPercentage float64, setResponseCookie func(cookie *fasthttp.Cookie)) (bool, string) {
+	req := &ctx.Request
+
+	shouldDim, skipPathProbabilities := s.dimDecider.ShouldDim(RequestInfo{
+		Path:              string(ctx.Path()),
+		Method:            string(ctx.Method()),
+		Referer:           string(req.Header.Referer()),
+		DimmingMode:       dimmingMode,
+		Request:           req,
+		SetResponseCookie: setResponseCookie,
+	}, dimmingPercentage)
+	if !shouldDim {
+		return false, wouldDimReasonController
+	}
+
+	if !skipPathProbabilities {
+		var candidateGroup int
+		shouldUseOnlineTrainingCandidateGroupProbabilities := false
+		if dimmingMode == DimmingWithOnlineTraining {
+			candidateGroup, shouldUseOnlineTrainingCandidateGroupProbabilities = s.onlineTraining.CandidateGroup(req)
+		}
+
+		methodMultiplier := s.methodMultiplier(string(ctx.Method()))
+		if shouldUseOnlineTrainingCandidateGroupProbabilities {
+			shouldDim = s.onlineTraining.SampleCandidateGroupShouldDim(candidateGroup, string(ctx.Path()), methodMultiplier)
+		} else {
+			shouldDim = s.dimming.PathProbabilities.SampleShouldDimWithMultiplier(string(ctx.Path()), methodMultiplier)
+		}
+		if !shouldDim {
+			return false, wouldDimReasonPathProbability
+		}
+	}
+
+	// The rate cap is checked before the budget, as the budget is consumed if
+	// the request is within it. A dim refused by the budget still counts
+	// towards the rate cap, erring on the side of the cap.
+	if !s.isWithinDimmedRateCap(ctx) {
+		return false, wouldDimReasonRateCap
+	}
+	if !s.isWithinDimmingBudget(ctx) {
+		return false, wouldDimReasonBudget
+	}
+	return true, wouldDimReasonDimmed
+}
+
+// isWithinDimmedRateCap returns true if dimming the request does not exceed
+// the dimmed rate cap of its path, recording the request as dimmed if so. It
+// must only be called once a request would otherwise be dimmed.
+func (s *Server) isWithinDimmedRateCap(ctx *fasthttp.RequestCtx) bool {
+	if s.dimmedRateCaps == nil {
+		return true
+	}
+	return s.dimmedRateCaps.TryDim(string(ctx.Path()))
+}
+
+// recordDecision exports the dimming decision for a dimmable request to the
+// decision sink, if set.
+func (s *Server) recordDecision(ctx *fasthttp.RequestCtx, isDimmed bool) {
+	if s.decisionSink == nil {
+		return
+	}
+	s.decisionSink.Record(logging.Decision{
+		Timestamp: time.Now(),
+		SessionID: string(ctx.Request.Header.Cookie(s.profilingSessionCookie)),
+		Method:    string(ctx.Method()),
+		Path:      string(ctx.Path()),
+		IsDimmed:  isDimmed,
+	})
+}
+
+// isWithinDimmingBudget returns true if dimming the request does not exceed
+// the session's dimming budget, consuming the budget if so. It must only be
+// called once a request would otherwise be dimmed. Requests without a session
+// cookie cannot be coordinated and are always within budget.
+func (s *Server) isWithinDimmingBudget(ctx *fasthttp.RequestCtx) bool {
+	if !s.isDimmingBudgetEnabled {
+		return true
+	}
+
+	sessionID := ctx.Request.Header.Cookie(s.profilingSessionCookie)
+	if len(sessionID) == 0 {
+		return true
+	}
+	return s.dimmingBudget.Allow(string(sessionID), string(ctx.Path()))
+}
+
+// writeDimmedResponse sets the response returned in place of a dimmed
+// component.
+func (s *Server) writeDimmedResponse(ctx *fasthttp.RequestCtx) {
+	if s.isControlStateHeadersEnabled {
+		s.setControlStateHeaders(ctx)
+	}
+	s.addVaryHeaders(&ctx.Response.Header)
+
+	response := s.dimResponse
+	if pathResponse, exists := s.lookupDimmedResponse(string(ctx.Path())); exists {
+		response = pathResponse
+	} else if s.navigationRedirectURL != nil && isNavigationRequest(&ctx.Request) {
+		ctx.SetStatusCode(s.navigationRedirectStatusCode)
+		ctx.Response.Header.Set("Location", s.navigationRedirectLocation(ctx))
+		return
+	} else if s.dimRedirectURL != "" {
+		ctx.SetStatusCode(http.StatusFound)
+		ctx.Response.Header.Set("Location", s.dimRedirectURL)
+		return
+	}
+
+	writePlaceholderResponse(ctx, response.StatusCode, response.Body)
+	if response.ContentType != "" {
+		ctx.SetContentType(response.ContentType)
+	}
+	// Retry-After is only meaningful for responses asking clients to retry,
+	// not for components which degrade silently with a 200.
+	isRetryable := response.StatusCode == http.StatusTooManyRequests || response.StatusCode == http.StatusServiceUnavailable
+	if s.dimRetryAfterBaseSeconds > 0 && isRetryable {
+		ctx.Response.Header.Set("Retry-After", strconv.Itoa(s.retryAfterSeconds()))
+	}
+}
+
+// addVaryHeaders merges varyHeaders into the Vary header, keeping any values
+// already set, e.g. by the backend. A Vary of * already varies on all headers
+// so is left unchanged.
+func (s *Server) addVaryHeaders(header *fasthttp.ResponseHeader) {
+	if len(s.varyHeaders) == 0 {
+		return
+	}
+
+	vary := strings.TrimSpace(string(header.Peek("Vary")))
+	if vary == "*" {
+		return
+	}
+	for _, name := range s.varyHeaders {
+		if varyContains(vary, name) {
+			continue
+		}
+		if vary != "" {
+			vary += ", "
+		}
+		vary += name
+	}
+	header.Set("Vary", vary)
+}
+
+// varyContains returns true if the comma-separated Vary value contains the
+// header name, which is case-insensitive.
+func varyContains(vary string, name string) bool {
+	for _, existing := range strings.Split(vary, ",") {
+		if strings.EqualFold(strings.TrimSpace(existing), name) {
+			return true
 		}
 	}
+	return false
+}
+
+// isNavigationRequest returns true if the request is a top-level navigation,
+// i.e. its Sec-Fetch-Mode is navigate, or for browsers which do not send
+// Sec-Fetch-Mode, it accepts text/html.
+func isNavigationRequest(req *fasthttp.Request) bool {
+	if string(req.Header.Peek("Sec-Fetch-Mode")) == "navigate" {
+		return true
+	}
+	return strings.Contains(string(req.Header.Peek("Accept")), "text/html")
+}
+
+// navigationRedirectLocation returns navigationRedirectURL with the request
+// path set as the navigationRedirectPathParam query parameter.
+func (s *Server) navigationRedirectLocation(ctx *fasthttp.RequestCtx) string {
+	location := *s.navigationRedirectURL
+	query := location.Query()
+	query.Set(s.navigationRedirectPathParam, string(ctx.Path()))
+	location.RawQuery = query.Encode()
+	return location.String()
+}
+
+// setControlStateHeaders sets the control loop's setpoint, input and dimming
+// percentage on the response. The input is in the setpoint's unit, so clients
+// can compare the two whichever percentiles drive the control loop.
+func (s *Server) setControlStateHeaders(ctx *fasthttp.RequestCtx) {
+	setpoint, input := s.dimming.ControlLoop.readSetpointAndInput()
+	ctx.Response.Header.Set("X-Dimmer-Setpoint", strconv.FormatFloat(setpoint, 'f', -1, 64))
+	ctx.Response.Header.Set("X-Dimmer-Input", strconv.FormatFloat(input, 'f', -1, 64))
+	ctx.Response.Header.Set("X-Dimmer-Output", strconv.FormatFloat(s.dimming.ControlLoop.readDimmingPercentage(), 'f', -1, 64))
+}
+
+// retryAfterSeconds returns the suggested delay before retrying a dimmed
+// request, rising linearly from the base delay at 0% dimming to
+// retryAfterMaxMultiplier times the base delay at 100% dimming. The delay is
+// rounded up to whole seconds as required by Retry-After.
+func (s *Server) retryAfterSeconds() int {
+	percentage := math.Max(0, math.Min(100, s.dimming.ControlLoop.readDimmingPercentage()))
+	multiplier := 1 + (retryAfterMaxMultiplier-1)*percentage/100
+	return int(math.Ceil(s.dimRetryAfterBaseSeconds * multiplier))
+}
+
+// lookupResponseTransformer returns the response transformer of the component
+// at path, or false if the component has none.
+func (s *Server) lookupResponseTransformer(path string) (filters.ResponseTransformer, bool) {
+	if s.responseTransformers == nil {
+		return nil, false
+	}
+	return s.responseTransformers.Lookup(path)
+}
+
+// transformResponse replaces the proxied response body with the body
+// transformed by transformer. The response is left unchanged if it is
+// compressed or cannot be transformed, e.g. it is not the expected JSON.
+func (s *Server) transformResponse(ctx *fasthttp.RequestCtx, transformer filters.ResponseTransformer) {
+	if len(ctx.Response.Header.Peek("Content-Encoding")) != 0 {
+		ctx.Logger().Printf("not transforming response as it is encoded with %s", ctx.Response.Header.Peek("Content-Encoding"))
+		return
+	}
+
+	body, err := transformer.Transform(ctx.Response.Body())
+	if err != nil {
+		ctx.Logger().Printf("not transforming response: %v", err)
+		return
+	}
+	ctx.Response.SetBody(body)
+}
+
+// lookupDimmedResponse returns the dimmed response of the component at path,
+// or false if the component has none.
+func (s *Server) lookupDimmedResponse(path string) (filters.DimmedResponse, bool) {
+	if s.dimmedResponses == nil {
+		return filters.DimmedResponse{}, false
+	}
+	return s.dimmedResponses.Lookup(path)
+}
+
+// stripRequestConnectionHeader removes the hop-by-hop Connection header from
+// a request before proxying. If isHTTP10KeepAliveEnabled, an HTTP/1.0 request
+// which explicitly requests keep-alive retains Connection: keep-alive, as
+// HTTP/1.0 connections are otherwise not persistent.
+func stripRequestConnectionHeader(req *fasthttp.Request, isHTTP10KeepAliveEnabled bool) {
+	// fasthttp marks HTTP/1.0 requests without Connection: keep-alive as
+	// closing the connection when parsing.
+	isHTTP10KeepAlive := !req.Header.IsHTTP11() && !req.Header.ConnectionClose()
+	req.Header.Del("Connection")
+	if isHTTP10KeepAliveEnabled && isHTTP10KeepAlive {
+		req.Header.Set("Connection", "keep-alive")
+	}
+}
+
+// isGzipEncoded returns true if the request body has a Content-Encoding of
+// gzip. Bodies with multiple encodings are not matched, as the backend must
+// then support the remaining encodings regardless.
+func isGzipEncoded(req *fasthttp.Request) bool {
+	encoding := strings.ToLower(strings.TrimSpace(string(req.Header.Peek("Content-Encoding"))))
+	return encoding == "gzip" || encoding == "x-gzip"
+}
+
+// errRequestBodyTooLarge is returned by decompressGzipRequestBody if the
+// decompressed body exceeds the maximum request body size.
+var errRequestBodyTooLarge = errors.New("request body too large")
+
+// decompressGzipRequestBody replaces a gzip-encoded request body with its
+// decompressed contents and removes the Content-Encoding header. The
+// Content-Length header is set from the new body when proxying. At most
+// maxSize bytes are decompressed, so a small gzip bomb cannot exhaust memory.
+func decompressGzipRequestBody(req *fasthttp.Request, maxSize int) error {
+	r, err := gzip.NewReader(bytes.NewReader(req.Body()))
+	if err != nil {
+		return fmt.Errorf("expected gzip.NewReader() returns nil err; got err = %w", err)
+	}
+	defer r.Close()
+
+	// One byte beyond maxSize is read to detect bodies which exceed it.
+	body, err := ioutil.ReadAll(io.LimitReader(r, int64(maxSize)+1))
+	if err != nil {
+		return fmt.Errorf("expected gzip body to decompress with nil err; got err = %w", err)
+	}
+	if len(body) > maxSize {
+		return fmt.Errorf("expected gzip body to decompress to at most %d bytes: %w", maxSize, errRequestBodyTooLarge)
+	}
+	req.SetBody(body)
+	req.Header.Del("Content-Encoding")
+	return nil
+}
+
+// writeMaintenanceResponse sets the response returned for all requests in
+// maintenance mode. Retry-After is only set if retryAfterSeconds is positive.
+func writeMaintenanceResponse(ctx *fasthttp.RequestCtx, retryAfterSeconds int32) {
+	writePlaceholderResponse(ctx, http.StatusServiceUnavailable, "Maintenance!")
+	if retryAfterSeconds > 0 {
+		ctx.Response.Header.Set("Retry-After", strconv.Itoa(int(retryAfterSeconds)))
+	}
+}
+
+// writePlaceholderResponse sets a response returned without proxying.
+func writePlaceholderResponse(ctx *fasthttp.RequestCtx, statusCode int, body string) {
+	ctx.SetStatusCode(statusCode)
+	ctx.SetBodyString(body)
 }
@@ -0,0 +1,1074 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kcz17/dimmer/filters"
+	"github.com/kcz17/dimmer/logging"
+	"github.com/kcz17/dimmer/offlinetraining"
+	"github.com/kcz17/dimmer/onlinetraining"
+	"github.com/kcz17/dimmer/responsetimecollector"
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+// newTestServerWithBackend returns a Server which dims GET /path and proxies
+// to an in-memory backend which always responds with 202 Accepted.
+func newTestServerWithBackend(t *testing.T, decider DimDecider) *Server {
+	controlLoop, err := NewServerControlLoop(&ServerControlLoopOptions{
+		Logger:                        logging.NewNoopLogger(),
+		PID:                           newTestPIDController(t),
+		ResponseTimeCollector:         responsetimecollector.NewArrayCollector(),
+		ResponseTimePercentileWeights: map[string]float64{P95: 1},
+	})
+	assert.Nilf(t, err, "expected NewServerControlLoop(...) has no err; got %v", err)
+	pathProbabilities, err := filters.NewPathProbabilities(1)
+	assert.Nilf(t, err, "expected NewPathProbabilities(...) has no err; got %v", err)
+	requestFilter := filters.NewRequestFilter(filters.FilterModeAllowlist, 0)
+	requestFilter.AddPath("/path", http.MethodGet)
+
+	s := NewServer(&ServerOptions{
+		ControlLoop:       controlLoop,
+		RequestFilter:     requestFilter,
+		PathProbabilities: pathProbabilities,
+		IsDimmingEnabled:  true,
+		DimDecider:        decider,
+	})
+
+	ln := fasthttputil.NewInmemoryListener()
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		_ = fasthttp.Serve(ln, func(ctx *fasthttp.RequestCtx) {
+			ctx.SetStatusCode(http.StatusAccepted)
+		})
+	}()
+	s.proxying.proxy = &fasthttp.HostClient{
+		Addr: "backend",
+		Dial: func(string) (net.Conn, error) { return ln.Dial() },
+	}
+
+	return s
+}
+
+// newTestRequestCtx returns an initialised RequestCtx, which is required for
+// its logger to be used.
+func newTestRequestCtx(method string, uri string) *fasthttp.RequestCtx {
+	req := &fasthttp.Request{}
+	req.Header.SetMethod(method)
+	req.SetRequestURI(uri)
+	req.Header.SetHost("dimmer")
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Init(req, nil, nil)
+	return ctx
+}
+
+func TestServer_requestHandler_ShadowDimmingReportsDecision(t *testing.T) {
+	s := newTestServerWithBackend(t, &alwaysDimDecider{})
+	s.dimmingMode = ShadowDimming
+
+	tests := []struct {
+		name       string
+		path       string
+		wantDim    string
+		wantReason string
+	}{
+		{name: "Dimmable request", path: "/path", wantDim: "true", wantReason: wouldDimReasonDimmed},
+		{name: "Request not matching filter", path: "/other", wantDim: "false", wantReason: wouldDimReasonNotDimmable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := newTestRequestCtx(http.MethodGet, tt.path)
+			s.requestHandler()(ctx)
+
+			// The request is proxied regardless of the decision.
+			assert.Equal(t, http.StatusAccepted, ctx.Response.StatusCode())
+			assert.Equal(t, tt.wantDim, string(ctx.Response.Header.Peek("X-Would-Dim")))
+			assert.Equal(t, tt.wantReason, string(ctx.Response.Header.Peek("X-Would-Dim-Reason")))
+		})
+	}
+}
+
+func TestServer_requestHandler_NoWouldDimHeaderOutsideShadowDimming(t *testing.T) {
+	s := newTestServerWithBackend(t, &alwaysDimDecider{})
+
+	ctx := newTestRequestCtx(http.MethodGet, "/other")
+	s.requestHandler()(ctx)
+
+	assert.Equal(t, http.StatusAccepted, ctx.Response.StatusCode())
+	assert.Empty(t, ctx.Response.Header.Peek("X-Would-Dim"))
+}
+
+func TestServer_requestHandler_DimmedRateCap(t *testing.T) {
+	s := newTestServerWithBackend(t, &alwaysDimDecider{})
+	caps, err := filters.NewDimmedRateCaps(time.Minute)
+	assert.Nil(t, err)
+	assert.Nil(t, caps.SetCap("/path", 0.25))
+	s.dimmedRateCaps = caps
+
+	dimmed := 0
+	for i := 0; i < 20; i++ {
+		ctx := newTestRequestCtx(http.MethodGet, "/path")
+		s.requestHandler()(ctx)
+		if ctx.Response.StatusCode() != http.StatusAccepted {
+			dimmed++
+		}
+	}
+	assert.Equal(t, 5, dimmed)
+}
+
+func TestServer_requestHandler_HeaderExclusion(t *testing.T) {
+	s := newTestServerWithBackend(t, &alwaysDimDecider{})
+	assert.Nil(t, s.dimming.RequestFilter.AddHeaderExclusion("/path", http.MethodGet, "X-Client-Type", "mobile"))
+
+	ctx := newTestRequestCtx(http.MethodGet, "/path")
+	ctx.Request.Header.Set("x-client-type", "mobile")
+	s.requestHandler()(ctx)
+	assert.Equal(t, http.StatusAccepted, ctx.Response.StatusCode())
+
+	ctx = newTestRequestCtx(http.MethodGet, "/path")
+	ctx.Request.Header.Set("X-Client-Type", "desktop")
+	s.requestHandler()(ctx)
+	assert.NotEqual(t, http.StatusAccepted, ctx.Response.StatusCode())
+}
+
+// pathProbabilitiesDimDecider dims every request subject to path
+// probabilities.
+type pathProbabilitiesDimDecider struct{}
+
+func (pathProbabilitiesDimDecider) ShouldDim(RequestInfo, float64) (bool, bool) {
+	return true, false
+}
+
+func TestServer_requestHandler_MethodMultipliersScalePathProbabilities(t *testing.T) {
+	s := newTestServerWithBackend(t, pathProbabilitiesDimDecider{})
+	s.dimming.RequestFilter.AddPath("/path", http.MethodPost)
+	methodMultipliers, err := filters.NewMethodMultipliers(map[string]float64{"post": 0})
+	assert.Nilf(t, err, "expected NewMethodMultipliers(...) has no err; got %v", err)
+	s.methodMultipliers = methodMultipliers
+
+	// The path probability is 1, so GET requests are always dimmed while POST
+	// requests are never dimmed.
+	ctx := newTestRequestCtx(http.MethodGet, "/path")
+	s.requestHandler()(ctx)
+	assert.Equal(t, http.StatusTooManyRequests, ctx.Response.StatusCode())
+
+	ctx = newTestRequestCtx(http.MethodPost, "/path")
+	s.requestHandler()(ctx)
+	assert.Equal(t, http.StatusAccepted, ctx.Response.StatusCode())
+}
+
+// recordingDecisionSink records decisions in memory.
+type recordingDecisionSink struct {
+	decisions []logging.Decision
+}
+
+func (s *recordingDecisionSink) Record(decision logging.Decision) {
+	s.decisions = append(s.decisions, decision)
+}
+
+// recordingEventSink records events in memory.
+type recordingEventSink struct {
+	events []logging.Event
+}
+
+func (s *recordingEventSink) Publish(event logging.Event) {
+	s.events = append(s.events, event)
+}
+
+func TestServer_SetDimmingMode_PublishesEvent(t *testing.T) {
+	s := newTestServerWithBackend(t, &neverDimDecider{})
+	s.offlineTraining = offlinetraining.NewOfflineTraining()
+	sink := &recordingEventSink{}
+	s.eventSink = sink
+	assert.Nil(t, s.dimming.ControlLoop.Start())
+	t.Cleanup(func() { _ = s.dimming.ControlLoop.Stop() })
+	s.isStarted = true
+
+	assert.Nil(t, s.SetDimmingMode(Dimming))
+	assert.Nil(t, s.SetDimmingMode(ShadowDimming))
+
+	if assert.Len(t, sink.events, 2) {
+		assert.Equal(t, logging.EventDimmingModeChanged, sink.events[1].Type)
+		assert.Equal(t, map[string]interface{}{"from": "Dimming", "to": "ShadowDimming"}, sink.events[1].Attributes)
+	}
+}
+
+func TestServer_requestHandler_RecordsDecisionsForDimmableRequests(t *testing.T) {
+	s := newTestServerWithBackend(t, &alwaysDimDecider{})
+	s.profilingSessionCookie = "SESSION"
+	sink := &recordingDecisionSink{}
+	s.decisionSink = sink
+
+	ctx := newTestRequestCtx(http.MethodGet, "/path")
+	ctx.Request.Header.SetCookie("SESSION", "abc")
+	s.requestHandler()(ctx)
+	s.requestHandler()(newTestRequestCtx(http.MethodGet, "/other"))
+
+	assert.Len(t, sink.decisions, 1)
+	assert.Equal(t, "abc", sink.decisions[0].SessionID)
+	assert.Equal(t, "/path", sink.decisions[0].Path)
+	assert.True(t, sink.decisions[0].IsDimmed)
+}
+
+func TestServer_requestHandler_DimsByResponseContentType(t *testing.T) {
+	s := newTestServerWithBackend(t, pathProbabilitiesDimDecider{})
+	s.isContentTypeDimmingEnabled = true
+	s.contentTypeFilter = filters.NewContentTypeFilter([]string{"image/"})
+	s.dimming.ControlLoop.setDimmingPercentage(100)
+
+	// The backend responds with the Content-Type requested in the query.
+	ln := fasthttputil.NewInmemoryListener()
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		_ = fasthttp.Serve(ln, func(ctx *fasthttp.RequestCtx) {
+			ctx.SetContentType(string(ctx.QueryArgs().Peek("type")))
+			ctx.Response.Header.Set("Content-Encoding", "identity")
+			ctx.SetStatusCode(http.StatusOK)
+			ctx.SetBodyString("backend")
+		})
+	}()
+	s.proxying.proxy = &fasthttp.HostClient{
+		Addr: "backend",
+		Dial: func(string) (net.Conn, error) { return ln.Dial() },
+	}
+
+	tests := []struct {
+		name           string
+		mode           DimmingMode
+		contentType    string
+		wantStatusCode int
+		wantWouldDim   string
+	}{
+		{name: "Matching Content-Type is dimmed", mode: Dimming, contentType: "image/png", wantStatusCode: http.StatusTooManyRequests},
+		{name: "Non-matching Content-Type is proxied", mode: Dimming, contentType: "text/html", wantStatusCode: http.StatusOK},
+		{name: "Matching Content-Type is proxied if dimming is disabled", mode: Disabled, contentType: "image/png", wantStatusCode: http.StatusOK},
+		{name: "Matching Content-Type is reported in shadow dimming", mode: ShadowDimming, contentType: "image/png", wantStatusCode: http.StatusOK, wantWouldDim: "true"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s.dimmingMode = tt.mode
+
+			ctx := newTestRequestCtx(http.MethodGet, "/other?type="+tt.contentType)
+			s.requestHandler()(ctx)
+
+			assert.Equal(t, tt.wantStatusCode, ctx.Response.StatusCode())
+			assert.Equal(t, tt.wantWouldDim, string(ctx.Response.Header.Peek("X-Would-Dim")))
+			if tt.wantStatusCode == http.StatusTooManyRequests {
+				// Backend headers do not apply to the dimmed body.
+				assert.Empty(t, ctx.Response.Header.Peek("Content-Encoding"))
+				assert.NotEqual(t, "backend", string(ctx.Response.Body()))
+			} else {
+				assert.Equal(t, "backend", string(ctx.Response.Body()))
+			}
+		})
+	}
+}
+
+func TestServer_requestHandler_RecordsContentTypeDimmingDecisions(t *testing.T) {
+	s := newTestServerWithBackend(t, pathProbabilitiesDimDecider{})
+	s.isContentTypeDimmingEnabled = true
+	s.contentTypeFilter = filters.NewContentTypeFilter([]string{"text/plain"})
+	s.dimming.ControlLoop.setDimmingPercentage(100)
+	sink := &recordingDecisionSink{}
+	s.decisionSink = sink
+
+	ctx := newTestRequestCtx(http.MethodGet, "/other")
+	s.requestHandler()(ctx)
+
+	assert.Equal(t, http.StatusTooManyRequests, ctx.Response.StatusCode())
+	if assert.Len(t, sink.decisions, 1) {
+		assert.Equal(t, "/other", sink.decisions[0].Path)
+		assert.True(t, sink.decisions[0].IsDimmed)
+	}
+}
+
+// countingDimDecider counts its decisions, never dimming.
+type countingDimDecider struct {
+	decisions int32
+}
+
+func (d *countingDimDecider) ShouldDim(RequestInfo, float64) (bool, bool) {
+	atomic.AddInt32(&d.decisions, 1)
+	return false, true
+}
+
+func TestServer_requestHandler_ContentTypeDimmingSkipsRequestsDecidedBeforeProxying(t *testing.T) {
+	decider := &countingDimDecider{}
+	s := newTestServerWithBackend(t, decider)
+	s.isContentTypeDimmingEnabled = true
+	s.contentTypeFilter = filters.NewContentTypeFilter([]string{"text/plain"})
+	sink := &recordingDecisionSink{}
+	s.decisionSink = sink
+
+	// /path is matched by the RequestFilter and the backend responds with a
+	// matching Content-Type, so it would be decided twice if Content-Type
+	// dimming did not skip it.
+	ctx := newTestRequestCtx(http.MethodGet, "/path")
+	s.requestHandler()(ctx)
+
+	assert.Equal(t, http.StatusAccepted, ctx.Response.StatusCode())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&decider.decisions))
+	if assert.Len(t, sink.decisions, 1) {
+		assert.False(t, sink.decisions[0].IsDimmed)
+	}
+}
+
+func TestServer_requestHandler_ContentTypeDimmingUsesCandidateGroupProbabilities(t *testing.T) {
+	s := newTestServerWithBackend(t, pathProbabilitiesDimDecider{})
+	s.isContentTypeDimmingEnabled = true
+	s.contentTypeFilter = filters.NewContentTypeFilter([]string{"text/plain"})
+	s.dimmingMode = DimmingWithOnlineTraining
+
+	// Candidate groups start with the control probabilities, so the control
+	// probability is raised once the candidate groups are created.
+	assert.Nil(t, s.dimming.PathProbabilities.Set(filters.PathProbabilityRule{Path: "/other", Probability: 0}))
+	onlineTraining, err := onlinetraining.NewOnlineTraining(logging.NewNoopLogger(), []string{"/other"}, s.dimming.PathProbabilities, 1, onlinetraining.Options{})
+	assert.Nilf(t, err, "expected NewOnlineTraining(...) has no err; got %v", err)
+	s.onlineTraining = onlineTraining
+	assert.Nil(t, s.dimming.PathProbabilities.Set(filters.PathProbabilityRule{Path: "/other", Probability: 1}))
+
+	tests := []struct {
+		name           string
+		cookie         string
+		wantStatusCode int
+	}{
+		{name: "Control group uses control probabilities", cookie: "CONTROL", wantStatusCode: http.StatusTooManyRequests},
+		{name: "Candidate group uses candidate probabilities", cookie: "CANDIDATE", wantStatusCode: http.StatusAccepted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := newTestRequestCtx(http.MethodGet, "/other")
+			ctx.Request.Header.SetCookie(onlinetraining.DefaultCookieName, tt.cookie)
+			s.requestHandler()(ctx)
+
+			assert.Equal(t, tt.wantStatusCode, ctx.Response.StatusCode())
+		})
+	}
+}
+
+func TestServer_requestHandler_ReturnsPerPathDimmedResponse(t *testing.T) {
+	s := newTestServerWithBackend(t, &alwaysDimDecider{})
+	s.dimming.RequestFilter.AddPath("/list", http.MethodGet)
+	dimmedResponses, err := filters.NewDimmedResponses(defaultDimmedResponse, map[string]filters.DimmedResponse{
+		"/list": {StatusCode: http.StatusOK, Body: "[]", ContentType: "application/json"},
+	})
+	assert.Nilf(t, err, "expected NewDimmedResponses(...) has no err; got %v", err)
+	s.dimmedResponses = dimmedResponses
+
+	ctx := newTestRequestCtx(http.MethodGet, "/list")
+	s.requestHandler()(ctx)
+	assert.Equal(t, http.StatusOK, ctx.Response.StatusCode())
+	assert.Equal(t, "[]", string(ctx.Response.Body()))
+	assert.Equal(t, "application/json", string(ctx.Response.Header.ContentType()))
+
+	ctx = newTestRequestCtx(http.MethodGet, "/path")
+	s.requestHandler()(ctx)
+	assert.Equal(t, http.StatusTooManyRequests, ctx.Response.StatusCode())
+	assert.Equal(t, "Dimming!", string(ctx.Response.Body()))
+}
+
+func TestServer_requestHandler_TransformsDimmedResponses(t *testing.T) {
+	s := newTestServerWithBackend(t, &alwaysDimDecider{})
+	s.dimming.RequestFilter.AddPath("/recommendations", http.MethodGet)
+	truncator, err := filters.NewJSONArrayTruncator(2)
+	assert.Nil(t, err)
+	responseTransformers, err := filters.NewResponseTransformers(map[string]filters.ResponseTransformer{
+		"/recommendations": truncator,
+	})
+	assert.Nil(t, err)
+	s.responseTransformers = responseTransformers
+
+	// The backend returns a JSON array and echoes the Accept-Encoding it
+	// receives.
+	ln := fasthttputil.NewInmemoryListener()
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		_ = fasthttp.Serve(ln, func(ctx *fasthttp.RequestCtx) {
+			ctx.Response.Header.Set("X-Received-Accept-Encoding", string(ctx.Request.Header.Peek("Accept-Encoding")))
+			ctx.SetContentType("application/json")
+			ctx.SetBodyString(`[{"id":1},{"id":2},{"id":3}]`)
+		})
+	}()
+	s.proxying.proxy = &fasthttp.HostClient{
+		Addr: "backend",
+		Dial: func(string) (net.Conn, error) { return ln.Dial() },
+	}
+
+	ctx := newTestRequestCtx(http.MethodGet, "/recommendations")
+	ctx.Request.Header.Set("Accept-Encoding", "gzip")
+	s.requestHandler()(ctx)
+	assert.Equal(t, http.StatusOK, ctx.Response.StatusCode())
+	assert.Equal(t, `[{"id":1},{"id":2}]`, string(ctx.Response.Body()))
+	assert.Empty(t, ctx.Response.Header.Peek("X-Received-Accept-Encoding"))
+
+	// Components without a transformer are dimmed wholesale.
+	ctx = newTestRequestCtx(http.MethodGet, "/path")
+	s.requestHandler()(ctx)
+	assert.Equal(t, http.StatusTooManyRequests, ctx.Response.StatusCode())
+}
+
+func TestServer_requestHandler_ReturnsConfiguredDimResponse(t *testing.T) {
+	s := newTestServerWithBackend(t, &alwaysDimDecider{})
+	s.dimResponse = filters.DimmedResponse{StatusCode: http.StatusServiceUnavailable, Body: "Busy!"}
+
+	ctx := newTestRequestCtx(http.MethodGet, "/path")
+	s.requestHandler()(ctx)
+	assert.Equal(t, http.StatusServiceUnavailable, ctx.Response.StatusCode())
+	assert.Equal(t, "Busy!", string(ctx.Response.Body()))
+}
+
+func TestServer_requestHandler_RedirectsDimmedRequests(t *testing.T) {
+	s := newTestServerWithBackend(t, &alwaysDimDecider{})
+	s.dimming.RequestFilter.AddPath("/list", http.MethodGet)
+	dimmedResponses, err := filters.NewDimmedResponses(defaultDimmedResponse, map[string]filters.DimmedResponse{
+		"/list": {StatusCode: http.StatusOK, Body: "[]"},
+	})
+	assert.Nilf(t, err, "expected NewDimmedResponses(...) has no err; got %v", err)
+	s.dimmedResponses = dimmedResponses
+	s.dimRedirectURL = "https://static.example.com/busy.html"
+
+	ctx := newTestRequestCtx(http.MethodGet, "/path")
+	s.requestHandler()(ctx)
+	assert.Equal(t, http.StatusFound, ctx.Response.StatusCode())
+	assert.Equal(t, "https://static.example.com/busy.html", string(ctx.Response.Header.Peek("Location")))
+	assert.Empty(t, ctx.Response.Body())
+
+	// Components with a dimmed response of their own are not redirected.
+	ctx = newTestRequestCtx(http.MethodGet, "/list")
+	s.requestHandler()(ctx)
+	assert.Equal(t, http.StatusOK, ctx.Response.StatusCode())
+	assert.Equal(t, "[]", string(ctx.Response.Body()))
+}
+
+func TestServer_requestHandler_RedirectsDimmedNavigations(t *testing.T) {
+	s := newTestServerWithBackend(t, &alwaysDimDecider{})
+	redirectURL, err := url.Parse("https://lite.example.com/?theme=lite")
+	assert.Nil(t, err)
+	s.navigationRedirectURL = redirectURL
+	s.navigationRedirectStatusCode = http.StatusTemporaryRedirect
+	s.navigationRedirectPathParam = "from"
+
+	tests := []struct {
+		name         string
+		headers      map[string]string
+		wantRedirect bool
+	}{
+		{name: "Sec-Fetch-Mode navigate", headers: map[string]string{"Sec-Fetch-Mode": "navigate"}, wantRedirect: true},
+		{name: "Accepts text/html", headers: map[string]string{"Accept": "text/html,application/xhtml+xml"}, wantRedirect: true},
+		{name: "Sec-Fetch-Mode cors", headers: map[string]string{"Sec-Fetch-Mode": "cors", "Accept": "application/json"}, wantRedirect: false},
+		{name: "No headers", headers: nil, wantRedirect: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := newTestRequestCtx(http.MethodGet, "/path")
+			for name, value := range tt.headers {
+				ctx.Request.Header.Set(name, value)
+			}
+			s.requestHandler()(ctx)
+
+			if tt.wantRedirect {
+				assert.Equal(t, http.StatusTemporaryRedirect, ctx.Response.StatusCode())
+				assert.Equal(t, "https://lite.example.com/?from=%2Fpath&theme=lite", string(ctx.Response.Header.Peek("Location")))
+			} else {
+				assert.Equal(t, defaultDimmedResponse.StatusCode, ctx.Response.StatusCode())
+				assert.Empty(t, ctx.Response.Header.Peek("Location"))
+			}
+		})
+	}
+}
+
+func TestServer_requestHandler_SetsVaryHeader(t *testing.T) {
+	tests := []struct {
+		name     string
+		decider  DimDecider
+		path     string
+		wantVary string
+	}{
+		{name: "Dimmed", decider: &alwaysDimDecider{}, path: "/path", wantVary: "Cookie, Accept"},
+		{name: "Proxied dimmable", decider: neverDimDecider{}, path: "/path", wantVary: "Cookie, Accept"},
+		{name: "Proxied non-dimmable", decider: &alwaysDimDecider{}, path: "/other", wantVary: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServerWithBackend(t, tt.decider)
+			s.varyHeaders = []string{"Cookie", "Accept"}
+
+			ctx := newTestRequestCtx(http.MethodGet, tt.path)
+			s.requestHandler()(ctx)
+			assert.Equal(t, tt.wantVary, string(ctx.Response.Header.Peek("Vary")))
+		})
+	}
+}
+
+func TestServer_addVaryHeaders_MergesExistingVary(t *testing.T) {
+	s := newTestServerWithBackend(t, &alwaysDimDecider{})
+	s.varyHeaders = []string{"Cookie", "Accept"}
+
+	tests := []struct {
+		existing string
+		wantVary string
+	}{
+		{existing: "", wantVary: "Cookie, Accept"},
+		{existing: "Accept-Encoding", wantVary: "Accept-Encoding, Cookie, Accept"},
+		{existing: "accept-encoding, cookie", wantVary: "accept-encoding, cookie, Accept"},
+		{existing: "*", wantVary: "*"},
+	}
+	for _, tt := range tests {
+		header := &fasthttp.ResponseHeader{}
+		if tt.existing != "" {
+			header.Set("Vary", tt.existing)
+		}
+		s.addVaryHeaders(header)
+		assert.Equalf(t, tt.wantVary, string(header.Peek("Vary")), "existing Vary = %q", tt.existing)
+	}
+}
+
+func TestServer_requestHandler_ExcludesStatusCodesFromControlSignal(t *testing.T) {
+	s := newTestServerWithBackend(t, neverDimDecider{})
+	s.excludedStatusCodes = map[int]bool{http.StatusNotModified: true}
+
+	ctx := newTestRequestCtx(http.MethodGet, "/path")
+	s.requestHandler()(ctx)
+	assert.Len(t, s.dimming.ControlLoop.responseTimeCollector.All(), 1)
+
+	// The backend responds with 202 Accepted, which is now excluded.
+	s.excludedStatusCodes[http.StatusAccepted] = true
+	ctx = newTestRequestCtx(http.MethodGet, "/path")
+	s.requestHandler()(ctx)
+	assert.Len(t, s.dimming.ControlLoop.responseTimeCollector.All(), 1)
+}
+
+func TestServer_requestHandler_SetsRetryAfterScaledByDimmingPercentage(t *testing.T) {
+	s := newTestServerWithBackend(t, &alwaysDimDecider{})
+	s.dimRetryAfterBaseSeconds = 2
+
+	tests := []struct {
+		dimmingPercentage float64
+		wantRetryAfter    string
+	}{
+		{dimmingPercentage: 0, wantRetryAfter: "2"},
+		{dimmingPercentage: 50, wantRetryAfter: "11"},
+		{dimmingPercentage: 100, wantRetryAfter: "20"},
+	}
+	for _, tt := range tests {
+		s.dimming.ControlLoop.setDimmingPercentage(tt.dimmingPercentage)
+		ctx := newTestRequestCtx(http.MethodGet, "/path")
+		s.requestHandler()(ctx)
+		assert.Equal(t, http.StatusTooManyRequests, ctx.Response.StatusCode())
+		assert.Equal(t, tt.wantRetryAfter, string(ctx.Response.Header.Peek("Retry-After")), "dimming percentage = %v", tt.dimmingPercentage)
+	}
+}
+
+func TestServer_requestHandler_SetsControlStateHeaders(t *testing.T) {
+	s := newTestServerWithBackend(t, &alwaysDimDecider{})
+	s.dimming.ControlLoop.setDimmingPercentage(40)
+	s.dimming.ControlLoop.setSetpointAndInput(0.5, 0.75)
+
+	ctx := newTestRequestCtx(http.MethodGet, "/path")
+	s.requestHandler()(ctx)
+	assert.Empty(t, ctx.Response.Header.Peek("X-Dimmer-Setpoint"), "expected no headers unless enabled")
+
+	s.isControlStateHeadersEnabled = true
+	ctx = newTestRequestCtx(http.MethodGet, "/path")
+	s.requestHandler()(ctx)
+	assert.Equal(t, http.StatusTooManyRequests, ctx.Response.StatusCode())
+	assert.Equal(t, "0.5", string(ctx.Response.Header.Peek("X-Dimmer-Setpoint")))
+	assert.Equal(t, "0.75", string(ctx.Response.Header.Peek("X-Dimmer-Input")))
+	assert.Equal(t, "40", string(ctx.Response.Header.Peek("X-Dimmer-Output")))
+}
+
+func TestNewServer_ServesDimResponseTemplate(t *testing.T) {
+	templatePath := filepath.Join(t.TempDir(), "dimmed.html")
+	template := "<html><body>Busy, try again soon.</body></html>"
+	assert.Nil(t, ioutil.WriteFile(templatePath, []byte(template), 0644))
+
+	s := NewServer(&ServerOptions{
+		DimResponseStatusCode:   http.StatusServiceUnavailable,
+		DimResponseBody:         "Dimming!",
+		DimResponseTemplatePath: templatePath,
+	})
+	ctx := newTestRequestCtx(http.MethodGet, "/path")
+	s.writeDimmedResponse(ctx)
+	assert.Equal(t, http.StatusServiceUnavailable, ctx.Response.StatusCode())
+	assert.Equal(t, template, string(ctx.Response.Body()))
+	assert.Equal(t, "text/html; charset=utf-8", string(ctx.Response.Header.ContentType()))
+}
+
+func TestNewServer_MissingDimResponseTemplateFallsBackToBody(t *testing.T) {
+	s := NewServer(&ServerOptions{
+		DimResponseStatusCode:   http.StatusTooManyRequests,
+		DimResponseBody:         "Dimming!",
+		DimResponseTemplatePath: filepath.Join(t.TempDir(), "missing.html"),
+	})
+	ctx := newTestRequestCtx(http.MethodGet, "/path")
+	s.writeDimmedResponse(ctx)
+	assert.Equal(t, http.StatusTooManyRequests, ctx.Response.StatusCode())
+	assert.Equal(t, "Dimming!", string(ctx.Response.Body()))
+	assert.NotContains(t, string(ctx.Response.Header.ContentType()), "text/html")
+}
+
+func TestServer_requestHandler_DecompressesGzipRequestBodies(t *testing.T) {
+	s := newTestServerWithBackend(t, &neverDimDecider{})
+	s.isRequestDecompressionEnabled = true
+
+	// The backend echoes the body and Content-Encoding it receives.
+	ln := fasthttputil.NewInmemoryListener()
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		_ = fasthttp.Serve(ln, func(ctx *fasthttp.RequestCtx) {
+			ctx.Response.Header.Set("X-Received-Content-Encoding", string(ctx.Request.Header.Peek("Content-Encoding")))
+			ctx.SetBody(ctx.Request.Body())
+		})
+	}()
+	s.proxying.proxy = &fasthttp.HostClient{
+		Addr: "backend",
+		Dial: func(string) (net.Conn, error) { return ln.Dial() },
+	}
+
+	ctx := newTestRequestCtx(http.MethodPost, "/orders")
+	ctx.Request.Header.Set("Content-Encoding", "gzip")
+	ctx.Request.SetBody(fasthttp.AppendGzipBytes(nil, []byte(`{"item": 1}`)))
+	s.requestHandler()(ctx)
+	assert.Equal(t, http.StatusOK, ctx.Response.StatusCode())
+	assert.Equal(t, `{"item": 1}`, string(ctx.Response.Body()))
+	assert.Empty(t, ctx.Response.Header.Peek("X-Received-Content-Encoding"))
+
+	ctx = newTestRequestCtx(http.MethodPost, "/orders")
+	ctx.Request.Header.Set("Content-Encoding", "gzip")
+	ctx.Request.SetBodyString("not gzip")
+	s.requestHandler()(ctx)
+	assert.Equal(t, http.StatusBadRequest, ctx.Response.StatusCode())
+
+	// Bodies are passed through unchanged if decompression is disabled.
+	s.isRequestDecompressionEnabled = false
+	ctx = newTestRequestCtx(http.MethodPost, "/orders")
+	ctx.Request.Header.Set("Content-Encoding", "gzip")
+	ctx.Request.SetBodyString("not gzip")
+	s.requestHandler()(ctx)
+	assert.Equal(t, "not gzip", string(ctx.Response.Body()))
+	assert.Equal(t, "gzip", string(ctx.Response.Header.Peek("X-Received-Content-Encoding")))
+}
+
+func TestServer_requestHandler_RejectsInvalidGzipRequestBodies(t *testing.T) {
+	s := newTestServerWithBackend(t, &neverDimDecider{})
+	s.isRequestDecompressionEnabled = true
+	s.maxRequestBodySize = 1024
+
+	// A body decompressing to exactly the maximum size is proxied.
+	ctx := newTestRequestCtx(http.MethodPost, "/orders")
+	ctx.Request.Header.Set("Content-Encoding", "gzip")
+	ctx.Request.SetBody(fasthttp.AppendGzipBytes(nil, make([]byte, 1024)))
+	s.requestHandler()(ctx)
+	assert.Equal(t, http.StatusAccepted, ctx.Response.StatusCode())
+
+	// A small body decompressing beyond the maximum size is rejected without
+	// being fully decompressed. fasthttp's gzip writer does not reach the
+	// compression ratio of a real bomb, so the standard library's is used.
+	var bomb bytes.Buffer
+	w, err := gzip.NewWriterLevel(&bomb, gzip.BestCompression)
+	assert.Nil(t, err)
+	_, err = w.Write(make([]byte, 256<<10))
+	assert.Nil(t, err)
+	assert.Nil(t, w.Close())
+	assert.Less(t, bomb.Len(), 1024)
+	ctx = newTestRequestCtx(http.MethodPost, "/orders")
+	ctx.Request.Header.Set("Content-Encoding", "gzip")
+	ctx.Request.SetBody(bomb.Bytes())
+	s.requestHandler()(ctx)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, ctx.Response.StatusCode())
+
+	// A truncated body is corrupt.
+	truncated := fasthttp.AppendGzipBytes(nil, []byte(`{"item": 1}`))
+	ctx = newTestRequestCtx(http.MethodPost, "/orders")
+	ctx.Request.Header.Set("Content-Encoding", "gzip")
+	ctx.Request.SetBody(truncated[:len(truncated)-4])
+	s.requestHandler()(ctx)
+	assert.Equal(t, http.StatusBadRequest, ctx.Response.StatusCode())
+}
+
+func TestServer_requestHandler_ConnectionHeaderIsVersionAware(t *testing.T) {
+	s := newTestServerWithBackend(t, &neverDimDecider{})
+	s.isHTTP10KeepAliveEnabled = true
+
+	// The backend echoes the Connection header it receives, which fasthttp
+	// reports as close for HTTP/1.0 requests without keep-alive, and always
+	// asks to close its connection to the dimmer.
+	backendLn := fasthttputil.NewInmemoryListener()
+	t.Cleanup(func() { _ = backendLn.Close() })
+	go func() {
+		_ = fasthttp.Serve(backendLn, func(ctx *fasthttp.RequestCtx) {
+			ctx.Response.Header.Set("X-Received-Connection", string(ctx.Request.Header.Peek("Connection")))
+			ctx.SetConnectionClose()
+		})
+	}()
+	s.proxying.proxy = &fasthttp.HostClient{
+		Addr: "backend",
+		Dial: func(string) (net.Conn, error) { return backendLn.Dial() },
+	}
+
+	// The dimmer is served by a fasthttp server so the client connection's
+	// keep-alive semantics can be observed.
+	ln := fasthttputil.NewInmemoryListener()
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		_ = fasthttp.Serve(ln, s.requestHandler())
+	}()
+
+	tests := []struct {
+		name                   string
+		protocol               string
+		connection             string
+		isHTTP10KeepAlive      bool
+		wantConnection         string
+		wantReceivedConnection string
+	}{
+		{name: "HTTP/1.0 keep-alive", protocol: "HTTP/1.0", connection: "keep-alive", isHTTP10KeepAlive: true, wantConnection: "keep-alive", wantReceivedConnection: "keep-alive"},
+		{name: "HTTP/1.0 keep-alive not preserved", protocol: "HTTP/1.0", connection: "keep-alive", isHTTP10KeepAlive: false, wantConnection: "keep-alive", wantReceivedConnection: "close"},
+		{name: "HTTP/1.0 without keep-alive", protocol: "HTTP/1.0", isHTTP10KeepAlive: true, wantConnection: "close", wantReceivedConnection: "close"},
+		{name: "HTTP/1.1", protocol: "HTTP/1.1", isHTTP10KeepAlive: true, wantConnection: "", wantReceivedConnection: ""},
+		{name: "HTTP/1.1 keep-alive", protocol: "HTTP/1.1", connection: "keep-alive", isHTTP10KeepAlive: true, wantConnection: "", wantReceivedConnection: ""},
+		{name: "HTTP/1.1 close", protocol: "HTTP/1.1", connection: "close", isHTTP10KeepAlive: true, wantConnection: "close", wantReceivedConnection: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s.isHTTP10KeepAliveEnabled = tt.isHTTP10KeepAlive
+
+			conn, err := ln.Dial()
+			assert.Nilf(t, err, "expected Dial() has no err; got %v", err)
+			defer conn.Close()
+
+			request := fmt.Sprintf("GET /orders %s\r\nHost: dimmer\r\n", tt.protocol)
+			if tt.connection != "" {
+				request += fmt.Sprintf("Connection: %s\r\n", tt.connection)
+			}
+			_, err = conn.Write([]byte(request + "\r\n"))
+			assert.Nilf(t, err, "expected Write() has no err; got %v", err)
+
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			assert.Nilf(t, err, "expected ReadResponse() has no err; got %v", err)
+			_ = resp.Body.Close()
+
+			// net/http removes Connection: close from the headers it reads.
+			connection := resp.Header.Get("Connection")
+			if resp.Close {
+				connection = "close"
+			}
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, tt.wantConnection, connection)
+			assert.Equal(t, tt.wantReceivedConnection, resp.Header.Get("X-Received-Connection"))
+		})
+	}
+}
+
+func TestServer_requestHandler_TimesOutSlowBackends(t *testing.T) {
+	s := newTestServerWithBackend(t, &neverDimDecider{})
+	s.requestTimeout = 20 * time.Millisecond
+
+	// The backend responds more slowly than the request timeout.
+	ln := fasthttputil.NewInmemoryListener()
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		_ = fasthttp.Serve(ln, func(ctx *fasthttp.RequestCtx) {
+			time.Sleep(200 * time.Millisecond)
+			ctx.SetStatusCode(http.StatusAccepted)
+		})
+	}()
+	s.proxying.proxy = &fasthttp.HostClient{
+		Addr: "backend",
+		Dial: func(string) (net.Conn, error) { return ln.Dial() },
+	}
+
+	ctx := newTestRequestCtx(http.MethodGet, "/path")
+	s.requestHandler()(ctx)
+	assert.Equal(t, http.StatusGatewayTimeout, ctx.Response.StatusCode())
+
+	// The response time recorded reflects the time waited before the backend
+	// request was abandoned.
+	responseTimes := s.dimming.ControlLoop.responseTimeCollector.All()
+	if assert.Len(t, responseTimes, 1) {
+		assert.Less(t, responseTimes[0], 0.2)
+	}
+
+	// Requests are not timed out if the timeout is disabled.
+	s.requestTimeout = 0
+	ctx = newTestRequestCtx(http.MethodGet, "/path")
+	s.requestHandler()(ctx)
+	assert.Equal(t, http.StatusAccepted, ctx.Response.StatusCode())
+}
+
+func TestUnixSocketPath(t *testing.T) {
+	path, isUnixSocket := unixSocketPath("unix:/run/dimmer.sock")
+	assert.True(t, isUnixSocket)
+	assert.Equal(t, "/run/dimmer.sock", path)
+
+	_, isUnixSocket = unixSocketPath("localhost:8080")
+	assert.False(t, isUnixSocket)
+}
+
+func TestNewBackendClient_DialsUnixSocket(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "backend.sock")
+	ln, err := net.Listen("unix", socketPath)
+	assert.Nilf(t, err, "expected net.Listen(...) has no err; got %v", err)
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		_ = fasthttp.Serve(ln, func(ctx *fasthttp.RequestCtx) {
+			ctx.SetStatusCode(http.StatusAccepted)
+		})
+	}()
+
+	client := newBackendClient(unixSocketAddrPrefix+socketPath, 1)
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	req.SetRequestURI("http://backend/path")
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+
+	assert.Nil(t, client.Do(req, resp))
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode())
+}
+
+func TestServer_ListenAndServe_TerminatesTLSOnUnixSocket(t *testing.T) {
+	dir := t.TempDir()
+	backendSocketPath := filepath.Join(dir, "backend.sock")
+	backendLn, err := net.Listen("unix", backendSocketPath)
+	assert.Nilf(t, err, "expected net.Listen(...) has no err; got %v", err)
+	t.Cleanup(func() { _ = backendLn.Close() })
+	go func() {
+		_ = fasthttp.Serve(backendLn, func(ctx *fasthttp.RequestCtx) {
+			ctx.SetStatusCode(http.StatusAccepted)
+		})
+	}()
+
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeSelfSignedCertificate(t, "dimmer", certFile, keyFile)
+	reloader, err := newCertificateReloader(certFile, keyFile)
+	assert.Nil(t, err)
+
+	s := newTestServerWithBackend(t, &neverDimDecider{})
+	frontendSocketPath := filepath.Join(dir, "frontend.sock")
+	s.proxying.FrontendAddr = unixSocketAddrPrefix + frontendSocketPath
+	s.proxying.BackendAddr = unixSocketAddrPrefix + backendSocketPath
+	s.proxying.TLSConfig = reloader.TLSConfig()
+	go func() { _ = s.ListenAndServe() }()
+
+	// The frontend only serves TLS, so a plaintext client would fail.
+	client := &fasthttp.HostClient{
+		Addr:      "dimmer",
+		IsTLS:     true,
+		TLSConfig: &tls.Config{InsecureSkipVerify: true},
+		Dial: func(string) (net.Conn, error) {
+			return net.Dial("unix", frontendSocketPath)
+		},
+	}
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	// HostClient compares its scheme with the parsed URI, which SetRequestURI
+	// does not parse.
+	req.URI().Update("https://dimmer/path")
+	// The connection is closed so Shutdown does not wait for it to idle out.
+	req.SetConnectionClose()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+
+	assert.Eventually(t, func() bool {
+		return client.Do(req, resp) == nil
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode())
+	assert.Nil(t, s.Shutdown())
+}
+
+// neverDimDecider never dims requests.
+type neverDimDecider struct{}
+
+func (neverDimDecider) ShouldDim(RequestInfo, float64) (bool, bool) {
+	return false, false
+}
+
+func TestServer_requestHandler_OverloadProtectorShedsWhenBackendFails(t *testing.T) {
+	s := newTestServerWithBackend(t, neverDimDecider{})
+	overloadProtector, err := filters.NewOverloadProtector(filters.OverloadProtectorOptions{
+		Window:          time.Nanosecond,
+		MinRequests:     1,
+		OpenErrorRate:   0.5,
+		CloseErrorRate:  0.1,
+		RampStep:        1,
+		MaxShedFraction: 1,
+	})
+	assert.Nilf(t, err, "expected NewOverloadProtector(...) has no err; got %v", err)
+	s.overloadProtector = overloadProtector
+	s.proxying.proxy = &fasthttp.HostClient{
+		Addr: "backend",
+		Dial: func(string) (net.Conn, error) { return nil, errors.New("backend unreachable") },
+	}
+
+	// The failed request opens the circuit once its window elapses.
+	s.requestHandler()(newTestRequestCtx(http.MethodGet, "/path"))
+	time.Sleep(time.Millisecond)
+
+	ctx := newTestRequestCtx(http.MethodGet, "/path")
+	s.requestHandler()(ctx)
+	assert.Equal(t, http.StatusTooManyRequests, ctx.Response.StatusCode())
+}
+
+func TestServer_requestHandler_OverloadProtectorShedsOnOverloadStatusCodes(t *testing.T) {
+	s := newTestServerWithBackend(t, neverDimDecider{})
+	overloadProtector, err := filters.NewOverloadProtector(filters.OverloadProtectorOptions{
+		Window:              time.Nanosecond,
+		MinRequests:         1,
+		OpenErrorRate:       0.5,
+		CloseErrorRate:      0.1,
+		RampStep:            1,
+		MaxShedFraction:     1,
+		OverloadStatusCodes: []int{529},
+	})
+	assert.Nilf(t, err, "expected NewOverloadProtector(...) has no err; got %v", err)
+	s.overloadProtector = overloadProtector
+
+	// The backend signals it is overloaded with a custom status code.
+	ln := fasthttputil.NewInmemoryListener()
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		_ = fasthttp.Serve(ln, func(ctx *fasthttp.RequestCtx) {
+			ctx.SetStatusCode(529)
+		})
+	}()
+	s.proxying.proxy = &fasthttp.HostClient{
+		Addr: "backend",
+		Dial: func(string) (net.Conn, error) { return ln.Dial() },
+	}
+
+	// The overload response is forwarded, then opens the circuit once its
+	// window elapses.
+	ctx := newTestRequestCtx(http.MethodGet, "/path")
+	s.requestHandler()(ctx)
+	assert.Equal(t, 529, ctx.Response.StatusCode())
+	time.Sleep(time.Millisecond)
+
+	ctx = newTestRequestCtx(http.MethodGet, "/path")
+	s.requestHandler()(ctx)
+	assert.Equal(t, http.StatusTooManyRequests, ctx.Response.StatusCode())
+}
+
+func TestServer_requestHandler_RejectsMalformedPaths(t *testing.T) {
+	s := newTestServerWithBackend(t, neverDimDecider{})
+	pathValidator, err := filters.NewPathValidator(16, "")
+	assert.Nilf(t, err, "expected NewPathValidator(...) has no err; got %v", err)
+	s.pathValidator = pathValidator
+
+	ctx := newTestRequestCtx(http.MethodGet, "/pa%00th")
+	s.requestHandler()(ctx)
+	assert.Equal(t, http.StatusBadRequest, ctx.Response.StatusCode())
+
+	ctx = newTestRequestCtx(http.MethodGet, "/path")
+	s.requestHandler()(ctx)
+	assert.Equal(t, http.StatusAccepted, ctx.Response.StatusCode())
+}
+
+// modeRecordingDimDecider records the modes requests are decided under.
+type modeRecordingDimDecider struct {
+	mux   sync.Mutex
+	modes map[DimmingMode]bool
+}
+
+func (d *modeRecordingDimDecider) ShouldDim(info RequestInfo, _ float64) (bool, bool) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	d.modes[info.DimmingMode] = true
+	return false, true
+}
+
+func TestServer_SetDimmingMode_IsAtomicUnderConcurrentRequests(t *testing.T) {
+	decider := &modeRecordingDimDecider{modes: map[DimmingMode]bool{}}
+	s := newTestServerWithBackend(t, decider)
+	s.offlineTraining = offlinetraining.NewOfflineTraining()
+	assert.Nil(t, s.dimming.ControlLoop.Start())
+	s.isStarted = true
+
+	stop := make(chan struct{})
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					s.requestHandler()(newTestRequestCtx(http.MethodGet, "/path"))
+				}
+			}
+		}()
+	}
+
+	modes := []DimmingMode{Dimming, ShadowDimming, OfflineTraining, Disabled}
+	for i := 0; i < 20; i++ {
+		assert.Nil(t, s.SetDimmingMode(modes[i%len(modes)]))
+	}
+	close(stop)
+	wg.Wait()
+
+	// Requests are only decided under modes the server transitioned to, and
+	// Disabled requests are never decided.
+	for mode := range decider.modes {
+		assert.Contains(t, []DimmingMode{Dimming, ShadowDimming, OfflineTraining}, mode)
+	}
+}
+
+// blockingDimDecider blocks each decision until unblock is closed, as a
+// DimDecider calling a slow external service would.
+type blockingDimDecider struct {
+	deciding chan struct{}
+	unblock  chan struct{}
+}
+
+func (d *blockingDimDecider) ShouldDim(RequestInfo, float64) (bool, bool) {
+	d.deciding <- struct{}{}
+	<-d.unblock
+	return false, true
+}
+
+func TestServer_SetDimmingMode_DoesNotWaitForDimDecider(t *testing.T) {
+	decider := &blockingDimDecider{deciding: make(chan struct{}), unblock: make(chan struct{})}
+	s := newTestServerWithBackend(t, decider)
+	s.offlineTraining = offlinetraining.NewOfflineTraining()
+	assert.Nil(t, s.dimming.ControlLoop.Start())
+	t.Cleanup(func() { _ = s.dimming.ControlLoop.Stop() })
+	s.isStarted = true
+	s.dimmingMode = Dimming
+
+	handled := make(chan struct{})
+	go func() {
+		defer close(handled)
+		s.requestHandler()(newTestRequestCtx(http.MethodGet, "/path"))
+	}()
+	<-decider.deciding
+
+	transitioned := make(chan error, 1)
+	go func() { transitioned <- s.SetDimmingMode(ShadowDimming) }()
+	select {
+	case err := <-transitioned:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Errorf("expected SetDimmingMode() to complete while a request is being decided")
+	}
+
+	close(decider.unblock)
+	<-handled
+}
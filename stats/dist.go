@@ -3,19 +3,34 @@ package stats
 import (
 	"golang.org/x/exp/rand"
 	"gonum.org/v1/gonum/stat/distuv"
+	"math"
 	"time"
 )
 
-func SampleTruncatedNormalDistribution(lo, hi, mean, variance float64) float64 {
-	// Set the random seed to the current time for sufficient uniqueness.
-	randSeed := uint64(time.Now().UTC().UnixNano())
+// SampleTruncatedNormalDistribution samples from a normal distribution
+// truncated to [lo, hi]. src allows a seeded source to be injected so samples
+// are reproducible; if src is nil, a source seeded with the current time is
+// used.
+//
+// If variance is not positive or the bounds are degenerate such that the
+// sample would be NaN or infinite, mean is returned as a safe fallback so NaN does not
+// propagate to callers such as path probabilities.
+func SampleTruncatedNormalDistribution(src rand.Source, lo, hi, mean, variance float64) float64 {
+	if !(variance > 0) || math.IsNaN(mean) {
+		return mean
+	}
+
+	if src == nil {
+		// Set the random seed to the current time for sufficient uniqueness.
+		src = rand.NewSource(uint64(time.Now().UTC().UnixNano()))
+	}
 
 	// Use an inverse transform method to sample from the distribution.
 	// Reference: https://www.r-bloggers.com/2020/08/generating-data-from-a-truncated-distribution/
 	norm := distuv.Normal{
 		Mu:    mean,
 		Sigma: variance,
-		Src:   rand.NewSource(randSeed),
+		Src:   src,
 	}
 
 	a := norm.CDF(lo)
@@ -23,8 +38,12 @@ func SampleTruncatedNormalDistribution(lo, hi, mean, variance float64) float64 {
 	u := distuv.Uniform{
 		Min: a,
 		Max: b,
-		Src: rand.NewSource(randSeed),
+		Src: src,
 	}.Rand()
 
-	return norm.Quantile(u)
+	sample := norm.Quantile(u)
+	if math.IsNaN(sample) || math.IsInf(sample, 0) {
+		return mean
+	}
+	return sample
 }
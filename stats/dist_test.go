@@ -1,6 +1,7 @@
 package stats
 
 import (
+	"golang.org/x/exp/rand"
 	"gonum.org/v1/plot"
 	"gonum.org/v1/plot/plotter"
 	"gonum.org/v1/plot/vg"
@@ -12,6 +13,7 @@ func TestSampleTruncatedNormalDistribution(t *testing.T) {
 	var samples []float64
 	for i := 0; i < 10000; i++ {
 		samples = append(samples, SampleTruncatedNormalDistribution(
+			nil,
 			0,
 			math.Inf(1),
 			0, 3,
@@ -33,3 +35,37 @@ func TestSampleTruncatedNormalDistribution(t *testing.T) {
 		panic(err)
 	}
 }
+
+func TestSampleTruncatedNormalDistribution_SeededSourceIsDeterministic(t *testing.T) {
+	first := rand.NewSource(42)
+	second := rand.NewSource(42)
+	for i := 0; i < 100; i++ {
+		a := SampleTruncatedNormalDistribution(first, 0, 1, 0.5, 0.8)
+		b := SampleTruncatedNormalDistribution(second, 0, 1, 0.5, 0.8)
+		if a != b {
+			t.Fatalf("expected identically seeded samples to match at i = %d; got %v and %v", i, a, b)
+		}
+	}
+}
+
+func TestSampleTruncatedNormalDistribution_FallsBackToMeanInsteadOfNaN(t *testing.T) {
+	tests := []struct {
+		name                   string
+		lo, hi, mean, variance float64
+	}{
+		{name: "Zero variance", lo: 0, hi: 1, mean: 0.5, variance: 0},
+		{name: "Negative variance", lo: 0, hi: 1, mean: 0.5, variance: -1},
+		{name: "Degenerate bounds far from mean", lo: 100, hi: 100, mean: 0.5, variance: 0.01},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := SampleTruncatedNormalDistribution(nil, tt.lo, tt.hi, tt.mean, tt.variance)
+			if math.IsNaN(got) {
+				t.Fatalf("SampleTruncatedNormalDistribution() = NaN, want %v", tt.mean)
+			}
+			if got != tt.mean {
+				t.Errorf("SampleTruncatedNormalDistribution() = %v, want %v", got, tt.mean)
+			}
+		})
+	}
+}
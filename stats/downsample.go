@@ -0,0 +1,30 @@
+package stats
+
+import "sort"
+
+// Downsample returns at most n samples as evenly spaced order statistics of
+// samples, preserving the shape of the distribution for later analysis. The
+// returned samples are sorted. If samples has at most n elements, a sorted
+// copy of samples is returned.
+func Downsample(samples []float64, n int) []float64 {
+	sorted := make([]float64, len(samples))
+	copy(sorted, samples)
+	sort.Float64s(sorted)
+
+	if len(sorted) <= n {
+		return sorted
+	}
+	if n <= 0 {
+		return []float64{}
+	}
+	if n == 1 {
+		return []float64{sorted[len(sorted)/2]}
+	}
+
+	// Always include the minimum and maximum so the tails are retained.
+	downsampled := make([]float64, n)
+	for i := 0; i < n; i++ {
+		downsampled[i] = sorted[i*(len(sorted)-1)/(n-1)]
+	}
+	return downsampled
+}
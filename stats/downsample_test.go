@@ -0,0 +1,28 @@
+package stats
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDownsample(t *testing.T) {
+	tests := []struct {
+		name    string
+		samples []float64
+		n       int
+		want    []float64
+	}{
+		{name: "Fewer samples than n are sorted", samples: []float64{3, 1, 2}, n: 5, want: []float64{1, 2, 3}},
+		{name: "Retains minimum and maximum", samples: []float64{5, 4, 3, 2, 1}, n: 3, want: []float64{1, 3, 5}},
+		{name: "Evenly spaced order statistics", samples: []float64{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, n: 4, want: []float64{0, 3, 6, 9}},
+		{name: "Single sample is the median", samples: []float64{1, 2, 3}, n: 1, want: []float64{2}},
+		{name: "Non-positive n", samples: []float64{1, 2, 3}, n: 0, want: []float64{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Downsample(tt.samples, tt.n); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Downsample() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,11 +1,14 @@
 package stats
 
 import (
+	"errors"
 	"fmt"
 	"gonum.org/v1/gonum/stat"
 	"log"
 	"math"
 	"sort"
+	"strconv"
+	"strings"
 )
 
 type Percentile = int
@@ -30,19 +33,47 @@ var coefficients = map[Percentile]float64{
 	P99d9: 1.95,
 }
 
-// KolmogorovSmirnovTestRejection performs a two-tailed KS-test, returning true
-// if rejected (i.e., the distributions are different) and returning false if
-// the candidate distribution belongs to the control distribution.
-func KolmogorovSmirnovTestRejection(control []float64, candidate []float64, percentile Percentile) bool {
-	// Calculate the KS-coefficient based on the percentile.
-	coeff, ok := coefficients[percentile]
+// percentileNames maps the names of percentiles used in configuration to
+// percentiles.
+var percentileNames = map[string]Percentile{
+	"p90":   P90,
+	"p95":   P95,
+	"p97.5": P97d5,
+	"p99":   P99,
+	"p99.5": P99d5,
+	"p99.9": P99d9,
+}
+
+// ParsePercentile returns the percentile with the name, e.g. p97.5 for P97d5.
+func ParsePercentile(name string) (Percentile, error) {
+	percentile, ok := percentileNames[name]
 	if !ok {
-		panic(fmt.Sprintf("unexpected percentile %v, see Percentile type", percentile))
+		return 0, errors.New(fmt.Sprintf("ParsePercentile() expected one of {p90|p95|p97.5|p99|p99.5|p99.9}; got %s", name))
 	}
+	return percentile, nil
+}
 
-	// Calculate the critical value.
-	criticalValue := coeff * math.Sqrt(float64(len(control)+len(candidate))/float64(len(control)*len(candidate)))
+// ParsePercentileRank returns the rank p in (0, 100) of a percentile in the
+// format "p<p>", e.g. 99.9 for "p99.9". Unlike ParsePercentile, any rank is
+// accepted.
+func ParsePercentileRank(percentile string) (float64, error) {
+	if !strings.HasPrefix(percentile, "p") {
+		return 0, errors.New(fmt.Sprintf("ParsePercentileRank() expected percentile to start with p; got %s", percentile))
+	}
+	p, err := strconv.ParseFloat(strings.TrimPrefix(percentile, "p"), 64)
+	if err != nil {
+		return 0, fmt.Errorf("ParsePercentileRank() expected percentile %s to be p followed by a number; got err = %w", percentile, err)
+	}
+	if !(p > 0 && p < 100) {
+		return 0, errors.New(fmt.Sprintf("ParsePercentileRank() expected percentile between p0 and p100 exclusive; got %s", percentile))
+	}
+	return p, nil
+}
 
+// KolmogorovSmirnovTestRejection performs a two-tailed KS-test, returning true
+// if rejected (i.e., the distributions are different) and returning false if
+// the candidate distribution belongs to the control distribution.
+func KolmogorovSmirnovTestRejection(control []float64, candidate []float64, percentile Percentile) bool {
 	// Copy the input slices so we can sort them.
 	sortedControl := make([]float64, len(control))
 	copy(sortedControl, control)
@@ -52,6 +83,23 @@ func KolmogorovSmirnovTestRejection(control []float64, candidate []float64, perc
 	copy(sortedCandidate, candidate)
 	sort.Float64s(sortedCandidate)
 
+	return KolmogorovSmirnovTestRejectionSorted(sortedControl, sortedCandidate, percentile)
+}
+
+// KolmogorovSmirnovTestRejectionSorted is KolmogorovSmirnovTestRejection for
+// inputs already in ascending order, e.g. from a sorted response time
+// collector, skipping the copy and sort. Unsorted inputs give incorrect
+// results.
+func KolmogorovSmirnovTestRejectionSorted(sortedControl []float64, sortedCandidate []float64, percentile Percentile) bool {
+	// Calculate the KS-coefficient based on the percentile.
+	coeff, ok := coefficients[percentile]
+	if !ok {
+		panic(fmt.Sprintf("unexpected percentile %v, see Percentile type", percentile))
+	}
+
+	// Calculate the critical value.
+	criticalValue := coeff * math.Sqrt(float64(len(sortedControl)+len(sortedCandidate))/float64(len(sortedControl)*len(sortedCandidate)))
+
 	// Pass in nil weights as gonum's stat package allows inputs to be
 	// weighted, which is not relevant to our situation.
 	testStatistic := stat.KolmogorovSmirnov(sortedControl, nil, sortedCandidate, nil)
@@ -51,3 +51,55 @@ func TestKolmogorovSmirnovTestRejection(t *testing.T) {
 		})
 	}
 }
+
+func TestParsePercentile(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    Percentile
+		wantErr bool
+	}{
+		{name: "p90", want: P90},
+		{name: "p97.5", want: P97d5},
+		{name: "p99.9", want: P99d9},
+		{name: "p50", wantErr: true},
+		{name: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParsePercentile(tt.name)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParsePercentile() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("ParsePercentile() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePercentileRank(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    float64
+		wantErr bool
+	}{
+		{name: "p50", want: 50},
+		{name: "p99.9", want: 99.9},
+		{name: "p0", wantErr: true},
+		{name: "p100", wantErr: true},
+		{name: "95", wantErr: true},
+		{name: "pfast", wantErr: true},
+		{name: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParsePercentileRank(tt.name)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParsePercentileRank() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("ParsePercentileRank() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}